@@ -1,5 +1,14 @@
 import axios from 'axios'
 
+// errors with field details are sent as { message, fields }, all others
+// are just the message string
+let newError = (status, data) => {
+  if (data !== null && typeof data === 'object' && typeof data.message === 'string') {
+    return { status, body: data.message, fields: data.fields || [] }
+  }
+  return { status, body: data, fields: [] }
+}
+
 let newApi = (isMDoApi) => {
   let mDoSending = false
   let mDoSent = false
@@ -15,10 +24,7 @@ let newApi = (isMDoApi) => {
       }).then((res) => {
         return res.data
       }).catch((err) => {
-        throw {
-          status: err.response.status,
-          body: err.response.data
-        }
+        throw newError(err.response.status, err.response.data)
       })
     } else if (isMDoApi && !mDoSending && !mDoSent) {
       let awaitingMDoObj = {
@@ -91,8 +97,9 @@ let newApi = (isMDoApi) => {
             if (res[key].status === 200) {
               awaitingMDoList[i].resolve(res[key].body)
             } else {
-              mdoErrors.push(res[key])
-              awaitingMDoList[i].reject(res[key])
+              let err = newError(res[key].status, res[key].body)
+              mdoErrors.push(err)
+              awaitingMDoList[i].reject(err)
             }
           }
         }).catch((error) => {
@@ -17,16 +17,22 @@ func main() {
 	config := config.Get("config.json")
 	app.Run(func(c *app.Config) {
 		c.StaticDir = config.Web.StaticDir
+		c.SPAFallback = config.Web.SPAFallback
+		c.CSRFSecure = config.Web.Session.Secure
 		c.ContentSecurityPolicies = config.Web.ContentSecurityPolicies
 		c.Name = "games"
 		c.Description = "a web app to play turn based multiplayer games"
 		c.TlbxSetup = app.TlbxMwares{
-			session.BasicMware(
-				config.Web.Session.AuthKey64s,
-				config.Web.Session.EncrKey32s,
-				config.Web.Session.Secure),
+			session.StoreMware(config.Web.Session.Store, config.Redis.Cache, func(c *session.Config) {
+				c.AuthKey64s = config.Web.Session.AuthKey64s
+				c.EncrKey32s = config.Web.Session.EncrKey32s
+				c.Secure = config.Web.Session.Secure
+				c.MaxAge = int(config.Web.Session.MaxAge.Seconds())
+				c.IdleTimeout = config.Web.Session.IdleTimeout
+				c.Lifetime = config.Web.Session.Lifetime
+			}),
 			ratelimit.MeMware(config.Redis.RateLimit, config.Web.RateLimit),
-			service.Mware(config.Redis.Cache, config.SQL.User, config.SQL.Pwd, config.SQL.Data, config.Email, config.Store, config.FCM),
+			service.Mware(config.Redis.Cache, config.SQL.User, config.SQL.Pwd, config.SQL.Data, config.Email, config.Store, config.FCM, config.WebPush),
 		}
 		c.Version = config.Version
 		c.Log = config.Log
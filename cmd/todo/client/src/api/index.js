@@ -2,6 +2,15 @@ import axios from 'axios'
 
 let memCache = {}
 
+// errors with field details are sent as { message, fields }, all others
+// are just the message string
+let newError = (status, data) => {
+  if (data !== null && typeof data === 'object' && typeof data.message === 'string') {
+    return { status, body: data.message, fields: data.fields || [] }
+  }
+  return { status, body: data, fields: [] }
+}
+
 let newApi = (isMDoApi) => {
   let mDoSending = false
   let mDoSent = false
@@ -17,10 +26,7 @@ let newApi = (isMDoApi) => {
       }).then((res) => {
         return res.data
       }).catch((err) => {
-        throw {
-          status: err.response.status,
-          body: err.response.data
-        }
+        throw newError(err.response.status, err.response.data)
       })
     } else if (isMDoApi && !mDoSending && !mDoSent) {
       let awaitingMDoObj = {
@@ -93,8 +99,9 @@ let newApi = (isMDoApi) => {
             if (res[key].status === 200) {
               awaitingMDoList[i].resolve(res[key].body)
             } else {
-              mdoErrors.push(res[key])
-              awaitingMDoList[i].reject(res[key])
+              let err = newError(res[key].status, res[key].body)
+              mdoErrors.push(err)
+              awaitingMDoList[i].reject(err)
             }
           }
         }).catch((error) => {
@@ -144,7 +151,18 @@ let newApi = (isMDoApi) => {
         return doReq('/user/delete', {pwd})
       },
       login: (email, pwd) => {
+        // resolves to {challenge} if two factor auth is enabled
         return doReq('/user/login', {email, pwd}).then((res)=>{
+          if (res.challenge) {
+            return res
+          }
+          memCache.me = res.me
+          memCache[res.me.id] = res.me
+          return res.me
+        })
+      },
+      loginTOTP: (challenge, code) => {
+        return doReq('/user/loginTOTP', {challenge, code}).then((res)=>{
           memCache.me = res
           memCache[res.id] = res
           return res
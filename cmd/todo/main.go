@@ -1,38 +1,71 @@
 package main
 
 import (
+	// notification quiet hours are in the users time zone
+	_ "time/tzdata"
+
 	"github.com/0xor1/tlbx/cmd/todo/pkg/config"
 	"github.com/0xor1/tlbx/cmd/todo/pkg/item/itemeps"
 	"github.com/0xor1/tlbx/cmd/todo/pkg/list/listeps"
+	"github.com/0xor1/tlbx/pkg/email/feedback"
+	"github.com/0xor1/tlbx/pkg/email/outbox"
 	"github.com/0xor1/tlbx/pkg/web/app"
+	"github.com/0xor1/tlbx/pkg/web/app/emailfeedback/emailfeedbackeps"
 	"github.com/0xor1/tlbx/pkg/web/app/ratelimit"
 	"github.com/0xor1/tlbx/pkg/web/app/service"
+	"github.com/0xor1/tlbx/pkg/web/app/service/fcm"
 	"github.com/0xor1/tlbx/pkg/web/app/session"
+	"github.com/0xor1/tlbx/pkg/web/app/session/me"
 	"github.com/0xor1/tlbx/pkg/web/app/user/usereps"
 )
 
 func main() {
 	config := config.Get()
+	emailClient := config.Email
+	if config.EmailSuppress {
+		emailClient = feedback.NewSuppressingClient(emailClient, config.SQL.User)
+	}
+	emailOutbox := outbox.NewDispatcher(config.SQL.User, emailClient, config.Log, config.EmailOutbox)
+	emailOutbox.Start()
+	defer emailOutbox.Stop()
+	fcmTokens := fcm.NewTokenExpirer(config.SQL.User, config.FCMTokens.Expiry, config.FCMTokens.ExpiryInterval, config.Log)
+	fcmTokens.Start()
+	defer fcmTokens.Stop()
+	digests := fcm.NewDigestSender(config.SQL.User, config.FCM, config.WebPush, config.Notifications.DigestInterval, config.Notifications.DigestCheckInterval, config.Log)
+	digests.Start()
+	defer digests.Stop()
 	eps := []*app.Endpoint{}
 	app.Run(func(c *app.Config) {
 		c.StaticDir = config.Web.StaticDir
+		c.SPAFallback = config.Web.SPAFallback
+		c.CSRFSecure = config.Web.Session.Secure
 		c.ContentSecurityPolicies = config.Web.ContentSecurityPolicies
 		c.Name = "Todo"
 		c.Description = "A simple Todo list application, create multiple lists with many items which can be marked complete or uncomplete"
 		c.TlbxSetup = app.TlbxMwares{
-			session.BasicMware(
-				config.Web.Session.AuthKey64s,
-				config.Web.Session.EncrKey32s,
-				config.Web.Session.Secure),
+			session.StoreMware(config.Web.Session.Store, config.Redis.Cache, func(c *session.Config) {
+				c.AuthKey64s = config.Web.Session.AuthKey64s
+				c.EncrKey32s = config.Web.Session.EncrKey32s
+				c.Secure = config.Web.Session.Secure
+				c.MaxAge = int(config.Web.Session.MaxAge.Seconds())
+				c.IdleTimeout = config.Web.Session.IdleTimeout
+				c.Lifetime = config.Web.Session.Lifetime
+			}),
+			me.BearerMware(config.SQL.User),
 			ratelimit.MeMware(config.Redis.RateLimit, config.Web.RateLimit),
-			service.Mware(config.Redis.Cache, config.SQL.User, config.SQL.Pwd, config.SQL.Data, config.Email, config.Store, config.FCM),
+			service.Mware(config.Redis.Cache, config.SQL.User, config.SQL.Pwd, config.SQL.Data, config.Email, config.Store, config.FCM, config.WebPush),
 		}
 		c.Version = config.Version
 		c.Log = config.Log
 		c.Endpoints = append(
 			append(
 				append(
-					eps,
+					append(
+						eps,
+						emailfeedbackeps.New(
+							config.EmailFeedback.SNS,
+							config.EmailFeedback.SparkPostUsername,
+							config.EmailFeedback.SparkPostPwd)...),
 					usereps.New(
 						config.App.FromEmail,
 						config.App.ActivateFmtLink,
@@ -42,8 +75,16 @@ func main() {
 						nil,
 						listeps.OnDelete,
 						nil,
-						nil,
-						false)...),
+						listeps.ValidateFcmTopic,
+						false,
+						func(c *usereps.Config) {
+							c.TOTPIssuer = config.App.TOTP.Issuer
+							c.TOTPEncrKey32s = config.App.TOTP.EncrKey32s
+							c.WebAuthn = config.App.WebAuthn
+							c.OIDCProviders = config.App.OIDC
+							c.PwdCheck = config.App.PwdCheck
+							c.EmailTemplates = config.App.EmailTemplates
+						})...),
 				listeps.Eps...),
 			itemeps.Eps...)
 	})
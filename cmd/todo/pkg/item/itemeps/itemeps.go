@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/0xor1/tlbx/cmd/todo/pkg/item"
+	"github.com/0xor1/tlbx/cmd/todo/pkg/list"
 	. "github.com/0xor1/tlbx/pkg/core"
 	"github.com/0xor1/tlbx/pkg/field"
 	"github.com/0xor1/tlbx/pkg/isql"
@@ -164,6 +165,12 @@ var (
 						PanicOn(err)
 					}
 					tx.Commit()
+					if rowsEffected == 1 && item.CompletedOn != nil && todoItemCountOp != "" {
+						srv.FCM().AsyncSend(list.CategoryItemCompleted, IDs{args.List}, map[string]string{
+							"list": args.List.String(),
+							"item": item.ID.String(),
+						}, 0)
+					}
 				}
 				return item
 			},
@@ -1,6 +1,7 @@
 package itemtest
 
 import (
+	"net/http"
 	"testing"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/0xor1/tlbx/pkg/ptr"
 	"github.com/0xor1/tlbx/pkg/web/app"
 	"github.com/0xor1/tlbx/pkg/web/app/test"
+	"github.com/0xor1/tlbx/pkg/web/app/user"
 	"github.com/0xor1/tlbx/pkg/web/app/user/usereps"
 	"github.com/stretchr/testify/assert"
 )
@@ -28,7 +30,7 @@ func Everything(t *testing.T) {
 		nil,
 		listeps.OnDelete,
 		usereps.NopOnSetSocials,
-		nil,
+		listeps.ValidateFcmTopic,
 		false)
 	defer r.CleanUp()
 
@@ -113,6 +115,21 @@ func Everything(t *testing.T) {
 	a.Equal(testItem1, get.Set[0])
 	a.True(get.More)
 
+	// completing an item is pushed to the lists fcm topic
+	(&user.SetFCMEnabled{
+		Val: true,
+	}).MustDo(r.Ali().Client())
+	fcmToken := "itemtest:" + r.UniqueStr()
+	(&user.RegisterForFCM{
+		Topic: IDs{testList1.ID},
+		Token: fcmToken,
+	}).MustDo(r.Ali().Client())
+	_, err := (&user.RegisterForFCM{
+		Topic: IDs{app.ExampleID()},
+		Token: fcmToken,
+	}).Do(r.Ali().Client())
+	a.Equal(&app.ErrMsg{Status: http.StatusNotFound, Msg: "no list with that id"}, err)
+
 	rename := "Test item 1 rename"
 	updatedItem1 := (&item.Update{
 		List:     testList1.ID,
@@ -123,13 +140,27 @@ func Everything(t *testing.T) {
 	testItem1.Name = rename
 	a.Equal(testItem1.Name, updatedItem1.Name)
 	a.NotNil(updatedItem1.CompletedOn)
+	push := r.Pushes(fcmToken, 1)[0]
+	a.Equal(testList1.ID.String(), push.Data["list"])
+	a.Equal(testItem1.ID.String(), push.Data["item"])
 
+	// users can have completed item notifications digested
+	(&user.SetNotificationPrefs{
+		TimeZone: "UTC",
+		Categories: map[string]*user.NotificationCategoryPrefs{
+			list.CategoryItemCompleted: {Enabled: true, Digest: true},
+		},
+	}).MustDo(r.Ali().Client())
 	updatedItem2 := (&item.Update{
 		List:     testList1.ID,
 		ID:       testItem2.ID,
 		Complete: &field.Bool{V: true},
 	}).MustDo(r.Ali().Client())
 	a.NotNil(updatedItem2.CompletedOn)
+	heldCount := 0
+	PanicOn(r.User().Primary().QueryRow(`SELECT count FROM notificationDigests WHERE user=? AND category=?`, r.Ali().ID(), list.CategoryItemCompleted).Scan(&heldCount))
+	a.Equal(1, heldCount)
+	a.Len(r.FCM().Msgs(fcmToken), 1)
 
 	get = (&item.Get{
 		List:      testList1.ID,
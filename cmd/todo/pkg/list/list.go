@@ -17,6 +17,12 @@ const (
 	SortCompletedItemCount sort = "completedItemCount"
 )
 
+// notification categories of pushes to a lists fcm topic, the topic is the
+// lists id
+const (
+	CategoryItemCompleted = "itemCompleted"
+)
+
 type List struct {
 	ID                 ID        `json:"id"`
 	Name               string    `json:"name"`
@@ -11,6 +11,7 @@ import (
 	"github.com/0xor1/tlbx/pkg/ptr"
 	"github.com/0xor1/tlbx/pkg/web/app"
 	"github.com/0xor1/tlbx/pkg/web/app/service"
+	ssql "github.com/0xor1/tlbx/pkg/web/app/service/sql"
 	"github.com/0xor1/tlbx/pkg/web/app/session/me"
 	"github.com/0xor1/tlbx/pkg/web/app/sql"
 	"github.com/0xor1/tlbx/pkg/web/app/validate"
@@ -187,6 +188,15 @@ func OnDelete(tlbx app.Tlbx, me ID) {
 	tx.Commit()
 }
 
+// ValidateFcmTopic allows users to register for pushes about one of their
+// lists, the topic is the lists id.
+func ValidateFcmTopic(tlbx app.Tlbx, topic IDs) (ssql.Tx, error) {
+	app.BadReqIf(len(topic) != 1, "topic must be a list id")
+	getSetRes := getSet(tlbx, &list.Get{IDs: topic})
+	app.ReturnIf(len(getSetRes.Set) == 0, http.StatusNotFound, "no list with that id")
+	return nil, nil
+}
+
 func getSet(tlbx app.Tlbx, args *list.Get) *list.GetRes {
 	validate.MaxIDs(tlbx, "ids", args.IDs, 100)
 	app.BadReqIf(
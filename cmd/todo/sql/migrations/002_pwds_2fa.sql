@@ -0,0 +1,31 @@
+# run against databases created before totp, recovery code and passkey
+# logins were added
+USE todo_pwds;
+
+CREATE TABLE IF NOT EXISTS totps(
+    id          BINARY(16) NOT NULL,
+    # aes-gcm sealed with app.totp.encrKey32s
+    secret      VARBINARY(64) NOT NULL,
+    confirmedOn DATETIME(3) NULL,
+    lastCounter BIGINT NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS recoveryCodes(
+    id   BINARY(16) NOT NULL,
+    hash BINARY(32) NOT NULL,
+    PRIMARY KEY (id, hash)
+);
+
+CREATE TABLE IF NOT EXISTS webAuthnCredentials(
+	id         VARBINARY(1023) NOT NULL,
+	user       BINARY(16) NOT NULL,
+	name       VARCHAR(50) NOT NULL,
+	publicKey  VARBINARY(1024) NOT NULL,
+	signCount  INT UNSIGNED NOT NULL,
+	transports JSON NOT NULL,
+	createdOn  DATETIME(3) NOT NULL,
+	lastUsedOn DATETIME(3) NULL,
+    PRIMARY KEY (id),
+    INDEX (user, createdOn)
+);
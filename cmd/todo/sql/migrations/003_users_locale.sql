@@ -0,0 +1,9 @@
+# run against databases created before emails were localised, users
+# without a locale get the default one
+USE todo_users;
+
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS locale VARCHAR(35) NULL AFTER loginLinkCode;
+
+# old fcm tokens are now expired by the app, see fcm.tokenExpiry config
+DROP EVENT IF EXISTS fcmTokenCleanup;
@@ -0,0 +1,53 @@
+# run against databases created before web push and notification
+# preferences were added
+USE todo_users;
+
+CREATE TABLE IF NOT EXISTS webPushSubscriptions (
+    topic VARCHAR(255) NOT NULL,
+    endpoint VARCHAR(1000) NOT NULL,
+    p256dh VARCHAR(100) NOT NULL,
+    auth VARCHAR(50) NOT NULL,
+    user BINARY(16) NOT NULL,
+    client BINARY(16) NOT NULL,
+    createdOn DATETIME(3) NOT NULL,
+    PRIMARY KEY (user, client),
+    INDEX (topic),
+    INDEX (endpoint(255)),
+    INDEX (user, createdOn),
+    INDEX(createdOn),
+    FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
+);
+
+# quiet hours are minutes after midnight in timeZone, null if not set
+CREATE TABLE IF NOT EXISTS notificationSettings (
+    user BINARY(16) NOT NULL,
+    timeZone VARCHAR(64) NOT NULL,
+    quietHoursStart SMALLINT UNSIGNED NULL,
+    quietHoursEnd SMALLINT UNSIGNED NULL,
+    PRIMARY KEY (user),
+    FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS notificationCategories (
+    user BINARY(16) NOT NULL,
+    category VARCHAR(50) NOT NULL,
+    enabled BOOL NOT NULL,
+    digest BOOL NOT NULL,
+    PRIMARY KEY (user, category),
+    FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
+);
+
+# notifications held back by quiet hours or digest preferences, digest is
+# false if the notifications were only held back by quiet hours, leasedUntil
+# is set while a digest sender is sending them
+CREATE TABLE IF NOT EXISTS notificationDigests (
+    user BINARY(16) NOT NULL,
+    category VARCHAR(50) NOT NULL,
+    count INT UNSIGNED NOT NULL,
+    digest BOOL NOT NULL,
+    createdOn DATETIME(3) NOT NULL,
+    leasedUntil DATETIME(3) NULL,
+    PRIMARY KEY (user, category),
+    INDEX(createdOn),
+    FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,36 @@
+# run against databases created before emails were sent via the outbox
+USE todo_users;
+
+SET GLOBAL event_scheduler=ON;
+
+CREATE TABLE IF NOT EXISTS emailOutbox (
+    id BINARY(16) NOT NULL,
+    sendTo JSON NOT NULL,
+    sendFrom VARCHAR(250) NOT NULL,
+    subject VARCHAR(500) NOT NULL,
+    html MEDIUMTEXT NOT NULL,
+    text MEDIUMTEXT NOT NULL,
+    status VARCHAR(10) NOT NULL,
+    attempts INT UNSIGNED NOT NULL,
+    lastError VARCHAR(1000) NULL,
+    createdOn DATETIME(3) NOT NULL,
+    nextAttemptOn DATETIME(3) NULL,
+    sentOn DATETIME(3) NULL,
+    PRIMARY KEY (id),
+    INDEX (status, nextAttemptOn)
+);
+
+# cleanup emails sent over a week ago
+DROP EVENT IF EXISTS emailOutboxCleanup;
+CREATE EVENT emailOutboxCleanup
+ON SCHEDULE EVERY 24 HOUR
+STARTS CURRENT_TIMESTAMP + INTERVAL 1 HOUR
+DO DELETE FROM emailOutbox WHERE status='sent' AND sentOn < NOW() - INTERVAL 7 DAY;
+
+CREATE TABLE IF NOT EXISTS emailSuppressions (
+    email VARCHAR(250) NOT NULL,
+    type VARCHAR(10) NOT NULL,
+    detail VARCHAR(1000) NOT NULL,
+    createdOn DATETIME(3) NOT NULL,
+    PRIMARY KEY (email)
+);
@@ -0,0 +1,14 @@
+# run against databases created before outbox email bodies were blanked
+# once they are done with, they may hold secrets, e.g. login links
+USE todo_users;
+
+UPDATE emailOutbox SET html='', text='' WHERE status IN ('sent', 'dead', 'suppressed');
+
+SET GLOBAL event_scheduler=ON;
+
+# cleanup emails that were sent, died or were suppressed over a week ago
+DROP EVENT IF EXISTS emailOutboxCleanup;
+CREATE EVENT emailOutboxCleanup
+ON SCHEDULE EVERY 24 HOUR
+STARTS CURRENT_TIMESTAMP + INTERVAL 1 HOUR
+DO DELETE FROM emailOutbox WHERE status IN ('sent', 'dead', 'suppressed') AND COALESCE(sentOn, createdOn) < NOW() - INTERVAL 7 DAY;
@@ -20,6 +20,7 @@ CREATE TABLE users (
 	lastPwdResetOn DATETIME(3) NULL,
     loginLinkCodeCreatedOn DATETIME(3) NULL,
     loginLinkCode VARCHAR(250) NULL,
+    locale VARCHAR(35) NULL,
     PRIMARY KEY email (email),
     UNIQUE INDEX id (id),
     INDEX(activatedOn, registeredOn),
@@ -56,13 +57,132 @@ CREATE TABLE fcmTokens (
     FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
 );
 
-# cleanup old fcm tokens that were createdOn over 2 days ago
-SET GLOBAL event_scheduler=ON;
+# old fcm tokens are expired by the app, see fcm.tokenExpiry config
 DROP EVENT IF EXISTS fcmTokenCleanup;
-CREATE EVENT fcmTokenCleanup
+
+DROP TABLE IF EXISTS webPushSubscriptions;
+CREATE TABLE webPushSubscriptions (
+    topic VARCHAR(255) NOT NULL,
+    endpoint VARCHAR(1000) NOT NULL,
+    p256dh VARCHAR(100) NOT NULL,
+    auth VARCHAR(50) NOT NULL,
+    user BINARY(16) NOT NULL,
+    client BINARY(16) NOT NULL,
+    createdOn DATETIME(3) NOT NULL,
+    PRIMARY KEY (user, client),
+    INDEX (topic),
+    INDEX (endpoint(255)),
+    INDEX (user, createdOn),
+    INDEX(createdOn),
+    FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
+);
+
+# quiet hours are minutes after midnight in timeZone, null if not set
+DROP TABLE IF EXISTS notificationSettings;
+CREATE TABLE notificationSettings (
+    user BINARY(16) NOT NULL,
+    timeZone VARCHAR(64) NOT NULL,
+    quietHoursStart SMALLINT UNSIGNED NULL,
+    quietHoursEnd SMALLINT UNSIGNED NULL,
+    PRIMARY KEY (user),
+    FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
+);
+
+DROP TABLE IF EXISTS notificationCategories;
+CREATE TABLE notificationCategories (
+    user BINARY(16) NOT NULL,
+    category VARCHAR(50) NOT NULL,
+    enabled BOOL NOT NULL,
+    digest BOOL NOT NULL,
+    PRIMARY KEY (user, category),
+    FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
+);
+
+# notifications held back by quiet hours or digest preferences, digest is
+# false if the notifications were only held back by quiet hours, leasedUntil
+# is set while a digest sender is sending them
+DROP TABLE IF EXISTS notificationDigests;
+CREATE TABLE notificationDigests (
+    user BINARY(16) NOT NULL,
+    category VARCHAR(50) NOT NULL,
+    count INT UNSIGNED NOT NULL,
+    digest BOOL NOT NULL,
+    createdOn DATETIME(3) NOT NULL,
+    leasedUntil DATETIME(3) NULL,
+    PRIMARY KEY (user, category),
+    INDEX(createdOn),
+    FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
+);
+
+DROP TABLE IF EXISTS tokens;
+CREATE TABLE tokens (
+    user BINARY(16) NOT NULL,
+    id BINARY(16) NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    scopes VARCHAR(2000) NOT NULL,
+    hash BINARY(32) NOT NULL,
+    createdOn DATETIME(3) NOT NULL,
+    expiresOn DATETIME(3) NULL,
+    lastUsedOn DATETIME(3) NULL,
+    PRIMARY KEY (user, id),
+    UNIQUE INDEX (hash),
+    INDEX(expiresOn),
+    FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
+);
+
+# cleanup expired api tokens
+SET GLOBAL event_scheduler=ON;
+DROP EVENT IF EXISTS tokenCleanup;
+CREATE EVENT tokenCleanup
 ON SCHEDULE EVERY 24 HOUR
 STARTS CURRENT_TIMESTAMP + INTERVAL 1 HOUR
-DO DELETE FROM fcmTokens WHERE createdOn < DATE_SUB(NOW(), INTERVAL 2 DAY);
+DO DELETE FROM tokens WHERE expiresOn < NOW();
+
+DROP TABLE IF EXISTS oidcIdentities;
+CREATE TABLE oidcIdentities (
+    user BINARY(16) NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(250) NOT NULL,
+    createdOn DATETIME(3) NOT NULL,
+    PRIMARY KEY (provider, subject),
+    UNIQUE INDEX (user, provider),
+    FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
+);
+
+DROP TABLE IF EXISTS emailOutbox;
+CREATE TABLE emailOutbox (
+    id BINARY(16) NOT NULL,
+    sendTo JSON NOT NULL,
+    sendFrom VARCHAR(250) NOT NULL,
+    subject VARCHAR(500) NOT NULL,
+    html MEDIUMTEXT NOT NULL,
+    text MEDIUMTEXT NOT NULL,
+    status VARCHAR(10) NOT NULL,
+    attempts INT UNSIGNED NOT NULL,
+    lastError VARCHAR(1000) NULL,
+    createdOn DATETIME(3) NOT NULL,
+    nextAttemptOn DATETIME(3) NULL,
+    sentOn DATETIME(3) NULL,
+    PRIMARY KEY (id),
+    INDEX (status, nextAttemptOn)
+);
+
+# cleanup emails that were sent, died or were suppressed over a week ago
+DROP EVENT IF EXISTS emailOutboxCleanup;
+CREATE EVENT emailOutboxCleanup
+ON SCHEDULE EVERY 24 HOUR
+STARTS CURRENT_TIMESTAMP + INTERVAL 1 HOUR
+DO DELETE FROM emailOutbox WHERE status IN ('sent', 'dead', 'suppressed') AND COALESCE(sentOn, createdOn) < NOW() - INTERVAL 7 DAY;
+
+DROP TABLE IF EXISTS emailSuppressions;
+CREATE TABLE emailSuppressions (
+    email VARCHAR(250) NOT NULL,
+    type VARCHAR(10) NOT NULL,
+    detail VARCHAR(1000) NOT NULL,
+    createdOn DATETIME(3) NOT NULL,
+    PRIMARY KEY (email)
+);
 
 DROP USER IF EXISTS 'todo_users'@'%';
 CREATE USER 'todo_users'@'%' IDENTIFIED BY 'C0-Mm-0n-U5-3r5';
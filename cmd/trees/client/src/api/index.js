@@ -77,9 +77,20 @@ let userGetInFlight = {}
 let globalErrorHandler = null
 let fcmUnregisterFnCalled = false
 let fcmUnregisterFn = () => {
-  if (memCache.me != null && fcmUnregisterFnCalled == false && fcmClientId != null && navigator.sendBeacon != null) {
+  if (memCache.me != null && fcmUnregisterFnCalled == false && fcmClientId != null) {
     fcmUnregisterFnCalled = true
-    navigator.sendBeacon(`/api/user/unregisterFromFCM?args={"client":"${fcmClientId}"}`)
+    // keepalive lets the request outlive the page like sendBeacon but
+    // unlike sendBeacon it can send the csrf header
+    let csrf = document.cookie.split('; ').find(c => c.startsWith('XSRF-TOKEN='))
+    fetch(`/api/user/unregisterFromFCM?args={"client":"${fcmClientId}"}`, {
+      method: 'POST',
+      keepalive: true,
+      credentials: 'same-origin',
+      headers: {
+        'X-Client': 'tlbx-web-client',
+        'X-XSRF-TOKEN': csrf != null ? csrf.substring('XSRF-TOKEN='.length) : ''
+      }
+    })
   }
 }
 window.addEventListener("unload", fcmUnregisterFn);
@@ -94,10 +105,20 @@ document.addEventListener("visibilitychange", () => {
   }
 });
 
+// errors with field details are sent as { message, fields }, all others
+// are just the message string
 function NewError(status, body) {
+  if (body !== null && typeof body === 'object' && typeof body.message === 'string') {
+    return {
+      status,
+      body: body.message,
+      fields: body.fields || []
+    }
+  }
   return {
     status,
-    body
+    body,
+    fields: []
   }
 }
 
@@ -145,6 +166,17 @@ function newApi(isMDoApi) {
       throw new Error('invalid get call, use the default api object or a new mdo instance from api.newMDoApi()')
     }
   }
+  // logins resolve to me, or to { challenge } if two factor auth is enabled
+  let loggedIn = (res) => {
+    if (res.challenge) {
+      return res
+    }
+    notAuthed = false
+    memCache.me = res.me
+    memCache[res.me.id] = res.me
+    fcmEnabled = res.me.fcmEnabled
+    return res.me
+  }
 
   return {
     setGlobalErrorHandler: (fn) => {
@@ -203,8 +235,9 @@ function newApi(isMDoApi) {
             if (res[key].status === 200) {
               awaitingMDoList[i].resolve(res[key].body)
             } else {
-              mdoErrors.push(res[key])
-              awaitingMDoList[i].reject(res[key])
+              let err = NewError(res[key].status, res[key].body)
+              mdoErrors.push(err)
+              awaitingMDoList[i].reject(err)
             }
           }
         }).catch((error) => {
@@ -304,25 +337,16 @@ function newApi(isMDoApi) {
         return doReq('/user/delete', { pwd })
       },
       login(email, pwd) {
-        return doReq('/user/login', { email, pwd }).then((res) => {
-          notAuthed = false
-          memCache.me = res
-          memCache[res.id] = res
-          fcmEnabled = res.fcmEnabled
-          return res
-        })
+        return doReq('/user/login', { email, pwd }).then(loggedIn)
+      },
+      loginTOTP(challenge, code) {
+        return doReq('/user/loginTOTP', { challenge, code }).then((res) => loggedIn({ me: res }))
       },
       sendLoginLinkEmail(email) {
         return doReq('/user/sendLoginLinkEmail', { email })
       },
       loginLinkLogin(me, code) {
-        return doReq('/user/loginLinkLogin', { me, code }).then((res) => {
-          notAuthed = false
-          memCache.me = res
-          memCache[res.id] = res
-          fcmEnabled = res.fcmEnabled
-          return res
-        })
+        return doReq('/user/loginLinkLogin', { me, code }).then(loggedIn)
       },
       logout() {
         memCache = {}
@@ -117,7 +117,7 @@ func runTrees(host, email, pwd, projectName string, treeK, treeH uint) {
 	me := (&user.Login{
 		Email: email,
 		Pwd:   pwd,
-	}).MustDo(c)
+	}).MustDo(c).Me
 
 	Println("starting in Trees")
 
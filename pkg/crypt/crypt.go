@@ -1,6 +1,8 @@
 package crypt
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"io"
 	"math/big"
@@ -34,3 +36,42 @@ func ScryptKey(password, salt []byte, N, r, p, keyLen int) []byte {
 	PanicOn(err)
 	return key
 }
+
+// Seal encrypts and authenticates plain with aes-gcm using the first of
+// keys, which must be 32 bytes each. The nonce is prepended to the result.
+func Seal(keys [][]byte, plain []byte) []byte {
+	PanicIf(len(keys) == 0, "no keys to seal with")
+	gcm := newGCM(keys[0])
+	nonce := Bytes(gcm.NonceSize())
+	return gcm.Seal(nonce, nonce, plain, nil)
+}
+
+// Open decrypts sealed with whichever of keys it was sealed with, so keys
+// can be rotated by putting a new key first and keeping the old ones.
+func Open(keys [][]byte, sealed []byte) ([]byte, error) {
+	for _, key := range keys {
+		gcm := newGCM(key)
+		if len(sealed) < gcm.NonceSize() {
+			return nil, Err("sealed data is too short")
+		}
+		plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+		if err == nil {
+			return plain, nil
+		}
+	}
+	return nil, Err("sealed data could not be opened with any key")
+}
+
+func MustOpen(keys [][]byte, sealed []byte) []byte {
+	plain, err := Open(keys, sealed)
+	PanicOn(err)
+	return plain
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	PanicOn(err)
+	gcm, err := cipher.NewGCM(block)
+	PanicOn(err)
+	return gcm
+}
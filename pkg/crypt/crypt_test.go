@@ -2,6 +2,7 @@ package crypt
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,6 +25,23 @@ func Test_UrlSafeString(t *testing.T) {
 	assert.Equal(t, l, len(bs))
 }
 
+func Test_SealOpen(t *testing.T) {
+	a := assert.New(t)
+	oldKey := Bytes(32)
+	newKey := Bytes(32)
+	plain := []byte("yolo")
+	sealed := Seal([][]byte{oldKey}, plain)
+	a.NotEqual(plain, sealed[len(sealed)-len(plain):])
+	a.Equal(plain, MustOpen([][]byte{oldKey}, sealed))
+	// old keys still open data after rotation
+	a.Equal(plain, MustOpen([][]byte{newKey, oldKey}, sealed))
+	_, err := Open([][]byte{newKey}, sealed)
+	a.NotNil(err)
+	sealed[len(sealed)-1] ^= 1
+	_, err = Open([][]byte{oldKey}, sealed)
+	a.NotNil(err)
+}
+
 func Test_ScryptKey(t *testing.T) {
 	l := 4
 	pwd := Bytes(l)
@@ -36,3 +54,52 @@ func Test_ScryptKey(t *testing.T) {
 	scryptPwd = ScryptKey(pwd, salt, l, l, l, l)
 	assert.Equal(t, l, len(scryptPwd))
 }
+
+func Test_TOTPCode(t *testing.T) {
+	a := assert.New(t)
+	// rfc 6238 appendix b sha1 vectors truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	a.Equal("287082", TOTPCode(secret, TOTPCounter(time.Unix(59, 0))))
+	a.Equal("081804", TOTPCode(secret, TOTPCounter(time.Unix(1111111109, 0))))
+	a.Equal("050471", TOTPCode(secret, TOTPCounter(time.Unix(1111111111, 0))))
+	a.Equal("005924", TOTPCode(secret, TOTPCounter(time.Unix(1234567890, 0))))
+	a.Equal("279037", TOTPCode(secret, TOTPCounter(time.Unix(2000000000, 0))))
+}
+
+func Test_TOTPURI(t *testing.T) {
+	a := assert.New(t)
+	uri := TOTPURI("tlbx", "joe@bloggs.example", []byte("12345678901234567890"))
+	a.Equal("otpauth://totp/tlbx:joe@bloggs.example?digits=6&issuer=tlbx&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", uri)
+}
+
+func Test_PwdHashers(t *testing.T) {
+	a := assert.New(t)
+	scrypt := &Scrypt{N: 16, R: 1, P: 1, SaltLen: 16, KeyLen: 16}
+	argon := &Argon2id{Time: 1, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 16}
+	pwd := []byte("J03-8l0-Gg5-Pwd")
+
+	old := NewPwdHashers(scrypt).Hash(pwd)
+	a.Equal(AlgScrypt, old.Alg)
+	hs := NewPwdHashers(argon, scrypt)
+	ok, rehash := hs.Verify([]byte("nope"), old)
+	a.False(ok)
+	a.False(rehash)
+	// old algs still verify but need rehashing
+	ok, rehash = hs.Verify(pwd, old)
+	a.True(ok)
+	a.True(rehash)
+
+	h := hs.Hash(pwd)
+	a.Equal(AlgArgon2id, h.Alg)
+	a.Equal([3]int{1, 64, 1}, h.Params)
+	ok, rehash = hs.Verify(pwd, h)
+	a.True(ok)
+	a.False(rehash)
+	ok, _ = hs.Verify([]byte("nope"), h)
+	a.False(ok)
+
+	// changed params need rehashing too
+	ok, rehash = NewPwdHashers(&Argon2id{Time: 2, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 16}).Verify(pwd, h)
+	a.True(ok)
+	a.True(rehash)
+}
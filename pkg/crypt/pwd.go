@@ -0,0 +1,136 @@
+package crypt
+
+import (
+	"crypto/subtle"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	AlgScrypt   = "scrypt"
+	AlgArgon2id = "argon2id"
+)
+
+// PwdHash is a hashed pwd with everything needed to verify it.
+type PwdHash struct {
+	Alg  string
+	Salt []byte
+	Key  []byte
+	// Params are algorithm specific,
+	// scrypt: N, r, p
+	// argon2id: time, memory in KiB, threads
+	Params [3]int
+}
+
+type PwdHasher interface {
+	// Alg is the identifier stored with each hash
+	Alg() string
+	Hash(pwd []byte) *PwdHash
+	// Verify must work with any params for this alg, not just the current
+	// ones, so old hashes can still be verified
+	Verify(pwd []byte, h *PwdHash) bool
+	// IsCurrent returns false if h was made with different params
+	IsCurrent(h *PwdHash) bool
+}
+
+// PwdHashers hashes new pwds with the current hasher and verifies hashes made
+// by any of them.
+type PwdHashers struct {
+	current PwdHasher
+	byAlg   map[string]PwdHasher
+}
+
+func NewPwdHashers(current PwdHasher, old ...PwdHasher) *PwdHashers {
+	hs := &PwdHashers{
+		current: current,
+		byAlg:   map[string]PwdHasher{},
+	}
+	for _, h := range append([]PwdHasher{current}, old...) {
+		PanicIf(hs.byAlg[h.Alg()] != nil, "duplicate pwd hasher alg %q", h.Alg())
+		hs.byAlg[h.Alg()] = h
+	}
+	return hs
+}
+
+func (hs *PwdHashers) Hash(pwd []byte) *PwdHash {
+	return hs.current.Hash(pwd)
+}
+
+// Verify returns whether pwd matches h, and if so, whether h should be
+// replaced by a new hash as it wasn't made by the current hasher and params.
+func (hs *PwdHashers) Verify(pwd []byte, h *PwdHash) (ok bool, rehash bool) {
+	hasher := hs.byAlg[h.Alg]
+	PanicIf(hasher == nil, "unknown pwd hash alg %q", h.Alg)
+	if !hasher.Verify(pwd, h) {
+		return false, false
+	}
+	return true, h.Alg != hs.current.Alg() || !hs.current.IsCurrent(h)
+}
+
+type Scrypt struct {
+	N       int
+	R       int
+	P       int
+	SaltLen int
+	KeyLen  int
+}
+
+func (s *Scrypt) Alg() string {
+	return AlgScrypt
+}
+
+func (s *Scrypt) Hash(pwd []byte) *PwdHash {
+	salt := Bytes(s.SaltLen)
+	return &PwdHash{
+		Alg:    AlgScrypt,
+		Salt:   salt,
+		Key:    ScryptKey(pwd, salt, s.N, s.R, s.P, s.KeyLen),
+		Params: [3]int{s.N, s.R, s.P},
+	}
+}
+
+func (s *Scrypt) Verify(pwd []byte, h *PwdHash) bool {
+	key := ScryptKey(pwd, h.Salt, h.Params[0], h.Params[1], h.Params[2], len(h.Key))
+	return subtle.ConstantTimeCompare(key, h.Key) == 1
+}
+
+func (s *Scrypt) IsCurrent(h *PwdHash) bool {
+	return len(h.Salt) == s.SaltLen &&
+		len(h.Key) == s.KeyLen &&
+		h.Params == [3]int{s.N, s.R, s.P}
+}
+
+type Argon2id struct {
+	Time uint32
+	// Memory in KiB
+	Memory  uint32
+	Threads uint8
+	SaltLen int
+	KeyLen  int
+}
+
+func (a *Argon2id) Alg() string {
+	return AlgArgon2id
+}
+
+func (a *Argon2id) Hash(pwd []byte) *PwdHash {
+	salt := Bytes(a.SaltLen)
+	return &PwdHash{
+		Alg:    AlgArgon2id,
+		Salt:   salt,
+		Key:    argon2.IDKey(pwd, salt, a.Time, a.Memory, a.Threads, uint32(a.KeyLen)),
+		Params: [3]int{int(a.Time), int(a.Memory), int(a.Threads)},
+	}
+}
+
+func (a *Argon2id) Verify(pwd []byte, h *PwdHash) bool {
+	key := argon2.IDKey(pwd, h.Salt, uint32(h.Params[0]), uint32(h.Params[1]), uint8(h.Params[2]), uint32(len(h.Key)))
+	return subtle.ConstantTimeCompare(key, h.Key) == 1
+}
+
+func (a *Argon2id) IsCurrent(h *PwdHash) bool {
+	return len(h.Salt) == a.SaltLen &&
+		len(h.Key) == a.KeyLen &&
+		h.Params == [3]int{int(a.Time), int(a.Memory), int(a.Threads)}
+}
@@ -0,0 +1,64 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"net/url"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+)
+
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPSecret returns a new random rfc 6238 secret.
+func TOTPSecret() []byte {
+	return Bytes(20)
+}
+
+// TOTPCounter returns the 30 second time step t falls in.
+func TOTPCounter(t time.Time) int64 {
+	return t.Unix() / int64(totpStep/time.Second)
+}
+
+// TOTPCode returns the 6 digit code for secret at counter, it is the
+// standard sha1 variant used by all common authenticator apps.
+func TOTPCode(secret []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return Strf("%06d", code%1000000)
+}
+
+// TOTPSecretString returns secret in the base32 form users type into
+// authenticator apps.
+func TOTPSecretString(secret []byte) string {
+	return totpEncoding.EncodeToString(secret)
+}
+
+// TOTPURI returns the otpauth provisioning uri to render as a QR code.
+func TOTPURI(issuer, account string, secret []byte) string {
+	q := url.Values{}
+	q.Set("secret", TOTPSecretString(secret))
+	q.Set("issuer", issuer)
+	q.Set("digits", Strf("%d", totpDigits))
+	q.Set("period", Strf("%d", int64(totpStep/time.Second)))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
@@ -0,0 +1,106 @@
+package email
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+)
+
+var linkRegex = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+type Msg struct {
+	SendTo  []string
+	From    string
+	Subject string
+	HTML    string
+	Text    string
+	SentOn  time.Time
+}
+
+// Links returns the links in the text body in order.
+func (m *Msg) Links() []string {
+	return linkRegex.FindAllString(m.Text, -1)
+}
+
+// LinkQuery returns the query params of the first link, including params in
+// the fragment of hash routed links like http://host/#/activate?code=abc,
+// nil if there are no links.
+func (m *Msg) LinkQuery() url.Values {
+	links := m.Links()
+	if len(links) == 0 {
+		return nil
+	}
+	link := links[0]
+	i := strings.LastIndexByte(link, '?')
+	if i == -1 {
+		return url.Values{}
+	}
+	q, err := url.ParseQuery(link[i+1:])
+	PanicOn(err)
+	return q
+}
+
+// NewCaptureClient returns a Client which records every email in memory
+// for tests to read back, then passes it on to next if it isn't nil.
+func NewCaptureClient(next Client) *CaptureClient {
+	return &CaptureClient{
+		next: next,
+		mtx:  &sync.Mutex{},
+	}
+}
+
+type CaptureClient struct {
+	next Client
+	mtx  *sync.Mutex
+	msgs []*Msg
+}
+
+func (c *CaptureClient) Send(sendTo []string, from, subject, html, text string) error {
+	c.mtx.Lock()
+	c.msgs = append(c.msgs, &Msg{
+		SendTo:  append([]string{}, sendTo...),
+		From:    from,
+		Subject: subject,
+		HTML:    html,
+		Text:    text,
+		SentOn:  NowMilli(),
+	})
+	c.mtx.Unlock()
+	if c.next != nil {
+		return c.next.Send(sendTo, from, subject, html, text)
+	}
+	return nil
+}
+
+func (c *CaptureClient) MustSend(sendTo []string, from, subject, html, text string) {
+	PanicOn(c.Send(sendTo, from, subject, html, text))
+}
+
+// Msgs returns the emails sent to sendTo, oldest first.
+func (c *CaptureClient) Msgs(sendTo string) []*Msg {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	res := []*Msg{}
+	for _, m := range c.msgs {
+		for _, to := range m.SendTo {
+			if strings.EqualFold(to, sendTo) {
+				res = append(res, m)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// Latest returns the last email sent to sendTo, nil if there are none.
+func (c *CaptureClient) Latest(sendTo string) *Msg {
+	msgs := c.Msgs(sendTo)
+	if len(msgs) == 0 {
+		return nil
+	}
+	return msgs[len(msgs)-1]
+}
@@ -0,0 +1,29 @@
+package email
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureClient(t *testing.T) {
+	a := assert.New(t)
+	c := NewCaptureClient(nil)
+	a.Nil(c.Latest("ali@test.localhost"))
+	c.MustSend([]string{"ali@test.localhost", "bob@test.localhost"}, "tlbx@test.localhost", "Hi", "<p>Hi</p>", "Hi")
+	c.MustSend([]string{"ali@test.localhost"}, "tlbx@test.localhost", "Activate", `<a href="http://localhost:8081/#/activate?me=abc&amp;code=x_y-z">activate</a>`, "activate here: http://localhost:8081/#/activate?me=abc&code=x_y-z\nthanks")
+
+	a.Equal(2, len(c.Msgs("ALI@test.localhost")))
+	a.Equal(1, len(c.Msgs("bob@test.localhost")))
+	m := c.Latest("ali@test.localhost")
+	a.Equal("Activate", m.Subject)
+	a.Equal([]string{"http://localhost:8081/#/activate?me=abc&code=x_y-z"}, m.Links())
+	a.Equal("abc", m.LinkQuery().Get("me"))
+	a.Equal("x_y-z", m.LinkQuery().Get("code"))
+	a.Nil(c.Latest("bob@test.localhost").LinkQuery())
+
+	// emails are passed on to the next client
+	next := NewCaptureClient(nil)
+	NewCaptureClient(next).MustSend([]string{"cat@test.localhost"}, "tlbx@test.localhost", "Hi", "<p>Hi</p>", "Hi")
+	a.Equal("Hi", next.Latest("cat@test.localhost").Subject)
+}
@@ -1,6 +1,8 @@
 package email
 
 import (
+	"errors"
+
 	. "github.com/0xor1/tlbx/pkg/core"
 	"github.com/0xor1/tlbx/pkg/log"
 	"github.com/0xor1/tlbx/pkg/ptr"
@@ -8,6 +10,10 @@ import (
 	"github.com/aws/aws-sdk-go/service/ses"
 )
 
+// ErrSuppressed is returned by clients which drop every recipient of an
+// email, e.g. because they have all hard bounced, so nothing was sent.
+var ErrSuppressed = errors.New("every recipient is suppressed")
+
 type Client interface {
 	Send(sendTo []string, from, subject, html, text string) error
 	MustSend(sendTo []string, from, subject, html, text string)
@@ -0,0 +1,168 @@
+// Package feedback processes email provider delivery feedback, hard bounces
+// and complaints are recorded in the emailSuppressions table and clients
+// wrapped by NewSuppressingClient stop sending to those addresses.
+package feedback
+
+import (
+	"database/sql"
+	"strings"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/email"
+	"github.com/0xor1/tlbx/pkg/isql"
+	"github.com/0xor1/tlbx/pkg/json"
+)
+
+const (
+	TypeBounce    = "bounce"
+	TypeComplaint = "complaint"
+
+	detailMaxLen = 1000
+)
+
+// Event is a hard bounce or complaint, soft bounces and other events are
+// dropped when parsing as they don't warrant suppression.
+type Event struct {
+	Email  string
+	Type   string
+	Detail string
+}
+
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+type Queryer interface {
+	Query(query string, args ...interface{}) (isql.Rows, error)
+}
+
+// Suppress records events, the latest event for an address replaces any
+// previous one.
+func Suppress(tx Execer, events ...*Event) {
+	for _, e := range events {
+		detail := e.Detail
+		if len(detail) > detailMaxLen {
+			detail = detail[:detailMaxLen]
+		}
+		_, err := tx.Exec(`INSERT INTO emailSuppressions (email, type, detail, createdOn) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE type=VALUES(type), detail=VALUES(detail), createdOn=VALUES(createdOn)`, StrLower(e.Email), e.Type, detail, NowMilli())
+		PanicOn(err)
+	}
+}
+
+// Unsuppress removes any suppression of addrs, e.g. once the owner says
+// their mailbox is working again.
+func Unsuppress(tx Execer, addrs ...string) {
+	for _, addr := range addrs {
+		_, err := tx.Exec(`DELETE FROM emailSuppressions WHERE email=?`, StrLower(addr))
+		PanicOn(err)
+	}
+}
+
+// Suppressed returns the lower cased addresses in sendTo which are suppressed.
+func Suppressed(q Queryer, sendTo ...string) (map[string]bool, error) {
+	res := map[string]bool{}
+	if len(sendTo) == 0 {
+		return res, nil
+	}
+	args := make([]interface{}, 0, len(sendTo))
+	for _, to := range sendTo {
+		args = append(args, StrLower(to))
+	}
+	rows, err := q.Query(`SELECT email FROM emailSuppressions WHERE email IN (?`+strings.Repeat(`,?`, len(args)-1)+`)`, args...)
+	if err != nil {
+		return nil, ToError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		addr := ""
+		if err = rows.Scan(&addr); err != nil {
+			return nil, ToError(err)
+		}
+		res[addr] = true
+	}
+	return res, ToError(rows.Err())
+}
+
+// NewSuppressingClient returns a client which drops suppressed addresses
+// before passing emails on to next, if every address is suppressed nothing
+// is sent and email.ErrSuppressed is returned.
+func NewSuppressingClient(next email.Client, db isql.ReplicaSet) email.Client {
+	return &suppressingClient{
+		next: next,
+		db:   db,
+	}
+}
+
+type suppressingClient struct {
+	next email.Client
+	db   isql.ReplicaSet
+}
+
+func (c *suppressingClient) Send(sendTo []string, from, subject, html, text string) error {
+	suppressed, err := Suppressed(c.db.Primary(), sendTo...)
+	if err != nil {
+		return err
+	}
+	if len(suppressed) > 0 {
+		allowed := make([]string, 0, len(sendTo))
+		for _, to := range sendTo {
+			if !suppressed[StrLower(to)] {
+				allowed = append(allowed, to)
+			}
+		}
+		if len(allowed) == 0 {
+			return email.ErrSuppressed
+		}
+		sendTo = allowed
+	}
+	return c.next.Send(sendTo, from, subject, html, text)
+}
+
+func (c *suppressingClient) MustSend(sendTo []string, from, subject, html, text string) {
+	PanicOn(c.Send(sendTo, from, subject, html, text))
+}
+
+type sparkPostEvent struct {
+	Msys struct {
+		MessageEvent *struct {
+			Type        string `json:"type"`
+			BounceClass string `json:"bounce_class"`
+			RcptTo      string `json:"rcpt_to"`
+			RawReason   string `json:"raw_reason"`
+			FbType      string `json:"fbtype"`
+		} `json:"message_event"`
+	} `json:"msys"`
+}
+
+// sparkPost bounce classes which mean the address will never work
+// https://www.sparkpost.com/docs/deliverability/bounce-classification-codes/
+var sparkPostHardBounceClasses = map[string]bool{
+	"10": true, // invalid recipient
+	"25": true, // admin failure
+	"30": true, // generic bounce no rcpt
+	"90": true, // unsubscribe
+}
+
+// ParseSparkPost parses a SparkPost webhook batch.
+func ParseSparkPost(body []byte) ([]*Event, error) {
+	batch := []*sparkPostEvent{}
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, ToError(err)
+	}
+	res := []*Event{}
+	for _, e := range batch {
+		me := e.Msys.MessageEvent
+		if me == nil || me.RcptTo == "" {
+			continue
+		}
+		switch me.Type {
+		case "bounce", "out_of_band":
+			if sparkPostHardBounceClasses[me.BounceClass] {
+				res = append(res, &Event{Email: me.RcptTo, Type: TypeBounce, Detail: me.RawReason})
+			}
+		case "spam_complaint":
+			res = append(res, &Event{Email: me.RcptTo, Type: TypeComplaint, Detail: me.FbType})
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,138 @@
+package feedback
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSparkPost(t *testing.T) {
+	a := assert.New(t)
+	events, err := ParseSparkPost([]byte(`[
+		{"msys":{"message_event":{"type":"bounce","bounce_class":"10","rcpt_to":"ali@test.localhost","raw_reason":"550 5.1.1 no such user"}}},
+		{"msys":{"message_event":{"type":"bounce","bounce_class":"21","rcpt_to":"bob@test.localhost","raw_reason":"421 try later"}}},
+		{"msys":{"message_event":{"type":"spam_complaint","rcpt_to":"cat@test.localhost","fbtype":"abuse"}}},
+		{"msys":{"message_event":{"type":"delivery","rcpt_to":"dan@test.localhost"}}},
+		{"msys":{"track_event":{"type":"click"}}}
+	]`))
+	a.Nil(err)
+	a.Equal([]*Event{
+		{Email: "ali@test.localhost", Type: TypeBounce, Detail: "550 5.1.1 no such user"},
+		{Email: "cat@test.localhost", Type: TypeComplaint, Detail: "abuse"},
+	}, events)
+	// sparkpost sends an empty batch when a webhook is created
+	events, err = ParseSparkPost([]byte(`[]`))
+	a.Nil(err)
+	a.Empty(events)
+	_, err = ParseSparkPost([]byte(`{`))
+	a.NotNil(err)
+}
+
+func TestSNS(t *testing.T) {
+	a := assert.New(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	PanicOn(err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    Now().Add(-time.Hour),
+		NotAfter:     Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	PanicOn(err)
+	confirmed := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cert.pem":
+			PanicOn(pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		case "/confirm":
+			confirmed++
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	topic := "arn:aws:sns:eu-west-1:123456789012:ses-feedback"
+	s := NewSNS(topic)
+	s.awsHost = regexp.MustCompile(`^127\.0\.0\.1$`)
+	s.client = srv.Client()
+	sign := func(m *snsMsg) []byte {
+		m.TopicArn = topic
+		m.MessageId = "id"
+		m.SignatureVersion = "2"
+		m.SigningCertURL = srv.URL + "/cert.pem"
+		if m.Timestamp == "" {
+			m.Timestamp = Now().Format(time.RFC3339)
+		}
+		sum := sha256.Sum256([]byte(m.signingString()))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		PanicOn(err)
+		m.Signature = base64.StdEncoding.EncodeToString(sig)
+		return json.MustMarshal(m)
+	}
+
+	events, err := s.Parse(sign(&snsMsg{
+		Type:         snsSubscriptionConfirmation,
+		Token:        "token",
+		Message:      "confirm me",
+		SubscribeURL: srv.URL + "/confirm",
+	}))
+	a.Nil(err)
+	a.Empty(events)
+	a.Equal(1, confirmed)
+
+	events, err = s.Parse(sign(&snsMsg{
+		Type:    snsNotification,
+		Message: `{"notificationType":"Bounce","bounce":{"bounceType":"Permanent","bouncedRecipients":[{"emailAddress":"ali@test.localhost","diagnosticCode":"smtp; 550 5.1.1 user unknown"}]}}`,
+	}))
+	a.Nil(err)
+	a.Equal([]*Event{{Email: "ali@test.localhost", Type: TypeBounce, Detail: "smtp; 550 5.1.1 user unknown"}}, events)
+
+	// soft bounces are ignored
+	events, err = s.Parse(sign(&snsMsg{
+		Type:    snsNotification,
+		Message: `{"notificationType":"Bounce","bounce":{"bounceType":"Transient","bouncedRecipients":[{"emailAddress":"ali@test.localhost"}]}}`,
+	}))
+	a.Nil(err)
+	a.Empty(events)
+
+	events, err = s.Parse(sign(&snsMsg{
+		Type:    snsNotification,
+		Subject: "complaint",
+		Message: `{"eventType":"Complaint","complaint":{"complaintFeedbackType":"abuse","complainedRecipients":[{"emailAddress":"bob@test.localhost"}]}}`,
+	}))
+	a.Nil(err)
+	a.Equal([]*Event{{Email: "bob@test.localhost", Type: TypeComplaint, Detail: "abuse"}}, events)
+
+	// tampered, stale and untrusted messages are rejected
+	body := sign(&snsMsg{Type: snsNotification, Message: `{"notificationType":"Delivery"}`})
+	m := &snsMsg{}
+	json.MustUnmarshal(body, m)
+	m.Message = `{"notificationType":"Complaint","complaint":{"complainedRecipients":[{"emailAddress":"cat@test.localhost"}]}}`
+	_, err = s.Parse(json.MustMarshal(m))
+	a.NotNil(err)
+	_, err = s.Parse(sign(&snsMsg{Type: snsNotification, Message: `{}`, Timestamp: Now().Add(-2 * time.Hour).Format(time.RFC3339)}))
+	a.Equal("sns message is too old", ToError(err).Message())
+	m.SigningCertURL = "https://evil.example/cert.pem"
+	_, err = s.Parse(json.MustMarshal(m))
+	a.Equal("untrusted sns url https://evil.example/cert.pem", ToError(err).Message())
+	m.TopicArn = "arn:aws:sns:eu-west-1:123456789012:other"
+	_, err = s.Parse(json.MustMarshal(m))
+	a.Equal("unexpected sns topic arn:aws:sns:eu-west-1:123456789012:other", ToError(err).Message())
+}
@@ -0,0 +1,248 @@
+package feedback
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/json"
+)
+
+const (
+	snsNotification             = "Notification"
+	snsSubscriptionConfirmation = "SubscriptionConfirmation"
+	snsUnsubscribeConfirmation  = "UnsubscribeConfirmation"
+	// messages older than this are rejected to limit replays
+	snsMaxAge = time.Hour
+	// signing certs are ~2KB, anything much bigger isn't one
+	snsCertMaxBytes = 64 * 1024
+)
+
+// SNS verifies and parses SES feedback delivered by SNS http(s) subscriptions.
+type SNS struct {
+	topicARNs map[string]bool
+	// certs and subscribe urls must be on this host
+	awsHost *regexp.Regexp
+	client  *http.Client
+	mtx     *sync.Mutex
+	certs   map[string]*x509.Certificate
+}
+
+// NewSNS returns an SNS which only accepts messages from topicARNs, or any
+// topic if none are given.
+func NewSNS(topicARNs ...string) *SNS {
+	s := &SNS{
+		topicARNs: map[string]bool{},
+		awsHost:   regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		mtx:       &sync.Mutex{},
+		certs:     map[string]*x509.Certificate{},
+	}
+	for _, arn := range topicARNs {
+		s.topicARNs[arn] = true
+	}
+	return s
+}
+
+type snsMsg struct {
+	Type             string
+	MessageId        string
+	Token            string
+	TopicArn         string
+	Subject          string
+	Message          string
+	Timestamp        string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
+	SubscribeURL     string
+	UnsubscribeURL   string
+}
+
+type sesNotification struct {
+	NotificationType string
+	// set instead of NotificationType by ses event publishing
+	EventType string
+	Bounce    *struct {
+		BounceType        string
+		BouncedRecipients []struct {
+			EmailAddress   string
+			DiagnosticCode string
+		}
+	}
+	Complaint *struct {
+		ComplaintFeedbackType string
+		ComplainedRecipients  []struct {
+			EmailAddress string
+		}
+	}
+}
+
+// Parse verifies an SNS message signature and returns the hard bounces and
+// complaints in it. Subscription confirmations are confirmed so the topic
+// starts delivering notifications.
+func (s *SNS) Parse(body []byte) ([]*Event, error) {
+	m := &snsMsg{}
+	if err := json.Unmarshal(body, m); err != nil {
+		return nil, ToError(err)
+	}
+	if len(s.topicARNs) > 0 && !s.topicARNs[m.TopicArn] {
+		return nil, Err("unexpected sns topic %s", m.TopicArn)
+	}
+	if err := s.verify(m); err != nil {
+		return nil, err
+	}
+	switch m.Type {
+	case snsSubscriptionConfirmation:
+		return nil, s.confirm(m.SubscribeURL)
+	case snsUnsubscribeConfirmation:
+		return nil, nil
+	}
+	n := &sesNotification{}
+	if err := json.Unmarshal([]byte(m.Message), n); err != nil {
+		return nil, ToError(err)
+	}
+	if n.NotificationType == "" {
+		n.NotificationType = n.EventType
+	}
+	res := []*Event{}
+	switch {
+	case n.NotificationType == "Bounce" && n.Bounce != nil && n.Bounce.BounceType == "Permanent":
+		for _, r := range n.Bounce.BouncedRecipients {
+			res = append(res, &Event{Email: r.EmailAddress, Type: TypeBounce, Detail: r.DiagnosticCode})
+		}
+	case n.NotificationType == "Complaint" && n.Complaint != nil:
+		for _, r := range n.Complaint.ComplainedRecipients {
+			res = append(res, &Event{Email: r.EmailAddress, Type: TypeComplaint, Detail: n.Complaint.ComplaintFeedbackType})
+		}
+	}
+	return res, nil
+}
+
+func (s *SNS) verify(m *snsMsg) error {
+	ts, err := time.Parse(time.RFC3339, m.Timestamp)
+	if err != nil {
+		return ToError(err)
+	}
+	if Now().Sub(ts) > snsMaxAge {
+		return Err("sns message is too old")
+	}
+	var hash crypto.Hash
+	var digest []byte
+	switch m.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(m.signingString()))
+		hash, digest = crypto.SHA1, sum[:]
+	case "2":
+		sum := sha256.Sum256([]byte(m.signingString()))
+		hash, digest = crypto.SHA256, sum[:]
+	default:
+		return Err("unsupported sns signature version %q", m.SignatureVersion)
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return ToError(err)
+	}
+	cert, err := s.cert(m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return Err("sns signing cert isn't rsa")
+	}
+	return ToError(rsa.VerifyPKCS1v15(pub, hash, digest, sig))
+}
+
+// signingString is the canonical form of the message that SNS signs.
+func (m *snsMsg) signingString() string {
+	fields := []string{"Message", m.Message, "MessageId", m.MessageId}
+	if m.Type == snsNotification {
+		if m.Subject != "" {
+			fields = append(fields, "Subject", m.Subject)
+		}
+		fields = append(fields, "Timestamp", m.Timestamp, "TopicArn", m.TopicArn, "Type", m.Type)
+	} else {
+		fields = append(fields, "SubscribeURL", m.SubscribeURL, "Timestamp", m.Timestamp, "Token", m.Token, "TopicArn", m.TopicArn, "Type", m.Type)
+	}
+	b := &strings.Builder{}
+	for i := 0; i < len(fields); i += 2 {
+		b.WriteString(fields[i] + "\n" + fields[i+1] + "\n")
+	}
+	return b.String()
+}
+
+func (s *SNS) checkURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ToError(err)
+	}
+	if parsed.Scheme != "https" || !s.awsHost.MatchString(parsed.Hostname()) {
+		return Err("untrusted sns url %s", u)
+	}
+	return nil
+}
+
+func (s *SNS) cert(certURL string) (*x509.Certificate, error) {
+	if err := s.checkURL(certURL); err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	cert := s.certs[certURL]
+	s.mtx.Unlock()
+	if cert != nil {
+		return cert, nil
+	}
+	resp, err := s.client.Get(certURL)
+	if err != nil {
+		return nil, ToError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, Err("failed to get sns signing cert: %s", resp.Status)
+	}
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, snsCertMaxBytes))
+	if err != nil {
+		return nil, ToError(err)
+	}
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		return nil, Err("invalid sns signing cert")
+	}
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, ToError(err)
+	}
+	s.mtx.Lock()
+	s.certs[certURL] = cert
+	s.mtx.Unlock()
+	return cert, nil
+}
+
+func (s *SNS) confirm(subscribeURL string) error {
+	if err := s.checkURL(subscribeURL); err != nil {
+		return err
+	}
+	resp, err := s.client.Get(subscribeURL)
+	if err != nil {
+		return ToError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Err("failed to confirm sns subscription: %s", resp.Status)
+	}
+	return nil
+}
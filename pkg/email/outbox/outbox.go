@@ -0,0 +1,274 @@
+// Package outbox is a transactional email outbox. Emails are inserted into
+// the emailOutbox table in the same transaction as the change that caused
+// them, then a Dispatcher sends them with retries, so a failing email
+// provider neither fails nor loses the change. Bodies are blanked once an
+// email is sent, dead or suppressed as they may hold secrets, e.g. login
+// links.
+package outbox
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/email"
+	"github.com/0xor1/tlbx/pkg/isql"
+	"github.com/0xor1/tlbx/pkg/json"
+	"github.com/0xor1/tlbx/pkg/log"
+)
+
+const (
+	StatusPending = "pending"
+	StatusSent    = "sent"
+	// dead emails failed MaxAttempts times and won't be retried
+	StatusDead = "dead"
+	// suppressed emails weren't sent as every recipient is suppressed
+	StatusSuppressed = "suppressed"
+
+	lastErrorMaxLen = 1000
+)
+
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+type Queryer interface {
+	QueryRow(query string, args ...interface{}) isql.Row
+}
+
+// Add queues an email, it is sent once tx commits.
+func Add(tx Execer, id ID, sendTo []string, from, subject, html, text string) {
+	_, err := tx.Exec(`INSERT INTO emailOutbox (id, sendTo, sendFrom, subject, html, text, status, attempts, createdOn, nextAttemptOn) VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?, ?)`, id, json.MustMarshal(sendTo), from, subject, html, text, StatusPending, NowMilli(), NowMilli())
+	PanicOn(err)
+}
+
+type Delivery struct {
+	ID            ID
+	SendTo        []string
+	Status        string
+	Attempts      int
+	LastError     *string
+	CreatedOn     time.Time
+	NextAttemptOn *time.Time
+	SentOn        *time.Time
+}
+
+// Get returns the delivery status of email id, nil if it doesn't exist.
+func Get(q Queryer, id ID) *Delivery {
+	d := &Delivery{}
+	sendTo := []byte{}
+	err := q.QueryRow(`SELECT id, sendTo, status, attempts, lastError, createdOn, nextAttemptOn, sentOn FROM emailOutbox WHERE id=?`, id).Scan(&d.ID, &sendTo, &d.Status, &d.Attempts, &d.LastError, &d.CreatedOn, &d.NextAttemptOn, &d.SentOn)
+	if err == isql.ErrNoRows {
+		return nil
+	}
+	PanicOn(err)
+	json.MustUnmarshal(sendTo, &d.SendTo)
+	return d
+}
+
+type Config struct {
+	PollInterval time.Duration
+	BatchSize    int
+	// how long a batch is claimed for before other dispatchers may retry it
+	Lease time.Duration
+	// retries back off exponentially from MinBackoff to MaxBackoff
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	MaxAttempts int
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		PollInterval: time.Second,
+		BatchSize:    50,
+		Lease:        time.Minute,
+		MinBackoff:   10 * time.Second,
+		MaxBackoff:   time.Hour,
+		MaxAttempts:  10,
+	}
+}
+
+// Dispatcher sends pending emails, any number can run against the same db.
+type Dispatcher struct {
+	db     isql.ReplicaSet
+	client email.Client
+	log    log.Log
+	c      *Config
+	mtx    *sync.Mutex
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func NewDispatcher(db isql.ReplicaSet, client email.Client, l log.Log, c *Config) *Dispatcher {
+	if c == nil {
+		c = DefaultConfig()
+	}
+	return &Dispatcher{
+		db:     db,
+		client: client,
+		log:    l,
+		c:      c,
+		mtx:    &sync.Mutex{},
+	}
+}
+
+// Start polls for pending emails until Stop is called.
+func (d *Dispatcher) Start() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	PanicIf(d.stop != nil, "outbox dispatcher already started")
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+	stop, done := d.stop, d.done
+	Go(func() {
+		defer close(done)
+		ticker := time.NewTicker(d.c.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// keep going while there is a backlog
+				for {
+					n, err := d.Dispatch()
+					if err != nil {
+						d.log.ErrorOn(err)
+					}
+					if err != nil || n < d.c.BatchSize {
+						break
+					}
+				}
+			}
+		}
+	}, d.log.ErrorOn)
+}
+
+// Stop stops polling, waiting for any in progress batch to finish.
+func (d *Dispatcher) Stop() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.stop == nil {
+		return
+	}
+	close(d.stop)
+	<-d.done
+	d.stop, d.done = nil, nil
+}
+
+type claimed struct {
+	id       ID
+	sendTo   []string
+	from     string
+	subject  string
+	html     string
+	text     string
+	attempts int
+}
+
+// Dispatch sends one batch of due emails, returning how many were tried.
+func (d *Dispatcher) Dispatch() (int, error) {
+	return d.dispatch(``)
+}
+
+// DispatchOne sends the email id now if it is due, rather than waiting for
+// it to be polled, e.g. straight after queueing it. It returns false if it
+// isn't due or another dispatcher has it.
+func (d *Dispatcher) DispatchOne(id ID) (bool, error) {
+	n, err := d.dispatch(` AND id=?`, id)
+	return n == 1, err
+}
+
+func (d *Dispatcher) dispatch(filter string, filterArgs ...interface{}) (int, error) {
+	batch, err := d.claim(filter, filterArgs...)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range batch {
+		sendErr := d.client.Send(e.sendTo, e.from, e.subject, e.html, e.text)
+		now := NowMilli()
+		attempts := e.attempts + 1
+		if sendErr == nil {
+			_, err = d.db.Primary().Exec(`UPDATE emailOutbox SET status=?, html='', text='', attempts=?, lastError=NULL, nextAttemptOn=NULL, sentOn=? WHERE id=?`, StatusSent, attempts, now, e.id)
+		} else if sendErr == email.ErrSuppressed {
+			_, err = d.db.Primary().Exec(`UPDATE emailOutbox SET status=?, html='', text='', attempts=?, lastError=NULL, nextAttemptOn=NULL WHERE id=?`, StatusSuppressed, attempts, e.id)
+		} else if attempts >= d.c.MaxAttempts {
+			d.log.Warning("email %s is dead after %d attempts: %s", e.id, attempts, sendErr)
+			_, err = d.db.Primary().Exec(`UPDATE emailOutbox SET status=?, html='', text='', attempts=?, lastError=?, nextAttemptOn=NULL WHERE id=?`, StatusDead, attempts, errMsg(sendErr), e.id)
+		} else {
+			_, err = d.db.Primary().Exec(`UPDATE emailOutbox SET attempts=?, lastError=?, nextAttemptOn=? WHERE id=?`, attempts, errMsg(sendErr), now.Add(d.backoff(attempts)), e.id)
+		}
+		if err != nil {
+			return len(batch), ToError(err)
+		}
+	}
+	return len(batch), nil
+}
+
+// claim leases a batch of due emails so concurrent dispatchers skip them.
+func (d *Dispatcher) claim(filter string, filterArgs ...interface{}) ([]*claimed, error) {
+	tx, err := d.db.Primary().Begin()
+	if err != nil {
+		return nil, ToError(err)
+	}
+	defer tx.Rollback()
+	now := NowMilli()
+	batch := make([]*claimed, 0, d.c.BatchSize)
+	args := append([]interface{}{StatusPending, now}, filterArgs...)
+	args = append(args, d.c.BatchSize)
+	rows, err := tx.Query(`SELECT id, sendTo, sendFrom, subject, html, text, attempts FROM emailOutbox WHERE status=? AND nextAttemptOn<=?`+filter+` ORDER BY nextAttemptOn LIMIT ? FOR UPDATE SKIP LOCKED`, args...)
+	if err != nil {
+		return nil, ToError(err)
+	}
+	for rows.Next() {
+		e := &claimed{}
+		sendTo := []byte{}
+		if err = rows.Scan(&e.id, &sendTo, &e.from, &e.subject, &e.html, &e.text, &e.attempts); err != nil {
+			rows.Close()
+			return nil, ToError(err)
+		}
+		if err = json.Unmarshal(sendTo, &e.sendTo); err != nil {
+			rows.Close()
+			return nil, ToError(err)
+		}
+		batch = append(batch, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, ToError(err)
+	}
+	if len(batch) == 0 {
+		return batch, nil
+	}
+	ids := make([]interface{}, 0, len(batch)+1)
+	ids = append(ids, now.Add(d.c.Lease))
+	for _, e := range batch {
+		ids = append(ids, e.id)
+	}
+	_, err = tx.Exec(`UPDATE emailOutbox SET nextAttemptOn=? WHERE id IN (?`+strings.Repeat(`,?`, len(batch)-1)+`)`, ids...)
+	if err != nil {
+		return nil, ToError(err)
+	}
+	return batch, ToError(tx.Commit())
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	b := d.c.MinBackoff
+	for i := 1; i < attempts && b < d.c.MaxBackoff; i++ {
+		b *= 2
+	}
+	if b > d.c.MaxBackoff {
+		b = d.c.MaxBackoff
+	}
+	return b
+}
+
+func errMsg(err error) string {
+	msg := ToError(err).Message()
+	if len(msg) > lastErrorMaxLen {
+		msg = msg[:lastErrorMaxLen]
+	}
+	return msg
+}
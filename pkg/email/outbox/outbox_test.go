@@ -0,0 +1,22 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	a := assert.New(t)
+	d := NewDispatcher(nil, nil, nil, &Config{
+		MinBackoff: time.Second,
+		MaxBackoff: 10 * time.Second,
+	})
+	a.Equal(time.Second, d.backoff(1))
+	a.Equal(2*time.Second, d.backoff(2))
+	a.Equal(8*time.Second, d.backoff(4))
+	a.Equal(10*time.Second, d.backoff(5))
+	a.Equal(10*time.Second, d.backoff(100))
+	a.Equal(DefaultConfig().MaxAttempts, NewDispatcher(nil, nil, nil, nil).c.MaxAttempts)
+}
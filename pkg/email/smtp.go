@@ -0,0 +1,287 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+)
+
+const (
+	// upgrade a plain connection with STARTTLS, the server must support it
+	SMTPStartTLS = "starttls"
+	// connect over TLS, usually port 465
+	SMTPImplicitTLS = "tls"
+	// no encryption, only for local stand-ins, auth is refused unless the
+	// host is localhost
+	SMTPNoTLS = "none"
+)
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Pwd      string
+	TLS      string
+	// max idle connections kept open for reuse
+	PoolSize int
+	// per connection and per send timeout
+	Timeout time.Duration
+}
+
+func NewSMTPClient(c *SMTPConfig) Client {
+	PanicIf(c.Host == "", "smtp host required")
+	PanicIf(c.TLS != SMTPStartTLS && c.TLS != SMTPImplicitTLS && c.TLS != SMTPNoTLS, "unsupported smtp tls mode %q", c.TLS)
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	return &smtpClient{
+		c:    c,
+		pool: make(chan *smtpCnn, c.PoolSize),
+	}
+}
+
+type smtpClient struct {
+	c    *SMTPConfig
+	pool chan *smtpCnn
+}
+
+type smtpCnn struct {
+	*smtp.Client
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// extend pushes the connections deadline timeout into the future.
+func (cnn *smtpCnn) extend() {
+	cnn.conn.SetDeadline(Now().Add(cnn.timeout))
+}
+
+func (c *smtpClient) Send(sendTo []string, from, subject, html, text string) error {
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return ToError(err)
+	}
+	msg, err := smtpMessage(sendTo, from, subject, html, text)
+	if err != nil {
+		return err
+	}
+	cnn, err := c.get()
+	if err != nil {
+		return err
+	}
+	if err = cnn.send(fromAddr.Address, sendTo, msg); err != nil {
+		cnn.Close()
+		return ToError(err)
+	}
+	c.put(cnn)
+	return nil
+}
+
+func (c *smtpClient) MustSend(sendTo []string, from, subject, html, text string) {
+	PanicOn(c.Send(sendTo, from, subject, html, text))
+}
+
+// get returns a pooled connection if one is still alive, otherwise dials.
+func (c *smtpClient) get() (*smtpCnn, error) {
+	for {
+		select {
+		case cnn := <-c.pool:
+			cnn.extend()
+			if cnn.Noop() == nil {
+				return cnn, nil
+			}
+			cnn.Close()
+		default:
+			return c.dial()
+		}
+	}
+}
+
+func (c *smtpClient) put(cnn *smtpCnn) {
+	if cnn.Reset() != nil {
+		cnn.Close()
+		return
+	}
+	select {
+	case c.pool <- cnn:
+	default:
+		cnn.Quit()
+	}
+}
+
+func (c *smtpClient) dial() (*smtpCnn, error) {
+	addr := net.JoinHostPort(c.c.Host, strconv.Itoa(c.c.Port))
+	dialer := &net.Dialer{Timeout: c.c.Timeout}
+	tlsConfig := &tls.Config{ServerName: c.c.Host}
+	var conn net.Conn
+	var err error
+	if c.c.TLS == SMTPImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, ToError(err)
+	}
+	cnn := &smtpCnn{conn: conn, timeout: c.c.Timeout}
+	cnn.extend()
+	cnn.Client, err = smtp.NewClient(conn, c.c.Host)
+	if err != nil {
+		conn.Close()
+		return nil, ToError(err)
+	}
+	if err = c.handshake(cnn, tlsConfig); err != nil {
+		cnn.Close()
+		return nil, err
+	}
+	return cnn, nil
+}
+
+func (c *smtpClient) handshake(cnn *smtpCnn, tlsConfig *tls.Config) error {
+	if c.c.TLS == SMTPStartTLS {
+		if ok, _ := cnn.Extension("STARTTLS"); !ok {
+			return Err("smtp server %s doesn't support STARTTLS", c.c.Host)
+		}
+		if err := cnn.StartTLS(tlsConfig); err != nil {
+			return ToError(err)
+		}
+	}
+	if c.c.Username == "" {
+		return nil
+	}
+	ok, mechs := cnn.Extension("AUTH")
+	if !ok {
+		return Err("smtp server %s doesn't support AUTH", c.c.Host)
+	}
+	var auth smtp.Auth
+	switch mechs = " " + strings.ToUpper(mechs) + " "; {
+	case strings.Contains(mechs, " PLAIN "):
+		auth = smtp.PlainAuth("", c.c.Username, c.c.Pwd, c.c.Host)
+	case strings.Contains(mechs, " LOGIN "):
+		auth = &loginAuth{host: c.c.Host, username: c.c.Username, pwd: c.c.Pwd}
+	default:
+		return Err("smtp server %s doesn't support PLAIN or LOGIN auth", c.c.Host)
+	}
+	return ToError(cnn.Auth(auth))
+}
+
+func (cnn *smtpCnn) send(from string, sendTo []string, msg []byte) error {
+	cnn.extend()
+	if err := cnn.Mail(from); err != nil {
+		return err
+	}
+	for _, to := range sendTo {
+		if err := cnn.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := cnn.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// loginAuth is the non standard but widely used LOGIN mechanism, like
+// smtp.PlainAuth it refuses to send credentials over unencrypted
+// connections unless the server is localhost.
+type loginAuth struct {
+	host     string
+	username string
+	pwd      string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, Err("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, Err("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.pwd), nil
+	default:
+		return nil, Err("unexpected smtp LOGIN challenge %q", fromServer)
+	}
+}
+
+// smtpMessage builds a multipart/alternative message with quoted-printable
+// text and html parts.
+func smtpMessage(sendTo []string, from, subject, html, text string) ([]byte, error) {
+	msgID := make([]byte, 16)
+	if _, err := rand.Read(msgID); err != nil {
+		return nil, ToError(err)
+	}
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndexByte(addr.Address, '@'); i != -1 {
+			domain = addr.Address[i+1:]
+		}
+	}
+	buf := &bytes.Buffer{}
+	body := multipart.NewWriter(buf)
+	header := func(name, value string) {
+		buf.WriteString(name + ": " + value + "\r\n")
+	}
+	header("From", from)
+	header("To", strings.Join(sendTo, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+hex.EncodeToString(msgID)+"@"+domain+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", `multipart/alternative; boundary="`+body.Boundary()+`"`)
+	buf.WriteString("\r\n")
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		// least preferred first
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, ToError(err)
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err = qp.Write([]byte(part.content)); err != nil {
+			return nil, ToError(err)
+		}
+		if err = qp.Close(); err != nil {
+			return nil, ToError(err)
+		}
+	}
+	if err := body.Close(); err != nil {
+		return nil, ToError(err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,194 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpStandIn is a minimal local smtp server which records what it's sent.
+type smtpStandIn struct {
+	l        net.Listener
+	authMech string
+	username string
+	pwd      string
+	mtx      sync.Mutex
+	cnns     int
+	auths    []string
+	msgs     []*smtpStandInMsg
+}
+
+type smtpStandInMsg struct {
+	from   string
+	sendTo []string
+	data   []byte
+}
+
+func newSMTPStandIn(authMech, username, pwd string) *smtpStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	PanicOn(err)
+	s := &smtpStandIn{l: l, authMech: authMech, username: username, pwd: pwd}
+	go func() {
+		for {
+			cnn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mtx.Lock()
+			s.cnns++
+			s.mtx.Unlock()
+			go s.serve(textproto.NewConn(cnn))
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStandIn) serve(c *textproto.Conn) {
+	defer c.Close()
+	c.PrintfLine("220 localhost ESMTP")
+	msg := &smtpStandInMsg{}
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(strings.TrimPrefix(line, line[:len(cmd)]))
+		switch cmd {
+		case "EHLO":
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250 AUTH %s", s.authMech)
+		case "AUTH":
+			var username, pwd string
+			if strings.HasPrefix(arg, "PLAIN ") {
+				bs, _ := base64.StdEncoding.DecodeString(arg[6:])
+				parts := strings.Split(string(bs), "\x00")
+				username, pwd = parts[1], parts[2]
+			} else {
+				c.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+				line, _ = c.ReadLine()
+				bs, _ := base64.StdEncoding.DecodeString(line)
+				username = string(bs)
+				c.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+				line, _ = c.ReadLine()
+				bs, _ = base64.StdEncoding.DecodeString(line)
+				pwd = string(bs)
+			}
+			if username != s.username || pwd != s.pwd {
+				c.PrintfLine("535 authentication failed")
+				continue
+			}
+			s.mtx.Lock()
+			s.auths = append(s.auths, strings.SplitN(arg, " ", 2)[0])
+			s.mtx.Unlock()
+			c.PrintfLine("235 authenticated")
+		case "MAIL":
+			msg.from = strings.Trim(strings.SplitN(arg, ":", 2)[1], "<>")
+			c.PrintfLine("250 ok")
+		case "RCPT":
+			msg.sendTo = append(msg.sendTo, strings.Trim(strings.SplitN(arg, ":", 2)[1], "<>"))
+			c.PrintfLine("250 ok")
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			msg.data, err = c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mtx.Lock()
+			s.msgs = append(s.msgs, msg)
+			s.mtx.Unlock()
+			msg = &smtpStandInMsg{}
+			c.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			msg = &smtpStandInMsg{}
+			c.PrintfLine("250 ok")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestSMTPClient(t *testing.T) {
+	a := assert.New(t)
+	for _, mech := range []string{"PLAIN", "LOGIN"} {
+		s := newSMTPStandIn(mech, "joe", "pwd")
+		c := NewSMTPClient(&SMTPConfig{
+			Host:     "127.0.0.1",
+			Port:     s.port(),
+			Username: "joe",
+			Pwd:      "pwd",
+			TLS:      SMTPNoTLS,
+			PoolSize: 1,
+		})
+		c.MustSend([]string{"ali@test.localhost", "bob@test.localhost"}, "Tlbx <tlbx@test.localhost>", "Héllo", "<p>Hi ünïcode</p>", "Hi ünïcode")
+		c.MustSend([]string{"cat@test.localhost"}, "tlbx@test.localhost", "Again", "<p>Again</p>", "Again")
+		s.l.Close()
+
+		// the pooled connection is reused
+		a.Equal(1, s.cnns)
+		a.Equal([]string{mech}, s.auths)
+		a.Equal(2, len(s.msgs))
+		a.Equal("tlbx@test.localhost", s.msgs[0].from)
+		a.Equal([]string{"ali@test.localhost", "bob@test.localhost"}, s.msgs[0].sendTo)
+		a.Equal([]string{"cat@test.localhost"}, s.msgs[1].sendTo)
+
+		m, err := mail.ReadMessage(bytes.NewReader(s.msgs[0].data))
+		a.Nil(err)
+		a.Equal("Tlbx <tlbx@test.localhost>", m.Header.Get("From"))
+		a.Equal("ali@test.localhost, bob@test.localhost", m.Header.Get("To"))
+		subject, err := (&mime.WordDecoder{}).DecodeHeader(m.Header.Get("Subject"))
+		a.Nil(err)
+		a.Equal("Héllo", subject)
+		a.True(strings.HasSuffix(m.Header.Get("Message-ID"), "@test.localhost>"))
+		mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+		a.Nil(err)
+		a.Equal("multipart/alternative", mediaType)
+		r := multipart.NewReader(m.Body, params["boundary"])
+		parts := map[string]string{}
+		for {
+			p, err := r.NextPart()
+			if err != nil {
+				break
+			}
+			// multipart.Reader transparently decodes quoted-printable
+			bs, err := ioutil.ReadAll(p)
+			a.Nil(err)
+			parts[p.Header.Get("Content-Type")] = string(bs)
+		}
+		a.Equal(map[string]string{
+			"text/plain; charset=utf-8": "Hi ünïcode",
+			"text/html; charset=utf-8":  "<p>Hi ünïcode</p>",
+		}, parts)
+	}
+
+	// bad credentials and unreachable servers are errors
+	s := newSMTPStandIn("PLAIN", "joe", "pwd")
+	c := NewSMTPClient(&SMTPConfig{Host: "127.0.0.1", Port: s.port(), Username: "joe", Pwd: "nope", TLS: SMTPNoTLS})
+	a.NotNil(c.Send([]string{"ali@test.localhost"}, "tlbx@test.localhost", "Hi", "Hi", "Hi"))
+	s.l.Close()
+	c = NewSMTPClient(&SMTPConfig{Host: "127.0.0.1", Port: s.port(), TLS: SMTPNoTLS})
+	a.NotNil(c.Send([]string{"ali@test.localhost"}, "tlbx@test.localhost", "Hi", "Hi", "Hi"))
+	// starttls is required when configured
+	s = newSMTPStandIn("PLAIN", "joe", "pwd")
+	defer s.l.Close()
+	c = NewSMTPClient(&SMTPConfig{Host: "127.0.0.1", Port: s.port(), TLS: SMTPStartTLS})
+	a.Contains(ToError(c.Send([]string{"ali@test.localhost"}, "tlbx@test.localhost", "Hi", "Hi", "Hi")).Message(), "doesn't support STARTTLS")
+}
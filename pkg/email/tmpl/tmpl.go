@@ -0,0 +1,241 @@
+// Package tmpl renders localized emails from html and text templates.
+//
+// Templates are read from a file system laid out as <locale>/<file>, e.g.
+//
+//	en/layout.html
+//	en/layout.txt
+//	en/activate.html
+//	en/activate.txt
+//
+// Each email is a .html and .txt file which define a "content" template for
+// the layout to include, the .txt file must also define a "subject" template.
+// A locale only needs the files it changes, the rest come from the default
+// locale, and later file systems passed to New override files in earlier
+// ones so apps can rebrand or translate individual emails.
+package tmpl
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/email"
+)
+
+const (
+	layoutHTML = "layout.html"
+	layoutText = "layout.txt"
+	// used if there is no layout file
+	noLayout = `{{template "content" .}}`
+)
+
+type Email struct {
+	Subject string
+	HTML    string
+	Text    string
+}
+
+type Set struct {
+	defaultLocale string
+	locales       map[string]*locale
+}
+
+type locale struct {
+	html map[string]*htmltemplate.Template
+	text map[string]*texttemplate.Template
+}
+
+// New parses all the templates in fss, later file systems override files in
+// earlier ones. defaultLocale must have a template for every email.
+func New(defaultLocale string, fss ...fs.FS) *Set {
+	defaultLocale = normalize(defaultLocale)
+	files := map[string]map[string][]byte{}
+	for _, fsys := range fss {
+		PanicOn(fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			parts := strings.Split(path, "/")
+			if len(parts) != 2 {
+				return nil
+			}
+			bs, err := fs.ReadFile(fsys, path)
+			if err != nil {
+				return err
+			}
+			l := normalize(parts[0])
+			if files[l] == nil {
+				files[l] = map[string][]byte{}
+			}
+			files[l][parts[1]] = bs
+			return nil
+		}))
+	}
+	PanicIf(files[defaultLocale] == nil, "no email templates for default locale %s", defaultLocale)
+	s := &Set{
+		defaultLocale: defaultLocale,
+		locales:       map[string]*locale{},
+	}
+	for l, lFiles := range files {
+		merged := map[string][]byte{}
+		for name, bs := range files[defaultLocale] {
+			merged[name] = bs
+		}
+		for name, bs := range lFiles {
+			merged[name] = bs
+		}
+		s.locales[l] = parse(l, merged)
+	}
+	return s
+}
+
+func parse(l string, files map[string][]byte) *locale {
+	res := &locale{
+		html: map[string]*htmltemplate.Template{},
+		text: map[string]*texttemplate.Template{},
+	}
+	layout := func(name string) string {
+		if bs, exists := files[name]; exists {
+			return string(bs)
+		}
+		return noLayout
+	}
+	for file, bs := range files {
+		if file == layoutHTML || file == layoutText {
+			continue
+		}
+		if name := strings.TrimSuffix(file, ".html"); name != file {
+			t, err := htmltemplate.New(file).Parse(layout(layoutHTML))
+			PanicOn(err)
+			res.html[name], err = t.Parse(string(bs))
+			PanicOn(err)
+		} else if name := strings.TrimSuffix(file, ".txt"); name != file {
+			t, err := texttemplate.New(file).Parse(layout(layoutText))
+			PanicOn(err)
+			res.text[name], err = t.Parse(string(bs))
+			PanicOn(err)
+			PanicIf(res.text[name].Lookup("subject") == nil, "email template %s/%s has no subject", l, file)
+		}
+	}
+	return res
+}
+
+// Locales returns the available locales.
+func (s *Set) Locales() []string {
+	res := make([]string, 0, len(s.locales))
+	for l := range s.locales {
+		res = append(res, l)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Has returns true if there is a locale for tag, ignoring region.
+func (s *Set) Has(tag string) bool {
+	return s.match(tag) != ""
+}
+
+// Locale returns the first of preferences which is available, by exact
+// match or by language, otherwise the default locale. Empty preferences are
+// skipped.
+func (s *Set) Locale(preferences ...string) string {
+	for _, p := range preferences {
+		if l := s.match(p); l != "" {
+			return l
+		}
+	}
+	return s.defaultLocale
+}
+
+func (s *Set) match(tag string) string {
+	tag = normalize(tag)
+	if tag == "" {
+		return ""
+	}
+	if _, exists := s.locales[tag]; exists {
+		return tag
+	}
+	if i := strings.IndexByte(tag, '-'); i != -1 {
+		if _, exists := s.locales[tag[:i]]; exists {
+			return tag[:i]
+		}
+	}
+	return ""
+}
+
+// Render renders email name in locale l, which should come from Locale.
+func (s *Set) Render(l, name string, data interface{}) (*Email, error) {
+	loc := s.locales[s.Locale(l)]
+	html, text := loc.html[name], loc.text[name]
+	if html == nil || text == nil {
+		return nil, Err("unknown email template %s", name)
+	}
+	res := &Email{}
+	buf := &bytes.Buffer{}
+	if err := text.ExecuteTemplate(buf, "subject", data); err != nil {
+		return nil, ToError(err)
+	}
+	res.Subject = strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err := text.Execute(buf, data); err != nil {
+		return nil, ToError(err)
+	}
+	res.Text = strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err := html.Execute(buf, data); err != nil {
+		return nil, ToError(err)
+	}
+	res.HTML = strings.TrimSpace(buf.String())
+	return res, nil
+}
+
+// MustSend renders and sends email name.
+func (s *Set) MustSend(c email.Client, sendTo []string, from, l, name string, data interface{}) {
+	e, err := s.Render(l, name, data)
+	PanicOn(err)
+	c.MustSend(sendTo, from, e.Subject, e.HTML, e.Text)
+}
+
+// ParseAcceptLanguage returns the language tags in an Accept-Language
+// header in order of preference.
+func ParseAcceptLanguage(header string) []string {
+	type tag struct {
+		tag string
+		q   float64
+	}
+	tags := []tag{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		t := tag{tag: strings.TrimSpace(fields[0]), q: 1}
+		if t.tag == "" || t.tag == "*" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			if f = strings.TrimSpace(f); strings.HasPrefix(f, "q=") {
+				if q, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					t.q = q
+				}
+			}
+		}
+		if t.q > 0 {
+			tags = append(tags, t)
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+	res := make([]string, 0, len(tags))
+	for _, t := range tags {
+		res = append(res, t.tag)
+	}
+	return res
+}
+
+func normalize(tag string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+}
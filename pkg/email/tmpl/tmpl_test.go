@@ -0,0 +1,57 @@
+package tmpl
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSet(t *testing.T) {
+	a := assert.New(t)
+	defaults := fstest.MapFS{
+		"en/layout.html": {Data: []byte(`<body>{{template "content" .}}</body>`)},
+		"en/layout.txt":  {Data: []byte(`{{template "content" .}}` + "\n-- tlbx")},
+		"en/hi.html":     {Data: []byte(`{{define "content"}}<p>Hi {{.}}</p>{{end}}`)},
+		"en/hi.txt":      {Data: []byte(`{{define "subject"}} Hi {{end}}{{define "content"}}Hi {{.}}{{end}}`)},
+		"en/bye.html":    {Data: []byte(`{{define "content"}}<p>Bye {{.}}</p>{{end}}`)},
+		"en/bye.txt":     {Data: []byte(`{{define "subject"}}Bye{{end}}{{define "content"}}Bye {{.}}{{end}}`)},
+		"fr/hi.html":     {Data: []byte(`{{define "content"}}<p>Salut {{.}}</p>{{end}}`)},
+		"fr/hi.txt":      {Data: []byte(`{{define "subject"}}Salut{{end}}{{define "content"}}Salut {{.}}{{end}}`)},
+	}
+	app := fstest.MapFS{
+		"en/layout.html": {Data: []byte(`<body class="app">{{template "content" .}}</body>`)},
+		"pt_BR/hi.txt":   {Data: []byte(`{{define "subject"}}Oi{{end}}{{define "content"}}Oi {{.}}{{end}}`)},
+	}
+	s := New("en", defaults, app)
+	a.Equal([]string{"en", "fr", "pt-br"}, s.Locales())
+
+	e, err := s.Render("en", "hi", "<joe>")
+	a.Nil(err)
+	a.Equal(&Email{
+		Subject: "Hi",
+		HTML:    `<body class="app"><p>Hi &lt;joe&gt;</p></body>`,
+		Text:    "Hi <joe>\n-- tlbx",
+	}, e)
+
+	// missing files come from the default locale
+	e, err = s.Render("fr", "bye", "joe")
+	a.Nil(err)
+	a.Equal("Bye", e.Subject)
+	e, err = s.Render("pt-br", "hi", "joe")
+	a.Nil(err)
+	a.Equal("Oi", e.Subject)
+	a.Equal(`<body class="app"><p>Hi joe</p></body>`, e.HTML)
+
+	_, err = s.Render("en", "nope", "joe")
+	a.NotNil(err)
+
+	a.Equal("fr", s.Locale("", "fr-CA", "en"))
+	a.Equal("pt-br", s.Locale("pt_BR"))
+	a.Equal("en", s.Locale("de"))
+	a.True(s.Has("fr-FR"))
+	a.False(s.Has("de"))
+
+	a.Equal([]string{"fr-CH", "fr", "en", "de"}, ParseAcceptLanguage("en;q=0.8, fr-CH, *;q=0.5, fr;q=0.9, de;q=0.7, es;q=0"))
+	a.Empty(ParseAcceptLanguage(""))
+}
@@ -0,0 +1,241 @@
+package fcm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/messaging"
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/json"
+	"google.golang.org/api/option"
+)
+
+// fcm error codes which can be scripted with Fake.Fail
+const (
+	ErrUnregistered     = "UNREGISTERED"
+	ErrInvalidArgument  = "INVALID_ARGUMENT"
+	ErrSenderIDMismatch = "SENDER_ID_MISMATCH"
+	ErrQuotaExceeded    = "QUOTA_EXCEEDED"
+	ErrUnavailable      = "UNAVAILABLE"
+	ErrInternal         = "INTERNAL"
+	ErrThirdPartyAuth   = "THIRD_PARTY_AUTH_ERROR"
+	fakeProjectID       = "fake"
+	fakeBatchBoundary   = "batch_fake"
+	fcmHost             = "fcm.googleapis.com"
+	fcmErrorDetailType  = "type.googleapis.com/google.firebase.fcm.v1.FcmError"
+)
+
+var fakeErrs = map[string]struct {
+	status int
+	name   string
+}{
+	ErrUnregistered:     {http.StatusNotFound, "NOT_FOUND"},
+	ErrInvalidArgument:  {http.StatusBadRequest, "INVALID_ARGUMENT"},
+	ErrSenderIDMismatch: {http.StatusForbidden, "PERMISSION_DENIED"},
+	ErrQuotaExceeded:    {http.StatusTooManyRequests, "RESOURCE_EXHAUSTED"},
+	ErrUnavailable:      {http.StatusServiceUnavailable, "UNAVAILABLE"},
+	ErrInternal:         {http.StatusInternalServerError, "INTERNAL"},
+	ErrThirdPartyAuth:   {http.StatusUnauthorized, "UNAUTHENTICATED"},
+}
+
+// NewFake returns a Client backed by an in process stand in for the fcm
+// batch send api, it uses the real firebase sdk so scripted failures are
+// reported with the same errors the real api causes. Every multicast
+// message it receives is recorded for tests to read back.
+func NewFake() *Fake {
+	f := &Fake{
+		mtx:      &sync.Mutex{},
+		failures: map[string]string{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.batch))
+	srvURL, err := url.Parse(f.server.URL)
+	PanicOn(err)
+	hc := &http.Client{
+		Transport: &fakeTransport{
+			url:  srvURL,
+			next: f.server.Client().Transport,
+		},
+	}
+	fa, err := firebase.NewApp(context.Background(), &firebase.Config{ProjectID: fakeProjectID}, option.WithHTTPClient(hc))
+	PanicOn(err)
+	mc, err := fa.Messaging(context.Background())
+	PanicOn(err)
+	f.client = NewClient(mc)
+	return f
+}
+
+type Fake struct {
+	server   *httptest.Server
+	client   Client
+	mtx      *sync.Mutex
+	msgs     []*messaging.MulticastMessage
+	failures map[string]string
+}
+
+func (f *Fake) Send(ctx context.Context, m *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	return f.client.Send(ctx, m)
+}
+
+func (f *Fake) MustSend(ctx context.Context, m *messaging.MulticastMessage) *messaging.BatchResponse {
+	res, err := f.Send(ctx, m)
+	PanicOn(err)
+	return res
+}
+
+// Fail makes every send to tokens fail with the fcm error code, one of the
+// Err constants, until Succeed is called for them.
+func (f *Fake) Fail(code string, tokens ...string) {
+	_, ok := fakeErrs[code]
+	PanicIf(!ok, "unknown fcm error code %q", code)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for _, token := range tokens {
+		f.failures[token] = code
+	}
+}
+
+// Succeed undoes Fail for tokens.
+func (f *Fake) Succeed(tokens ...string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for _, token := range tokens {
+		delete(f.failures, token)
+	}
+}
+
+// Msgs returns the multicast messages sent to token, oldest first,
+// including those which failed for token.
+func (f *Fake) Msgs(token string) []*messaging.MulticastMessage {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	res := []*messaging.MulticastMessage{}
+	for _, m := range f.msgs {
+		for _, t := range m.Tokens {
+			if t == token {
+				res = append(res, m)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// Latest returns the last multicast message sent to token, nil if there
+// are none.
+func (f *Fake) Latest(token string) *messaging.MulticastMessage {
+	msgs := f.Msgs(token)
+	if len(msgs) == 0 {
+		return nil
+	}
+	return msgs[len(msgs)-1]
+}
+
+func (f *Fake) Close() {
+	f.server.Close()
+}
+
+// batch handles a multipart batch of messages:send requests, a
+// batch is what the sdk sends for each multicast message.
+func (f *Fake) batch(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	PanicOn(err)
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	m := &messaging.MulticastMessage{}
+	out := &bytes.Buffer{}
+	mw := multipart.NewWriter(out)
+	PanicOn(mw.SetBoundary(fakeBatchBoundary))
+	for i := 0; ; i++ {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		PanicOn(err)
+		req, err := http.ReadRequest(bufio.NewReader(p))
+		PanicOn(err)
+		body := struct {
+			Message *messaging.Message `json:"message"`
+		}{}
+		json.MustUnmarshalReader(req.Body, &body)
+		msg := body.Message
+		if i == 0 {
+			m.Data = msg.Data
+			m.Notification = msg.Notification
+			m.Android = msg.Android
+			m.Webpush = msg.Webpush
+			m.APNS = msg.APNS
+		}
+		m.Tokens = append(m.Tokens, msg.Token)
+		f.mtx.Lock()
+		code, failed := f.failures[msg.Token]
+		f.mtx.Unlock()
+		status, resBody := http.StatusOK, json.MustMarshal(map[string]string{
+			"name": Strf("projects/%s/messages/%d", fakeProjectID, i),
+		})
+		if failed {
+			status, resBody = fakeErr(code)
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-ID", Strf("response-%d", i+1))
+		pw, err := mw.CreatePart(header)
+		PanicOn(err)
+		fmt.Fprintf(pw, "HTTP/1.1 %d %s\r\nContent-Type: application/json; charset=UTF-8\r\nContent-Length: %d\r\n\r\n", status, http.StatusText(status), len(resBody))
+		_, err = pw.Write(resBody)
+		PanicOn(err)
+	}
+	PanicOn(mw.Close())
+	f.mtx.Lock()
+	f.msgs = append(f.msgs, m)
+	f.mtx.Unlock()
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+fakeBatchBoundary)
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(out.Bytes())
+	PanicOn(err)
+}
+
+// fakeErr returns the status and body of the fcm v1 api's response to a
+// send which failed with code.
+func fakeErr(code string) (int, []byte) {
+	e := fakeErrs[code]
+	return e.status, json.MustMarshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    e.status,
+			"message": strings.ToLower(strings.Replace(code, "_", " ", -1)),
+			"status":  e.name,
+			"details": []map[string]string{
+				{
+					"@type":     fcmErrorDetailType,
+					"errorCode": code,
+				},
+			},
+		},
+	})
+}
+
+// fakeTransport sends requests for the fcm api to url instead.
+type fakeTransport struct {
+	url  *url.URL
+	next http.RoundTripper
+}
+
+func (t *fakeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host == fcmHost {
+		r = r.Clone(r.Context())
+		r.URL.Scheme = t.url.Scheme
+		r.URL.Host = t.url.Host
+		r.Host = t.url.Host
+	}
+	return t.next.RoundTrip(r)
+}
@@ -54,6 +54,34 @@ func (c *client) MustSend(ctx context.Context, m *messaging.MulticastMessage) *m
 	return res
 }
 
+// Failures returns the tokens which failed in res, the response to sending
+// to tokens, split into those which are invalid and should be forgotten and
+// those which failed transiently and may be retried. Tokens without a
+// response, because the send was cut short by an error, are retried.
+func Failures(tokens []string, res *messaging.BatchResponse) (invalid []string, retry []string) {
+	responses := 0
+	if res != nil {
+		responses = len(res.Responses)
+	}
+	for i, token := range tokens {
+		if i >= responses {
+			retry = append(retry, token)
+			continue
+		}
+		r := res.Responses[i]
+		switch {
+		case r.Success:
+		case messaging.IsRegistrationTokenNotRegistered(r.Error) || messaging.IsInvalidArgument(r.Error):
+			invalid = append(invalid, token)
+		case messaging.IsMismatchedCredential(r.Error) || messaging.IsInvalidAPNSCredentials(r.Error) || messaging.IsTooManyTopics(r.Error):
+			// config errors, retrying won't help
+		default:
+			retry = append(retry, token)
+		}
+	}
+	return
+}
+
 func NewNopClient(l log.Log) Client {
 	return &nopClient{
 		log: l,
@@ -66,7 +94,15 @@ type nopClient struct {
 
 func (c *nopClient) Send(ctx context.Context, m *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
 	c.log.Warning("nop fcm client called for %d tokens", len(m.Tokens))
-	return &messaging.BatchResponse{}, nil
+	// report success so callers don't retry
+	res := &messaging.BatchResponse{
+		SuccessCount: len(m.Tokens),
+		Responses:    make([]*messaging.SendResponse, 0, len(m.Tokens)),
+	}
+	for range m.Tokens {
+		res.Responses = append(res.Responses, &messaging.SendResponse{Success: true})
+	}
+	return res, nil
 }
 
 func (c *nopClient) MustSend(ctx context.Context, m *messaging.MulticastMessage) *messaging.BatchResponse {
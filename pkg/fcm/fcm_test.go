@@ -0,0 +1,77 @@
+package fcm
+
+import (
+	"context"
+	"testing"
+
+	"firebase.google.com/go/messaging"
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailures(t *testing.T) {
+	a := assert.New(t)
+	invalid, retry := Failures([]string{"a", "b", "c"}, &messaging.BatchResponse{
+		Responses: []*messaging.SendResponse{
+			{Success: true},
+			{Error: Err("connection reset")},
+		},
+	})
+	a.Empty(invalid)
+	// c has no response so is retried too
+	a.Equal([]string{"b", "c"}, retry)
+
+	invalid, retry = Failures([]string{"a"}, nil)
+	a.Empty(invalid)
+	a.Equal([]string{"a"}, retry)
+
+	// the nop client reports success so nothing is retried
+	tokens := []string{"a", "b"}
+	res := NewNopClient(log.New()).MustSend(context.Background(), &messaging.MulticastMessage{Tokens: tokens})
+	invalid, retry = Failures(tokens, res)
+	a.Empty(invalid)
+	a.Empty(retry)
+}
+
+func TestFake(t *testing.T) {
+	a := assert.New(t)
+	f := NewFake()
+	defer f.Close()
+	f.Fail(ErrUnregistered, "gone")
+	f.Fail(ErrInvalidArgument, "bad")
+	f.Fail(ErrUnavailable, "busy")
+	f.Fail(ErrSenderIDMismatch, "other")
+	tokens := []string{"ok", "gone", "bad", "busy", "other"}
+	res := f.MustSend(context.Background(), &messaging.MulticastMessage{
+		Tokens: tokens,
+		Data:   map[string]string{"a": "b"},
+	})
+	a.Equal(1, res.SuccessCount)
+	a.Equal(4, res.FailureCount)
+	a.True(messaging.IsRegistrationTokenNotRegistered(res.Responses[1].Error))
+	invalid, retry := Failures(tokens, res)
+	a.Equal([]string{"gone", "bad"}, invalid)
+	a.Equal([]string{"busy"}, retry)
+
+	f.Succeed("busy")
+	f.MustSend(context.Background(), &messaging.MulticastMessage{
+		Tokens: []string{"busy"},
+		Data:   map[string]string{"c": "d"},
+	})
+	a.Len(f.Msgs("ok"), 1)
+	a.Equal(tokens, f.Msgs("ok")[0].Tokens)
+	a.Len(f.Msgs("busy"), 2)
+	a.Equal(map[string]string{"c": "d"}, f.Latest("busy").Data)
+	a.Nil(f.Latest("nope"))
+
+	// batches over the 500 token limit are split
+	tokens = make([]string, 501)
+	for i := range tokens {
+		tokens[i] = Strf("%d", i)
+	}
+	res = f.MustSend(context.Background(), &messaging.MulticastMessage{Tokens: tokens})
+	a.Equal(501, res.SuccessCount)
+	a.Len(f.Msgs("0")[0].Tokens, 500)
+	a.Len(f.Msgs("500")[0].Tokens, 1)
+}
@@ -0,0 +1,227 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/json"
+)
+
+const (
+	fakeKid          = "fake"
+	fakeClientID     = "fake-client"
+	fakeClientSecret = "fake-secret"
+)
+
+// FakeProvider is a local stand in OIDC provider for tests, every
+// authorization request is approved as the current user.
+type FakeProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	mtx    *sync.Mutex
+	user   *FakeUser
+	codes  map[string]*fakeCode
+}
+
+type FakeUser struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type fakeCode struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	user        FakeUser
+}
+
+func NewFakeProvider() *FakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	PanicOn(err)
+	f := &FakeProvider{
+		key:   key,
+		mtx:   &sync.Mutex{},
+		codes: map[string]*fakeCode{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, f.discovery)
+	mux.HandleFunc("/authorize", f.authorize)
+	mux.HandleFunc("/token", f.token)
+	mux.HandleFunc("/jwks", f.jwks)
+	f.server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *FakeProvider) Issuer() string {
+	return f.server.URL
+}
+
+// Config returns a provider config for the fake named name.
+func (f *FakeProvider) Config(name string) *Config {
+	return &Config{
+		Name:         name,
+		Issuer:       f.Issuer(),
+		ClientID:     fakeClientID,
+		ClientSecret: fakeClientSecret,
+	}
+}
+
+// SetUser sets who is logged in at the provider.
+func (f *FakeProvider) SetUser(u *FakeUser) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.user = u
+}
+
+// Authorize does what a browser would with authURL, returning the state and
+// code the provider redirects back with.
+func (f *FakeProvider) Authorize(authURL string) (state, code string, err error) {
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(authURL)
+	if err != nil {
+		return "", "", ToError(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		return "", "", Err("fake oidc authorize failed with %d", res.StatusCode)
+	}
+	loc, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return "", "", ToError(err)
+	}
+	return loc.Query().Get("state"), loc.Query().Get("code"), nil
+}
+
+func (f *FakeProvider) Close() {
+	f.server.Close()
+}
+
+func (f *FakeProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &discovery{
+		Issuer:                f.Issuer(),
+		AuthorizationEndpoint: f.Issuer() + "/authorize",
+		TokenEndpoint:         f.Issuer() + "/token",
+		JwksURI:               f.Issuer() + "/jwks",
+	})
+}
+
+func (f *FakeProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.user == nil ||
+		q.Get("client_id") != fakeClientID ||
+		q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" ||
+		q.Get("code_challenge") == "" ||
+		q.Get("redirect_uri") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	code := Verifier()
+	f.codes[code] = &fakeCode{
+		redirectURI: q.Get("redirect_uri"),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		user:        *f.user,
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	PanicOn(err)
+	rq := redirect.Query()
+	rq.Set("state", q.Get("state"))
+	rq.Set("code", code)
+	redirect.RawQuery = rq.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (f *FakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	tokenErr := func(msg string) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenErr("invalid_request")
+		return
+	}
+	id, secret, _ := r.BasicAuth()
+	if id != fakeClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(fakeClientSecret)) != 1 {
+		tokenErr("invalid_client")
+		return
+	}
+	f.mtx.Lock()
+	code := f.codes[r.PostForm.Get("code")]
+	// codes are single use
+	delete(f.codes, r.PostForm.Get("code"))
+	f.mtx.Unlock()
+	if code == nil ||
+		r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("redirect_uri") != code.redirectURI ||
+		challenge(r.PostForm.Get("code_verifier")) != code.challenge {
+		tokenErr("invalid_grant")
+		return
+	}
+	now := Now()
+	idToken := f.sign(&Claims{
+		Issuer:        f.Issuer(),
+		Subject:       code.user.Subject,
+		Audience:      fakeClientID,
+		Expiry:        now.Add(time.Hour).Unix(),
+		IssuedAt:      now.Unix(),
+		Nonce:         code.nonce,
+		Email:         code.user.Email,
+		EmailVerified: code.user.EmailVerified,
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": Verifier(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func (f *FakeProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := f.key.PublicKey
+	writeJSON(w, http.StatusOK, &jwks{
+		Keys: []*jwk{
+			{
+				Kty: "RSA",
+				Kid: fakeKid,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			},
+		},
+	})
+}
+
+func (f *FakeProvider) sign(claims *Claims) string {
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(json.MustMarshal(&jwtHeader{Alg: "RS256", Kid: fakeKid})) +
+		"." + enc.EncodeToString(json.MustMarshal(claims))
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, hash[:])
+	PanicOn(err)
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err := w.Write(json.MustMarshal(v))
+	PanicOn(err)
+}
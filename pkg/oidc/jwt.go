@@ -0,0 +1,109 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"strings"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/json"
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// rsa
+	N string `json:"n"`
+	E string `json:"e"`
+	// ec
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []*jwk `json:"keys"`
+}
+
+// parse returns the usable signing keys by id, others are skipped.
+func (s *jwks) parse() map[string]interface{} {
+	keys := map[string]interface{}{}
+	b64 := func(s string) *big.Int {
+		bs, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(bs) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(bs)
+	}
+	for _, k := range s.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, e := b64(k.N), b64(k.E)
+			if n != nil && e != nil && e.IsInt64() && n.BitLen() >= 2048 {
+				keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+			}
+		case "EC":
+			x, y := b64(k.X), b64(k.Y)
+			if k.Crv == "P-256" && x != nil && y != nil && elliptic.P256().IsOnCurve(x, y) {
+				keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+			}
+		}
+	}
+	return keys
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks token's signature and unmarshals its claims into dst, only
+// RS256 and ES256 are accepted.
+func (p *Provider) verify(token string, dst interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Err("oidc id token is not a jwt")
+	}
+	headerBs, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ToError(err)
+	}
+	header := &jwtHeader{}
+	if err := json.Unmarshal(headerBs, header); err != nil {
+		return ToError(err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ToError(err)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	valid := false
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		valid = header.Alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+	case *ecdsa.PublicKey:
+		valid = header.Alg == "ES256" && len(sig) == 64 &&
+			ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	if !valid {
+		return Err("oidc id token has an invalid signature")
+	}
+	claimsBs, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ToError(err)
+	}
+	return ToError(json.Unmarshal(claimsBs, dst))
+}
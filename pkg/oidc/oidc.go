@@ -0,0 +1,264 @@
+// Package oidc is an OpenID Connect relying party for the authorization code
+// flow with PKCE.
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/crypt"
+	"github.com/0xor1/tlbx/pkg/json"
+)
+
+const (
+	discoveryPath   = "/.well-known/openid-configuration"
+	discoveryMaxAge = time.Hour
+	// how often unknown key ids can trigger a jwks refresh
+	keysMinAge = time.Minute
+	// allowed clock difference with the provider
+	leeway        = time.Minute
+	verifierLen   = 64
+	maxRespBytes  = 1 << 20
+	clientTimeout = 10 * time.Second
+)
+
+type Config struct {
+	// Name identifies the provider in urls and the db, e.g. google
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes default to openid email profile
+	Scopes []string
+}
+
+// Claims are the id token claims used for login.
+type Claims struct {
+	Issuer        string      `json:"iss"`
+	Subject       string      `json:"sub"`
+	Audience      interface{} `json:"aud"`
+	Expiry        int64       `json:"exp"`
+	IssuedAt      int64       `json:"iat"`
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	Name          string      `json:"name"`
+}
+
+// IsEmailVerified handles providers which send email_verified as a string.
+func (c *Claims) IsEmailVerified() bool {
+	return c.EmailVerified == true || c.EmailVerified == "true"
+}
+
+func (c *Claims) hasAudience(aud string) bool {
+	switch v := c.Audience.(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if a == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type Provider struct {
+	c           *Config
+	redirectURL string
+	client      *http.Client
+	mtx         *sync.Mutex
+	disc        *discovery
+	discOn      time.Time
+	keys        map[string]interface{}
+	keysOn      time.Time
+}
+
+// New returns a provider, discovery is lazy so this never makes requests.
+func New(c *Config, redirectURL string) *Provider {
+	PanicIf(c.Name == "" || c.Issuer == "" || c.ClientID == "", "oidc provider name, issuer and clientID are required")
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &Provider{
+		c:           c,
+		redirectURL: redirectURL,
+		client:      &http.Client{Timeout: clientTimeout},
+		mtx:         &sync.Mutex{},
+	}
+}
+
+func (p *Provider) Name() string {
+	return p.c.Name
+}
+
+// Verifier returns a new random PKCE code verifier, it can also be used for
+// state and nonce values.
+func Verifier() string {
+	return crypt.UrlSafeString(verifierLen)
+}
+
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL returns the url to send the user to, the provider redirects back
+// to the redirect url with state and a code for Exchange.
+func (p *Provider) AuthURL(state, nonce, verifier string) (string, error) {
+	d, err := p.discovery()
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.c.ClientID)
+	q.Set("redirect_uri", p.redirectURL)
+	q.Set("scope", strings.Join(p.c.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", challenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange swaps code for tokens and returns the verified id token claims.
+func (p *Provider) Exchange(code, verifier, nonce string) (*Claims, error) {
+	d, err := p.discovery()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, ToError(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.c.ClientID), url.QueryEscape(p.c.ClientSecret))
+	res := &struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}{}
+	if err := p.do(req, res); err != nil {
+		return nil, err
+	}
+	if res.IDToken == "" {
+		return nil, Err("oidc token response has no id_token")
+	}
+	claims := &Claims{}
+	if err := p.verify(res.IDToken, claims); err != nil {
+		return nil, err
+	}
+	now := Now()
+	switch {
+	case claims.Issuer != d.Issuer:
+		return nil, Err("oidc id token issuer %q is not %q", claims.Issuer, d.Issuer)
+	case !claims.hasAudience(p.c.ClientID):
+		return nil, Err("oidc id token audience does not include client")
+	case now.After(time.Unix(claims.Expiry, 0).Add(leeway)):
+		return nil, Err("oidc id token has expired")
+	case claims.Nonce != nonce:
+		return nil, Err("oidc id token nonce does not match")
+	case claims.Subject == "":
+		return nil, Err("oidc id token has no subject")
+	}
+	return claims, nil
+}
+
+func (p *Provider) do(req *http.Request, dst interface{}) error {
+	res, err := p.client.Do(req)
+	if err != nil {
+		return ToError(err)
+	}
+	defer res.Body.Close()
+	bs, err := ioutil.ReadAll(io.LimitReader(res.Body, maxRespBytes))
+	if err != nil {
+		return ToError(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return Err("oidc request to %s failed with %d: %s", req.URL.Path, res.StatusCode, bs)
+	}
+	return ToError(json.Unmarshal(bs, dst))
+}
+
+func (p *Provider) get(u string, dst interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return ToError(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	return p.do(req, dst)
+}
+
+func (p *Provider) discovery() (*discovery, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.disc != nil && Now().Sub(p.discOn) < discoveryMaxAge {
+		return p.disc, nil
+	}
+	d := &discovery{}
+	if err := p.get(strings.TrimSuffix(p.c.Issuer, "/")+discoveryPath, d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.c.Issuer {
+		return nil, Err("oidc discovery issuer %q is not %q", d.Issuer, p.c.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+		return nil, Err("oidc discovery for %s is missing endpoints", p.c.Issuer)
+	}
+	p.disc = d
+	p.discOn = Now()
+	return d, nil
+}
+
+// key returns the signing key with id kid, refreshing the key set if kid is
+// unknown, as providers rotate keys.
+func (p *Provider) key(kid string) (interface{}, error) {
+	d, err := p.discovery()
+	if err != nil {
+		return nil, err
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if key, exists := p.keys[kid]; exists {
+		return key, nil
+	}
+	if p.keys != nil && Now().Sub(p.keysOn) < keysMinAge {
+		return nil, Err("oidc signing key %q not found", kid)
+	}
+	set := &jwks{}
+	if err := p.get(d.JwksURI, set); err != nil {
+		return nil, err
+	}
+	p.keys = set.parse()
+	p.keysOn = Now()
+	if key, exists := p.keys[kid]; exists {
+		return key, nil
+	}
+	return nil, Err("oidc signing key %q not found", kid)
+}
@@ -0,0 +1,54 @@
+package oidc
+
+import (
+	"testing"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlow(t *testing.T) {
+	a := assert.New(t)
+	f := NewFakeProvider()
+	defer f.Close()
+	p := New(f.Config("fake"), "http://localhost/oidcCallback")
+	f.SetUser(&FakeUser{
+		Subject:       "123",
+		Email:         "joe@bloggs.example",
+		EmailVerified: true,
+	})
+
+	state, nonce, verifier := Verifier(), Verifier(), Verifier()
+	authURL, err := p.AuthURL(state, nonce, verifier)
+	a.Nil(err)
+	gotState, code, err := f.Authorize(authURL)
+	a.Nil(err)
+	a.Equal(state, gotState)
+	claims, err := p.Exchange(code, verifier, nonce)
+	a.Nil(err)
+	a.Equal("123", claims.Subject)
+	a.Equal("joe@bloggs.example", claims.Email)
+	a.True(claims.IsEmailVerified())
+
+	// codes are single use
+	_, err = p.Exchange(code, verifier, nonce)
+	a.NotNil(err)
+
+	// the verifier must match the challenge
+	_, code, err = f.Authorize(authURL)
+	a.Nil(err)
+	_, err = p.Exchange(code, Verifier(), nonce)
+	a.NotNil(err)
+
+	// the nonce must match
+	_, code, err = f.Authorize(authURL)
+	a.Nil(err)
+	_, err = p.Exchange(code, verifier, Verifier())
+	a.Equal("oidc id token nonce does not match", ToError(err).Message())
+
+	// tokens signed by another key are rejected
+	other := NewFakeProvider()
+	defer other.Close()
+	token := other.sign(&Claims{Issuer: f.Issuer()})
+	a.Equal("oidc id token has an invalid signature", ToError(p.verify(token, &Claims{})).Message())
+}
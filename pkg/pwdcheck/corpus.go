@@ -0,0 +1,66 @@
+package pwdcheck
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+)
+
+const prefixLen = 5
+
+// Corpus is a breached pwd corpus on disk in the k-anonymity range format,
+// a file per 5 hex char sha1 prefix, e.g. ABCDE or ABCDE.txt, where each
+// line is the remaining 35 hex chars of a breached pwd's sha1, optionally
+// followed by :count. Only the one prefix file is read per check so the
+// corpus can be far bigger than memory.
+type Corpus struct {
+	dir string
+}
+
+func NewCorpus(dir string) *Corpus {
+	info, err := os.Stat(dir)
+	PanicOn(err)
+	PanicIf(!info.IsDir(), "pwd corpus %s is not a directory", dir)
+	return &Corpus{dir: dir}
+}
+
+// Contains returns true if pwd is in the corpus, a missing prefix file
+// means no breached pwds have that prefix.
+func (c *Corpus) Contains(pwd string) (bool, error) {
+	prefix, suffix := HashPrefix(pwd)
+	f, err := os.Open(filepath.Join(c.dir, prefix))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(c.dir, prefix+".txt"))
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, ToError(err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if i := strings.IndexByte(line, ':'); i != -1 {
+			line = line[:i]
+		}
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, ToError(s.Err())
+}
+
+// HashPrefix returns the upper case hex sha1 of pwd split into the prefix
+// file name and the suffix to look for in it.
+func HashPrefix(pwd string) (string, string) {
+	sum := sha1.Sum([]byte(pwd))
+	h := strings.ToUpper(hex.EncodeToString(sum[:]))
+	return h[:prefixLen], h[prefixLen:]
+}
@@ -0,0 +1,211 @@
+// Package pwdcheck rejects weak pwds using an offline entropy estimate and an
+// optional local corpus of breached pwds.
+package pwdcheck
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+const (
+	MinScore = 0
+	MaxScore = 4
+
+	CodeWeak         = "pwdWeak"
+	CodeRepeats      = "pwdRepeats"
+	CodeSequences    = "pwdSequences"
+	CodePersonalInfo = "pwdPersonalInfo"
+	CodeBreached     = "pwdBreached"
+)
+
+// entropy in bits needed for each score above 0
+var scoreBits = [MaxScore]float64{30, 45, 60, 75}
+
+// rows of adjacent keys, walking along these is as predictable as abc
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+type Issue struct {
+	Code string
+	Msg  string
+}
+
+type Checker struct {
+	// MinScore is the lowest acceptable Score, 0 to 4
+	MinScore int
+	// Breached is optional
+	Breached *Corpus
+}
+
+// Check returns why pwd is not acceptable, if it is the result is empty.
+// userInputs are things like the users email and handle which make poor pwds.
+// Breach check errors are returned but do not stop the strength check.
+func (c *Checker) Check(pwd string, userInputs ...string) ([]*Issue, error) {
+	issues := []*Issue{}
+	bits, patterns := Entropy(pwd, userInputs...)
+	if Score(bits) < c.MinScore {
+		issues = append(issues, &Issue{
+			Code: CodeWeak,
+			Msg:  "pwd is too easy to guess, try a longer pwd with a mix of character types",
+		})
+		for _, p := range patterns {
+			issues = append(issues, &Issue{
+				Code: p,
+				Msg:  patternMsgs[p],
+			})
+		}
+	}
+	var err error
+	if c.Breached != nil {
+		var breached bool
+		breached, err = c.Breached.Contains(pwd)
+		if breached {
+			issues = append(issues, &Issue{
+				Code: CodeBreached,
+				Msg:  "pwd has appeared in a data breach, please choose another",
+			})
+		}
+	}
+	return issues, err
+}
+
+var patternMsgs = map[string]string{
+	CodeRepeats:      "avoid repeated characters like aaa",
+	CodeSequences:    "avoid sequences like abc, 321 or qwerty",
+	CodePersonalInfo: "avoid using your email or handle",
+}
+
+// Score maps an Entropy estimate to 0 (very weak) to 4 (strong).
+func Score(bits float64) int {
+	score := MinScore
+	for _, min := range scoreBits {
+		if bits < min {
+			break
+		}
+		score++
+	}
+	return score
+}
+
+// Entropy estimates the bits of entropy in pwd, assuming an attacker knows
+// userInputs and tries repeats and sequences first. The patterns found are
+// returned as issue codes.
+func Entropy(pwd string, userInputs ...string) (float64, []string) {
+	patterns := []string{}
+	rs := []rune(pwd)
+	lower := []rune(strings.ToLower(pwd))
+	isPersonal := make([]bool, len(rs))
+	for _, input := range userInputs {
+		for _, part := range strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+			return r == '@' || r == '.' || r == '_' || r == '-' || unicode.IsSpace(r)
+		}) {
+			p := []rune(part)
+			if len(p) < 3 {
+				continue
+			}
+			for i := 0; i+len(p) <= len(lower); i++ {
+				if string(lower[i:i+len(p)]) == part {
+					patterns = appendOnce(patterns, CodePersonalInfo)
+					for j := i; j < i+len(p); j++ {
+						isPersonal[j] = true
+					}
+				}
+			}
+		}
+	}
+	var hasLower, hasUpper, hasDigit, hasSymbol, hasOther bool
+	for i, r := range rs {
+		switch {
+		case isPersonal[i]:
+		case r >= 'a' && r <= 'z':
+			hasLower = true
+		case r >= 'A' && r <= 'Z':
+			hasUpper = true
+		case r >= '0' && r <= '9':
+			hasDigit = true
+		case r <= unicode.MaxASCII:
+			hasSymbol = true
+		default:
+			hasOther = true
+		}
+	}
+	charset := 0
+	for _, c := range []struct {
+		has  bool
+		size int
+	}{{hasLower, 26}, {hasUpper, 26}, {hasDigit, 10}, {hasSymbol, 33}, {hasOther, 100}} {
+		if c.has {
+			charset += c.size
+		}
+	}
+	perChar := 0.0
+	if charset > 0 {
+		perChar = math.Log2(float64(charset))
+	}
+	bits := 0.0
+	prev, delta := rune(-1), rune(0)
+	for i, r := range rs {
+		if isPersonal[i] {
+			// personal info is a single guess of which input it is
+			if i == 0 || !isPersonal[i-1] {
+				bits += math.Log2(float64(len(userInputs) + 1))
+			}
+			prev, delta = -1, 0
+			continue
+		}
+		step := r - prev
+		switch {
+		case r == prev:
+			bits++
+			patterns = appendOnce(patterns, CodeRepeats)
+			delta = 0
+		case prev != -1 && (step == 1 || step == -1):
+			// the first step could be anything, following steps in the same
+			// direction are predictable
+			if step == delta {
+				bits++
+				patterns = appendOnce(patterns, CodeSequences)
+			} else {
+				bits += perChar
+			}
+			delta = step
+		case prev != -1 && areAdjacentKeys(lower[i-1], lower[i]):
+			bits += 2
+			patterns = appendOnce(patterns, CodeSequences)
+			delta = 0
+		default:
+			bits += perChar
+			delta = 0
+		}
+		prev = r
+	}
+	return bits, patterns
+}
+
+func areAdjacentKeys(a, b rune) bool {
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		if i == -1 {
+			continue
+		}
+		j := strings.IndexRune(row, b)
+		if j != -1 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendOnce(ss []string, s string) []string {
+	for _, existing := range ss {
+		if existing == s {
+			return ss
+		}
+	}
+	return append(ss, s)
+}
@@ -0,0 +1,65 @@
+package pwdcheck
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScore(t *testing.T) {
+	a := assert.New(t)
+	score := func(pwd string, userInputs ...string) int {
+		bits, _ := Entropy(pwd, userInputs...)
+		return Score(bits)
+	}
+	// dictionary words are left to the breach corpus
+	a.Equal(1, score("password"))
+	a.Equal(0, score("aaaaaaaaaaaaaaaa"))
+	a.Equal(0, score("abcdefghijklmnop"))
+	a.Equal(0, score("qwertyuiop"))
+	a.Equal(2, score("1aA$_t;3"))
+	a.Equal(4, score("J03-8l0-Gg5-Pwd"))
+	// the same pwd is weak if it's mostly personal info
+	a.Equal(3, score("Joebloggs1!"))
+	a.Equal(0, score("Joebloggs1!", "joe.bloggs@example.com"))
+
+	_, patterns := Entropy("aaa123qwe", "xyz")
+	a.Equal([]string{CodeRepeats, CodeSequences}, patterns)
+	_, patterns = Entropy("Bloggs99", "joe.bloggs@example.com")
+	a.Equal([]string{CodePersonalInfo, CodeRepeats}, patterns)
+}
+
+func TestChecker(t *testing.T) {
+	a := assert.New(t)
+	dir, err := ioutil.TempDir("", "pwdcheck")
+	a.Nil(err)
+	defer os.RemoveAll(dir)
+	prefix, suffix := HashPrefix("J03-8l0-Gg5-Pwd")
+	a.Equal(5, len(prefix))
+	a.Nil(ioutil.WriteFile(filepath.Join(dir, prefix+".txt"), []byte("0000000000000000000000000000000000A:3\r\n"+suffix+":12\r\n"), 0600))
+
+	c := &Checker{MinScore: 2}
+	issues, err := c.Check("J03-8l0-Gg5-Pwd")
+	a.Nil(err)
+	a.Empty(issues)
+	issues, err = c.Check("abcdefgh")
+	a.Nil(err)
+	a.Equal([]*Issue{
+		{Code: CodeWeak, Msg: "pwd is too easy to guess, try a longer pwd with a mix of character types"},
+		{Code: CodeSequences, Msg: "avoid sequences like abc, 321 or qwerty"},
+	}, issues)
+
+	c.Breached = NewCorpus(dir)
+	issues, err = c.Check("J03-8l0-Gg5-Pwd")
+	a.Nil(err)
+	a.Equal([]*Issue{
+		{Code: CodeBreached, Msg: "pwd has appeared in a data breach, please choose another"},
+	}, issues)
+	// missing prefix files mean no breach
+	issues, err = c.Check("N3w-J03-8l0-Gg5-Pwd")
+	a.Nil(err)
+	a.Empty(issues)
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -31,14 +32,64 @@ type Client interface {
 	MustPut(bucket, key string, name, mimeType string, size int64, isPublic, isAttachment bool, content io.ReadSeeker)
 	PresignedPutUrl(bucket, key string, name, mimeType string, size int64) (string, error)
 	MustPresignedPutUrl(bucket, key string, name, mimeType string, size int64) string
+	PresignedPutReq(bucket, key string, name, mimeType string, size int64, isPublic, isAttachment bool, expire time.Duration) (string, http.Header, error)
+	MustPresignedPutReq(bucket, key string, name, mimeType string, size int64, isPublic, isAttachment bool, expire time.Duration) (string, http.Header)
 	Get(bucket, key string) (string, string, int64, io.ReadCloser, error)
 	MustGet(bucket, key string) (string, string, int64, io.ReadCloser)
+	GetRange(bucket, key string, r *Range, ifRange string) (*Object, error)
+	MustGetRange(bucket, key string, r *Range, ifRange string) *Object
 	PresignedGetUrl(bucket, key string, name string, isAttachment bool) (string, error)
 	MustPresignedGetUrl(bucket, key string, name string, isAttachment bool) string
+	Head(bucket, key string) (string, string, int64, error)
+	MustHead(bucket, key string) (string, string, int64)
 	Delete(bucket, key string) error
 	MustDelete(bucket, key string)
 	DeletePrefix(bucket, prefix string) error
 	MustDeletePrefix(bucket, prefix string)
+	CreateMultipartUpload(bucket, key, name, mimeType string, isPublic, isAttachment bool) (string, error)
+	MustCreateMultipartUpload(bucket, key, name, mimeType string, isPublic, isAttachment bool) string
+	UploadPart(bucket, key, uploadID string, num, size int64, timeout time.Duration, content io.Reader) (string, error)
+	MustUploadPart(bucket, key, uploadID string, num, size int64, timeout time.Duration, content io.Reader) string
+	CompleteMultipartUpload(bucket, key, uploadID string, parts []*Part) error
+	MustCompleteMultipartUpload(bucket, key, uploadID string, parts []*Part)
+	AbortMultipartUpload(bucket, key, uploadID string) error
+	MustAbortMultipartUpload(bucket, key, uploadID string)
+}
+
+// Range is an inclusive byte range, Start < 0 requests the last -Start
+// bytes and End < 0 requests everything from Start to the end.
+type Range struct {
+	Start int64
+	End   int64
+}
+
+func (r *Range) header() string {
+	if r.Start < 0 {
+		return Strf("bytes=%d", r.Start)
+	}
+	if r.End < 0 {
+		return Strf("bytes=%d-", r.Start)
+	}
+	return Strf("bytes=%d-%d", r.Start, r.End)
+}
+
+// Object is a fetched object or part of one
+type Object struct {
+	Name string
+	Type string
+	ETag string
+	// Size is the size of the whole object
+	Size int64
+	// Range is the part of the object in Content,
+	// nil if Content is the whole object
+	Range   *Range
+	Content io.ReadCloser
+}
+
+// Part is an uploaded part of a multipart upload, Num starts at 1
+type Part struct {
+	Num  int64
+	ETag string
 }
 
 func New(s3 *s3.S3) Client {
@@ -161,6 +212,21 @@ func (c *client) MustPresignedPutUrl(bucket, key string, name, mimeType string,
 	return str
 }
 
+// PresignedPutReq returns a presigned put url and the headers the uploader
+// must send with it, the headers are part of the signature so the object is
+// created with the given name, type, size and acl.
+func (c *client) PresignedPutReq(bucket, key string, name, mimeType string, size int64, isPublic, isAttachment bool, expire time.Duration) (string, http.Header, error) {
+	req, _ := c.putReq(bucket, key, name, mimeType, size, isPublic, isAttachment, nil)
+	url, header, err := req.PresignRequest(expire)
+	return url, header, ToError(err)
+}
+
+func (c *client) MustPresignedPutReq(bucket, key string, name, mimeType string, size int64, isPublic, isAttachment bool, expire time.Duration) (string, http.Header) {
+	url, header, err := c.PresignedPutReq(bucket, key, name, mimeType, size, isPublic, isAttachment, expire)
+	PanicOn(err)
+	return url, header
+}
+
 func (c *client) getReq(bucket, key string, name string, isAttachment bool) (*request.Request, *s3.GetObjectOutput) {
 	return c.s3.GetObjectRequest(&s3.GetObjectInput{
 		Bucket:                     ptr.String(bucket),
@@ -181,6 +247,65 @@ func (c *client) MustGet(bucket, key string) (string, string, int64, io.ReadClos
 	return name, mimeType, size, content
 }
 
+// GetRange fetches r of the object, if ifRange is set, either an etag or an
+// http date, and the object has changed since then the whole object is
+// returned instead, as is the case if r is nil.
+func (c *client) GetRange(bucket, key string, r *Range, ifRange string) (*Object, error) {
+	in := &s3.GetObjectInput{
+		Bucket: ptr.String(bucket),
+		Key:    ptr.String(key),
+	}
+	var ifRangeTime *time.Time
+	if r != nil {
+		in.Range = ptr.String(r.header())
+		if ifRange != "" {
+			if t, err := http.ParseTime(ifRange); err == nil {
+				// s3 has no exact date match condition so it's checked
+				// against the response below
+				ifRangeTime = &t
+			} else {
+				in.IfMatch = ptr.String(ifRange)
+			}
+		}
+	}
+	res, err := c.s3.GetObject(in)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "PreconditionFailed" {
+		return c.GetRange(bucket, key, nil, "")
+	}
+	if err != nil {
+		return nil, ToError(err)
+	}
+	if ifRangeTime != nil && (res.LastModified == nil || !res.LastModified.Equal(*ifRangeTime)) {
+		// If-Range only matches the exact Last-Modified date, otherwise
+		// the full object is returned
+		res.Body.Close()
+		return c.GetRange(bucket, key, nil, "")
+	}
+	obj := &Object{
+		Name:    getName(res.ContentDisposition),
+		Type:    ptr.StringOr(res.ContentType, defaultMimeType),
+		ETag:    ptr.StringOr(res.ETag, ""),
+		Size:    ptr.Int64Or(res.ContentLength, 0),
+		Content: res.Body,
+	}
+	// Content-Range: bytes 0-99/1234
+	var start, end, size int64
+	if _, err := fmt.Sscanf(ptr.StringOr(res.ContentRange, ""), "bytes %d-%d/%d", &start, &end, &size); err == nil {
+		obj.Size = size
+		obj.Range = &Range{
+			Start: start,
+			End:   end,
+		}
+	}
+	return obj, nil
+}
+
+func (c *client) MustGetRange(bucket, key string, r *Range, ifRange string) *Object {
+	obj, err := c.GetRange(bucket, key, r, ifRange)
+	PanicOn(err)
+	return obj
+}
+
 func (c *client) PresignedGetUrl(bucket, key string, name string, isAttachment bool) (string, error) {
 	req, _ := c.getReq(bucket, key, name, isAttachment)
 	url, err := req.Presign(10 * time.Minute)
@@ -193,6 +318,25 @@ func (c *client) MustPresignedGetUrl(bucket, key string, name string, isAttachme
 	return str
 }
 
+// Head returns the name, mime type and size of an object without fetching
+// its content.
+func (c *client) Head(bucket, key string) (string, string, int64, error) {
+	res, err := c.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: ptr.String(bucket),
+		Key:    ptr.String(key),
+	})
+	if err != nil {
+		return "", "", 0, ToError(err)
+	}
+	return getName(res.ContentDisposition), ptr.StringOr(res.ContentType, defaultMimeType), ptr.Int64Or(res.ContentLength, 0), nil
+}
+
+func (c *client) MustHead(bucket, key string) (string, string, int64) {
+	name, mimeType, size, err := c.Head(bucket, key)
+	PanicOn(err)
+	return name, mimeType, size
+}
+
 func (c *client) Delete(bucket, key string) error {
 	_, err := c.s3.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: ptr.String(bucket),
@@ -241,6 +385,102 @@ func (c *client) MustDeletePrefix(bucket, prefix string) {
 	PanicOn(c.DeletePrefix(bucket, prefix))
 }
 
+func (c *client) CreateMultipartUpload(bucket, key, name, mimeType string, isPublic, isAttachment bool) (string, error) {
+	res, err := c.s3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:             ptr.String(bucket),
+		Key:                ptr.String(key),
+		ACL:                acl(isPublic),
+		ContentDisposition: contentDisposition(name, isAttachment),
+		ContentType:        contentType(mimeType),
+	})
+	if err != nil {
+		return "", ToError(err)
+	}
+	return ptr.StringOr(res.UploadId, ""), nil
+}
+
+func (c *client) MustCreateMultipartUpload(bucket, key, name, mimeType string, isPublic, isAttachment bool) string {
+	uploadID, err := c.CreateMultipartUpload(bucket, key, name, mimeType, isPublic, isAttachment)
+	PanicOn(err)
+	return uploadID
+}
+
+// UploadPart streams content to the store via a presigned url so parts
+// don't have to be buffered in memory to be hashed for signing.
+func (c *client) UploadPart(bucket, key, uploadID string, num, size int64, timeout time.Duration, content io.Reader) (string, error) {
+	presign, _ := c.s3.UploadPartRequest(&s3.UploadPartInput{
+		Bucket:        ptr.String(bucket),
+		Key:           ptr.String(key),
+		UploadId:      ptr.String(uploadID),
+		PartNumber:    ptr.Int64(num),
+		ContentLength: ptr.Int64(size),
+	})
+	partUrl, err := presign.Presign(10 * time.Minute)
+	if err != nil {
+		return "", ToError(err)
+	}
+	req, err := http.NewRequest(http.MethodPut, partUrl, content)
+	if err != nil {
+		return "", ToError(err)
+	}
+	req.ContentLength = size
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return "", ToError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", Err("resp.StatusCode: %d, resp.Body: %s", resp.StatusCode, string(body))
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (c *client) MustUploadPart(bucket, key, uploadID string, num, size int64, timeout time.Duration, content io.Reader) string {
+	etag, err := c.UploadPart(bucket, key, uploadID, num, size, timeout, content)
+	PanicOn(err)
+	return etag
+}
+
+func (c *client) CompleteMultipartUpload(bucket, key, uploadID string, parts []*Part) error {
+	completed := make([]*s3.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		completed = append(completed, &s3.CompletedPart{
+			PartNumber: ptr.Int64(p.Num),
+			ETag:       ptr.String(p.ETag),
+		})
+	}
+	_, err := c.s3.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   ptr.String(bucket),
+		Key:      ptr.String(key),
+		UploadId: ptr.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: completed,
+		},
+	})
+	return ToError(err)
+}
+
+func (c *client) MustCompleteMultipartUpload(bucket, key, uploadID string, parts []*Part) {
+	PanicOn(c.CompleteMultipartUpload(bucket, key, uploadID, parts))
+}
+
+func (c *client) AbortMultipartUpload(bucket, key, uploadID string) error {
+	_, err := c.s3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   ptr.String(bucket),
+		Key:      ptr.String(key),
+		UploadId: ptr.String(uploadID),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+		err = nil
+	}
+	return ToError(err)
+}
+
+func (c *client) MustAbortMultipartUpload(bucket, key, uploadID string) {
+	PanicOn(c.AbortMultipartUpload(bucket, key, uploadID))
+}
+
 func Key(prefix string, root ID, ids ...ID) string {
 	var key *bytes.Buffer
 	if prefix != "" {
@@ -254,6 +494,31 @@ func Key(prefix string, root ID, ids ...ID) string {
 	return key.String()
 }
 
+// IsInvalidRange returns true if err was returned because
+// the requested range is not satisfiable
+func IsInvalidRange(err error) bool {
+	if e, ok := err.(Error); ok {
+		if v, ok := e.Value().(error); ok {
+			err = v
+		}
+	}
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "InvalidRange"
+}
+
+// IsNotFound returns true if err was returned because the object does not exist
+func IsNotFound(err error) bool {
+	if e, ok := err.(Error); ok {
+		if v, ok := e.Value().(error); ok {
+			err = v
+		}
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+	}
+	return false
+}
+
 func contentDisposition(name string, isAttachment bool) *string {
 	contentDisposition := "inline"
 	if isAttachment {
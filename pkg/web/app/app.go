@@ -3,18 +3,25 @@ package app
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/crypt"
 	"github.com/0xor1/tlbx/pkg/json"
 	"github.com/0xor1/tlbx/pkg/log"
 	"github.com/0xor1/tlbx/pkg/ptr"
@@ -28,6 +35,12 @@ const (
 
 	ApiPathPrefix        = "/api"
 	ApiPathPrefixSegment = ApiPathPrefix + "/"
+
+	// CSRFCookieName and CSRFHeaderName match the axios defaults so web
+	// clients send the double submit token without any extra code
+	CSRFCookieName = "XSRF-TOKEN"
+	CSRFHeaderName = "X-XSRF-TOKEN"
+	csrfTokenLen   = 32
 )
 
 type Config struct {
@@ -36,6 +49,18 @@ type Config struct {
 	StaticDir               string
 	ProvideApiDocs          bool
 	ContentSecurityPolicies []string
+	// StaticFS, if set, is served instead of StaticDir, typically an
+	// embed.FS passed through fs.Sub so the binary carries its client
+	StaticFS fs.FS
+	// SPAFallback, if set, is the static file served for GET requests to non
+	// api paths with no file extension that don't match a static file, so
+	// client side routes can be deep linked
+	SPAFallback string
+	// HashedAssets matches static file paths which contain a content hash,
+	// they are cached for a year while html is always revalidated
+	HashedAssets *regexp.Regexp
+	// csrf
+	CSRFSecure bool
 	// id
 	IDGenPoolSize int
 	// mdo
@@ -69,10 +94,15 @@ type TlbxMwares []func(Tlbx)
 func Run(configs ...func(*Config)) {
 	c := config(configs...)
 	mDoEp.MaxBodyBytes = c.MDoMaxBodyBytes
+	mDoSeqEp.MaxBodyBytes = c.MDoMaxBodyBytes
 	// static file server
 	staticFileDir, err := filepath.Abs(c.StaticDir)
 	PanicOn(err)
-	fileServer := http.FileServer(http.Dir(staticFileDir))
+	var staticFS http.FileSystem = http.Dir(staticFileDir)
+	if c.StaticFS != nil {
+		staticFS = http.FS(c.StaticFS)
+	}
+	fileServer := http.FileServer(staticFS)
 	// content-security-policy
 	csps := strings.Join(append([]string{"default-src 'self'"}, c.ContentSecurityPolicies...), ";")
 	// id pool
@@ -139,7 +169,11 @@ func Run(configs ...func(*Config)) {
 			docs.Endpoints = append(docs.Endpoints, epDocs)
 		}
 	}
-	if c.ProvideApiDocs {
+	// docs are held in memory if StaticFS is set as it's read only
+	var docsBytes []byte
+	if c.ProvideApiDocs && c.StaticFS != nil {
+		docsBytes = json.MustMarshal(docs)
+	} else if c.ProvideApiDocs {
 		// write docs to StaticDir/api/docs.json
 		apiDocsDir := filepath.Join(c.StaticDir, `api`)
 		PanicOn(os.MkdirAll(apiDocsDir, os.ModePerm))
@@ -184,7 +218,9 @@ func Run(configs ...func(*Config)) {
 		// recover from errors / redirects
 		defer func() {
 			if e := ToError(recover()); e != nil {
-				if err, ok := e.Value().(*ErrMsg); ok {
+				if err, ok := e.Value().(*ErrMsg); ok && len(err.Fields) > 0 {
+					writeJson(tlbx.resp, err.Status, err)
+				} else if ok {
 					writeJson(tlbx.resp, err.Status, err.Msg)
 				} else if redirect, ok := e.Value().(*redirect); ok {
 					http.Redirect(tlbx.resp, tlbx.req, redirect.url, redirect.status)
@@ -200,6 +236,20 @@ func Run(configs ...func(*Config)) {
 		method := tlbx.req.Method
 		BadReqIf(!(method == http.MethodPut || method == http.MethodGet || method == http.MethodPost), "only GET, PUT and POST methods are accepted")
 		lPath := StrLower(tlbx.req.URL.Path)
+		// issue a csrf token to any client without one
+		if !tlbx.isSubMDo && csrfToken(tlbx.req) == "" {
+			http.SetCookie(tlbx.resp, &http.Cookie{
+				Name:     CSRFCookieName,
+				Value:    crypt.UrlSafeString(csrfTokenLen),
+				Path:     "/",
+				Secure:   c.CSRFSecure,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		// let mwares see the endpoint config, e.g. rate limits
+		if ep, exists := router[lPath]; exists {
+			tlbx.Set(endpointKey{}, ep)
+		}
 		// tlbx mwares
 		for _, setup := range c.TlbxSetup {
 			setup(tlbx)
@@ -211,15 +261,38 @@ func Run(configs ...func(*Config)) {
 		}()
 		// serve static file
 		if (method == http.MethodGet && !strings.HasPrefix(lPath, ApiPathPrefixSegment)) || lPath == lDocsPath {
-			if lPath == lDocsPath {
-				tlbx.req.Method = http.MethodGet
-				tlbx.req.URL.Path += `.json`
-			}
 			// set common headers
 			tlbx.resp.Header().Set("Cache-Control", "public, max-age=3600, immutable")
 			tlbx.resp.Header().Set("X-Frame-Options", "DENY")
 			tlbx.resp.Header().Set("X-XSS-Protection", "1; mode=block")
 			tlbx.resp.Header().Set("Content-Security-Policy", csps)
+			if lPath == lDocsPath {
+				if docsBytes != nil {
+					writeJsonRaw(tlbx.resp, http.StatusOK, docsBytes)
+					return
+				}
+				tlbx.req.Method = http.MethodGet
+				tlbx.req.URL.Path += `.json`
+				fileServer.ServeHTTP(tlbx.resp, tlbx.req)
+				return
+			}
+			upath := path.Clean("/" + tlbx.req.URL.Path)
+			if c.SPAFallback != "" && path.Ext(upath) == "" && !staticExists(staticFS, upath) {
+				tlbx.resp.Header().Set("Cache-Control", "no-cache")
+				f, err := staticFS.Open("/" + c.SPAFallback)
+				ReturnIf(err != nil, http.StatusNotFound, "")
+				defer f.Close()
+				info, err := f.Stat()
+				PanicOn(err)
+				http.ServeContent(tlbx.resp, tlbx.req, info.Name(), info.ModTime(), f)
+				return
+			}
+			if strings.HasSuffix(upath, "/") || upath == "/" || path.Ext(upath) == ".html" {
+				// the html shell references hashed assets so must always be revalidated
+				tlbx.resp.Header().Set("Cache-Control", "no-cache")
+			} else if c.HashedAssets != nil && c.HashedAssets.MatchString(upath) {
+				tlbx.resp.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			}
 			fileServer.ServeHTTP(tlbx.resp, tlbx.req)
 			return
 		}
@@ -232,6 +305,9 @@ func Run(configs ...func(*Config)) {
 		ReturnIf(!exists, http.StatusNotFound, "")
 		// check all requests have a X-Client header
 		BadReqIf(!ep.SkipXClientCheck && tlbx.req.Header.Get("X-Client") == "", "X-Client header missing")
+		if !ep.SkipCSRFCheck {
+			checkCSRF(tlbx)
+		}
 
 		if ep.MaxBodyBytes > 0 {
 			tlbx.req.Body = http.MaxBytesReader(tlbx.resp, tlbx.req.Body, ep.MaxBodyBytes)
@@ -277,17 +353,31 @@ func Run(configs ...func(*Config)) {
 			// handle request
 			res := ep.Handler(tlbx, args)
 			// process response
-			if s, ok := res.(*DownStream); ok {
+			if s, ok := res.(*DownStream); ok && s.Redirect != "" {
+				BadReqIf(tlbx.isSubMDo, "can not call stream endpoint in an mdo request")
+				http.Redirect(tlbx.resp, tlbx.req, s.Redirect, http.StatusSeeOther)
+			} else if ok {
 				defer s.Content.Close()
 				BadReqIf(tlbx.isSubMDo, "can not call stream endpoint in an mdo request")
+				status := http.StatusOK
+				size := s.Size
+				if s.Range != nil {
+					status = http.StatusPartialContent
+					size = s.Range.End - s.Range.Start + 1
+					tlbx.resp.Header().Add("Content-Range", Strf("bytes %d-%d/%d", s.Range.Start, s.Range.End, s.Size))
+				}
 				tlbx.resp.Header().Add("Content-Type", s.Type)
-				tlbx.resp.Header().Add("Content-Length", Strf("%d", s.Size))
+				tlbx.resp.Header().Add("Content-Length", Strf("%d", size))
 				tlbx.resp.Header().Add("Content-Name", Strf("%s", s.Name))
 				tlbx.resp.Header().Add("Content-Id", Strf("%s", s.ID))
+				if s.ETag != "" {
+					tlbx.resp.Header().Add("Accept-Ranges", "bytes")
+					tlbx.resp.Header().Add("ETag", s.ETag)
+				}
 				if s.IsDownload {
 					tlbx.resp.Header().Add("Content-Disposition", Strf(`attachment; filename="%s"`, s.Name))
 				}
-				tlbx.resp.WriteHeader(http.StatusOK)
+				tlbx.resp.WriteHeader(status)
 				_, err = io.Copy(tlbx.resp, s.Content)
 				PanicOn(err)
 			} else if resBs, ok := res.([]byte); ok {
@@ -324,6 +414,7 @@ func config(configs ...func(*Config)) *Config {
 		Log:             l,
 		Version:         "dev",
 		StaticDir:       ".",
+		HashedAssets:    regexp.MustCompile(`[.-][0-9a-f]{8,}\.[a-z0-9]+$`),
 		ProvideApiDocs:  true,
 		IDGenPoolSize:   50,
 		MDoMax:          20,
@@ -483,6 +574,17 @@ func BadReqIf(condition bool, format string, args ...interface{}) {
 	ReturnIf(condition, http.StatusBadRequest, format, args...)
 }
 
+// BadReqFieldsIf returns a 400 with the field errors if there are any.
+func BadReqFieldsIf(fields []*FieldErr, format string, args ...interface{}) {
+	if len(fields) > 0 {
+		PanicOn(&ErrMsg{
+			Status: http.StatusBadRequest,
+			Msg:    Strf(format, args...),
+			Fields: fields,
+		})
+	}
+}
+
 func (t *tlbx) Get(key interface{}) interface{} {
 	t.storeMtx.RLock()
 	defer t.storeMtx.RUnlock()
@@ -500,9 +602,20 @@ type redirect struct {
 	url    string
 }
 
+// ErrMsg is written as just the json message string unless it has Fields,
+// then it is written as the whole json object.
 type ErrMsg struct {
-	Status int    `json:"status"`
-	Msg    string `json:"message"`
+	Status int         `json:"status"`
+	Msg    string      `json:"message"`
+	Fields []*FieldErr `json:"fields,omitempty"`
+}
+
+// FieldErr is why an arg was rejected, Code is for clients to match on and
+// Msg is human readable.
+type FieldErr struct {
+	Field string `json:"field"`
+	Code  string `json:"code"`
+	Msg   string `json:"message"`
 }
 
 func (e *ErrMsg) Error() string {
@@ -524,10 +637,44 @@ func writeJsonRaw(w http.ResponseWriter, status int, body []byte) {
 	PanicOn(err)
 }
 
+func staticExists(fs http.FileSystem, name string) bool {
+	f, err := fs.Open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
 func isSubMDo(r *http.Request) bool {
 	return r.URL.Query().Get("isSubMDo") == "true"
 }
 
+type csrfExemptKey struct{}
+
+// CSRFExempt marks the request as not needing a csrf token, it is for
+// requests which aren't authenticated by cookie e.g. bearer tokens, so
+// must be called from a TlbxSetup mware to take effect.
+func CSRFExempt(tlbx Tlbx) {
+	tlbx.Set(csrfExemptKey{}, true)
+}
+
+func checkCSRF(tlbx *tlbx) {
+	if exempt, _ := tlbx.Get(csrfExemptKey{}).(bool); exempt {
+		return
+	}
+	token := csrfToken(tlbx.req)
+	ReturnIf(token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(tlbx.req.Header.Get(CSRFHeaderName))) != 1, http.StatusForbidden, "csrf token missing or invalid")
+}
+
+func csrfToken(r *http.Request) string {
+	cookie, err := r.Cookie(CSRFCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
 type MDoReq struct {
 	Header bool       `json:"header,omitempty"`
 	Path   string     `json:"path,omitempty"`
@@ -573,18 +720,51 @@ func (r *mDoResp) MarshalJSON() ([]byte, error) {
 }
 
 type Endpoint struct {
-	Description        string
-	Path               string
-	Timeout            int64
-	SkipXClientCheck   bool
-	MaxBodyBytes       int64
-	IsPrivate          bool
+	Description      string
+	Path             string
+	Timeout          int64
+	SkipXClientCheck bool
+	// SkipCSRFCheck should only be set on endpoints which are safe to be
+	// called cross site, e.g. read only endpoints used in img tags
+	SkipCSRFCheck bool
+	MaxBodyBytes  int64
+	IsPrivate     bool
+	// RateLimit, if set, replaces the rate limit mwares default policy for
+	// this endpoint, it is counted separately from all other endpoints
+	RateLimit *RateLimit
+	// RateLimitWeight is how many requests each call counts as, < 1 is 1
+	RateLimitWeight    int
 	GetDefaultArgs     func() interface{}
 	GetExampleArgs     func() interface{}
 	GetExampleResponse func() interface{}
 	Handler            func(tlbx Tlbx, args interface{}) interface{}
 }
 
+type RateLimitAlgo uint8
+
+const (
+	// SlidingWindow allows Limit requests in any Window
+	SlidingWindow RateLimitAlgo = iota
+	// TokenBucket allows bursts of Limit requests and refills at Limit
+	// requests per Window
+	TokenBucket
+)
+
+type RateLimit struct {
+	Algo   RateLimitAlgo
+	Limit  int
+	Window time.Duration
+}
+
+type endpointKey struct{}
+
+// GetEndpoint returns the endpoint the request is for, or nil if it isn't
+// for an endpoint e.g. static files.
+func GetEndpoint(tlbx Tlbx) *Endpoint {
+	ep, _ := tlbx.Get(endpointKey{}).(*Endpoint)
+	return ep
+}
+
 func ExampleID() ID {
 	id := ID{}
 	id.UnmarshalText([]byte("01DWWXG07ZKYXGWJFP1XMBM45C"))
@@ -675,6 +855,60 @@ type DownStream struct {
 	stream
 	ID         ID
 	IsDownload bool
+	// Redirect, if set, sends the client to this url, typically a
+	// presigned store url, instead of proxying Content
+	Redirect string
+	// ETag, if set, enables Range requests, If-Range is checked against it
+	ETag string
+	// Range is the part of the content being returned, Size is always
+	// the size of the whole content
+	Range *Range
+}
+
+// Range is an inclusive byte range, when requested Start < 0 means the
+// last -Start bytes and End < 0 means from Start to the end.
+type Range struct {
+	Start int64
+	End   int64
+}
+
+// GetRange returns the byte range requested by the Range header and the
+// If-Range value, nil if there is no Range header or it can't be served as
+// a single range, in which case the whole content should be returned.
+func GetRange(tlbx Tlbx) (*Range, string) {
+	header := tlbx.Req().Header.Get("Range")
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return nil, ""
+	}
+	parts := strings.Split(strings.TrimSpace(strings.TrimPrefix(header, "bytes=")), "-")
+	if len(parts) != 2 || (parts[0] == "" && parts[1] == "") {
+		return nil, ""
+	}
+	r := &Range{
+		Start: -1,
+		End:   -1,
+	}
+	var err error
+	if parts[0] == "" {
+		// suffix range, bytes=-500
+		r.Start, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || r.Start < 1 {
+			return nil, ""
+		}
+		r.Start = -r.Start
+		return r, tlbx.Req().Header.Get("If-Range")
+	}
+	r.Start, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || r.Start < 0 {
+		return nil, ""
+	}
+	if parts[1] != "" {
+		r.End, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || r.End < r.Start {
+			return nil, ""
+		}
+	}
+	return r, tlbx.Req().Header.Get("If-Range")
 }
 
 func (s *UpStream) ToReq(method, url string) (*http.Request, error) {
@@ -710,9 +944,26 @@ func (s *DownStream) FromResp(r *http.Response) error {
 	if contentID != "" {
 		id = MustParseID(contentID)
 	}
+	name := r.Header.Get("Content-Name")
+	if name == "" {
+		// redirected to the store so there is no Content-Name
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Disposition"))
+		name = params["filename"]
+	}
+	var rng *Range
+	if r.StatusCode == http.StatusPartialContent {
+		// Content-Range: bytes 0-99/1234
+		rng = &Range{}
+		_, err = fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &rng.Start, &rng.End, &size)
+		if err != nil {
+			return ToError(err)
+		}
+	}
 	s.Type = r.Header.Get("Content-Type")
 	s.Size = size
-	s.Name = r.Header.Get("Content-Name")
+	s.Name = name
+	s.ETag = r.Header.Get("ETag")
+	s.Range = rng
 	s.ID = id
 	s.Content = r.Body
 	return nil
@@ -735,6 +986,13 @@ type Client struct {
 	baseHref string
 	http     httpClient
 	cookies  map[string]string
+	bearer   string
+}
+
+// SetBearer makes the client authenticate with an api token
+// instead of a session cookie.
+func (c *Client) SetBearer(token string) {
+	c.bearer = token
 }
 
 func NewClient(baseHref string, optClient ...httpClient) *Client {
@@ -771,6 +1029,11 @@ func Call(c *Client, path string, args interface{}, res interface{}) error {
 	if err != nil {
 		return ToError(err)
 	}
+	if c.cookies[CSRFCookieName] == "" {
+		// double submit tokens can be generated client side
+		c.cookies[CSRFCookieName] = crypt.UrlSafeString(csrfTokenLen)
+	}
+	req.Header.Set(CSRFHeaderName, c.cookies[CSRFCookieName])
 	for name, value := range c.cookies {
 		req.AddCookie(&http.Cookie{
 			Name:  name,
@@ -778,6 +1041,9 @@ func Call(c *Client, path string, args interface{}, res interface{}) error {
 		})
 	}
 	req.Header.Set("X-Client", "tlbx-go-client")
+	if c.bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearer)
+	}
 
 	httpRes, err := c.http.Do(req)
 	if err != nil {
@@ -808,10 +1074,13 @@ func Call(c *Client, path string, args interface{}, res interface{}) error {
 			v := reflect.ValueOf(res)
 			v.Elem().Set(reflect.Zero(v.Elem().Type()))
 		}
-		msg := &ErrMsg{
-			Status: httpRes.StatusCode,
+		msg := &ErrMsg{}
+		if len(bs) > 0 && bs[0] == '{' {
+			err = json.Unmarshal(bs, msg)
+		} else {
+			err = json.Unmarshal(bs, &msg.Msg)
 		}
-		err = json.Unmarshal(bs, &msg.Msg)
+		msg.Status = httpRes.StatusCode
 		if err != nil {
 			return ToError(err)
 		}
@@ -859,6 +1128,7 @@ var pingEp = &Endpoint{
 	Timeout:          500,
 	MaxBodyBytes:     KB,
 	SkipXClientCheck: true,
+	SkipCSRFCheck:    true,
 	GetDefaultArgs: func() interface{} {
 		return nil
 	},
@@ -897,6 +1167,7 @@ var docsEp = &Endpoint{
 	Timeout:          500,
 	MaxBodyBytes:     KB,
 	SkipXClientCheck: true,
+	SkipCSRFCheck:    true,
 	GetDefaultArgs: func() interface{} {
 		return nil
 	},
@@ -940,6 +1211,7 @@ var mDoEp = &Endpoint{
 	Timeout:          2000,
 	MaxBodyBytes:     MB,
 	SkipXClientCheck: true,
+	SkipCSRFCheck:    true,
 	GetDefaultArgs: func() interface{} {
 		return &MDo{}
 	},
@@ -987,6 +1259,7 @@ var mDoEp = &Endpoint{
 		}
 		mDoReqs := *mDoReqsPtr
 		BadReqIf(tlbx.req.Header.Get("X-Client") == "", "X-Client header missing")
+		checkCSRF(tlbx)
 		BadReqIf(len(mDoReqs) == 0, "empty mdo req")
 		BadReqIf(len(mDoReqs) > tlbx.mDoMax, "too many mdo reqs, max reqs allowed: %d", tlbx.mDoMax)
 		fullMDoResp := map[string]*mDoResp{}
@@ -995,25 +1268,9 @@ var mDoEp = &Endpoint{
 		for key := range mDoReqs {
 			does = append(does, func(key string, mdoReq *MDoReq) func() {
 				return func() {
-					argsBytes, err := json.Marshal(mdoReq.Args)
-					PanicOn(err)
-					subReq, err := http.NewRequest(http.MethodPut, StrLower(mdoReq.Path)+"?isSubMDo=true", bytes.NewReader(argsBytes))
-					PanicOn(err)
-					PanicIf(subReq.URL.Path == ApiPathPrefix+(&MDo{}).Path(), "can't have mdo request inside an mdo request")
-					PanicIf(!strings.HasPrefix(subReq.URL.Path, ApiPathPrefixSegment), "can't have none api request inside an mdo request")
-					for _, c := range tlbx.req.Cookies() {
-						subReq.AddCookie(c)
-					}
-					for name := range tlbx.req.Header {
-						subReq.Header.Add(name, tlbx.req.Header.Get(name))
-					}
-					subResp := &mDoResp{returnHeaders: mdoReq.Header, header: http.Header{}, body: new(bytes.Buffer)}
-					tlbx.root(subResp, subReq)
+					subResp := doMDoSubReq(tlbx, mdoReq, nil)
 					fullMDoRespMtx.Lock()
 					defer fullMDoRespMtx.Unlock()
-					for _, val := range subResp.Header().Values("Set-Cookie") {
-						tlbx.Resp().Header().Add("Set-Cookie", val)
-					}
 					fullMDoResp[key] = subResp
 				}
 			}(key, mDoReqs[key]))
@@ -1023,10 +1280,201 @@ var mDoEp = &Endpoint{
 	},
 }
 
+type MDoSeq struct {
+	Tx   bool      `json:"tx,omitempty"`
+	Reqs []*MDoReq `json:"reqs"`
+}
+
+func (_ *MDoSeq) Path() string {
+	return "/mdoSeq"
+}
+
+func (a *MDoSeq) Do(c *Client) ([]*MDoResp, error) {
+	res := []*MDoResp{}
+	err := Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *MDoSeq) MustDo(c *Client) []*MDoResp {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+var mDoSeqEp = &Endpoint{
+	Description:      "perform multiple requests sequentially in the given order, stopping at the first failure, if tx is true all sql writes are made in one transaction per database which is rolled back if any request fails",
+	Path:             (&MDoSeq{}).Path(),
+	Timeout:          2000,
+	MaxBodyBytes:     MB,
+	SkipXClientCheck: true,
+	SkipCSRFCheck:    true,
+	GetDefaultArgs: func() interface{} {
+		return &MDoSeq{}
+	},
+	GetExampleArgs: func() interface{} {
+		return &MDoSeq{
+			Tx: true,
+			Reqs: []*MDoReq{
+				{
+					Path: "/api/list/create",
+					Args: json.FromInterface(map[string]interface{}{
+						"name": "my list",
+					}),
+				},
+				{
+					Header: true,
+					Path:   "/api/list/get",
+				},
+			},
+		}
+	},
+	GetExampleResponse: func() interface{} {
+		return []*MDoResp{
+			{
+				Status: http.StatusOK,
+				Body:   json.MustFromString(`{"id":"01DWWXG07ZKYXGWJFP1XMBM45C","name":"my list"}`),
+			},
+			{
+				Status: http.StatusOK,
+				Header: http.Header{
+					"Content-Type": []string{"application/json"},
+				},
+				Body: json.MustFromString(`{"set":[{"id":"01DWWXG07ZKYXGWJFP1XMBM45C","name":"my list"}],"more":false}`),
+			},
+		}
+	},
+	Handler: func(t Tlbx, a interface{}) interface{} {
+		tlbx := t.(*tlbx)
+		args := a.(*MDoSeq)
+		BadReqIf(tlbx.req.Header.Get("X-Client") == "", "X-Client header missing")
+		checkCSRF(tlbx)
+		BadReqIf(len(args.Reqs) == 0, "empty mdo req")
+		BadReqIf(len(args.Reqs) > tlbx.mDoMax, "too many mdo reqs, max reqs allowed: %d", tlbx.mDoMax)
+		var mtx *mDoTx
+		if args.Tx {
+			mtx = &mDoTx{
+				ctx:  tlbx.Ctx(),
+				mtx:  &sync.Mutex{},
+				vals: map[interface{}]interface{}{},
+			}
+		}
+		res := make([]*mDoResp, 0, len(args.Reqs))
+		success := true
+		for _, mdoReq := range args.Reqs {
+			subResp := doMDoSubReq(tlbx, mdoReq, mtx)
+			res = append(res, subResp)
+			if subResp.status >= http.StatusBadRequest {
+				success = false
+				break
+			}
+		}
+		if mtx != nil {
+			mtx.end(success)
+		}
+		return res
+	},
+}
+
+// MDoTx is the shared scope of an all or nothing mdoSeq request,
+// service layers use it to make all sub requests share one transaction
+// per resource, calling OnEnd to commit or rollback once all sub requests
+// have completed.
+type MDoTx interface {
+	// Ctx is the context of the parent mdoSeq request which outlives
+	// all of the sub requests.
+	Ctx() context.Context
+	Get(key interface{}) interface{}
+	Set(key, value interface{})
+	OnEnd(func(commit bool))
+}
+
+type mDoTxKey struct{}
+
+// GetMDoTx returns the shared transaction scope if tlbx is a sub request of
+// an mdoSeq request with tx set, otherwise it returns nil.
+func GetMDoTx(tlbx Tlbx) MDoTx {
+	if mtx, ok := tlbx.Ctx().Value(mDoTxKey{}).(*mDoTx); ok {
+		return mtx
+	}
+	return nil
+}
+
+type mDoTx struct {
+	ctx   context.Context
+	mtx   *sync.Mutex
+	vals  map[interface{}]interface{}
+	onEnd []func(bool)
+}
+
+func (m *mDoTx) Ctx() context.Context {
+	return m.ctx
+}
+
+func (m *mDoTx) Get(key interface{}) interface{} {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.vals[key]
+}
+
+func (m *mDoTx) Set(key, value interface{}) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.vals[key] = value
+}
+
+func (m *mDoTx) OnEnd(f func(commit bool)) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.onEnd = append(m.onEnd, f)
+}
+
+func (m *mDoTx) end(commit bool) {
+	m.mtx.Lock()
+	onEnd := m.onEnd
+	m.onEnd = nil
+	m.mtx.Unlock()
+	// call all of them even if some fail so no transactions are left open
+	errs := make(Errors, 0, len(onEnd))
+	for _, f := range onEnd {
+		Do(func() { f(commit) }, func(i interface{}) {
+			errs = append(errs, ToError(i))
+		})
+	}
+	if len(errs) > 0 {
+		PanicOn(errs)
+	}
+}
+
+func doMDoSubReq(tlbx *tlbx, mdoReq *MDoReq, mtx *mDoTx) *mDoResp {
+	argsBytes, err := json.Marshal(mdoReq.Args)
+	PanicOn(err)
+	subReq, err := http.NewRequest(http.MethodPut, StrLower(mdoReq.Path)+"?isSubMDo=true", bytes.NewReader(argsBytes))
+	PanicOn(err)
+	PanicIf(subReq.URL.Path == ApiPathPrefix+StrLower((&MDo{}).Path()) ||
+		subReq.URL.Path == ApiPathPrefix+StrLower((&MDoSeq{}).Path()), "can't have mdo request inside an mdo request")
+	PanicIf(!strings.HasPrefix(subReq.URL.Path, ApiPathPrefixSegment), "can't have none api request inside an mdo request")
+	if mtx != nil {
+		subReq = subReq.WithContext(context.WithValue(mtx.ctx, mDoTxKey{}, mtx))
+	}
+	for _, c := range tlbx.req.Cookies() {
+		subReq.AddCookie(c)
+	}
+	for name := range tlbx.req.Header {
+		subReq.Header.Add(name, tlbx.req.Header.Get(name))
+	}
+	subResp := &mDoResp{returnHeaders: mdoReq.Header, header: http.Header{}, body: new(bytes.Buffer)}
+	tlbx.root(subResp, subReq)
+	for _, val := range subResp.Header().Values("Set-Cookie") {
+		tlbx.Resp().Header().Add("Set-Cookie", val)
+	}
+	return subResp
+}
+
 var defaultEps = []*Endpoint{
 	pingEp,
 	docsEp,
 	mDoEp,
+	mDoSeqEp,
 }
 
 type typeInfo struct {
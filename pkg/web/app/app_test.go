@@ -1,15 +1,19 @@
 package app_test
 
 import (
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	. "github.com/0xor1/tlbx/pkg/core"
 	"github.com/0xor1/tlbx/pkg/json"
 	"github.com/0xor1/tlbx/pkg/web/app"
 	"github.com/0xor1/tlbx/pkg/web/app/config"
+	"github.com/0xor1/tlbx/pkg/web/app/service"
 	"github.com/0xor1/tlbx/pkg/web/app/test"
 	"github.com/0xor1/tlbx/pkg/web/app/user/usertest"
 
@@ -92,6 +96,29 @@ func Test(t *testing.T) {
 					return nil
 				},
 			},
+			{
+				Description:  "insert id into data table",
+				Path:         "/test/insert",
+				Timeout:      500,
+				MaxBodyBytes: app.KB,
+				GetDefaultArgs: func() interface{} {
+					return &ID{}
+				},
+				GetExampleArgs: func() interface{} {
+					return app.ExampleID()
+				},
+				GetExampleResponse: func() interface{} {
+					return nil
+				},
+				Handler: func(tlbx app.Tlbx, args interface{}) interface{} {
+					tx := service.Get(tlbx).Data().BeginWrite()
+					defer tx.Rollback()
+					_, err := tx.Exec(`INSERT INTO data (id) VALUES (?)`, args.(*ID))
+					PanicOn(err)
+					tx.Commit()
+					return nil
+				},
+			},
 			{
 				Description:  "panic",
 				Path:         "/test/panic",
@@ -157,4 +184,227 @@ func Test(t *testing.T) {
 	a.Equal(w.Header().Get("X-Frame-Options"), "DENY")
 	a.Equal(w.Header().Get("X-XSS-Protection"), "1; mode=block")
 	a.Contains(w.Header().Get("Content-Security-Policy"), "default-src 'self'")
+
+	// test mdoSeq stops at first failure
+	mdoSeqRes := (&app.MDoSeq{
+		Reqs: []*app.MDoReq{
+			{
+				Path: "/api/ping",
+			},
+			{
+				Path: "/api/test/echo",
+				Args: json.FromInterface(map[string]interface{}{
+					"msg": "yolo",
+				}),
+			},
+			{
+				Path: "/api/test/panic",
+			},
+			{
+				Path: "/api/ping",
+			},
+		},
+	}).MustDo(c)
+	a.Equal(3, len(mdoSeqRes))
+	a.Equal(http.StatusOK, mdoSeqRes[0].Status)
+	a.Equal("yolo", mdoSeqRes[1].Body.MustString("msg"))
+	a.Equal(http.StatusInternalServerError, mdoSeqRes[2].Status)
+
+	// test mdoSeq tx rolls back on failure
+	id := NewIDGen().MustNew()
+	countID := func() int {
+		count := 0
+		PanicOn(r.Data().Primary().QueryRow(`SELECT COUNT(*) FROM data WHERE id=?`, id).Scan(&count))
+		return count
+	}
+	mdoSeqRes = (&app.MDoSeq{
+		Tx: true,
+		Reqs: []*app.MDoReq{
+			{
+				Path: "/api/test/insert",
+				Args: json.FromInterface(id),
+			},
+			{
+				Path: "/api/test/panic",
+			},
+		},
+	}).MustDo(c)
+	a.Equal(2, len(mdoSeqRes))
+	a.Equal(http.StatusOK, mdoSeqRes[0].Status)
+	a.Equal(http.StatusInternalServerError, mdoSeqRes[1].Status)
+	a.Equal(0, countID())
+
+	// test mdoSeq tx commits on success
+	mdoSeqRes = (&app.MDoSeq{
+		Tx: true,
+		Reqs: []*app.MDoReq{
+			{
+				Path: "/api/test/insert",
+				Args: json.FromInterface(id),
+			},
+			{
+				Path: "/api/ping",
+			},
+		},
+	}).MustDo(c)
+	a.Equal(2, len(mdoSeqRes))
+	a.Equal(1, countID())
+	_, err = r.Data().Primary().Exec(`DELETE FROM data WHERE id=?`, id)
+	PanicOn(err)
+}
+
+func TestStatic(t *testing.T) {
+	a := assert.New(t)
+	var root http.HandlerFunc
+	app.Run(func(c *app.Config) {
+		c.StaticFS = fstest.MapFS{
+			"index.html":           &fstest.MapFile{Data: []byte("<html></html>")},
+			"js/app.3f2a9b1c.js":   &fstest.MapFile{Data: []byte("app()")},
+			"favicon.ico":          &fstest.MapFile{Data: []byte("ico")},
+			"docs/getting-started": &fstest.MapFile{Data: []byte("not the spa")},
+		}
+		c.SPAFallback = "index.html"
+		c.Serve = func(h http.HandlerFunc) {
+			root = h
+		}
+	})
+	get := func(path string) *http.Response {
+		rec := httptest.NewRecorder()
+		root(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Result()
+	}
+	body := func(res *http.Response) string {
+		defer res.Body.Close()
+		bs, err := ioutil.ReadAll(res.Body)
+		PanicOn(err)
+		return string(bs)
+	}
+
+	res := get("/")
+	a.Equal(http.StatusOK, res.StatusCode)
+	a.Equal("no-cache", res.Header.Get("Cache-Control"))
+	a.Equal("<html></html>", body(res))
+
+	res = get("/js/app.3f2a9b1c.js")
+	a.Equal(http.StatusOK, res.StatusCode)
+	a.Equal("public, max-age=31536000, immutable", res.Header.Get("Cache-Control"))
+	a.Equal("app()", body(res))
+
+	res = get("/favicon.ico")
+	a.Equal("public, max-age=3600, immutable", res.Header.Get("Cache-Control"))
+
+	// deep links into the spa get the html shell
+	res = get("/lists/123/items")
+	a.Equal(http.StatusOK, res.StatusCode)
+	a.Equal("no-cache", res.Header.Get("Cache-Control"))
+	a.Equal("<html></html>", body(res))
+
+	// real files are never shadowed by the fallback
+	a.Equal("not the spa", body(get("/docs/getting-started")))
+
+	// missing assets still 404
+	a.Equal(http.StatusNotFound, get("/js/missing.js").StatusCode)
+	a.Equal(http.StatusNotFound, get("/api/missing").StatusCode)
+
+	// docs are served from memory as StaticFS is read only
+	res = get("/api/docs")
+	a.Equal(http.StatusOK, res.StatusCode)
+	a.Contains(body(res), `"name":"Web App"`)
+}
+
+func TestCSRF(t *testing.T) {
+	a := assert.New(t)
+	var root http.HandlerFunc
+	app.Run(func(c *app.Config) {
+		c.ProvideApiDocs = false
+		c.TlbxSetup = app.TlbxMwares{
+			func(tlbx app.Tlbx) {
+				if tlbx.Req().Header.Get("Authorization") != "" {
+					app.CSRFExempt(tlbx)
+				}
+			},
+		}
+		c.Endpoints = []*app.Endpoint{
+			{
+				Description:  "echo back the json obj args",
+				Path:         "/test/echo",
+				Timeout:      500,
+				MaxBodyBytes: app.KB,
+				GetDefaultArgs: func() interface{} {
+					return &map[string]interface{}{}
+				},
+				GetExampleArgs: func() interface{} {
+					return &map[string]interface{}{}
+				},
+				GetExampleResponse: func() interface{} {
+					return &map[string]interface{}{}
+				},
+				Handler: func(tlbx app.Tlbx, args interface{}) interface{} {
+					return args
+				},
+			},
+		}
+		c.Serve = func(h http.HandlerFunc) {
+			root = h
+		}
+	})
+	do := func(path, cookie, header string, mods ...func(*http.Request)) *http.Response {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(`{}`))
+		req.Header.Set("X-Client", "tlbx-app-tests")
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: app.CSRFCookieName, Value: cookie})
+		}
+		if header != "" {
+			req.Header.Set(app.CSRFHeaderName, header)
+		}
+		for _, mod := range mods {
+			mod(req)
+		}
+		rec := httptest.NewRecorder()
+		root(rec, req)
+		return rec.Result()
+	}
+	csrfCookie := func(res *http.Response) *http.Cookie {
+		for _, c := range res.Cookies() {
+			if c.Name == app.CSRFCookieName {
+				return c
+			}
+		}
+		return nil
+	}
+
+	// no token is rejected but issued one
+	res := do("/api/test/echo", "", "")
+	a.Equal(http.StatusForbidden, res.StatusCode)
+	issued := csrfCookie(res)
+	a.NotNil(issued)
+	a.NotEmpty(issued.Value)
+	a.Equal(http.SameSiteStrictMode, issued.SameSite)
+
+	// mismatched tokens are rejected
+	a.Equal(http.StatusForbidden, do("/api/test/echo", issued.Value, "nope").StatusCode)
+
+	// matching tokens are accepted and not reissued
+	res = do("/api/test/echo", issued.Value, issued.Value)
+	a.Equal(http.StatusOK, res.StatusCode)
+	a.Nil(csrfCookie(res))
+
+	// exempt requests don't need a token
+	a.Equal(http.StatusOK, do("/api/test/echo", "", "", func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer yolo")
+	}).StatusCode)
+
+	// skipped endpoints don't need a token
+	a.Equal(http.StatusOK, do("/api/ping", "", "").StatusCode)
+
+	// mdo and its sub requests need a token
+	mdoBody := `{"0":{"path":"/api/test/echo","args":{}}}`
+	res = do("/api/mdo", "", "", func(r *http.Request) {
+		r.Body = ioutil.NopCloser(strings.NewReader(mdoBody))
+	})
+	a.Equal(http.StatusForbidden, res.StatusCode)
+	res = do("/api/mdo", issued.Value, issued.Value, func(r *http.Request) {
+		r.Body = ioutil.NopCloser(strings.NewReader(mdoBody))
+	})
+	a.Equal(http.StatusOK, res.StatusCode)
 }
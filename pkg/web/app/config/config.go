@@ -3,18 +3,27 @@ package config
 import (
 	"context"
 	"encoding/base64"
+	"io/fs"
+	"os"
+	"sort"
 	"time"
 
 	firebase "firebase.google.com/go"
 	"github.com/0xor1/tlbx/pkg/config"
 	. "github.com/0xor1/tlbx/pkg/core"
 	"github.com/0xor1/tlbx/pkg/email"
+	"github.com/0xor1/tlbx/pkg/email/feedback"
+	"github.com/0xor1/tlbx/pkg/email/outbox"
 	"github.com/0xor1/tlbx/pkg/fcm"
 	"github.com/0xor1/tlbx/pkg/iredis"
 	"github.com/0xor1/tlbx/pkg/isql"
 	"github.com/0xor1/tlbx/pkg/log"
+	"github.com/0xor1/tlbx/pkg/oidc"
 	"github.com/0xor1/tlbx/pkg/ptr"
+	"github.com/0xor1/tlbx/pkg/pwdcheck"
 	"github.com/0xor1/tlbx/pkg/store"
+	"github.com/0xor1/tlbx/pkg/webauthn"
+	"github.com/0xor1/tlbx/pkg/webpush"
 	sp "github.com/SparkPost/gosparkpost"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -30,12 +39,17 @@ type Config struct {
 	Web     struct {
 		AppBindTo               string
 		StaticDir               string
+		SPAFallback             string
 		ContentSecurityPolicies []string
 		RateLimit               int
 		Session                 struct {
-			Secure     bool
-			AuthKey64s [][]byte
-			EncrKey32s [][]byte
+			Store       string
+			Secure      bool
+			MaxAge      time.Duration
+			IdleTimeout time.Duration
+			Lifetime    time.Duration
+			AuthKey64s  [][]byte
+			EncrKey32s  [][]byte
 		}
 	}
 	App struct {
@@ -43,6 +57,18 @@ type Config struct {
 		ActivateFmtLink           string
 		LoginLinkFmtLink          string
 		ConfirmChangeEmailFmtLink string
+		WebAuthn                  *webauthn.Config
+		OIDCRedirectURL           string
+		OIDC                      []*oidc.Provider
+		PwdCheck                  *pwdcheck.Checker
+		EmailTemplates            fs.FS
+		TOTP                      struct {
+			// shown with the account in authenticator apps
+			Issuer string
+			// the first key encrypts totp secrets at rest, the others
+			// only decrypt so keys can be rotated
+			EncrKey32s [][]byte
+		}
 	}
 	Redis struct {
 		RateLimit iredis.Pool
@@ -53,9 +79,31 @@ type Config struct {
 		Pwd  isql.ReplicaSet
 		Data isql.ReplicaSet
 	}
-	Email email.Client
-	Store store.Client
-	FCM   fcm.Client
+	// Email isn't suppressing, wrap it with feedback.NewSuppressingClient
+	// if EmailSuppress is set, so tests can capture emails inside the wrap
+	Email         email.Client
+	EmailSuppress bool
+	EmailOutbox   *outbox.Config
+	EmailFeedback struct {
+		SNS               *feedback.SNS
+		SparkPostUsername string
+		SparkPostPwd      string
+	}
+	Store     store.Client
+	FCM       fcm.Client
+	FCMTokens struct {
+		// tokens and web push subscriptions not refreshed within Expiry
+		// are deleted
+		Expiry         time.Duration
+		ExpiryInterval time.Duration
+	}
+	WebPush       webpush.Client
+	Notifications struct {
+		// how often held back notifications are sent as a digest
+		DigestInterval time.Duration
+		// how often to check for due digests
+		DigestCheckInterval time.Duration
+	}
 }
 
 func GetBase(file ...string) *config.Config {
@@ -63,11 +111,18 @@ func GetBase(file ...string) *config.Config {
 	c.SetDefault("version", "dev")
 	c.SetDefault("log.type", "local")
 	c.SetDefault("web.staticDir", "client/dist")
+	c.SetDefault("web.spaFallback", "index.html")
 	c.SetDefault("web.appBindTo", ":8080")
 	c.SetDefault("web.contentSecurityPolicies", []string{})
 	c.SetDefault("web.rateLimit", 300)
+	// "redis" or "cookie", redis sessions can be listed and revoked
+	c.SetDefault("web.session.store", "redis")
 	// session cookie store
 	c.SetDefault("web.session.secure", true)
+	// 0 makes it a browser session cookie
+	c.SetDefault("web.session.maxAge", time.Duration(0))
+	c.SetDefault("web.session.idleTimeout", 7*24*time.Hour)
+	c.SetDefault("web.session.lifetime", 30*24*time.Hour)
 	c.SetDefault("web.session.authKey64s", []string{
 		"Va3ZMfhH4qSfolDHLU7oPal599DMcL93A80rV2KLM_om_HBFFUbodZKOHAGDYg4LCvjYKaicodNmwLXROKVgcA",
 		"WK_2RgRx6vjfWVkpiwOCB1fvv1yklnltstBjYlQGfRsl6LyVV4mkt6UamUylmkwC8MEgb9bSGr1FYgM2Zk20Ug",
@@ -80,6 +135,22 @@ func GetBase(file ...string) *config.Config {
 	c.SetDefault("app.activateFmtLink", "http://localhost:8081/#/activate?me=%s&code=%s")
 	c.SetDefault("app.loginLinkFmtLink", "http://localhost:8081/#/loginLinkLogin?me=%s&code=%s")
 	c.SetDefault("app.confirmChangeEmailFmtLink", "http://localhost:8081/#/confirmChangeEmail?me=%s&code=%s")
+	c.SetDefault("app.totp.issuer", "tlbx")
+	c.SetDefault("app.totp.encrKey32s", []string{
+		"rSsf37ymTDpfSdWWf-b_swxM8HRow95nw3dmLwkAV10",
+	})
+	// passkeys are disabled if rpID is empty
+	c.SetDefault("app.webAuthn.rpID", "localhost")
+	c.SetDefault("app.webAuthn.rpName", "tlbx")
+	c.SetDefault("app.webAuthn.origins", []string{"http://localhost:8081"})
+	c.SetDefault("app.oidc.redirectURL", "http://localhost:8081/oidcCallback")
+	// name -> {"issuer": "", "clientID": "", "clientSecret": "", "scopes": []}
+	c.SetDefault("app.oidc.providers", map[string]interface{}{})
+	// 0 to 4, breachedDir is an optional k-anonymity prefix file corpus
+	c.SetDefault("app.pwd.minScore", 2)
+	c.SetDefault("app.pwd.breachedDir", "")
+	// optional dir of <locale>/<file> email templates overriding the defaults
+	c.SetDefault("app.emailTemplatesDir", "")
 	c.SetDefault("redis.rateLimit", "localhost:6379")
 	c.SetDefault("redis.cache", "localhost:6379")
 	c.SetDefault("sql.user.primary", "users:C0-Mm-0n-U5-3r5@tcp(localhost:3306)/users?parseTime=true&loc=UTC&multiStatements=true")
@@ -93,6 +164,28 @@ func GetBase(file ...string) *config.Config {
 	c.SetDefault("sql.maxOpenConns", 100)
 	c.SetDefault("email.type", "local")
 	c.SetDefault("email.apikey", "")
+	c.SetDefault("email.smtp.host", "localhost")
+	c.SetDefault("email.smtp.port", 587)
+	c.SetDefault("email.smtp.username", "")
+	c.SetDefault("email.smtp.pwd", "")
+	// starttls, tls or none
+	c.SetDefault("email.smtp.tls", email.SMTPStartTLS)
+	c.SetDefault("email.smtp.poolSize", 2)
+	c.SetDefault("email.smtp.timeout", 10*time.Second)
+	// drop emails to addresses which have hard bounced or complained
+	c.SetDefault("email.suppress", true)
+	// enables the sns webhook, an empty topic list accepts any topic
+	c.SetDefault("email.feedback.sns.enabled", false)
+	c.SetDefault("email.feedback.sns.topicArns", []string{})
+	// enables the sparkpost webhook, its basic auth credentials
+	c.SetDefault("email.feedback.sparkPost.username", "")
+	c.SetDefault("email.feedback.sparkPost.pwd", "")
+	c.SetDefault("email.outbox.pollInterval", time.Second)
+	c.SetDefault("email.outbox.batchSize", 50)
+	c.SetDefault("email.outbox.lease", time.Minute)
+	c.SetDefault("email.outbox.minBackoff", 10*time.Second)
+	c.SetDefault("email.outbox.maxBackoff", time.Hour)
+	c.SetDefault("email.outbox.maxAttempts", 10)
 	c.SetDefault("aws.region", "local")
 	c.SetDefault("aws.ses.creds.id", "localtest")
 	c.SetDefault("aws.ses.creds.secret", "localtest")
@@ -100,6 +193,14 @@ func GetBase(file ...string) *config.Config {
 	c.SetDefault("aws.s3.creds.id", "localtest")
 	c.SetDefault("aws.s3.creds.secret", "localtest")
 	c.SetDefault("fcm.serviceAccountKeyFile", "")
+	c.SetDefault("fcm.tokenExpiry", 48*time.Hour)
+	c.SetDefault("fcm.tokenExpiryInterval", time.Hour)
+	c.SetDefault("fcm.digestInterval", time.Hour)
+	c.SetDefault("fcm.digestCheckInterval", 5*time.Minute)
+	// web push is disabled if vapidPrivateKey is empty, generate a key pair
+	// with webpush.GenerateKeys
+	c.SetDefault("webPush.vapidPrivateKey", "")
+	c.SetDefault("webPush.subject", "mailto:test@test.localhost")
 
 	return c
 }
@@ -118,9 +219,14 @@ func GetProcessed(c *config.Config) *Config {
 
 	res.Web.AppBindTo = c.GetString("web.appBindTo")
 	res.Web.StaticDir = c.GetString("web.staticDir")
+	res.Web.SPAFallback = c.GetString("web.spaFallback")
 	res.Web.ContentSecurityPolicies = c.GetStringSlice("web.contentSecurityPolicies")
 	res.Web.RateLimit = c.GetInt("web.rateLimit")
+	res.Web.Session.Store = c.GetString("web.session.store")
 	res.Web.Session.Secure = c.GetBool("web.session.secure")
+	res.Web.Session.MaxAge = c.GetDuration("web.session.maxAge")
+	res.Web.Session.IdleTimeout = c.GetDuration("web.session.idleTimeout")
+	res.Web.Session.Lifetime = c.GetDuration("web.session.lifetime")
 	authKey64s := c.GetStringSlice("web.session.authKey64s")
 	encrKey32s := c.GetStringSlice("web.session.encrKey32s")
 	for i := range authKey64s {
@@ -138,6 +244,57 @@ func GetProcessed(c *config.Config) *Config {
 	res.App.ActivateFmtLink = c.GetString("app.activateFmtLink")
 	res.App.LoginLinkFmtLink = c.GetString("app.loginLinkFmtLink")
 	res.App.ConfirmChangeEmailFmtLink = c.GetString("app.confirmChangeEmailFmtLink")
+	res.App.TOTP.Issuer = c.GetString("app.totp.issuer")
+	for _, key := range c.GetStringSlice("app.totp.encrKey32s") {
+		keyBytes, err := base64.RawURLEncoding.DecodeString(key)
+		PanicOn(err)
+		PanicIf(len(keyBytes) != 32, "totpEncrKey32s length is not 32")
+		res.App.TOTP.EncrKey32s = append(res.App.TOTP.EncrKey32s, keyBytes)
+	}
+	if rpID := c.GetString("app.webAuthn.rpID"); rpID != "" {
+		res.App.WebAuthn = &webauthn.Config{
+			RPID:    rpID,
+			RPName:  c.GetString("app.webAuthn.rpName"),
+			Origins: c.GetStringSlice("app.webAuthn.origins"),
+		}
+	}
+	res.App.OIDCRedirectURL = c.GetString("app.oidc.redirectURL")
+	oidcProviders := c.GetMap("app.oidc.providers")
+	oidcNames := make([]string, 0, len(oidcProviders))
+	for name := range oidcProviders {
+		oidcNames = append(oidcNames, name)
+	}
+	sort.Strings(oidcNames)
+	for _, name := range oidcNames {
+		p, ok := oidcProviders[name].(map[string]interface{})
+		PanicIf(!ok, "invalid oidc provider config %s", name)
+		str := func(key string) string {
+			s, _ := p[key].(string)
+			return s
+		}
+		oc := &oidc.Config{
+			Name:         name,
+			Issuer:       str("issuer"),
+			ClientID:     str("clientID"),
+			ClientSecret: str("clientSecret"),
+		}
+		scopes, _ := p["scopes"].([]interface{})
+		for _, scope := range scopes {
+			if scope, ok := scope.(string); ok {
+				oc.Scopes = append(oc.Scopes, scope)
+			}
+		}
+		res.App.OIDC = append(res.App.OIDC, oidc.New(oc, res.App.OIDCRedirectURL))
+	}
+	res.App.PwdCheck = &pwdcheck.Checker{
+		MinScore: c.GetInt("app.pwd.minScore"),
+	}
+	if dir := c.GetString("app.pwd.breachedDir"); dir != "" {
+		res.App.PwdCheck.Breached = pwdcheck.NewCorpus(dir)
+	}
+	if dir := c.GetString("app.emailTemplatesDir"); dir != "" {
+		res.App.EmailTemplates = os.DirFS(dir)
+	}
 
 	res.Redis.RateLimit = iredis.CreatePool(c.GetString("redis.rateLimit"))
 	res.Redis.Cache = iredis.CreatePool(c.GetString("redis.cache"))
@@ -184,9 +341,33 @@ func GetProcessed(c *config.Config) *Config {
 						Region:      ptr.String(c.GetString("aws.region")),
 						Credentials: credentials.NewStaticCredentials(c.GetString("aws.ses.creds.id"), c.GetString("aws.ses.creds.secret"), ""),
 					})))
+	case "smtp":
+		res.Email = email.NewSMTPClient(&email.SMTPConfig{
+			Host:     c.GetString("email.smtp.host"),
+			Port:     c.GetInt("email.smtp.port"),
+			Username: c.GetString("email.smtp.username"),
+			Pwd:      c.GetString("email.smtp.pwd"),
+			TLS:      c.GetString("email.smtp.tls"),
+			PoolSize: c.GetInt("email.smtp.poolSize"),
+			Timeout:  c.GetDuration("email.smtp.timeout"),
+		})
 	default:
 		PanicIf(true, "unsupported email type %s", c.GetString("email.type"))
 	}
+	res.EmailSuppress = c.GetBool("email.suppress")
+	if c.GetBool("email.feedback.sns.enabled") {
+		res.EmailFeedback.SNS = feedback.NewSNS(c.GetStringSlice("email.feedback.sns.topicArns")...)
+	}
+	res.EmailFeedback.SparkPostUsername = c.GetString("email.feedback.sparkPost.username")
+	res.EmailFeedback.SparkPostPwd = c.GetString("email.feedback.sparkPost.pwd")
+	res.EmailOutbox = &outbox.Config{
+		PollInterval: c.GetDuration("email.outbox.pollInterval"),
+		BatchSize:    c.GetInt("email.outbox.batchSize"),
+		Lease:        c.GetDuration("email.outbox.lease"),
+		MinBackoff:   c.GetDuration("email.outbox.minBackoff"),
+		MaxBackoff:   c.GetDuration("email.outbox.maxBackoff"),
+		MaxAttempts:  c.GetInt("email.outbox.maxAttempts"),
+	}
 
 	res.Store = store.New(
 		s3.New(
@@ -209,6 +390,19 @@ func GetProcessed(c *config.Config) *Config {
 	} else {
 		res.FCM = fcm.NewNopClient(res.Log)
 	}
+	res.FCMTokens.Expiry = c.GetDuration("fcm.tokenExpiry")
+	res.FCMTokens.ExpiryInterval = c.GetDuration("fcm.tokenExpiryInterval")
+	res.Notifications.DigestInterval = c.GetDuration("fcm.digestInterval")
+	res.Notifications.DigestCheckInterval = c.GetDuration("fcm.digestCheckInterval")
+
+	if c.GetString("webPush.vapidPrivateKey") != "" {
+		res.WebPush = webpush.NewClient(&webpush.Config{
+			PrivateKey: c.GetString("webPush.vapidPrivateKey"),
+			Subject:    c.GetString("webPush.subject"),
+		})
+	} else {
+		res.WebPush = webpush.NewNopClient(res.Log)
+	}
 
 	return res
 }
@@ -0,0 +1,51 @@
+package emailfeedback
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/web/app"
+)
+
+// SNS is an SES feedback notification delivered by an SNS subscription.
+type SNS struct {
+	Body []byte
+}
+
+func (_ *SNS) Path() string {
+	return "/emailFeedback/sns"
+}
+
+func (a *SNS) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), stream(a.Body), nil)
+}
+
+func (a *SNS) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
+
+// SparkPost is a SparkPost webhook event batch.
+type SparkPost struct {
+	Body []byte
+}
+
+func (_ *SparkPost) Path() string {
+	return "/emailFeedback/sparkPost"
+}
+
+func (a *SparkPost) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), stream(a.Body), nil)
+}
+
+func (a *SparkPost) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
+
+func stream(body []byte) *app.UpStream {
+	s := &app.UpStream{}
+	s.Type = "application/json"
+	s.Size = int64(len(body))
+	s.Content = ioutil.NopCloser(bytes.NewReader(body))
+	return s
+}
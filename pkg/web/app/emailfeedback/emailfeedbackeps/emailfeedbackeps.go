@@ -0,0 +1,105 @@
+package emailfeedbackeps
+
+import (
+	"crypto/subtle"
+	"io/ioutil"
+	"net/http"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/email/feedback"
+	"github.com/0xor1/tlbx/pkg/web/app"
+	"github.com/0xor1/tlbx/pkg/web/app/emailfeedback"
+	"github.com/0xor1/tlbx/pkg/web/app/service"
+)
+
+// New returns the email provider webhook endpoints, the SNS endpoint is only
+// included if sns isn't nil and the SparkPost endpoint only if
+// sparkPostUsername is set, SparkPost doesn't sign its payloads so its
+// webhook must be configured to use basic auth with these credentials.
+func New(sns *feedback.SNS, sparkPostUsername, sparkPostPwd string) []*app.Endpoint {
+	eps := []*app.Endpoint{}
+	if sns != nil {
+		eps = append(eps, &app.Endpoint{
+			Description:      "ses bounce and complaint notifications from an sns subscription",
+			Path:             (&emailfeedback.SNS{}).Path(),
+			Timeout:          5000,
+			SkipXClientCheck: true,
+			SkipCSRFCheck:    true,
+			MaxBodyBytes:     app.MB,
+			IsPrivate:        false,
+			GetDefaultArgs: func() interface{} {
+				return &app.UpStream{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &app.UpStream{}
+			},
+			GetExampleResponse: func() interface{} {
+				return nil
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				body := read(a.(*app.UpStream))
+				events, err := sns.Parse(body)
+				if err != nil {
+					tlbx.Log().Warning("invalid sns message: %s", err)
+				}
+				app.ReturnIf(err != nil, http.StatusUnauthorized, "invalid sns message")
+				suppress(tlbx, events)
+				return nil
+			},
+		})
+	}
+	if sparkPostUsername != "" {
+		eps = append(eps, &app.Endpoint{
+			Description:      "sparkpost bounce and complaint webhook",
+			Path:             (&emailfeedback.SparkPost{}).Path(),
+			Timeout:          5000,
+			SkipXClientCheck: true,
+			SkipCSRFCheck:    true,
+			MaxBodyBytes:     5 * app.MB,
+			IsPrivate:        false,
+			GetDefaultArgs: func() interface{} {
+				return &app.UpStream{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &app.UpStream{}
+			},
+			GetExampleResponse: func() interface{} {
+				return nil
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*app.UpStream)
+				username, pwd, ok := tlbx.Req().BasicAuth()
+				app.ReturnIf(!ok ||
+					subtle.ConstantTimeCompare([]byte(username), []byte(sparkPostUsername)) != 1 ||
+					subtle.ConstantTimeCompare([]byte(pwd), []byte(sparkPostPwd)) != 1,
+					http.StatusUnauthorized, "")
+				events, err := feedback.ParseSparkPost(read(args))
+				app.BadReqIf(err != nil, "invalid sparkpost events: %s", err)
+				suppress(tlbx, events)
+				return nil
+			},
+		})
+	}
+	return eps
+}
+
+func read(args *app.UpStream) []byte {
+	defer args.Content.Close()
+	body, err := ioutil.ReadAll(args.Content)
+	app.ReturnIf(err != nil && err.Error() == "http: request body too large", http.StatusRequestEntityTooLarge, "request body too large")
+	PanicOn(err)
+	return body
+}
+
+func suppress(tlbx app.Tlbx, events []*feedback.Event) {
+	if len(events) == 0 {
+		return
+	}
+	tx := service.Get(tlbx).User().BeginWrite()
+	defer tx.Rollback()
+	feedback.Suppress(tx, events...)
+	tx.Commit()
+	for _, e := range events {
+		tlbx.Log().Info("suppressed email %s after %s: %s", e.Email, e.Type, e.Detail)
+	}
+}
@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/0xor1/tlbx/pkg/web/app"
+)
+
+// memory is the per instance fallback used when redis is unavailable, it
+// implements the same algorithms as the redis scripts.
+type memory struct {
+	mtx       *sync.Mutex
+	entries   map[string]*memEntry
+	lastSweep time.Time
+}
+
+type memEntry struct {
+	expires time.Time
+	// sliding window
+	hits []time.Time
+	// token bucket
+	tokens float64
+	ts     time.Time
+}
+
+func newMemory() *memory {
+	return &memory{
+		mtx:     &sync.Mutex{},
+		entries: map[string]*memEntry{},
+	}
+}
+
+func (m *memory) take(key string, limit *app.RateLimit, weight int, now time.Time) *result {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.sweep(now)
+	e, exists := m.entries[key]
+	if !exists {
+		e = &memEntry{
+			tokens: float64(limit.Limit),
+			ts:     now,
+		}
+		m.entries[key] = e
+	}
+	if limit.Algo == app.TokenBucket {
+		return e.tokenBucket(limit, weight, now)
+	}
+	return e.slidingWindow(limit, weight, now)
+}
+
+// sweep drops expired entries at most once a minute so the map doesn't
+// grow forever.
+func (m *memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for key, e := range m.entries {
+		if !now.Before(e.expires) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+func (e *memEntry) slidingWindow(limit *app.RateLimit, weight int, now time.Time) *result {
+	cutoff := now.Add(-limit.Window)
+	i := 0
+	for i < len(e.hits) && !e.hits[i].After(cutoff) {
+		i++
+	}
+	e.hits = e.hits[i:]
+	count := len(e.hits)
+	if count+weight > limit.Limit {
+		retry := limit.Window
+		if idx := count + weight - limit.Limit - 1; weight <= limit.Limit && idx < count {
+			retry = e.hits[idx].Add(limit.Window).Sub(now)
+		}
+		return &result{
+			allowed:    false,
+			remaining:  limit.Limit - count,
+			retryAfter: retry,
+		}
+	}
+	for i := 0; i < weight; i++ {
+		e.hits = append(e.hits, now)
+	}
+	e.expires = now.Add(limit.Window)
+	return &result{
+		allowed:   true,
+		remaining: limit.Limit - count - weight,
+	}
+}
+
+func (e *memEntry) tokenBucket(limit *app.RateLimit, weight int, now time.Time) *result {
+	// tokens per nanosecond
+	rate := float64(limit.Limit) / float64(limit.Window)
+	if elapsed := now.Sub(e.ts); elapsed > 0 {
+		e.tokens = math.Min(float64(limit.Limit), e.tokens+float64(elapsed)*rate)
+	}
+	e.ts = now
+	res := &result{}
+	if e.tokens >= float64(weight) {
+		e.tokens -= float64(weight)
+		res.allowed = true
+	} else if weight > limit.Limit {
+		res.retryAfter = limit.Window
+	} else {
+		res.retryAfter = time.Duration(math.Ceil((float64(weight) - e.tokens) / rate))
+	}
+	res.remaining = int(math.Floor(e.tokens))
+	e.expires = now.Add(time.Duration(math.Ceil((float64(limit.Limit) - e.tokens) / rate)))
+	return res
+}
@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/0xor1/tlbx/pkg/web/app"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemorySlidingWindow(t *testing.T) {
+	a := assert.New(t)
+	m := newMemory()
+	limit := &app.RateLimit{
+		Algo:   app.SlidingWindow,
+		Limit:  3,
+		Window: time.Minute,
+	}
+	now := time.Now()
+	res := m.take("a", limit, 1, now)
+	a.True(res.allowed)
+	a.Equal(2, res.remaining)
+	res = m.take("a", limit, 2, now.Add(10*time.Second))
+	a.True(res.allowed)
+	a.Equal(0, res.remaining)
+	res = m.take("a", limit, 1, now.Add(20*time.Second))
+	a.False(res.allowed)
+	// the first hit leaves the window after a minute
+	a.Equal(40*time.Second, res.retryAfter)
+	// other keys are independent
+	a.True(m.take("b", limit, 1, now.Add(20*time.Second)).allowed)
+	// weights wait for enough hits to leave the window
+	res = m.take("a", limit, 2, now.Add(61*time.Second))
+	a.False(res.allowed)
+	a.Equal(9*time.Second, res.retryAfter)
+	a.True(m.take("a", limit, 1, now.Add(61*time.Second)).allowed)
+}
+
+func TestMemoryTokenBucket(t *testing.T) {
+	a := assert.New(t)
+	m := newMemory()
+	limit := &app.RateLimit{
+		Algo:   app.TokenBucket,
+		Limit:  6,
+		Window: time.Minute,
+	}
+	now := time.Now()
+	// full bucket allows a burst
+	res := m.take("a", limit, 6, now)
+	a.True(res.allowed)
+	a.Equal(0, res.remaining)
+	res = m.take("a", limit, 1, now)
+	a.False(res.allowed)
+	a.Equal(10*time.Second, res.retryAfter)
+	// refills at 1 token every 10 seconds
+	res = m.take("a", limit, 1, now.Add(10*time.Second))
+	a.True(res.allowed)
+	a.Equal(0, res.remaining)
+	res = m.take("a", limit, 2, now.Add(20*time.Second))
+	a.False(res.allowed)
+	a.Equal(10*time.Second, res.retryAfter)
+	// never more than a full bucket
+	res = m.take("a", limit, 1, now.Add(time.Hour))
+	a.True(res.allowed)
+	a.Equal(5, res.remaining)
+	// weights larger than the bucket can never pass
+	a.False(m.take("a", limit, 7, now.Add(2*time.Hour)).allowed)
+}
@@ -1,8 +1,10 @@
 package ratelimit
 
 import (
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	. "github.com/0xor1/tlbx/pkg/core"
@@ -40,98 +42,70 @@ func BasicMware(sesExists func(app.Tlbx) bool, sesID func(app.Tlbx) string, cach
 	})
 }
 
+// Mware limits api requests, static files are never limited. Endpoints use
+// the default policy of PerMinute requests per minute unless they set their
+// own RateLimit. If redis is unavailable limits are tracked in memory so
+// they are per instance rather than global until it is back.
 func Mware(configs ...func(*Config)) func(app.Tlbx) {
 	c := config(configs...)
+	mem := newMemory()
 	return func(tlbx app.Tlbx) {
-		if c.Pool == nil ||
-			c.PerMinute < 1 ||
-			c.KeyGen == nil {
+		if c.PerMinute < 1 ||
+			c.KeyGen == nil ||
+			!strings.HasPrefix(StrLower(tlbx.Req().URL.Path), app.ApiPathPrefixSegment) {
 			return
 		}
 
-		shouldReturn := func(err error) bool {
+		limit := &app.RateLimit{
+			Algo:   c.Algo,
+			Limit:  c.PerMinute,
+			Window: time.Minute,
+		}
+		key := c.KeyGen(tlbx)
+		weight := 1
+		if ep := app.GetEndpoint(tlbx); ep != nil {
+			if ep.RateLimit != nil {
+				limit = ep.RateLimit
+				key = Strf("%s-%s", key, StrLower(ep.Path))
+			}
+			if ep.RateLimitWeight > 1 {
+				weight = ep.RateLimitWeight
+			}
+		}
+		key = Strf("%s-%s", key, algoNames[limit.Algo])
+
+		var res *result
+		var err error
+		if c.Pool != nil {
+			res, err = take(c.Pool, key, tlbx.NewID().String(), limit, weight, tlbx.Start())
 			if err != nil {
 				if c.ExitOnError {
 					PanicOn(err)
 				}
 				tlbx.Log().ErrorOn(err)
-				return true
 			}
-			return false
-		}
-
-		remaining := c.PerMinute
-
-		defer func() {
-			tlbx.Resp().Header().Add("X-Rate-Limit-Limit", strconv.Itoa(c.PerMinute))
-			tlbx.Resp().Header().Add("X-Rate-Limit-Remaining", strconv.Itoa(remaining))
-			tlbx.Resp().Header().Add("X-Rate-Limit-Reset", "60")
-
-			app.ReturnIf(remaining < 1, http.StatusTooManyRequests, "")
-		}()
-
-		key := c.KeyGen(tlbx)
-
-		now := NowUnixNano()
-		cnn := c.Pool.Get()
-		defer cnn.Close()
-
-		err := cnn.Send("MULTI")
-		if shouldReturn(err) {
-			return
 		}
-
-		err = cnn.Send("ZREMRANGEBYSCORE", key, 0, now-time.Minute.Nanoseconds())
-		if shouldReturn(err) {
-			return
+		if res == nil {
+			res = mem.take(key, limit, weight, tlbx.Start())
 		}
 
-		err = cnn.Send("ZRANGE", key, 0, -1)
-		if shouldReturn(err) {
-			return
-		}
-
-		results, err := redis.Values(cnn.Do("EXEC"))
-		if shouldReturn(err) {
-			return
-		}
-
-		keys, err := redis.Strings(results[len(results)-1], err)
-		if shouldReturn(err) {
-			return
-		}
-
-		remaining = remaining - len(keys)
-
-		if remaining > 0 {
-			remaining--
-
-			err := cnn.Send("MULTI")
-			if shouldReturn(err) {
-				return
-			}
-
-			err = cnn.Send("ZADD", key, now, now)
-			if shouldReturn(err) {
-				return
-			}
-
-			err = cnn.Send("EXPIRE", key, 60)
-			if shouldReturn(err) {
-				return
-			}
-
-			_, err = cnn.Do("EXEC")
-			if shouldReturn(err) {
-				return
-			}
+		header := tlbx.Resp().Header()
+		header.Set("X-Rate-Limit-Limit", strconv.Itoa(limit.Limit))
+		header.Set("X-Rate-Limit-Remaining", strconv.Itoa(res.remaining))
+		header.Set("X-Rate-Limit-Reset", strconv.Itoa(ceilSeconds(limit.Window)))
+		if !res.allowed {
+			header.Set("Retry-After", strconv.Itoa(ceilSeconds(res.retryAfter)))
 		}
+		app.ReturnIf(!res.allowed, http.StatusTooManyRequests, "")
 	}
 }
 
 type Config struct {
-	KeyGen      func(tlbx app.Tlbx) string
+	KeyGen func(tlbx app.Tlbx) string
+	// PerMinute and Algo make the default policy for endpoints which
+	// don't set their own RateLimit
 	PerMinute   int
+	Algo        app.RateLimitAlgo
 	ExitOnError bool
 	Pool        iredis.Pool
 }
@@ -140,6 +114,7 @@ func config(configs ...func(*Config)) *Config {
 	c := &Config{
 		KeyGen:      nil,
 		PerMinute:   300,
+		Algo:        app.SlidingWindow,
 		ExitOnError: false,
 		Pool:        nil,
 	}
@@ -148,3 +123,104 @@ func config(configs ...func(*Config)) *Config {
 	}
 	return c
 }
+
+var algoNames = map[app.RateLimitAlgo]string{
+	app.SlidingWindow: "sw",
+	app.TokenBucket:   "tb",
+}
+
+type result struct {
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration
+}
+
+// scripts run atomically in redis so concurrent requests can't both see
+// capacity that only one of them can have, all times are unix milliseconds.
+var (
+	slidingWindow = redis.NewScript(1, `
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local weight = tonumber(ARGV[4])
+local reqID = ARGV[5]
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local count = redis.call('ZCARD', key)
+if count + weight > limit then
+	local retry = window
+	local oldest = redis.call('ZRANGE', key, count + weight - limit - 1, count + weight - limit - 1, 'WITHSCORES')
+	if weight <= limit and oldest[2] then
+		retry = tonumber(oldest[2]) + window - now
+	end
+	return {0, limit - count, retry}
+end
+for i = 1, weight do
+	redis.call('ZADD', key, now, reqID .. '-' .. i)
+end
+redis.call('PEXPIRE', key, window)
+return {1, limit - count - weight, 0}
+`)
+	tokenBucket = redis.NewScript(1, `
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local weight = tonumber(ARGV[4])
+local rate = limit / window
+local state = redis.call('HMGET', key, 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = limit
+	ts = now
+end
+tokens = math.min(limit, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local retry = 0
+if tokens >= weight then
+	tokens = tokens - weight
+	allowed = 1
+elseif weight > limit then
+	retry = window
+else
+	retry = math.ceil((weight - tokens) / rate)
+end
+redis.call('HSET', key, 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', key, math.max(1, math.ceil((limit - tokens) / rate)))
+return {allowed, math.floor(tokens), retry}
+`)
+)
+
+func take(pool iredis.Pool, key, reqID string, limit *app.RateLimit, weight int, now time.Time) (*result, error) {
+	cnn := pool.Get()
+	defer cnn.Close()
+	script := slidingWindow
+	if limit.Algo == app.TokenBucket {
+		script = tokenBucket
+	}
+	vals, err := redis.Int64s(script.Do(cnn, key, unixMilli(now), limit.Window.Milliseconds(), limit.Limit, weight, reqID))
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) != 3 {
+		return nil, Err("unexpected rate limit script result: %v", vals)
+	}
+	return &result{
+		allowed:    vals[0] == 1,
+		remaining:  int(vals[1]),
+		retryAfter: time.Duration(vals[2]) * time.Millisecond,
+	}, nil
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func ceilSeconds(d time.Duration) int {
+	secs := int(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		return 1
+	}
+	return secs
+}
@@ -2,14 +2,19 @@ package fcm
 
 import (
 	"context"
+	"strings"
+	"sync"
 	"time"
 
 	"firebase.google.com/go/messaging"
 	. "github.com/0xor1/tlbx/pkg/core"
 	"github.com/0xor1/tlbx/pkg/fcm"
 	"github.com/0xor1/tlbx/pkg/isql"
+	"github.com/0xor1/tlbx/pkg/json"
+	"github.com/0xor1/tlbx/pkg/log"
 	"github.com/0xor1/tlbx/pkg/web/app"
 	"github.com/0xor1/tlbx/pkg/web/app/service/sql"
+	"github.com/0xor1/tlbx/pkg/webpush"
 )
 
 type tlbxKey struct {
@@ -18,17 +23,24 @@ type tlbxKey struct {
 
 type Client interface {
 	fcm.Client
-	AsyncSend(topic IDs, data map[string]string, timeout time.Duration)
+	WebPush() webpush.Client
+	// sends data to the fcm tokens and web push subscriptions registered
+	// for topic, if category isn't empty each users notification
+	// preferences for it are applied, pass an empty category for pushes
+	// which aren't user facing notifications, e.g. to sync client state
+	AsyncSend(category string, topic IDs, data map[string]string, timeout time.Duration)
 	RawAsyncSend(fcmType string, tokens []string, data map[string]string, timeout time.Duration)
+	RawAsyncWebPush(fcmType string, subs []*webpush.Subscription, data map[string]string, timeout time.Duration)
 }
 
-func Mware(userSqlName, name string, fcm fcm.Client) func(app.Tlbx) {
+func Mware(userSqlName, name string, fcm fcm.Client, webPush webpush.Client) func(app.Tlbx) {
 	return func(tlbx app.Tlbx) {
 		tlbx.Set(tlbxKey{name}, &client{
 			tlbx:        tlbx,
 			userSqlName: userSqlName,
 			name:        name,
 			fcm:         fcm,
+			webPush:     webPush,
 		})
 	}
 }
@@ -42,6 +54,11 @@ type client struct {
 	userSqlName string
 	name        string
 	fcm         fcm.Client
+	webPush     webpush.Client
+}
+
+func (c *client) WebPush() webpush.Client {
+	return c.webPush
 }
 
 func (c *client) Send(ctx context.Context, m *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
@@ -71,49 +88,325 @@ func (c *client) do(do func(), action string) {
 	})
 }
 
-func (c *client) AsyncSend(topic IDs, data map[string]string, timeout time.Duration) {
+func (c *client) AsyncSend(category string, topic IDs, data map[string]string, timeout time.Duration) {
 	app.BadReqIf(len(topic) == 0 || len(topic) > 5, "topic must be 1-5 ids long")
-	tokens := make([]string, 0, 20)
-	sql.Get(c.tlbx, c.userSqlName).Query(func(rows isql.Rows) {
+	PanicIf(category != "" && !CategoryRegex.MatchString(category), "invalid notification category %q", category)
+	srv := sql.Get(c.tlbx, c.userSqlName)
+	tokens := map[string]ID{}
+	srv.Query(func(rows isql.Rows) {
+		for rows.Next() {
+			token, user := "", ID{}
+			PanicOn(rows.Scan(&token, &user))
+			tokens[token] = user
+		}
+	}, `SELECT DISTINCT f.token, f.user FROM fcmTokens f JOIN users u ON f.user=u.id WHERE topic=? AND u.fcmEnabled=1`, topic.StrJoin("_"))
+	subs := map[*webpush.Subscription]ID{}
+	srv.Query(func(rows isql.Rows) {
 		for rows.Next() {
-			token := ""
-			PanicOn(rows.Scan(&token))
-			tokens = append(tokens, token)
+			sub, user := &webpush.Subscription{}, ID{}
+			PanicOn(rows.Scan(&sub.Endpoint, &sub.Keys.P256dh, &sub.Keys.Auth, &user))
+			subs[sub] = user
+		}
+	}, `SELECT DISTINCT w.endpoint, w.p256dh, w.auth, w.user FROM webPushSubscriptions w JOIN users u ON w.user=u.id WHERE topic=? AND u.fcmEnabled=1`, topic.StrJoin("_"))
+	deliveries := map[ID]delivery{}
+	if category != "" {
+		users := make(IDs, 0, len(tokens)+len(subs))
+		for _, user := range tokens {
+			users = append(users, user)
+		}
+		for _, user := range subs {
+			users = append(users, user)
+		}
+		deliveries = deliveriesFor(srv, category, users, Now())
+		hold(srv, category, deliveries)
+	}
+	nowTokens := make([]string, 0, len(tokens))
+	for token, user := range tokens {
+		if deliveries[user] == deliverNow {
+			nowTokens = append(nowTokens, token)
+		}
+	}
+	nowSubs := make([]*webpush.Subscription, 0, len(subs))
+	for sub, user := range subs {
+		if deliveries[user] == deliverNow {
+			nowSubs = append(nowSubs, sub)
 		}
-	}, `SELECT DISTINCT f.token FROM fcmTokens f JOIN users u ON f.user=u.id WHERE topic=? AND u.fcmEnabled=1`, topic.StrJoin("_"))
-	c.RawAsyncSend("data", tokens, data, timeout)
+	}
+	c.RawAsyncSend("data", nowTokens, data, timeout)
+	c.RawAsyncWebPush("data", nowSubs, data, timeout)
+}
+
+// ScanWebPushSubscriptions scans rows of endpoint, p256dh, auth.
+func ScanWebPushSubscriptions(rows isql.Rows) []*webpush.Subscription {
+	res := make([]*webpush.Subscription, 0, 5)
+	for rows.Next() {
+		sub := &webpush.Subscription{}
+		PanicOn(rows.Scan(&sub.Endpoint, &sub.Keys.P256dh, &sub.Keys.Auth))
+		res = append(res, sub)
+	}
+	return res
 }
 
 var clientHeaderName = "X-Fcm-Client"
 var fcmTypeName = "X-Fcm-Type"
 
+const (
+	maxSendAttempts = 3
+	// doubled after each failed attempt
+	retryBackoff = time.Second
+	// how long push services hold web pushes for offline browsers
+	webPushTTL = 24 * time.Hour
+)
+
 // this should only be used by AsyncSend and in usereps
 func (c *client) RawAsyncSend(fcmType string, tokens []string, data map[string]string, timeout time.Duration) {
-	PanicIf(fcmType == "", "fcmType must be none empty string")
-	_, fcmTypeExists := data[fcmTypeName]
-	PanicIf(fcmTypeExists, fcmTypeName+" is a reserved fcm push property for internal api use")
-	data[fcmTypeName] = fcmType
+	data = c.data(fcmType, data)
 	if len(tokens) == 0 {
 		return
 	}
+	log := c.tlbx.Log()
+	db := sql.Get(c.tlbx, c.userSqlName).Base()
+	Go(func() {
+		sendFCM(log, db, c, tokens, data, timeout)
+	}, log.ErrorOn)
+}
+
+// this should only be used by AsyncSend and in usereps
+func (c *client) RawAsyncWebPush(fcmType string, subs []*webpush.Subscription, data map[string]string, timeout time.Duration) {
+	data = c.data(fcmType, data)
+	if len(subs) == 0 {
+		return
+	}
+	log := c.tlbx.Log()
+	db := sql.Get(c.tlbx, c.userSqlName).Base()
+	Go(func() {
+		sendWebPush(log, db, c.webPush, subs, data, timeout)
+	}, log.ErrorOn)
+}
+
+// sendFCM sends data to tokens, deleting invalid tokens and retrying
+// transient failures, it returns false if it gave up retrying.
+func sendFCM(log log.Log, db isql.ReplicaSet, c fcm.Client, tokens []string, data map[string]string, timeout time.Duration) bool {
+	timeout = sendTimeout(timeout)
+	return withRetries(log, "fcm tokens", func() int {
+		log.Info("doing async call to fcm service with %d tokens", len(tokens))
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		res, err := c.Send(ctx, &messaging.MulticastMessage{
+			Tokens: tokens,
+			Data:   data,
+		})
+		cancel()
+		if err != nil {
+			log.Warning("fcm send error: %s", err)
+		}
+		invalid, retry := fcm.Failures(tokens, res)
+		if res != nil {
+			log.Info("FCM success: %d, fail: %d, invalid: %d", res.SuccessCount, res.FailureCount, len(invalid))
+		}
+		DeleteTokens(db, invalid...)
+		tokens = retry
+		return len(tokens)
+	})
+}
+
+// sendWebPush sends data to subs, deleting gone subscriptions and retrying
+// transient failures, it returns false if it gave up retrying.
+func sendWebPush(log log.Log, db isql.ReplicaSet, c webpush.Client, subs []*webpush.Subscription, data map[string]string, timeout time.Duration) bool {
+	timeout = sendTimeout(timeout)
+	payload := json.MustMarshal(data)
+	return withRetries(log, "web push subscriptions", func() int {
+		log.Info("doing async call to web push services with %d subscriptions", len(subs))
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		res, err := c.Send(ctx, &webpush.Message{
+			Subscriptions: subs,
+			Payload:       payload,
+			TTL:           webPushTTL,
+		})
+		cancel()
+		if err != nil {
+			log.Warning("web push send error: %s", err)
+		}
+		invalid, retry := webpush.Failures(subs, res)
+		if res != nil {
+			log.Info("web push success: %d, fail: %d, invalid: %d", res.SuccessCount, res.FailureCount, len(invalid))
+		}
+		endpoints := make([]string, 0, len(invalid))
+		for _, sub := range invalid {
+			endpoints = append(endpoints, sub.Endpoint)
+		}
+		DeleteWebPushSubscriptions(db, endpoints...)
+		subs = retry
+		return len(subs)
+	})
+}
+
+// data returns a copy of data with the internal api properties set.
+func (c *client) data(fcmType string, data map[string]string) map[string]string {
+	PanicIf(fcmType == "", "fcmType must be none empty string")
+	_, fcmTypeExists := data[fcmTypeName]
+	PanicIf(fcmTypeExists, fcmTypeName+" is a reserved fcm push property for internal api use")
 	_, clientExists := data[clientHeaderName]
 	PanicIf(clientExists, clientHeaderName+" is a reserved fcm push property for internal api use")
+	res := make(map[string]string, len(data)+2)
+	for k, v := range data {
+		res[k] = v
+	}
+	res[fcmTypeName] = fcmType
 	client := c.tlbx.Req().Header.Get(clientHeaderName)
 	if client != "" {
-		data[clientHeaderName] = client
+		res[clientHeaderName] = client
 	}
+	return res
+}
+
+func sendTimeout(timeout time.Duration) time.Duration {
 	if timeout <= 0 {
-		timeout = 2 * time.Second
+		return 2 * time.Second
 	}
-	log := c.tlbx.Log()
+	return timeout
+}
+
+// withRetries calls send, which returns how many recipients failed
+// transiently, until there are none or maxSendAttempts is reached, it
+// returns false in the latter case.
+func withRetries(log log.Log, recipients string, send func() int) bool {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		retry := send()
+		if retry == 0 {
+			return true
+		}
+		if attempt == maxSendAttempts {
+			log.Warning("giving up on %d %s after %d attempts", retry, recipients, attempt)
+			return false
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// DeleteTokens deletes tokens fcm has rejected as unregistered or invalid.
+func DeleteTokens(db isql.ReplicaSet, tokens ...string) {
+	if len(tokens) == 0 {
+		return
+	}
+	args := make([]interface{}, 0, len(tokens))
+	for _, t := range tokens {
+		args = append(args, t)
+	}
+	_, err := db.Primary().Exec(`DELETE FROM fcmTokens WHERE token IN (?`+strings.Repeat(`,?`, len(args)-1)+`)`, args...)
+	PanicOn(err)
+}
+
+// DeleteWebPushSubscriptions deletes subscriptions push services have
+// reported as gone or which can't be sent to.
+func DeleteWebPushSubscriptions(db isql.ReplicaSet, endpoints ...string) {
+	if len(endpoints) == 0 {
+		return
+	}
+	args := make([]interface{}, 0, len(endpoints))
+	for _, e := range endpoints {
+		args = append(args, e)
+	}
+	_, err := db.Primary().Exec(`DELETE FROM webPushSubscriptions WHERE endpoint IN (?`+strings.Repeat(`,?`, len(args)-1)+`)`, args...)
+	PanicOn(err)
+}
+
+// TokenExpirer periodically deletes fcm tokens and web push subscriptions
+// which clients haven't refreshed, by registering again, within a window.
+type TokenExpirer struct {
+	*poller
+	db     isql.ReplicaSet
+	window time.Duration
+}
+
+func NewTokenExpirer(db isql.ReplicaSet, window, interval time.Duration, l log.Log) *TokenExpirer {
+	PanicIf(window <= 0, "fcm token expiry window must be > 0")
+	e := &TokenExpirer{
+		db:     db,
+		window: window,
+	}
+	e.poller = newPoller("fcm token expirer", interval, l, func() {
+		n, err := e.Expire()
+		if err != nil {
+			l.ErrorOn(err)
+		} else if n > 0 {
+			l.Info("expired %d fcm tokens", n)
+		}
+	})
+	return e
+}
+
+// Expire deletes expired tokens and subscriptions and returns how many were
+// deleted.
+func (e *TokenExpirer) Expire() (int64, error) {
+	total := int64(0)
+	expireBefore := NowMilli().Add(-e.window)
+	for _, table := range []string{"fcmTokens", "webPushSubscriptions"} {
+		res, err := e.db.Primary().Exec(`DELETE FROM `+table+` WHERE createdOn<?`, expireBefore)
+		if err != nil {
+			return total, ToError(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, ToError(err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// poller calls run every interval between Start and Stop.
+type poller struct {
+	name     string
+	interval time.Duration
+	log      log.Log
+	run      func()
+	mtx      *sync.Mutex
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newPoller(name string, interval time.Duration, l log.Log, run func()) *poller {
+	PanicIf(interval <= 0, "%s interval must be > 0", name)
+	return &poller{
+		name:     name,
+		interval: interval,
+		log:      l,
+		run:      run,
+		mtx:      &sync.Mutex{},
+	}
+}
+
+func (p *poller) Start() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	PanicIf(p.stop != nil, "%s already started", p.name)
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	stop, done := p.stop, p.done
 	Go(func() {
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-		log.Info("doing async call to fcm service with %d tokens", len(tokens))
-		res := c.MustSend(ctx, &messaging.MulticastMessage{
-			Tokens: tokens,
-			Data:   data,
-		})
-		log.Info("FCM success: %d, fail: %d", res.SuccessCount, res.FailureCount)
-	}, log.ErrorOn)
+		defer close(done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				Do(p.run, p.log.ErrorOn)
+			}
+		}
+	}, p.log.ErrorOn)
+}
+
+func (p *poller) Stop() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop, p.done = nil, nil
 }
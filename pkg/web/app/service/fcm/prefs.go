@@ -0,0 +1,338 @@
+package fcm
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/fcm"
+	"github.com/0xor1/tlbx/pkg/isql"
+	"github.com/0xor1/tlbx/pkg/json"
+	"github.com/0xor1/tlbx/pkg/log"
+	"github.com/0xor1/tlbx/pkg/web/app/service/sql"
+	"github.com/0xor1/tlbx/pkg/webpush"
+)
+
+var CategoryRegex = regexp.MustCompile(`\A[a-zA-Z0-9_.-]{1,50}\z`)
+
+// how long a digest is claimed for before other senders may retry it, longer
+// than sending can take with retries
+const digestLease = time.Minute
+
+type delivery int
+
+const (
+	deliverNow delivery = iota
+	deliverNever
+	// held until the next digest
+	deliverDigest
+	// held until quiet hours end
+	deliverAfterQuietHours
+)
+
+// Settings are a users category independent notification preferences.
+type Settings struct {
+	TimeZone string
+	// minutes after midnight in TimeZone, if end is before start quiet hours
+	// span midnight
+	QuietHoursStart *int
+	QuietHoursEnd   *int
+}
+
+// Quiet returns whether now is within s's quiet hours.
+func (s *Settings) Quiet(now time.Time) bool {
+	if s == nil || s.QuietHoursStart == nil || s.QuietHoursEnd == nil {
+		return false
+	}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	m := local.Hour()*60 + local.Minute()
+	start, end := *s.QuietHoursStart, *s.QuietHoursEnd
+	if start <= end {
+		return start <= m && m < end
+	}
+	return m >= start || m < end
+}
+
+// deliveriesFor returns how a notification in category should be delivered
+// to each of users, users without preferences get it now.
+func deliveriesFor(srv sql.Client, category string, users IDs, now time.Time) map[ID]delivery {
+	res := map[ID]delivery{}
+	if len(users) == 0 {
+		return res
+	}
+	args := make([]interface{}, 0, len(users)+1)
+	args = append(args, category)
+	seen := map[ID]bool{}
+	for _, user := range users {
+		if !seen[user] {
+			seen[user] = true
+			args = append(args, user)
+		}
+	}
+	srv.Query(func(rows isql.Rows) {
+		for rows.Next() {
+			user := ID{}
+			var timeZone *string
+			s := &Settings{}
+			var enabled, digest *bool
+			PanicOn(rows.Scan(&user, &timeZone, &s.QuietHoursStart, &s.QuietHoursEnd, &enabled, &digest))
+			if timeZone != nil {
+				s.TimeZone = *timeZone
+			}
+			switch {
+			case enabled != nil && !*enabled:
+				res[user] = deliverNever
+			case digest != nil && *digest:
+				res[user] = deliverDigest
+			case s.Quiet(now):
+				res[user] = deliverAfterQuietHours
+			}
+		}
+	}, `SELECT u.id, s.timeZone, s.quietHoursStart, s.quietHoursEnd, c.enabled, c.digest FROM users u LEFT JOIN notificationSettings s ON s.user=u.id LEFT JOIN notificationCategories c ON c.user=u.id AND c.category=? WHERE u.id IN (?`+strings.Repeat(`,?`, len(args)-2)+`)`, args...)
+	return res
+}
+
+// hold records notifications held back by deliveries so they're included in
+// the users next digest.
+func hold(srv sql.Client, category string, deliveries map[ID]delivery) {
+	args := make([]interface{}, 0, len(deliveries)*5)
+	for user, d := range deliveries {
+		if d == deliverDigest || d == deliverAfterQuietHours {
+			args = append(args, user, category, 1, d == deliverDigest, NowMilli())
+		}
+	}
+	if len(args) == 0 {
+		return
+	}
+	_, err := srv.Exec(`INSERT INTO notificationDigests (user, category, count, digest, createdOn) VALUES (?,?,?,?,?)`+strings.Repeat(`,(?,?,?,?,?)`, len(args)/5-1)+` ON DUPLICATE KEY UPDATE count=count+1, digest=digest AND VALUES(digest)`, args...)
+	PanicOn(err)
+}
+
+// DigestSender periodically sends each user a single push summarising the
+// notifications held back for them, once they're out of quiet hours and
+// either the oldest held notification is older than the digest interval or
+// some were only held for quiet hours. Held notifications are only deleted
+// once their digest is sent, so failed digests are retried.
+type DigestSender struct {
+	*poller
+	db      isql.ReplicaSet
+	fcm     fcm.Client
+	webPush webpush.Client
+	digest  time.Duration
+	log     log.Log
+}
+
+func NewDigestSender(db isql.ReplicaSet, fcm fcm.Client, webPush webpush.Client, digest, interval time.Duration, l log.Log) *DigestSender {
+	PanicIf(digest <= 0, "notification digest interval must be > 0")
+	d := &DigestSender{
+		db:      db,
+		fcm:     fcm,
+		webPush: webPush,
+		digest:  digest,
+		log:     l,
+	}
+	d.poller = newPoller("notification digest sender", interval, l, func() {
+		n, err := d.Send()
+		if err != nil {
+			l.ErrorOn(err)
+		} else if n > 0 {
+			l.Info("sent %d notification digests", n)
+		}
+	})
+	return d
+}
+
+type heldFor struct {
+	settings *Settings
+	oldest   time.Time
+	// some were only held for quiet hours
+	quietOnly bool
+}
+
+// Send sends the digests which are due and returns how many were sent.
+func (d *DigestSender) Send() (int, error) {
+	now := NowMilli()
+	rows, err := d.db.Primary().Query(`SELECT d.user, d.digest, d.createdOn, s.timeZone, s.quietHoursStart, s.quietHoursEnd FROM notificationDigests d LEFT JOIN notificationSettings s ON s.user=d.user`)
+	if err != nil {
+		return 0, ToError(err)
+	}
+	held := map[ID]*heldFor{}
+	for rows.Next() {
+		user := ID{}
+		digest := false
+		createdOn := time.Time{}
+		var timeZone *string
+		s := &Settings{}
+		if err = rows.Scan(&user, &digest, &createdOn, &timeZone, &s.QuietHoursStart, &s.QuietHoursEnd); err != nil {
+			rows.Close()
+			return 0, ToError(err)
+		}
+		if timeZone != nil {
+			s.TimeZone = *timeZone
+		}
+		h := held[user]
+		if h == nil {
+			h = &heldFor{settings: s, oldest: createdOn}
+			held[user] = h
+		}
+		if createdOn.Before(h.oldest) {
+			h.oldest = createdOn
+		}
+		h.quietOnly = h.quietOnly || !digest
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, ToError(err)
+	}
+	sent := 0
+	for user, h := range held {
+		if h.settings.Quiet(now) || (!h.quietOnly && now.Sub(h.oldest) < d.digest) {
+			continue
+		}
+		counts, err := d.claim(user)
+		if err != nil {
+			return sent, err
+		}
+		if len(counts) == 0 {
+			// claimed by another sender
+			continue
+		}
+		ok, err := d.send(user, counts)
+		if err != nil {
+			d.log.ErrorOn(d.release(user))
+			return sent, err
+		}
+		if !ok {
+			d.log.Warning("notification digest for %s wasn't sent, it will be retried", user)
+			if err = d.release(user); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if err = d.sent(user, counts); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// claim leases and returns the held notification counts by category for
+// user so concurrent senders don't send the same digest, it returns none
+// if another sender has them.
+func (d *DigestSender) claim(user ID) (map[string]int, error) {
+	tx, err := d.db.Primary().Begin()
+	if err != nil {
+		return nil, ToError(err)
+	}
+	defer tx.Rollback()
+	now := NowMilli()
+	rows, err := tx.Query(`SELECT category, count, leasedUntil FROM notificationDigests WHERE user=? FOR UPDATE`, user)
+	if err != nil {
+		return nil, ToError(err)
+	}
+	counts := map[string]int{}
+	leased := false
+	for rows.Next() {
+		category, count := "", 0
+		var leasedUntil *time.Time
+		if err = rows.Scan(&category, &count, &leasedUntil); err != nil {
+			rows.Close()
+			return nil, ToError(err)
+		}
+		counts[category] = count
+		leased = leased || (leasedUntil != nil && leasedUntil.After(now))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, ToError(err)
+	}
+	if len(counts) == 0 || leased {
+		return map[string]int{}, nil
+	}
+	if _, err = tx.Exec(`UPDATE notificationDigests SET leasedUntil=? WHERE user=?`, now.Add(digestLease), user); err != nil {
+		return nil, ToError(err)
+	}
+	return counts, ToError(tx.Commit())
+}
+
+// sent deletes the notifications counted in user's sent digest, any held
+// while it was sending are left for the next one.
+func (d *DigestSender) sent(user ID, counts map[string]int) error {
+	tx, err := d.db.Primary().Begin()
+	if err != nil {
+		return ToError(err)
+	}
+	defer tx.Rollback()
+	for category, count := range counts {
+		if _, err = tx.Exec(`UPDATE notificationDigests SET count=count-? WHERE user=? AND category=?`, count, user, category); err != nil {
+			return ToError(err)
+		}
+	}
+	if _, err = tx.Exec(`DELETE FROM notificationDigests WHERE user=? AND count=0`, user); err != nil {
+		return ToError(err)
+	}
+	if _, err = tx.Exec(`UPDATE notificationDigests SET leasedUntil=NULL, createdOn=? WHERE user=?`, NowMilli(), user); err != nil {
+		return ToError(err)
+	}
+	return ToError(tx.Commit())
+}
+
+// release gives up the lease on user's digest so it's retried.
+func (d *DigestSender) release(user ID) error {
+	_, err := d.db.Primary().Exec(`UPDATE notificationDigests SET leasedUntil=NULL WHERE user=?`, user)
+	return ToError(err)
+}
+
+// send returns false if the digest wasn't sent to some of user's tokens or
+// subscriptions after retrying.
+func (d *DigestSender) send(user ID, counts map[string]int) (bool, error) {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	data := map[string]string{
+		fcmTypeName:  "digest",
+		"count":      Strf("%d", total),
+		"categories": string(json.MustMarshal(counts)),
+	}
+	tokens := make([]string, 0, 5)
+	rows, err := d.db.Primary().Query(`SELECT DISTINCT f.token FROM fcmTokens f JOIN users u ON f.user=u.id WHERE f.user=? AND u.fcmEnabled=1`, user)
+	if err != nil {
+		return false, ToError(err)
+	}
+	for rows.Next() {
+		token := ""
+		if err = rows.Scan(&token); err != nil {
+			rows.Close()
+			return false, ToError(err)
+		}
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, ToError(err)
+	}
+	rows, err = d.db.Primary().Query(`SELECT DISTINCT w.endpoint, w.p256dh, w.auth FROM webPushSubscriptions w JOIN users u ON w.user=u.id WHERE w.user=? AND u.fcmEnabled=1`, user)
+	if err != nil {
+		return false, ToError(err)
+	}
+	subs := ScanWebPushSubscriptions(rows)
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, ToError(err)
+	}
+	ok := true
+	if len(tokens) > 0 {
+		ok = sendFCM(d.log, d.db, d.fcm, tokens, data, 0)
+	}
+	if len(subs) > 0 {
+		ok = sendWebPush(d.log, d.db, d.webPush, subs, data, 0) && ok
+	}
+	return ok, nil
+}
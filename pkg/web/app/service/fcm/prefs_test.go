@@ -0,0 +1,47 @@
+package fcm
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/ptr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettingsQuiet(t *testing.T) {
+	a := assert.New(t)
+	at := func(hhmm string) time.Time {
+		res, err := time.Parse("2006-01-02 15:04", "2021-06-01 "+hhmm)
+		PanicOn(err)
+		return res
+	}
+	var s *Settings
+	a.False(s.Quiet(at("03:00")))
+	s = &Settings{TimeZone: "UTC"}
+	a.False(s.Quiet(at("03:00")))
+
+	// spanning midnight
+	s.QuietHoursStart = ptr.Int(22 * 60)
+	s.QuietHoursEnd = ptr.Int(7 * 60)
+	a.False(s.Quiet(at("21:59")))
+	a.True(s.Quiet(at("22:00")))
+	a.True(s.Quiet(at("03:00")))
+	a.False(s.Quiet(at("07:00")))
+
+	// within a day
+	s.QuietHoursStart = ptr.Int(13 * 60)
+	s.QuietHoursEnd = ptr.Int(14 * 60)
+	a.False(s.Quiet(at("12:59")))
+	a.True(s.Quiet(at("13:30")))
+	a.False(s.Quiet(at("14:00")))
+
+	// in the users time zone, new york is utc-4 in june
+	s.TimeZone = "America/New_York"
+	a.True(s.Quiet(at("17:30")))
+	a.False(s.Quiet(at("13:30")))
+
+	// unknown time zones fall back to utc
+	s.TimeZone = "Nowhere/Nope"
+	a.True(s.Quiet(at("13:30")))
+}
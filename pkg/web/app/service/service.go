@@ -12,6 +12,7 @@ import (
 	"github.com/0xor1/tlbx/pkg/web/app/service/redis"
 	"github.com/0xor1/tlbx/pkg/web/app/service/sql"
 	storemw "github.com/0xor1/tlbx/pkg/web/app/service/store"
+	"github.com/0xor1/tlbx/pkg/webpush"
 )
 
 const (
@@ -34,7 +35,7 @@ type Layer interface {
 	FCM() fcmmw.Client
 }
 
-func Mware(pool iredis.Pool, user, pwd, data isql.ReplicaSet, email email.Client, store store.Client, fcm fcm.Client) func(app.Tlbx) {
+func Mware(pool iredis.Pool, user, pwd, data isql.ReplicaSet, email email.Client, store store.Client, fcm fcm.Client, webPush webpush.Client) func(app.Tlbx) {
 	mwares := []func(app.Tlbx){
 		redis.Mware(cache, pool),
 		sql.Mware(sqlUser, user),
@@ -42,7 +43,7 @@ func Mware(pool iredis.Pool, user, pwd, data isql.ReplicaSet, email email.Client
 		sql.Mware(sqlData, data),
 		emailmw.Mware(emailName, email),
 		storemw.Mware(storeName, store),
-		fcmmw.Mware(sqlUser, fcmName, fcm),
+		fcmmw.Mware(sqlUser, fcmName, fcm, webPush),
 	}
 	return func(tlbx app.Tlbx) {
 		for _, mw := range mwares {
@@ -46,7 +46,10 @@ type tx struct {
 	tlbx      app.Tlbx
 	sqlClient *client
 	readOnly  bool
-	done      bool
+	// shared txs belong to an mdoSeq request and are committed
+	// or rolled back by it once all of its sub requests are done
+	shared bool
+	done   bool
 }
 
 func (t *tx) Exec(query string, args ...interface{}) (res sql.Result, err error) {
@@ -73,6 +76,10 @@ func (t *tx) QueryRow(query string, args ...interface{}) (row isql.Row) {
 }
 
 func (t *tx) Rollback() {
+	if t.shared {
+		t.done = true
+		return
+	}
 	if !t.done {
 		t.sqlClient.do(func(q string) {
 			err := t.tx.Rollback()
@@ -85,6 +92,10 @@ func (t *tx) Rollback() {
 }
 
 func (t *tx) Commit() {
+	if t.shared {
+		t.done = true
+		return
+	}
 	t.sqlClient.do(func(q string) { PanicOn(t.tx.Commit()); t.done = true }, "COMMIT")
 }
 
@@ -99,6 +110,9 @@ func (c *client) Base() isql.ReplicaSet {
 }
 
 func (c *client) BeginRead() Tx {
+	if t := c.sharedTx(true); t != nil {
+		return t
+	}
 	var t isql.Tx
 	var err error
 	c.do(func(s string) {
@@ -116,6 +130,9 @@ func (c *client) BeginRead() Tx {
 }
 
 func (c *client) BeginWrite() Tx {
+	if t := c.sharedTx(false); t != nil {
+		return t
+	}
 	var t isql.Tx
 	var err error
 	c.do(func(s string) {
@@ -133,11 +150,17 @@ func (c *client) BeginWrite() Tx {
 }
 
 func (c *client) Exec(query string, args ...interface{}) (res sql.Result, err error) {
+	if t := c.sharedTx(false); t != nil {
+		return t.Exec(query, args...)
+	}
 	c.do(func(q string) { res, err = c.sql.Primary().ExecContext(c.tlbx.Ctx(), q, args...) }, query)
 	return
 }
 
 func (c *client) Query(rowsFn func(isql.Rows), query string, args ...interface{}) (err error) {
+	if t := c.sharedTx(true); t != nil {
+		return t.Query(rowsFn, query, args...)
+	}
 	c.do(func(q string) {
 		var rows isql.Rows
 		rows, err = c.sql.RandSlave().QueryContext(c.tlbx.Ctx(), q, args...)
@@ -150,10 +173,56 @@ func (c *client) Query(rowsFn func(isql.Rows), query string, args ...interface{}
 }
 
 func (c *client) QueryRow(query string, args ...interface{}) (row isql.Row) {
+	if t := c.sharedTx(true); t != nil {
+		return t.QueryRow(query, args...)
+	}
 	c.do(func(q string) { row = c.sql.RandSlave().QueryRowContext(c.tlbx.Ctx(), q, args...) }, query)
 	return
 }
 
+type mDoTxKey struct {
+	name string
+}
+
+// sharedTx returns nil unless this request is part of an all or nothing
+// mdoSeq request, in which case all queries go through one write transaction
+// on the primary so later sub requests see the writes of earlier ones.
+func (c *client) sharedTx(readOnly bool) *tx {
+	mtx := app.GetMDoTx(c.tlbx)
+	if mtx == nil {
+		return nil
+	}
+	key := mDoTxKey{c.name}
+	t, _ := mtx.Get(key).(isql.Tx)
+	if t == nil {
+		var err error
+		c.do(func(s string) {
+			t, err = c.sql.Primary().BeginTx(mtx.Ctx(), &sql.TxOptions{
+				ReadOnly: false,
+			})
+		}, "START TRANSACTION (MDO WRITE)")
+		PanicOn(err)
+		mtx.Set(key, t)
+		mtx.OnEnd(func(commit bool) {
+			if commit {
+				PanicOn(t.Commit())
+			} else {
+				err := t.Rollback()
+				if err != nil && err != sql.ErrTxDone {
+					PanicOn(err)
+				}
+			}
+		})
+	}
+	return &tx{
+		tx:        t,
+		tlbx:      c.tlbx,
+		readOnly:  readOnly,
+		sqlClient: c,
+		shared:    true,
+	}
+}
+
 func (c *client) do(do func(string), query string) {
 	// no query should ever even come close to 1 second in execution time
 	start := NowUnixMilli()
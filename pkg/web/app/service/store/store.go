@@ -2,6 +2,7 @@ package service
 
 import (
 	"io"
+	"net/http"
 	"time"
 
 	. "github.com/0xor1/tlbx/pkg/core"
@@ -96,6 +97,22 @@ func (s *client) MustPresignedPutUrl(bucket, key string, name, mimeType string,
 	return url
 }
 
+func (c *client) PresignedPutReq(bucket, key string, name, mimeType string, size int64, isPublic, isAttachment bool, expire time.Duration) (string, http.Header, error) {
+	var url string
+	var header http.Header
+	var err error
+	c.do(func() {
+		url, header, err = c.store.PresignedPutReq(bucket, key, name, mimeType, size, isPublic, isAttachment, expire)
+	}, Strf("%s %s %s", "PUT_PRESIGNED_REQ", bucket, key))
+	return url, header, err
+}
+
+func (c *client) MustPresignedPutReq(bucket, key string, name, mimeType string, size int64, isPublic, isAttachment bool, expire time.Duration) (string, http.Header) {
+	url, header, err := c.PresignedPutReq(bucket, key, name, mimeType, size, isPublic, isAttachment, expire)
+	PanicOn(err)
+	return url, header
+}
+
 func (c *client) Get(bucket, key string) (string, string, int64, io.ReadCloser, error) {
 	var name string
 	var mimeType string
@@ -114,6 +131,21 @@ func (c *client) MustGet(bucket, key string) (string, string, int64, io.ReadClos
 	return name, mimeType, size, content
 }
 
+func (c *client) GetRange(bucket, key string, r *store.Range, ifRange string) (*store.Object, error) {
+	var obj *store.Object
+	var err error
+	c.do(func() {
+		obj, err = c.store.GetRange(bucket, key, r, ifRange)
+	}, Strf("%s %s %s", "GET_RANGE", bucket, key))
+	return obj, err
+}
+
+func (c *client) MustGetRange(bucket, key string, r *store.Range, ifRange string) *store.Object {
+	obj, err := c.GetRange(bucket, key, r, ifRange)
+	PanicOn(err)
+	return obj
+}
+
 func (c *client) PresignedGetUrl(bucket, key string, name string, isAttachment bool) (string, error) {
 	var url string
 	var err error
@@ -129,6 +161,23 @@ func (c *client) MustPresignedGetUrl(bucket, key string, name string, isAttachme
 	return url
 }
 
+func (c *client) Head(bucket, key string) (string, string, int64, error) {
+	var name string
+	var mimeType string
+	var size int64
+	var err error
+	c.do(func() {
+		name, mimeType, size, err = c.store.Head(bucket, key)
+	}, Strf("%s %s %s", "HEAD", bucket, key))
+	return name, mimeType, size, err
+}
+
+func (c *client) MustHead(bucket, key string) (string, string, int64) {
+	name, mimeType, size, err := c.Head(bucket, key)
+	PanicOn(err)
+	return name, mimeType, size
+}
+
 func (c *client) Delete(bucket, key string) error {
 	var err error
 	c.do(func() {
@@ -153,6 +202,60 @@ func (c *client) MustDeletePrefix(bucket, prefix string) {
 	PanicOn(c.DeletePrefix(bucket, prefix))
 }
 
+func (c *client) CreateMultipartUpload(bucket, key, name, mimeType string, isPublic, isAttachment bool) (string, error) {
+	var uploadID string
+	var err error
+	c.do(func() {
+		uploadID, err = c.store.CreateMultipartUpload(bucket, key, name, mimeType, isPublic, isAttachment)
+	}, Strf("%s %s %s", "CREATE_MULTIPART_UPLOAD", bucket, key))
+	return uploadID, err
+}
+
+func (c *client) MustCreateMultipartUpload(bucket, key, name, mimeType string, isPublic, isAttachment bool) string {
+	uploadID, err := c.CreateMultipartUpload(bucket, key, name, mimeType, isPublic, isAttachment)
+	PanicOn(err)
+	return uploadID
+}
+
+func (c *client) UploadPart(bucket, key, uploadID string, num, size int64, timeout time.Duration, content io.Reader) (string, error) {
+	var etag string
+	var err error
+	c.do(func() {
+		etag, err = c.store.UploadPart(bucket, key, uploadID, num, size, timeout, content)
+	}, Strf("%s %s %s %d", "UPLOAD_PART", bucket, key, num))
+	return etag, err
+}
+
+func (c *client) MustUploadPart(bucket, key, uploadID string, num, size int64, timeout time.Duration, content io.Reader) string {
+	etag, err := c.UploadPart(bucket, key, uploadID, num, size, timeout, content)
+	PanicOn(err)
+	return etag
+}
+
+func (c *client) CompleteMultipartUpload(bucket, key, uploadID string, parts []*store.Part) error {
+	var err error
+	c.do(func() {
+		err = c.store.CompleteMultipartUpload(bucket, key, uploadID, parts)
+	}, Strf("%s %s %s", "COMPLETE_MULTIPART_UPLOAD", bucket, key))
+	return err
+}
+
+func (c *client) MustCompleteMultipartUpload(bucket, key, uploadID string, parts []*store.Part) {
+	PanicOn(c.CompleteMultipartUpload(bucket, key, uploadID, parts))
+}
+
+func (c *client) AbortMultipartUpload(bucket, key, uploadID string) error {
+	var err error
+	c.do(func() {
+		err = c.store.AbortMultipartUpload(bucket, key, uploadID)
+	}, Strf("%s %s %s", "ABORT_MULTIPART_UPLOAD", bucket, key))
+	return err
+}
+
+func (c *client) MustAbortMultipartUpload(bucket, key, uploadID string) {
+	PanicOn(c.AbortMultipartUpload(bucket, key, uploadID))
+}
+
 func (c *client) do(do func(), action string) {
 	start := NowUnixMilli()
 	do()
@@ -163,3 +266,39 @@ func (c *client) do(do func(), action string) {
 		Action: action,
 	})
 }
+
+// DownStream returns the object at key ready to be returned from a
+// DownStream endpoint, honouring the requests Range and If-Range headers
+// so only the requested bytes are fetched from the store.
+func DownStream(tlbx app.Tlbx, s store.Client, bucket, key string) *app.DownStream {
+	var sr *store.Range
+	r, ifRange := app.GetRange(tlbx)
+	if r != nil {
+		sr = &store.Range{
+			Start: r.Start,
+			End:   r.End,
+		}
+	}
+	obj, err := s.GetRange(bucket, key, sr, ifRange)
+	if store.IsInvalidRange(err) {
+		// rfc 7233 4.4, a 416 must include the current size
+		_, _, size, err := s.Head(bucket, key)
+		PanicOn(err)
+		tlbx.Resp().Header().Set("Content-Range", Strf("bytes */%d", size))
+		app.ReturnIf(true, http.StatusRequestedRangeNotSatisfiable, "")
+	}
+	PanicOn(err)
+	ds := &app.DownStream{}
+	ds.Name = obj.Name
+	ds.Type = obj.Type
+	ds.Size = obj.Size
+	ds.Content = obj.Content
+	ds.ETag = obj.ETag
+	if obj.Range != nil {
+		ds.Range = &app.Range{
+			Start: obj.Range.Start,
+			End:   obj.Range.End,
+		}
+	}
+	return ds
+}
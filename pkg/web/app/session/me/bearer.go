@@ -0,0 +1,87 @@
+package me
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/isql"
+	"github.com/0xor1/tlbx/pkg/json"
+	"github.com/0xor1/tlbx/pkg/web/app"
+	"github.com/0xor1/tlbx/pkg/web/app/session"
+)
+
+const bearerPrefix = "Bearer "
+
+// BearerMware authenticates requests with an Authorization: Bearer header
+// against the tokens table in the users db. Token requests are authed for
+// the token owner exactly as a cookie session would be, but nothing is read
+// from or written to the session cookie. It must come after the session
+// mware in TlbxSetup.
+func BearerMware(users isql.ReplicaSet) func(app.Tlbx) {
+	return func(tlbx app.Tlbx) {
+		header := tlbx.Req().Header.Get("Authorization")
+		if !strings.HasPrefix(header, bearerPrefix) {
+			return
+		}
+		unauthed := func(condition bool) {
+			app.ReturnIf(condition, http.StatusUnauthorized, "invalid bearer token")
+		}
+		token := strings.TrimSpace(strings.TrimPrefix(header, bearerPrefix))
+		unauthed(token == "")
+		var user, id ID
+		var scopesBs []byte
+		var expiresOn, lastUsedOn *time.Time
+		row := users.Primary().QueryRow(`SELECT user, id, scopes, expiresOn, lastUsedOn FROM tokens WHERE hash=?`, HashToken(token))
+		err := row.Scan(&user, &id, &scopesBs, &expiresOn, &lastUsedOn)
+		unauthed(err == isql.ErrNoRows)
+		PanicOn(err)
+		unauthed(expiresOn != nil && expiresOn.Before(tlbx.Start()))
+		scopes := []string{}
+		json.MustUnmarshal(scopesBs, &scopes)
+		path := StrLower(tlbx.Req().URL.Path)
+		app.ReturnIf(!InScope(scopes, path), http.StatusForbidden, "bearer token is not scoped for %s", path)
+		if lastUsedOn == nil || tlbx.Start().Sub(*lastUsedOn) > time.Minute {
+			_, err = users.Primary().Exec(`UPDATE tokens SET lastUsedOn=? WHERE user=? AND id=?`, tlbx.Start(), user, id)
+			PanicOn(err)
+		}
+		ses := &ses{
+			isAuthed: true,
+			id:       user,
+		}
+		bs, err := ses.MarshalBinary()
+		PanicOn(err)
+		session.SetBearer(tlbx, bs)
+	}
+}
+
+// HashToken returns the value stored in place of a bearer token, tokens are
+// long random strings so a fast hash is sufficient.
+func HashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// InScope returns true if path is allowed by scopes, scopes are endpoint
+// path prefixes e.g. "/user/me" or "/list" and no scopes allows every path.
+// Only api paths are checked and mdo is always allowed as each of its sub
+// requests is checked individually.
+func InScope(scopes []string, path string) bool {
+	path = StrLower(path)
+	if len(scopes) == 0 || !strings.HasPrefix(path, app.ApiPathPrefixSegment) {
+		return true
+	}
+	path = strings.TrimPrefix(path, app.ApiPathPrefix)
+	if path == "/mdo" || path == "/mdoseq" {
+		return true
+	}
+	for _, scope := range scopes {
+		scope = strings.TrimSuffix(StrLower(scope), "/")
+		if path == scope || strings.HasPrefix(path, scope+"/") {
+			return true
+		}
+	}
+	return false
+}
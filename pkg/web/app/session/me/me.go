@@ -92,5 +92,5 @@ func AuthedSet(tlbx app.Tlbx, me ID) {
 	}
 	bs, err := ses.MarshalBinary()
 	PanicOn(err)
-	session.Get(tlbx).Set(bs)
+	session.SetOwned(tlbx, me, bs)
 }
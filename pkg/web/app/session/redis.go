@@ -0,0 +1,389 @@
+package session
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/crypt"
+	"github.com/0xor1/tlbx/pkg/iredis"
+	"github.com/0xor1/tlbx/pkg/web/app"
+	"github.com/0xor1/tlbx/pkg/web/server/realip"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	idLen          = 32
+	sessionPrefix  = "session:"
+	sessionsPrefix = "sessions:"
+)
+
+const (
+	// CookieStore holds sessions entirely in the encrypted cookie, they
+	// can't be listed or revoked
+	CookieStore = "cookie"
+	// RedisStore holds sessions in redis so they can be listed and revoked
+	RedisStore = "redis"
+)
+
+// StoreMware returns RedisMware using pool if store is RedisStore or the
+// cookie store Mware if it is CookieStore.
+func StoreMware(store string, pool iredis.Pool, configs ...func(*Config)) func(app.Tlbx) {
+	switch store {
+	case RedisStore:
+		return RedisMware(pool, configs...)
+	case CookieStore:
+		return Mware(configs...)
+	}
+	PanicIf(true, "unknown session store %q", store)
+	return nil
+}
+
+// RedisMware stores session values server side in redis, the cookie only
+// holds an opaque session id, this allows sessions to be listed and revoked.
+func RedisMware(pool iredis.Pool, configs ...func(*Config)) func(app.Tlbx) {
+	PanicIf(pool == nil, "pool is required")
+	c := config(configs...)
+	c.validate()
+	return func(tlbx app.Tlbx) {
+		s := &redisSession{
+			tlbx: tlbx,
+			c:    c,
+			pool: pool,
+			mtx:  &sync.RWMutex{},
+		}
+		cookie, err := tlbx.Req().Cookie(c.Name)
+		if err == nil && len(cookie.Value) == idLen {
+			tlbx.Log().ErrorOn(s.load(cookie.Value))
+		}
+		tlbx.Set(tlbxKey{}, s)
+	}
+}
+
+// Info describes a stored session
+type Info struct {
+	ID         string
+	Device     string
+	IP         string
+	CreatedOn  time.Time
+	LastSeenOn time.Time
+	IsCurrent  bool
+}
+
+// IsRevocable returns true if sessions are stored server side and
+// so can be listed and revoked.
+func IsRevocable(tlbx app.Tlbx) bool {
+	_, ok := Get(tlbx).(*redisSession)
+	return ok
+}
+
+// SetOwned sets the session value and records owner against it so it can
+// be listed and revoked, the session id is rotated to prevent fixation and
+// the session lifetime restarts.
+func SetOwned(tlbx app.Tlbx, owner ID, v []byte) {
+	switch s := Get(tlbx).(type) {
+	case *redisSession:
+		s.setOwned(owner, v)
+	case *session:
+		s.setOwned(v)
+	default:
+		s.Set(v)
+	}
+}
+
+// List returns all the active sessions of owner, most recently seen first.
+func List(tlbx app.Tlbx, owner ID) []*Info {
+	s, ok := Get(tlbx).(*redisSession)
+	app.BadReqIf(!ok, "sessions are not stored server side")
+	cnn := s.pool.Get()
+	defer cnn.Close()
+	ids := s.ownerIDs(cnn, owner)
+	res := make([]*Info, 0, len(ids))
+	for _, id := range ids {
+		vals, err := redis.StringMap(cnn.Do("HGETALL", sessionPrefix+id))
+		PanicOn(err)
+		if len(vals) == 0 {
+			continue
+		}
+		res = append(res, &Info{
+			ID:         id,
+			Device:     vals["device"],
+			IP:         vals["ip"],
+			CreatedOn:  parseUnixMilli(vals["created"]),
+			LastSeenOn: parseUnixMilli(vals["lastSeen"]),
+			IsCurrent:  id == s.ID(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastSeenOn.After(res[j].LastSeenOn)
+	})
+	return res
+}
+
+// Revoke deletes the sessions of owner with the given ids, ids which
+// don't belong to owner are ignored. It is a no op if sessions are not
+// stored server side.
+func Revoke(tlbx app.Tlbx, owner ID, ids ...string) {
+	s, ok := Get(tlbx).(*redisSession)
+	if !ok || len(ids) == 0 {
+		return
+	}
+	cnn := s.pool.Get()
+	defer cnn.Close()
+	owned := map[string]bool{}
+	for _, id := range s.ownerIDs(cnn, owner) {
+		owned[id] = true
+	}
+	isCurrentRevoked := false
+	PanicOn(cnn.Send("MULTI"))
+	for _, id := range ids {
+		if !owned[id] {
+			continue
+		}
+		isCurrentRevoked = isCurrentRevoked || id == s.ID()
+		PanicOn(cnn.Send("DEL", sessionPrefix+id))
+		PanicOn(cnn.Send("ZREM", sessionsPrefix+owner.String(), id))
+	}
+	_, err := cnn.Do("EXEC")
+	PanicOn(err)
+	if isCurrentRevoked {
+		s.clear()
+	}
+}
+
+// RevokeAll deletes all the sessions of owner, if exceptCurrent is true
+// the session making the request is kept. It is a no op if sessions are
+// not stored server side.
+func RevokeAll(tlbx app.Tlbx, owner ID, exceptCurrent bool) {
+	s, ok := Get(tlbx).(*redisSession)
+	if !ok {
+		return
+	}
+	cnn := s.pool.Get()
+	defer cnn.Close()
+	ids := s.ownerIDs(cnn, owner)
+	if exceptCurrent {
+		for i, id := range ids {
+			if id == s.ID() {
+				ids = append(ids[:i], ids[i+1:]...)
+				break
+			}
+		}
+	}
+	Revoke(tlbx, owner, ids...)
+}
+
+type redisSession struct {
+	tlbx     app.Tlbx
+	c        *Config
+	pool     iredis.Pool
+	id       string
+	owner    *ID
+	v        []byte
+	created  time.Time
+	lastSeen time.Time
+	mtx      *sync.RWMutex
+}
+
+func (s *redisSession) ID() string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.id
+}
+
+func (s *redisSession) Exists() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return len(s.v) > 0
+}
+
+func (s *redisSession) Get() []byte {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.v
+}
+
+func (s *redisSession) Set(v []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.save(v)
+}
+
+func (s *redisSession) setOwned(owner ID, v []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	oldID, oldOwner := s.id, s.owner
+	s.id = ""
+	s.owner = &owner
+	s.save(v)
+	if oldID != "" {
+		s.del(oldID, oldOwner)
+	}
+}
+
+func (s *redisSession) Del() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.id != "" {
+		s.del(s.id, s.owner)
+	}
+	s.clearLocked()
+}
+
+func (s *redisSession) del(id string, owner *ID) {
+	cnn := s.pool.Get()
+	defer cnn.Close()
+	PanicOn(cnn.Send("MULTI"))
+	PanicOn(cnn.Send("DEL", sessionPrefix+id))
+	if owner != nil {
+		PanicOn(cnn.Send("ZREM", sessionsPrefix+owner.String(), id))
+	}
+	_, err := cnn.Do("EXEC")
+	PanicOn(err)
+}
+
+func (s *redisSession) clear() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.clearLocked()
+}
+
+func (s *redisSession) clearLocked() {
+	s.id = ""
+	s.owner = nil
+	s.v = nil
+	s.setCookie("", -1)
+}
+
+// save must be called with mtx locked
+func (s *redisSession) save(v []byte) {
+	now := NowMilli()
+	isNew := s.id == ""
+	if isNew {
+		s.id = crypt.UrlSafeString(idLen)
+		s.created = now
+		s.setCookie(s.id, s.c.MaxAge)
+	}
+	s.v = v
+	s.lastSeen = now
+	key := sessionPrefix + s.id
+	args := redis.Args{
+		key,
+		"v", v,
+		"device", s.tlbx.Req().UserAgent(),
+		"ip", realip.RealIP(s.tlbx.Req()),
+		"lastSeen", unixMilli(now),
+	}
+	if isNew {
+		args = args.Add("created", unixMilli(now))
+	}
+	if s.owner != nil {
+		args = args.Add("owner", s.owner.String())
+	}
+	cnn := s.pool.Get()
+	defer cnn.Close()
+	PanicOn(cnn.Send("MULTI"))
+	PanicOn(cnn.Send("HSET", args...))
+	s.sendExpire(cnn)
+	_, err := cnn.Do("EXEC")
+	PanicOn(err)
+}
+
+// sendExpire queues the expiry updates for the session and its owners set,
+// it must be called inside a MULTI.
+func (s *redisSession) sendExpire(cnn iredis.Conn) {
+	expiresOn := s.c.expiresOn(s.created, s.lastSeen)
+	if s.owner == nil && s.lastSeen.Equal(s.created) {
+		// anonymous sessions only get the idle timeout once they're reused
+		if anon := s.created.Add(s.c.AnonTimeout); anon.Before(expiresOn) {
+			expiresOn = anon
+		}
+	}
+	PanicOn(cnn.Send("PEXPIREAT", sessionPrefix+s.id, unixMilli(expiresOn)))
+	if s.owner != nil {
+		// no session can outlive its last use plus the idle timeout
+		PanicOn(cnn.Send("ZADD", sessionsPrefix+s.owner.String(), expiresOn.UnixNano(), s.id))
+		PanicOn(cnn.Send("PEXPIRE", sessionsPrefix+s.owner.String(), s.c.IdleTimeout.Milliseconds()))
+	}
+}
+
+func (s *redisSession) load(id string) error {
+	cnn := s.pool.Get()
+	defer cnn.Close()
+	vals, err := redis.StringMap(cnn.Do("HGETALL", sessionPrefix+id))
+	if err != nil || len(vals) == 0 {
+		// expired or revoked, a new id is issued on the next Set
+		return err
+	}
+	var owner *ID
+	if vals["owner"] != "" {
+		o, err := ParseID(vals["owner"])
+		if err != nil {
+			return err
+		}
+		owner = &o
+	}
+	created := parseUnixMilli(vals["created"])
+	lastSeen := parseUnixMilli(vals["lastSeen"])
+	now := NowMilli()
+	if s.c.isExpired(created, lastSeen, now) {
+		// past its lifetime, remove it and carry on anonymously
+		s.del(id, owner)
+		return nil
+	}
+	s.id = id
+	s.owner = owner
+	s.v = []byte(vals["v"])
+	s.created = created
+	s.lastSeen = lastSeen
+	if now.Sub(s.lastSeen) < s.c.TouchInterval {
+		return nil
+	}
+	s.lastSeen = now
+	PanicOn(cnn.Send("MULTI"))
+	PanicOn(cnn.Send("HSET", sessionPrefix+id, "lastSeen", unixMilli(now), "ip", realip.RealIP(s.tlbx.Req())))
+	s.sendExpire(cnn)
+	_, err = cnn.Do("EXEC")
+	return err
+}
+
+func (s *redisSession) ownerIDs(cnn iredis.Conn, owner ID) []string {
+	key := sessionsPrefix + owner.String()
+	_, err := cnn.Do("ZREMRANGEBYSCORE", key, "-inf", NowUnixNano())
+	PanicOn(err)
+	ids, err := redis.Strings(cnn.Do("ZRANGE", key, 0, -1))
+	PanicOn(err)
+	return ids
+}
+
+func (s *redisSession) setCookie(value string, maxAge int) {
+	http.SetCookie(s.tlbx.Resp(), &http.Cookie{
+		Name:     s.c.Name,
+		Value:    value,
+		Path:     s.c.Path,
+		Domain:   s.c.Domain,
+		MaxAge:   maxAge,
+		Secure:   s.c.Secure,
+		HttpOnly: s.c.HttpOnly,
+		SameSite: s.c.SameSite,
+	})
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func parseUnixMilli(str string) time.Time {
+	milli, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return fromUnixMilli(milli)
+}
+
+func fromUnixMilli(milli int64) time.Time {
+	return time.Unix(0, milli*int64(time.Millisecond)).UTC()
+}
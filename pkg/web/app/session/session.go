@@ -3,6 +3,7 @@ package session
 import (
 	"net/http"
 	"sync"
+	"time"
 
 	. "github.com/0xor1/tlbx/pkg/core"
 	"github.com/0xor1/tlbx/pkg/web/app"
@@ -21,6 +22,7 @@ func BasicMware(authKey64s, encrKey32s [][]byte, secure bool) func(app.Tlbx) {
 
 func Mware(configs ...func(*Config)) func(app.Tlbx) {
 	c := config(configs...)
+	c.validate()
 	AuthEncrKeyPairs := make([][]byte, 0, len(c.AuthKey64s)*2)
 	for i := range c.AuthKey64s {
 		PanicIf(len(c.AuthKey64s[i]) != 64, "authKey64s length is not 64")
@@ -28,6 +30,9 @@ func Mware(configs ...func(*Config)) func(app.Tlbx) {
 		AuthEncrKeyPairs = append(AuthEncrKeyPairs, c.AuthKey64s[i], c.EncrKey32s[i])
 	}
 	store := sessions.NewCookieStore(AuthEncrKeyPairs...)
+	// the cookie signature must be valid for the whole session lifetime,
+	// this also sets Options.MaxAge so it's overridden below
+	store.MaxAge(int(c.Lifetime.Seconds()))
 	store.Options.Path = c.Path
 	store.Options.Domain = c.Domain
 	store.Options.MaxAge = c.MaxAge
@@ -40,14 +45,12 @@ func Mware(configs ...func(*Config)) func(app.Tlbx) {
 		PanicIf(gorilla == nil, "nil gorilla session object")
 		s := &session{
 			tlbx:    tlbx,
+			c:       c,
 			gorilla: gorilla,
 			mtx:     &sync.RWMutex{},
 		}
 		if !s.gorilla.IsNew {
-			i, ok := s.gorilla.Values["v"]
-			if ok {
-				s.v = i.([]byte)
-			}
+			s.load()
 		}
 		tlbx.Set(tlbxKey{}, s)
 	}
@@ -67,6 +70,37 @@ type Config struct {
 	Secure     bool
 	HttpOnly   bool
 	SameSite   http.SameSite
+	// IdleTimeout is how long a session lasts without being used
+	IdleTimeout time.Duration
+	// Lifetime is how long a session lasts from login however much it's used
+	Lifetime time.Duration
+	// TouchInterval is the min time between writes of a sessions last seen
+	// time so the cookie / store isn't rewritten on every request
+	TouchInterval time.Duration
+	// AnonTimeout is how long a server side anonymous session lasts if it
+	// isn't used again after TouchInterval, so one off anonymous requests
+	// don't fill the store
+	AnonTimeout time.Duration
+}
+
+func (c *Config) validate() {
+	PanicIf(c.IdleTimeout < time.Minute, "idle timeout must be >= 1 minute")
+	PanicIf(c.Lifetime < c.IdleTimeout, "lifetime must be >= idle timeout")
+	PanicIf(c.TouchInterval >= c.IdleTimeout, "touch interval must be < idle timeout")
+	PanicIf(c.AnonTimeout <= c.TouchInterval, "anon timeout must be > touch interval")
+}
+
+func (c *Config) expiresOn(created, lastSeen time.Time) time.Time {
+	idle := lastSeen.Add(c.IdleTimeout)
+	absolute := created.Add(c.Lifetime)
+	if idle.Before(absolute) {
+		return idle
+	}
+	return absolute
+}
+
+func (c *Config) isExpired(created, lastSeen, now time.Time) bool {
+	return !now.Before(c.expiresOn(created, lastSeen))
 }
 
 type Session interface {
@@ -78,11 +112,29 @@ type Session interface {
 
 type session struct {
 	tlbx    app.Tlbx
+	c       *Config
 	v       []byte
+	created time.Time
 	gorilla *sessions.Session
 	mtx     *sync.RWMutex
 }
 
+func (s *session) load() {
+	v, _ := s.gorilla.Values["v"].([]byte)
+	created, _ := s.gorilla.Values["created"].(int64)
+	lastSeen, _ := s.gorilla.Values["lastSeen"].(int64)
+	now := NowMilli()
+	if len(v) == 0 || s.c.isExpired(fromUnixMilli(created), fromUnixMilli(lastSeen), now) {
+		// expired sessions are treated as anonymous
+		return
+	}
+	s.v = v
+	s.created = fromUnixMilli(created)
+	if now.Sub(fromUnixMilli(lastSeen)) >= s.c.TouchInterval {
+		s.save()
+	}
+}
+
 func (s *session) Exists() bool {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
@@ -99,10 +151,29 @@ func (s *session) Set(v []byte) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 	s.v = v
+	s.save()
+}
+
+// setOwned restarts the sessions lifetime as it's a new login
+func (s *session) setOwned(v []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.v = v
+	s.created = time.Time{}
+	s.save()
+}
+
+// save must be called with mtx locked
+func (s *session) save() {
+	now := NowMilli()
+	if s.created.IsZero() {
+		s.created = now
+	}
 	s.gorilla.Values = map[interface{}]interface{}{
-		"v": v,
+		"v":        s.v,
+		"created":  unixMilli(s.created),
+		"lastSeen": unixMilli(now),
 	}
-
 	PanicOn(s.gorilla.Save(s.tlbx.Req(), s.tlbx.Resp()))
 }
 
@@ -110,6 +181,7 @@ func (s *session) Del() {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 	s.v = nil
+	s.created = time.Time{}
 	s.gorilla.Options.MaxAge = -1
 	s.gorilla.Values = map[interface{}]interface{}{}
 	PanicOn(s.gorilla.Save(s.tlbx.Req(), s.tlbx.Resp()))
@@ -126,9 +198,61 @@ func config(configs ...func(*Config)) *Config {
 		Secure:     false,
 		HttpOnly:   true,
 		SameSite:   http.SameSiteDefaultMode,
+		// 1 week idle and 30 days absolute
+		IdleTimeout:   7 * 24 * time.Hour,
+		Lifetime:      30 * 24 * time.Hour,
+		TouchInterval: time.Minute,
+		AnonTimeout:   time.Hour,
 	}
 	for _, config := range configs {
 		config(c)
 	}
 	return c
 }
+
+// SetBearer replaces the requests session with one that holds v for this
+// request only, used when a request authenticates with a bearer token
+// rather than a cookie.
+func SetBearer(tlbx app.Tlbx, v []byte) {
+	// bearer tokens can't be sent cross site by browsers
+	app.CSRFExempt(tlbx)
+	tlbx.Set(tlbxKey{}, &bearer{
+		v:   v,
+		mtx: &sync.RWMutex{},
+	})
+}
+
+// IsBearer returns true if the request authenticated with a bearer token.
+func IsBearer(tlbx app.Tlbx) bool {
+	_, ok := Get(tlbx).(*bearer)
+	return ok
+}
+
+type bearer struct {
+	v   []byte
+	mtx *sync.RWMutex
+}
+
+func (s *bearer) Exists() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return len(s.v) > 0
+}
+
+func (s *bearer) Get() []byte {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.v
+}
+
+func (s *bearer) Set(v []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.v = v
+}
+
+func (s *bearer) Del() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.v = nil
+}
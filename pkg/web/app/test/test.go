@@ -4,14 +4,19 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"time"
 
+	"firebase.google.com/go/messaging"
 	. "github.com/0xor1/tlbx/pkg/core"
 	"github.com/0xor1/tlbx/pkg/email"
+	"github.com/0xor1/tlbx/pkg/email/feedback"
+	"github.com/0xor1/tlbx/pkg/email/outbox"
 	"github.com/0xor1/tlbx/pkg/fcm"
 	"github.com/0xor1/tlbx/pkg/iredis"
 	"github.com/0xor1/tlbx/pkg/isql"
 	"github.com/0xor1/tlbx/pkg/log"
+	"github.com/0xor1/tlbx/pkg/oidc"
 	"github.com/0xor1/tlbx/pkg/ptr"
 	"github.com/0xor1/tlbx/pkg/store"
 	"github.com/0xor1/tlbx/pkg/web/app"
@@ -20,8 +25,11 @@ import (
 	"github.com/0xor1/tlbx/pkg/web/app/service"
 	"github.com/0xor1/tlbx/pkg/web/app/service/sql"
 	"github.com/0xor1/tlbx/pkg/web/app/session"
+	"github.com/0xor1/tlbx/pkg/web/app/session/me"
 	"github.com/0xor1/tlbx/pkg/web/app/user"
 	"github.com/0xor1/tlbx/pkg/web/app/user/usereps"
+	"github.com/0xor1/tlbx/pkg/webauthn"
+	"github.com/0xor1/tlbx/pkg/webpush"
 )
 
 const (
@@ -52,6 +60,25 @@ type Rig interface {
 	Data() isql.ReplicaSet
 	Email() email.Client
 	Store() store.Client
+	// passkeys, nil if webauthn isn't configured
+	Authenticator() *webauthn.SoftAuthenticator
+	// local oidc provider, registered with usereps as "fake"
+	OIDC() *oidc.FakeProvider
+	// email outbox dispatcher, it isn't started so tests
+	// must call DispatchOne to send queued emails, the
+	// outbox is shared with other tests so don't Dispatch
+	Outbox() *outbox.Dispatcher
+	// every email sent through Email()
+	Mailbox() *email.CaptureClient
+	// local fcm backend, records every push and can be
+	// scripted to fail sends to specific tokens
+	FCM() *fcm.Fake
+	// returns the pushes sent to token once there are at least n,
+	// panics if they aren't sent within a few seconds
+	Pushes(token string, n int) []*messaging.MulticastMessage
+	// dispatches emails queued for sendTo and returns the latest one
+	// sent to it, panics if none is sent within a few seconds
+	LatestEmail(sendTo string) *email.Msg
 	// cleanup
 	CleanUp()
 }
@@ -89,6 +116,7 @@ func (u *testUser) Pwd() string {
 type rig struct {
 	rootHandler     http.HandlerFunc
 	unique          int
+	remoteAddr      string
 	preRegisterHook func(Rig, *user.Register)
 	ali             *testUser
 	bob             *testUser
@@ -102,7 +130,12 @@ type rig struct {
 	data            isql.ReplicaSet
 	email           email.Client
 	store           store.Client
-	fcm             fcm.Client
+	fcm             *fcm.Fake
+	webPush         webpush.Client
+	authenticator   *webauthn.SoftAuthenticator
+	oidc            *oidc.FakeProvider
+	outbox          *outbox.Dispatcher
+	mailbox         *email.CaptureClient
 	useAuth         bool
 }
 
@@ -166,18 +199,103 @@ func (r *rig) Store() store.Client {
 	return r.store
 }
 
-func (r *rig) FCM() fcm.Client {
+func (r *rig) FCM() *fcm.Fake {
 	return r.fcm
 }
 
+func (r *rig) WebPush() webpush.Client {
+	return r.webPush
+}
+
+func (r *rig) Authenticator() *webauthn.SoftAuthenticator {
+	return r.authenticator
+}
+
+func (r *rig) OIDC() *oidc.FakeProvider {
+	return r.oidc
+}
+
+func (r *rig) Outbox() *outbox.Dispatcher {
+	return r.outbox
+}
+
+func (r *rig) Mailbox() *email.CaptureClient {
+	return r.mailbox
+}
+
+func (r *rig) LatestEmail(sendTo string) *email.Msg {
+	deadline := Now().Add(5 * time.Second)
+	for {
+		// the outbox is shared by every test using the db, so
+		// only dispatch emails queued for sendTo
+		rows, err := r.user.Primary().Query(`SELECT id FROM emailOutbox WHERE status=? AND JSON_CONTAINS(sendTo, JSON_QUOTE(?))`, outbox.StatusPending, sendTo)
+		PanicOn(err)
+		ids := IDs{}
+		for rows.Next() {
+			id := ID{}
+			PanicOn(rows.Scan(&id))
+			ids = append(ids, id)
+		}
+		PanicOn(rows.Close())
+		for _, id := range ids {
+			_, err = r.outbox.DispatchOne(id)
+			PanicOn(err)
+		}
+		if m := r.mailbox.Latest(sendTo); m != nil {
+			return m
+		}
+		PanicIf(Now().After(deadline), "no email sent to %s", sendTo)
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (r *rig) Pushes(token string, n int) []*messaging.MulticastMessage {
+	deadline := Now().Add(5 * time.Second)
+	for {
+		if msgs := r.fcm.Msgs(token); len(msgs) >= n {
+			return msgs
+		}
+		PanicIf(Now().After(deadline), "fewer than %d pushes sent to %s", n, token)
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
 func (r *rig) NewClient() *app.Client {
 	return app.NewClient(baseHref, r)
 }
 
+var redirectHeaders = []string{
+	"Range",
+	"If-Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
 func (r *rig) Do(req *http.Request) (*http.Response, error) {
+	if req.RemoteAddr == "" {
+		req.RemoteAddr = r.remoteAddr
+	}
 	rec := httptest.NewRecorder()
 	r.rootHandler(rec, req)
-	return rec.Result(), nil
+	res := rec.Result()
+	if res.StatusCode == http.StatusSeeOther {
+		// DownStream redirects point at the store, so follow them for real
+		redirect, err := http.NewRequest(http.MethodGet, res.Header.Get("Location"), nil)
+		if err != nil {
+			return nil, err
+		}
+		// only forward the headers the store needs, auth headers must
+		// not leak to it and break presigned urls
+		for _, name := range redirectHeaders {
+			if v := req.Header.Get(name); v != "" {
+				redirect.Header.Set(name, v)
+			}
+		}
+		return http.DefaultClient.Do(redirect)
+	}
+	return res, nil
 }
 
 func NewNoRig(
@@ -227,6 +345,9 @@ func NewMeRig(
 		buckets...)
 }
 
+// rigCount keeps users unique between rigs in the same process
+var rigCount int32
+
 func NewRig(
 	config *config.Config,
 	eps []*app.Endpoint,
@@ -242,19 +363,34 @@ func NewRig(
 	buckets ...string,
 ) Rig {
 	r := &rig{
-		unique:          os.Getpid(),
+		unique:          os.Getpid()*100 + int(atomic.AddInt32(&rigCount, 1)),
 		preRegisterHook: preRegisterHook,
 		log:             config.Log,
 		rateLimit:       config.Redis.RateLimit,
 		cache:           config.Redis.Cache,
-		email:           config.Email,
+		mailbox:         email.NewCaptureClient(config.Email),
 		store:           config.Store,
-		fcm:             config.FCM,
+		fcm:             fcm.NewFake(),
+		webPush:         config.WebPush,
 		user:            config.SQL.User,
 		pwd:             config.SQL.Pwd,
 		data:            config.SQL.Data,
 		useAuth:         useUsers,
 	}
+	// each rig gets its own ip so per ip rate limits and guards aren't
+	// shared with other rigs running against the same redis
+	r.remoteAddr = Strf("10.%d.%d.%d:1234", r.unique>>16&255, r.unique>>8&255, r.unique&255)
+	// suppression wraps the mailbox so it only captures emails which
+	// would really be sent
+	r.email = r.mailbox
+	if config.EmailSuppress {
+		r.email = feedback.NewSuppressingClient(r.mailbox, r.user)
+	}
+	r.outbox = outbox.NewDispatcher(r.user, r.email, r.log, config.EmailOutbox)
+
+	if wa := config.App.WebAuthn; wa != nil && len(wa.Origins) > 0 {
+		r.authenticator = webauthn.NewSoftAuthenticator(wa.RPID, wa.Origins[0])
+	}
 
 	for _, bucket := range buckets {
 		r.store.MustCreateBucket(bucket, "private")
@@ -262,6 +398,8 @@ func NewRig(
 
 	if useUsers {
 		r.store.MustCreateBucket(usereps.AvatarBucket, "public_read")
+		r.oidc = oidc.NewFakeProvider()
+		oidcProviders := append([]*oidc.Provider{oidc.New(r.oidc.Config("fake"), config.App.OIDCRedirectURL)}, config.App.OIDC...)
 		eps = append(
 			eps,
 			usereps.New(
@@ -274,18 +412,32 @@ func NewRig(
 				onDelete,
 				onSetSocials,
 				validateFcmTopic,
-				enableJin)...)
+				enableJin,
+				func(c *usereps.Config) {
+					c.TOTPIssuer = config.App.TOTP.Issuer
+					c.TOTPEncrKey32s = config.App.TOTP.EncrKey32s
+					c.WebAuthn = config.App.WebAuthn
+					c.OIDCProviders = oidcProviders
+					c.PwdCheck = config.App.PwdCheck
+					c.EmailTemplates = config.App.EmailTemplates
+				})...)
 	}
 	Go(func() {
 		app.Run(func(c *app.Config) {
 			c.ProvideApiDocs = false
+			c.CSRFSecure = config.Web.Session.Secure
 			c.TlbxSetup = app.TlbxMwares{
-				session.BasicMware(
-					config.Web.Session.AuthKey64s,
-					config.Web.Session.EncrKey32s,
-					config.Web.Session.Secure),
+				session.StoreMware(config.Web.Session.Store, r.cache, func(c *session.Config) {
+					c.AuthKey64s = config.Web.Session.AuthKey64s
+					c.EncrKey32s = config.Web.Session.EncrKey32s
+					c.Secure = config.Web.Session.Secure
+					c.MaxAge = int(config.Web.Session.MaxAge.Seconds())
+					c.IdleTimeout = config.Web.Session.IdleTimeout
+					c.Lifetime = config.Web.Session.Lifetime
+				}),
+				me.BearerMware(r.user),
 				rateLimitMware(r.rateLimit, 1000000),
-				service.Mware(r.cache, r.user, r.pwd, r.data, r.email, r.store, r.fcm),
+				service.Mware(r.cache, r.user, r.pwd, r.data, r.email, r.store, r.fcm, r.webPush),
 			}
 			c.Endpoints = eps
 			c.Serve = func(h http.HandlerFunc) {
@@ -317,7 +469,9 @@ func (r *rig) CleanUp() {
 		(&user.Delete{
 			Pwd: r.Dan().Pwd(),
 		}).MustDo(r.Dan().Client())
+		r.oidc.Close()
 	}
+	r.fcm.Close()
 }
 
 func (r *rig) createUser(handleSuffix, emailSuffix, pwd string) *testUser {
@@ -335,20 +489,16 @@ func (r *rig) createUser(handleSuffix, emailSuffix, pwd string) *testUser {
 		}
 		reg.MustDo(c)
 
-		var me ID
-		var code string
-		row := r.User().Primary().QueryRow(`SELECT id, activateCode FROM users WHERE email=?`, email)
-		PanicOn(row.Scan(&me, &code))
-
+		link := r.LatestEmail(email).LinkQuery()
 		(&user.Activate{
-			Me:   me,
-			Code: code,
+			Me:   MustParseID(link.Get("me")),
+			Code: link.Get("code"),
 		}).MustDo(c)
 
 		id := (&user.Login{
 			Email: email,
 			Pwd:   pwd,
-		}).MustDo(c).ID
+		}).MustDo(c).Me.ID
 
 		return &testUser{
 			client: c,
@@ -0,0 +1,259 @@
+package upload
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/json"
+	"github.com/0xor1/tlbx/pkg/web/app"
+)
+
+type Upload struct {
+	ID        ID      `json:"id"`
+	Kind      string  `json:"kind"`
+	Name      string  `json:"name"`
+	Type      string  `json:"type"`
+	Size      int64   `json:"size"`
+	ChunkSize int64   `json:"chunkSize"`
+	Received  int64   `json:"received"`
+	Missing   []int64 `json:"missing"`
+}
+
+// IsComplete returns true if all chunks have been received and
+// the upload is ready to be finalized.
+func (u *Upload) IsComplete() bool {
+	return len(u.Missing) == 0
+}
+
+type Init struct {
+	Kind string     `json:"kind"`
+	Name string     `json:"name"`
+	Type string     `json:"type"`
+	Size int64      `json:"size"`
+	Args *json.Json `json:"args,omitempty"`
+}
+
+func (_ *Init) Path() string {
+	return "/upload/init"
+}
+
+func (a *Init) Do(c *app.Client) (*Upload, error) {
+	res := &Upload{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *Init) MustDo(c *app.Client) *Upload {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type ChunkArgs struct {
+	ID     ID    `json:"id"`
+	Offset int64 `json:"offset"`
+}
+
+type Chunk struct {
+	ID      ID
+	Offset  int64
+	Size    int64
+	Content io.ReadCloser
+}
+
+func (_ *Chunk) Path() string {
+	return "/upload/chunk"
+}
+
+func (a *Chunk) Do(c *app.Client) (*Upload, error) {
+	stream := &app.UpStream{}
+	stream.Size = a.Size
+	stream.Content = a.Content
+	stream.Type = "application/octet-stream"
+	stream.Args = &ChunkArgs{
+		ID:     a.ID,
+		Offset: a.Offset,
+	}
+	res := &Upload{}
+	err := app.Call(c, a.Path(), stream, &res)
+	return res, err
+}
+
+func (a *Chunk) MustDo(c *app.Client) *Upload {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type Progress struct {
+	ID ID `json:"id"`
+}
+
+func (_ *Progress) Path() string {
+	return "/upload/progress"
+}
+
+func (a *Progress) Do(c *app.Client) (*Upload, error) {
+	res := &Upload{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *Progress) MustDo(c *app.Client) *Upload {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type Finalize struct {
+	ID ID `json:"id"`
+}
+
+func (_ *Finalize) Path() string {
+	return "/upload/finalize"
+}
+
+func (a *Finalize) Do(c *app.Client) (*json.Json, error) {
+	res := &json.Json{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *Finalize) MustDo(c *app.Client) *json.Json {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type Abort struct {
+	ID ID `json:"id"`
+}
+
+func (_ *Abort) Path() string {
+	return "/upload/abort"
+}
+
+func (a *Abort) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), a, nil)
+}
+
+func (a *Abort) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
+
+// Send uploads every chunk still missing from up, so calling it again with
+// the result of Progress resumes an interrupted upload.
+func Send(c *app.Client, up *Upload, content io.ReaderAt) (*Upload, error) {
+	for _, offset := range up.Missing {
+		size := up.ChunkSize
+		if offset+size > up.Size {
+			size = up.Size - offset
+		}
+		bs := make([]byte, size)
+		_, err := content.ReadAt(bs, offset)
+		if err != nil && err != io.EOF {
+			return up, ToError(err)
+		}
+		res, err := (&Chunk{
+			ID:      up.ID,
+			Offset:  offset,
+			Size:    size,
+			Content: ioutil.NopCloser(bytes.NewReader(bs)),
+		}).Do(c)
+		if err != nil {
+			return up, err
+		}
+		up = res
+	}
+	return up, nil
+}
+
+func MustSend(c *app.Client, up *Upload, content io.ReaderAt) *Upload {
+	res, err := Send(c, up, content)
+	PanicOn(err)
+	return res
+}
+
+type Presign struct {
+	Kind string     `json:"kind"`
+	Name string     `json:"name"`
+	Type string     `json:"type"`
+	Size int64      `json:"size"`
+	Args *json.Json `json:"args,omitempty"`
+}
+
+func (_ *Presign) Path() string {
+	return "/upload/presign"
+}
+
+func (a *Presign) Do(c *app.Client) (*Presigned, error) {
+	res := &Presigned{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *Presign) MustDo(c *app.Client) *Presigned {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+// Presigned is a direct to store upload, the content must be PUT
+// to Url with Headers set before calling Confirm.
+type Presigned struct {
+	ID      ID                `json:"id"`
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+type Confirm struct {
+	ID ID `json:"id"`
+}
+
+func (_ *Confirm) Path() string {
+	return "/upload/confirm"
+}
+
+func (a *Confirm) Do(c *app.Client) (*json.Json, error) {
+	res := &json.Json{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *Confirm) MustDo(c *app.Client) *json.Json {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+// Put uploads content directly to the store using a presigned upload.
+func Put(p *Presigned, size int64, content io.Reader) error {
+	req, err := http.NewRequest(http.MethodPut, p.Url, content)
+	if err != nil {
+		return ToError(err)
+	}
+	for name, value := range p.Headers {
+		req.Header.Set(name, value)
+	}
+	req.ContentLength = size
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ToError(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return ToError(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return Err("resp.StatusCode: %d, resp.Body: %s", res.StatusCode, string(body))
+	}
+	return nil
+}
+
+func MustPut(p *Presigned, size int64, content io.Reader) {
+	PanicOn(Put(p, size, content))
+}
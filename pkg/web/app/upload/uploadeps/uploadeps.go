@@ -0,0 +1,537 @@
+package uploadeps
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/json"
+	"github.com/0xor1/tlbx/pkg/store"
+	"github.com/0xor1/tlbx/pkg/web/app"
+	"github.com/0xor1/tlbx/pkg/web/app/service"
+	"github.com/0xor1/tlbx/pkg/web/app/session/me"
+	"github.com/0xor1/tlbx/pkg/web/app/upload"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// s3 requires all but the last part of a multipart upload to be >= 5MB
+	MinChunkSize = 5 * app.MB
+	// s3 allows at most 10000 parts in a multipart upload
+	maxChunks = 10000
+	// s3 allows at most 5GB in a single put
+	maxPresignedSize = 5 * app.GB
+	keyPrefix        = "upload:"
+	sweepKey         = "uploads"
+	metaField        = "meta"
+	claimSuffix      = ":claim"
+	claimTimeout     = time.Minute
+	sweepBatchSize   = 10
+	chunkTimeout     = 20 * time.Second
+)
+
+type Kind struct {
+	Name         string
+	Bucket       string
+	MaxSize      int64
+	IsPublic     bool
+	IsAttachment bool
+	// GetDefaultArgs returns the struct to unmarshal init args into,
+	// return nil if the kind takes no args
+	GetDefaultArgs func() interface{}
+	// OnInit validates the upload and returns the store key to write to
+	OnInit func(tlbx app.Tlbx, up *upload.Upload, args interface{}) string
+	// OnFinalize is called once the object is complete in the store,
+	// its return value is the finalize response
+	OnFinalize func(tlbx app.Tlbx, up *upload.Upload, key string, args interface{}) interface{}
+}
+
+// New returns the resumable and presigned upload endpoints, chunkSize must be
+// >= MinChunkSize and uploads with no activity for expiry are aborted and
+// cleaned up, expiry is also the lifetime of presigned urls.
+func New(chunkSize int64, expiry time.Duration, kinds ...*Kind) []*app.Endpoint {
+	PanicIf(chunkSize < MinChunkSize, "chunkSize must be >= %d", MinChunkSize)
+	PanicIf(expiry < time.Minute, "expiry must be >= 1 minute")
+	PanicIf(len(kinds) == 0, "at least one upload kind is required")
+	kindsMap := make(map[string]*Kind, len(kinds))
+	for _, k := range kinds {
+		PanicIf(k.Name == "", "upload kind missing Name")
+		PanicIf(k.Bucket == "", "upload kind %q missing Bucket", k.Name)
+		PanicIf(k.OnInit == nil, "upload kind %q missing OnInit", k.Name)
+		PanicIf(k.OnFinalize == nil, "upload kind %q missing OnFinalize", k.Name)
+		PanicIf(k.MaxSize > chunkSize*maxChunks, "upload kind %q MaxSize must be <= %d", k.Name, chunkSize*maxChunks)
+		_, exists := kindsMap[k.Name]
+		PanicIf(exists, "duplicate upload kind %q", k.Name)
+		kindsMap[k.Name] = k
+	}
+	ttl := int64(expiry.Seconds())
+	exampleUpload := func() *upload.Upload {
+		return &upload.Upload{
+			ID:        app.ExampleID(),
+			Kind:      kinds[0].Name,
+			Name:      "my_video.mp4",
+			Type:      "video/mp4",
+			Size:      12 * app.MB,
+			ChunkSize: chunkSize,
+			Received:  chunkSize,
+			Missing:   []int64{chunkSize, 2 * chunkSize},
+		}
+	}
+	return []*app.Endpoint{
+		{
+			Description:  "initiate a resumable upload",
+			Path:         (&upload.Init{}).Path(),
+			Timeout:      1000,
+			MaxBodyBytes: 10 * app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &upload.Init{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &upload.Init{
+					Kind: kinds[0].Name,
+					Name: "my_video.mp4",
+					Type: "video/mp4",
+					Size: 12 * app.MB,
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return exampleUpload()
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*upload.Init)
+				m, k := start(tlbx, kindsMap, args, chunkSize)
+				m.UploadID = service.Get(tlbx).Store().MustCreateMultipartUpload(k.Bucket, m.Key, m.Upload.Name, m.Upload.Type, k.IsPublic, k.IsAttachment)
+				set(tlbx, m, ttl, expiry)
+				return progress(m, map[int64]string{})
+			},
+		},
+		{
+			Description:  "upload a chunk of a resumable upload, offset must be a multiple of chunkSize",
+			Path:         (&upload.Chunk{}).Path(),
+			Timeout:      int64(chunkTimeout / time.Millisecond),
+			MaxBodyBytes: chunkSize + app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &app.UpStream{
+					Args: &upload.ChunkArgs{},
+				}
+			},
+			GetExampleArgs: func() interface{} {
+				return &app.UpStream{
+					Args: &upload.ChunkArgs{
+						ID:     app.ExampleID(),
+						Offset: chunkSize,
+					},
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return exampleUpload()
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*app.UpStream)
+				defer args.Content.Close()
+				chunkArgs := args.Args.(*upload.ChunkArgs)
+				m, parts := getUpload(tlbx, chunkArgs.ID)
+				app.BadReqIf(m.IsPresigned, "presigned uploads must be confirmed")
+				app.BadReqIf(m.IsComplete, "upload is already complete")
+				app.BadReqIf(chunkArgs.Offset < 0 || chunkArgs.Offset >= m.Upload.Size, "offset out of range")
+				app.BadReqIf(chunkArgs.Offset%chunkSize != 0, "offset must be a multiple of chunkSize %d", chunkSize)
+				expectedSize := chunkSize
+				if chunkArgs.Offset+expectedSize > m.Upload.Size {
+					expectedSize = m.Upload.Size - chunkArgs.Offset
+				}
+				app.BadReqIf(args.Size != expectedSize, "chunk size must be %d", expectedSize)
+				num := chunkArgs.Offset/chunkSize + 1
+				srv := service.Get(tlbx)
+				etag := srv.Store().MustUploadPart(m.Bucket, m.Key, m.UploadID, num, expectedSize, chunkTimeout, args.Content)
+				idStr := chunkArgs.ID.String()
+				cnn := srv.Cache().Get()
+				defer cnn.Close()
+				PanicOn(cnn.Send("MULTI"))
+				PanicOn(cnn.Send("HSET", keyPrefix+idStr, strconv.FormatInt(num, 10), etag))
+				PanicOn(cnn.Send("EXPIRE", keyPrefix+idStr, ttl*2))
+				PanicOn(cnn.Send("ZADD", sweepKey, "XX", tlbx.Start().Add(expiry).UnixNano(), idStr))
+				_, err := cnn.Do("EXEC")
+				PanicOn(err)
+				parts[num] = etag
+				return progress(m, parts)
+			},
+		},
+		{
+			Description:  "get the progress of a resumable upload",
+			Path:         (&upload.Progress{}).Path(),
+			Timeout:      500,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &upload.Progress{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &upload.Progress{
+					ID: app.ExampleID(),
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return exampleUpload()
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*upload.Progress)
+				return progress(getUpload(tlbx, args.ID))
+			},
+		},
+		{
+			Description:  "finalize a resumable upload once all chunks have been received",
+			Path:         (&upload.Finalize{}).Path(),
+			Timeout:      5000,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &upload.Finalize{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &upload.Finalize{
+					ID: app.ExampleID(),
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return nil
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*upload.Finalize)
+				claim(tlbx, args.ID)
+				defer unclaim(tlbx, args.ID)
+				m, parts := getUpload(tlbx, args.ID)
+				app.BadReqIf(m.IsPresigned, "presigned uploads must be confirmed")
+				up := progress(m, parts)
+				app.BadReqIf(!up.IsComplete(), "upload is missing %d chunks", len(up.Missing))
+				k := kindsMap[m.Upload.Kind]
+				app.ReturnIf(k == nil, http.StatusNotFound, "upload kind no longer exists")
+				if !m.IsComplete {
+					completed := make([]*store.Part, 0, len(parts))
+					for num, etag := range parts {
+						completed = append(completed, &store.Part{
+							Num:  num,
+							ETag: etag,
+						})
+					}
+					sort.Slice(completed, func(i, j int) bool {
+						return completed[i].Num < completed[j].Num
+					})
+					service.Get(tlbx).Store().MustCompleteMultipartUpload(m.Bucket, m.Key, m.UploadID, completed)
+					// record completion so finalize can be retried if
+					// OnFinalize fails
+					m.IsComplete = true
+					setMeta(tlbx, m)
+				}
+				res := k.OnFinalize(tlbx, up, m.Key, getKindArgs(k, m.Args))
+				del(tlbx, args.ID)
+				return res
+			},
+		},
+		{
+			Description:  "abort a resumable upload",
+			Path:         (&upload.Abort{}).Path(),
+			Timeout:      1000,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &upload.Abort{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &upload.Abort{
+					ID: app.ExampleID(),
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return nil
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*upload.Abort)
+				m, _ := getUpload(tlbx, args.ID)
+				PanicOn(cleanUp(tlbx, m))
+				del(tlbx, args.ID)
+				return nil
+			},
+		},
+		{
+			Description:  "initiate a direct to store upload, PUT the content to the returned url with the returned headers then call confirm",
+			Path:         (&upload.Presign{}).Path(),
+			Timeout:      1000,
+			MaxBodyBytes: 10 * app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &upload.Presign{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &upload.Presign{
+					Kind: kinds[0].Name,
+					Name: "my_video.mp4",
+					Type: "video/mp4",
+					Size: 12 * app.MB,
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return &upload.Presigned{
+					ID:  app.ExampleID(),
+					Url: "https://my-bucket.s3.amazonaws.com/my-key?X-Amz-Signature=abc",
+					Headers: map[string]string{
+						"Content-Type":        "video/mp4",
+						"Content-Disposition": "attachment; filename=my_video.mp4",
+					},
+				}
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := upload.Init(*a.(*upload.Presign))
+				app.BadReqIf(args.Size > maxPresignedSize, "size must be <= %d, use a resumable upload", maxPresignedSize)
+				m, k := start(tlbx, kindsMap, &args, args.Size)
+				m.IsPresigned = true
+				url, header := service.Get(tlbx).Store().MustPresignedPutReq(k.Bucket, m.Key, m.Upload.Name, m.Upload.Type, m.Upload.Size, k.IsPublic, k.IsAttachment, expiry)
+				set(tlbx, m, ttl, expiry)
+				res := &upload.Presigned{
+					ID:      m.Upload.ID,
+					Url:     url,
+					Headers: make(map[string]string, len(header)),
+				}
+				for name := range header {
+					res.Headers[name] = header.Get(name)
+				}
+				return res
+			},
+		},
+		{
+			Description:  "confirm a direct to store upload has completed, the stored object must match the presigned name, type and size",
+			Path:         (&upload.Confirm{}).Path(),
+			Timeout:      5000,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &upload.Confirm{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &upload.Confirm{
+					ID: app.ExampleID(),
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return nil
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*upload.Confirm)
+				claim(tlbx, args.ID)
+				defer unclaim(tlbx, args.ID)
+				m, _ := getUpload(tlbx, args.ID)
+				app.BadReqIf(!m.IsPresigned, "chunked uploads must be finalized")
+				k := kindsMap[m.Upload.Kind]
+				app.ReturnIf(k == nil, http.StatusNotFound, "upload kind no longer exists")
+				srv := service.Get(tlbx)
+				_, mimeType, size, err := srv.Store().Head(m.Bucket, m.Key)
+				app.BadReqIf(store.IsNotFound(err), "upload content not received")
+				PanicOn(err)
+				if size != m.Upload.Size || mimeType != m.Upload.Type {
+					// the signed headers should make this impossible but
+					// never trust what landed in the bucket
+					srv.Store().MustDelete(m.Bucket, m.Key)
+					del(tlbx, args.ID)
+					app.BadReqIf(true, "upload content does not match, expected type %q size %d got type %q size %d", m.Upload.Type, m.Upload.Size, mimeType, size)
+				}
+				up := *m.Upload
+				up.Received = size
+				up.Missing = []int64{}
+				res := k.OnFinalize(tlbx, &up, m.Key, getKindArgs(k, m.Args))
+				del(tlbx, args.ID)
+				return res
+			},
+		},
+	}
+}
+
+type meta struct {
+	Me          ID             `json:"me"`
+	Upload      *upload.Upload `json:"upload"`
+	Key         string         `json:"key"`
+	Args        *json.Json     `json:"args"`
+	Bucket      string         `json:"bucket"`
+	UploadID    string         `json:"uploadId"`
+	IsPresigned bool           `json:"isPresigned"`
+	// the multipart upload has been completed but not yet finalized
+	IsComplete bool `json:"isComplete"`
+}
+
+// start validates args, calls the kinds OnInit and returns the
+// new uploads meta, the caller must set UploadID or IsPresigned.
+func start(tlbx app.Tlbx, kindsMap map[string]*Kind, args *upload.Init, chunkSize int64) (*meta, *Kind) {
+	k := kindsMap[args.Kind]
+	app.BadReqIf(k == nil, "unknown upload kind %q", args.Kind)
+	app.BadReqIf(args.Size < 1, "size must be > 0")
+	app.BadReqIf(k.MaxSize > 0 && args.Size > k.MaxSize, "size must be <= %d", k.MaxSize)
+	sweep(tlbx)
+	up := &upload.Upload{
+		ID:        tlbx.NewID(),
+		Kind:      k.Name,
+		Name:      args.Name,
+		Type:      args.Type,
+		Size:      args.Size,
+		ChunkSize: chunkSize,
+	}
+	key := k.OnInit(tlbx, up, getKindArgs(k, args.Args))
+	return &meta{
+		Me:     me.Get(tlbx).ID(),
+		Upload: up,
+		Key:    key,
+		Args:   args.Args,
+		Bucket: k.Bucket,
+	}, k
+}
+
+func set(tlbx app.Tlbx, m *meta, ttl int64, expiry time.Duration) {
+	id := m.Upload.ID.String()
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	PanicOn(cnn.Send("MULTI"))
+	PanicOn(cnn.Send("HSET", keyPrefix+id, metaField, json.MustMarshal(m)))
+	PanicOn(cnn.Send("EXPIRE", keyPrefix+id, ttl*2))
+	PanicOn(cnn.Send("ZADD", sweepKey, tlbx.Start().Add(expiry).UnixNano(), id))
+	_, err := cnn.Do("EXEC")
+	PanicOn(err)
+}
+
+// setMeta updates an existing uploads meta without extending its expiry.
+func setMeta(tlbx app.Tlbx, m *meta) {
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	_, err := cnn.Do("HSET", keyPrefix+m.Upload.ID.String(), metaField, json.MustMarshal(m))
+	PanicOn(err)
+}
+
+// claim stops concurrent finalize or confirm calls for the same upload both
+// completing it, the upload must be read after claiming so the winner sees
+// the latest meta and losers get a 409.
+func claim(tlbx app.Tlbx, id ID) {
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	res, err := cnn.Do("SET", keyPrefix+id.String()+claimSuffix, 1, "NX", "PX", claimTimeout.Milliseconds())
+	PanicOn(err)
+	app.ReturnIf(res == nil, http.StatusConflict, "upload is already being finalized")
+}
+
+func unclaim(tlbx app.Tlbx, id ID) {
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	_, err := cnn.Do("DEL", keyPrefix+id.String()+claimSuffix)
+	PanicOn(err)
+}
+
+// cleanUp removes any partial, unconfirmed or unfinalized content from the
+// store
+func cleanUp(tlbx app.Tlbx, m *meta) error {
+	if m.IsPresigned || m.IsComplete {
+		return service.Get(tlbx).Store().Delete(m.Bucket, m.Key)
+	}
+	return service.Get(tlbx).Store().AbortMultipartUpload(m.Bucket, m.Key, m.UploadID)
+}
+
+func getKindArgs(k *Kind, js *json.Json) interface{} {
+	if k.GetDefaultArgs == nil {
+		return nil
+	}
+	kindArgs := k.GetDefaultArgs()
+	if js != nil {
+		d := json.NewDecoder(bytes.NewReader(json.MustMarshal(js)))
+		d.DisallowUnknownFields()
+		err := d.Decode(kindArgs)
+		app.BadReqIf(err != nil, "error unmarshalling args json: %s", err)
+	}
+	return kindArgs
+}
+
+func getUpload(tlbx app.Tlbx, id ID) (*meta, map[int64]string) {
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	vals, err := redis.StringMap(cnn.Do("HGETALL", keyPrefix+id.String()))
+	PanicOn(err)
+	metaStr, exists := vals[metaField]
+	app.ReturnIf(!exists, http.StatusNotFound, "upload not found")
+	m := &meta{}
+	json.MustUnmarshal([]byte(metaStr), m)
+	app.ReturnIf(!m.Me.Equal(me.Get(tlbx).ID()), http.StatusNotFound, "upload not found")
+	parts := make(map[int64]string, len(vals)-1)
+	for field, etag := range vals {
+		if field == metaField {
+			continue
+		}
+		num, err := strconv.ParseInt(field, 10, 64)
+		PanicOn(err)
+		parts[num] = etag
+	}
+	return m, parts
+}
+
+func progress(m *meta, parts map[int64]string) *upload.Upload {
+	up := *m.Upload
+	up.Received = 0
+	up.Missing = []int64{}
+	for offset := int64(0); offset < up.Size; offset += up.ChunkSize {
+		if _, exists := parts[offset/up.ChunkSize+1]; exists {
+			if offset+up.ChunkSize > up.Size {
+				up.Received += up.Size - offset
+			} else {
+				up.Received += up.ChunkSize
+			}
+		} else {
+			up.Missing = append(up.Missing, offset)
+		}
+	}
+	return &up
+}
+
+func del(tlbx app.Tlbx, id ID) {
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	PanicOn(cnn.Send("MULTI"))
+	PanicOn(cnn.Send("DEL", keyPrefix+id.String()))
+	PanicOn(cnn.Send("ZREM", sweepKey, id.String()))
+	_, err := cnn.Do("EXEC")
+	PanicOn(err)
+}
+
+// sweep aborts a batch of uploads which have had no activity within expiry,
+// it is called on each init so abandoned uploads are cleaned up at roughly
+// the rate new ones are created. Errors are logged rather than failing the
+// request that happened to trigger the sweep.
+func sweep(tlbx app.Tlbx) {
+	srv := service.Get(tlbx)
+	cnn := srv.Cache().Get()
+	defer cnn.Close()
+	ids, err := redis.Strings(cnn.Do("ZRANGEBYSCORE", sweepKey, "-inf", tlbx.Start().UnixNano(), "LIMIT", 0, sweepBatchSize))
+	if err != nil {
+		tlbx.Log().ErrorOn(err)
+		return
+	}
+	for _, id := range ids {
+		// only the request that removes the id from the set aborts the upload
+		removed, err := redis.Int(cnn.Do("ZREM", sweepKey, id))
+		if err != nil || removed == 0 {
+			tlbx.Log().ErrorOn(err)
+			continue
+		}
+		metaStr, err := redis.Bytes(cnn.Do("HGET", keyPrefix+id, metaField))
+		if err != nil {
+			if err != redis.ErrNil {
+				tlbx.Log().ErrorOn(err)
+			}
+			continue
+		}
+		m := &meta{}
+		if err := json.Unmarshal(metaStr, m); err != nil {
+			tlbx.Log().ErrorOn(err)
+			continue
+		}
+		tlbx.Log().ErrorOn(cleanUp(tlbx, m))
+		_, err = cnn.Do("DEL", keyPrefix+id)
+		tlbx.Log().ErrorOn(err)
+	}
+}
@@ -0,0 +1,232 @@
+package uploadeps_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/crypt"
+	"github.com/0xor1/tlbx/pkg/json"
+	"github.com/0xor1/tlbx/pkg/store"
+	"github.com/0xor1/tlbx/pkg/web/app"
+	"github.com/0xor1/tlbx/pkg/web/app/config"
+	"github.com/0xor1/tlbx/pkg/web/app/service"
+	"github.com/0xor1/tlbx/pkg/web/app/test"
+	"github.com/0xor1/tlbx/pkg/web/app/upload"
+	"github.com/0xor1/tlbx/pkg/web/app/upload/uploadeps"
+	"github.com/stretchr/testify/assert"
+)
+
+const bucket = "uploads"
+
+type fileArgs struct {
+	Folder string `json:"folder"`
+}
+
+func TestEverything(t *testing.T) {
+	a := assert.New(t)
+	failFinalize := false
+	var onFinalize func()
+	r := test.NewNoRig(
+		config.GetProcessed(config.GetBase()),
+		append(uploadeps.New(
+			uploadeps.MinChunkSize,
+			time.Hour,
+			&uploadeps.Kind{
+				Name:    "file",
+				Bucket:  bucket,
+				MaxSize: 20 * app.MB,
+				GetDefaultArgs: func() interface{} {
+					return &fileArgs{}
+				},
+				OnInit: func(tlbx app.Tlbx, up *upload.Upload, args interface{}) string {
+					app.BadReqIf(args.(*fileArgs).Folder == "", "folder required")
+					return store.Key("", up.ID)
+				},
+				OnFinalize: func(tlbx app.Tlbx, up *upload.Upload, key string, args interface{}) interface{} {
+					if onFinalize != nil {
+						onFinalize()
+					}
+					if failFinalize {
+						failFinalize = false
+						app.BadReqIf(true, "finalize failed")
+					}
+					name, _, size, content := service.Get(tlbx).Store().MustGet(bucket, key)
+					content.Close()
+					return map[string]interface{}{
+						"folder": args.(*fileArgs).Folder,
+						"name":   name,
+						"size":   size,
+					}
+				},
+			}),
+			&app.Endpoint{
+				Description:  "download",
+				Path:         "/test/download",
+				Timeout:      500,
+				MaxBodyBytes: app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return &upload.Confirm{}
+				},
+				GetExampleArgs: func() interface{} {
+					return &upload.Confirm{}
+				},
+				GetExampleResponse: func() interface{} {
+					return &app.DownStream{}
+				},
+				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+					id := a.(*upload.Confirm).ID
+					return &app.DownStream{
+						Redirect: service.Get(tlbx).Store().MustPresignedGetUrl(bucket, store.Key("", id), "test.txt", true),
+					}
+				},
+			}),
+		bucket)
+	defer r.CleanUp()
+
+	c := r.NewClient()
+	size := 2*uploadeps.MinChunkSize + 123
+	content := crypt.Bytes(int(size))
+
+	_, err := (&upload.Init{
+		Kind: "file",
+		Name: "test.bin",
+		Type: "application/octet-stream",
+		Size: size,
+	}).Do(c)
+	a.Equal(&app.ErrMsg{Status: 400, Msg: "folder required"}, err)
+
+	up := (&upload.Init{
+		Kind: "file",
+		Name: "test.bin",
+		Type: "application/octet-stream",
+		Size: size,
+		Args: json.MustFromString(`{"folder":"a"}`),
+	}).MustDo(c)
+	a.Equal(int64(0), up.Received)
+	a.Equal([]int64{0, uploadeps.MinChunkSize, 2 * uploadeps.MinChunkSize}, up.Missing)
+
+	// upload the last chunk first to simulate an interrupted upload
+	up = (&upload.Chunk{
+		ID:      up.ID,
+		Offset:  2 * uploadeps.MinChunkSize,
+		Size:    123,
+		Content: ioutil.NopCloser(bytes.NewReader(content[2*uploadeps.MinChunkSize:])),
+	}).MustDo(c)
+	a.Equal(int64(123), up.Received)
+	a.Equal(2, len(up.Missing))
+
+	_, err = (&upload.Finalize{ID: up.ID}).Do(c)
+	a.Equal(&app.ErrMsg{Status: 400, Msg: "upload is missing 2 chunks"}, err)
+
+	// resume from the progress endpoint
+	up = (&upload.Progress{ID: up.ID}).MustDo(c)
+	up = upload.MustSend(c, up, bytes.NewReader(content))
+	a.True(up.IsComplete())
+	a.Equal(size, up.Received)
+
+	// other sessions can't see this upload
+	_, err = (&upload.Progress{ID: up.ID}).Do(r.NewClient())
+	a.Equal(&app.ErrMsg{Status: 404, Msg: "upload not found"}, err)
+
+	res := (&upload.Finalize{ID: up.ID}).MustDo(c)
+	a.Equal("a", res.MustString("folder"))
+	a.Equal(size, res.MustInt64("size"))
+	PanicOn(r.Store().Delete(bucket, store.Key("", up.ID)))
+
+	_, err = (&upload.Progress{ID: up.ID}).Do(c)
+	a.Equal(&app.ErrMsg{Status: 404, Msg: "upload not found"}, err)
+
+	// a failed OnFinalize leaves the upload to be finalized again
+	up = (&upload.Init{
+		Kind: "file",
+		Name: "test.bin",
+		Size: 123,
+		Args: json.MustFromString(`{"folder":"a"}`),
+	}).MustDo(c)
+	up = upload.MustSend(c, up, bytes.NewReader(content[:123]))
+	failFinalize = true
+	_, err = (&upload.Finalize{ID: up.ID}).Do(c)
+	a.Equal(&app.ErrMsg{Status: 400, Msg: "finalize failed"}, err)
+	a.True((&upload.Progress{ID: up.ID}).MustDo(c).IsComplete())
+	res = (&upload.Finalize{ID: up.ID}).MustDo(c)
+	a.Equal(int64(123), res.MustInt64("size"))
+	PanicOn(r.Store().Delete(bucket, store.Key("", up.ID)))
+
+	// concurrent finalizes only finalize once, the loser gets a 409
+	up = (&upload.Init{
+		Kind: "file",
+		Name: "test.bin",
+		Size: 123,
+		Args: json.MustFromString(`{"folder":"a"}`),
+	}).MustDo(c)
+	up = upload.MustSend(c, up, bytes.NewReader(content[:123]))
+	entered, release := make(chan bool), make(chan bool)
+	onFinalize = func() {
+		entered <- true
+		<-release
+	}
+	finalized := make(chan error)
+	go func() {
+		_, err := (&upload.Finalize{ID: up.ID}).Do(c)
+		finalized <- err
+	}()
+	<-entered
+	_, err = (&upload.Finalize{ID: up.ID}).Do(c)
+	a.Equal(&app.ErrMsg{Status: 409, Msg: "upload is already being finalized"}, err)
+	release <- true
+	a.Nil(<-finalized)
+	onFinalize = nil
+	_, err = (&upload.Finalize{ID: up.ID}).Do(c)
+	a.Equal(&app.ErrMsg{Status: 404, Msg: "upload not found"}, err)
+	PanicOn(r.Store().Delete(bucket, store.Key("", up.ID)))
+
+	up = (&upload.Init{
+		Kind: "file",
+		Name: "test.bin",
+		Size: size,
+		Args: json.MustFromString(`{"folder":"a"}`),
+	}).MustDo(c)
+	(&upload.Abort{ID: up.ID}).MustDo(c)
+	_, err = (&upload.Progress{ID: up.ID}).Do(c)
+	a.Equal(&app.ErrMsg{Status: 404, Msg: "upload not found"}, err)
+
+	// presigned direct to store uploads
+	small := []byte("yolo")
+	p := (&upload.Presign{
+		Kind: "file",
+		Name: "test.txt",
+		Type: "text/plain",
+		Size: int64(len(small)),
+		Args: json.MustFromString(`{"folder":"b"}`),
+	}).MustDo(c)
+
+	_, err = (&upload.Finalize{ID: p.ID}).Do(c)
+	a.Equal(&app.ErrMsg{Status: 400, Msg: "presigned uploads must be confirmed"}, err)
+
+	_, err = (&upload.Confirm{ID: p.ID}).Do(c)
+	a.Equal(&app.ErrMsg{Status: 400, Msg: "upload content not received"}, err)
+
+	upload.MustPut(p, int64(len(small)), bytes.NewReader(small))
+	res = (&upload.Confirm{ID: p.ID}).MustDo(c)
+	a.Equal("b", res.MustString("folder"))
+	a.Equal("test.txt", res.MustString("name"))
+	a.Equal(int64(len(small)), res.MustInt64("size"))
+
+	_, err = (&upload.Confirm{ID: p.ID}).Do(c)
+	a.Equal(&app.ErrMsg{Status: 404, Msg: "upload not found"}, err)
+
+	// downstreams can redirect to the store
+	ds := &app.DownStream{}
+	PanicOn(app.Call(c, "/test/download", &upload.Confirm{ID: p.ID}, &ds))
+	bs, err := ioutil.ReadAll(ds.Content)
+	PanicOn(err)
+	ds.Content.Close()
+	a.Equal(small, bs)
+	a.Equal("test.txt", ds.Name)
+	a.Equal("text/plain", ds.Type)
+	PanicOn(r.Store().Delete(bucket, store.Key("", p.ID)))
+}
@@ -2,10 +2,12 @@ package user
 
 import (
 	"io"
+	"time"
 
 	. "github.com/0xor1/tlbx/pkg/core"
 	"github.com/0xor1/tlbx/pkg/json"
 	"github.com/0xor1/tlbx/pkg/web/app"
+	"github.com/0xor1/tlbx/pkg/webpush"
 )
 
 type Register struct {
@@ -156,6 +158,36 @@ func (a *SetAlias) MustDo(c *app.Client) {
 	PanicOn(a.Do(c))
 }
 
+type SetLocale struct {
+	Locale *string `json:"locale"`
+}
+
+func (_ *SetLocale) Path() string {
+	return "/user/setLocale"
+}
+
+func (a *SetLocale) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), a, nil)
+}
+
+func (a *SetLocale) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
+
+type UnsuppressEmail struct{}
+
+func (_ *UnsuppressEmail) Path() string {
+	return "/user/unsuppressEmail"
+}
+
+func (a *UnsuppressEmail) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), nil, nil)
+}
+
+func (a *UnsuppressEmail) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
+
 type SetAvatar struct {
 	Avatar io.ReadCloser
 }
@@ -215,17 +247,26 @@ type Login struct {
 	Pwd   string `json:"pwd"`
 }
 
+type LoginRes struct {
+	// Me is set when login is complete
+	Me *Me `json:"me,omitempty"`
+	// Challenge is set instead of Me when the user has two factor auth
+	// enabled, it must be passed to LoginTOTP or BeginWebAuthnLogin within
+	// 5 minutes
+	Challenge *string `json:"challenge,omitempty"`
+}
+
 func (_ *Login) Path() string {
 	return "/user/login"
 }
 
-func (a *Login) Do(c *app.Client) (*Me, error) {
-	res := &Me{}
+func (a *Login) Do(c *app.Client) (*LoginRes, error) {
+	res := &LoginRes{}
 	err := app.Call(c, a.Path(), a, &res)
 	return res, err
 }
 
-func (a *Login) MustDo(c *app.Client) *Me {
+func (a *Login) MustDo(c *app.Client) *LoginRes {
 	res, err := a.Do(c)
 	PanicOn(err)
 	return res
@@ -256,13 +297,13 @@ func (_ *LoginLinkLogin) Path() string {
 	return "/user/loginLinkLogin"
 }
 
-func (a *LoginLinkLogin) Do(c *app.Client) (*Me, error) {
-	res := &Me{}
+func (a *LoginLinkLogin) Do(c *app.Client) (*LoginRes, error) {
+	res := &LoginRes{}
 	err := app.Call(c, a.Path(), a, &res)
 	return res, err
 }
 
-func (a *LoginLinkLogin) MustDo(c *app.Client) *Me {
+func (a *LoginLinkLogin) MustDo(c *app.Client) *LoginRes {
 	res, err := a.Do(c)
 	PanicOn(err)
 	return res
@@ -439,3 +480,620 @@ func (a *UnregisterFromFCM) Do(c *app.Client) error {
 func (a *UnregisterFromFCM) MustDo(c *app.Client) {
 	PanicOn(a.Do(c))
 }
+
+type GetWebPushKey struct{}
+
+func (_ *GetWebPushKey) Path() string {
+	return "/user/getWebPushKey"
+}
+
+func (a *GetWebPushKey) Do(c *app.Client) (string, error) {
+	res := ""
+	err := app.Call(c, a.Path(), nil, &res)
+	return res, err
+}
+
+func (a *GetWebPushKey) MustDo(c *app.Client) string {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type RegisterForWebPush struct {
+	Topic        IDs                  `json:"topic"`
+	Client       *ID                  `json:"client"`
+	Subscription webpush.Subscription `json:"subscription"`
+}
+
+func (_ *RegisterForWebPush) Path() string {
+	return "/user/registerForWebPush"
+}
+
+func (a *RegisterForWebPush) Do(c *app.Client) (*ID, error) {
+	res := &ID{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *RegisterForWebPush) MustDo(c *app.Client) *ID {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type UnregisterFromWebPush struct {
+	Client ID `json:"client"`
+}
+
+func (_ *UnregisterFromWebPush) Path() string {
+	return "/user/unregisterFromWebPush"
+}
+
+func (a *UnregisterFromWebPush) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), a, nil)
+}
+
+func (a *UnregisterFromWebPush) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
+
+type NotificationPrefs struct {
+	// IANA time zone quiet hours are in, e.g. Europe/London
+	TimeZone   string      `json:"timeZone"`
+	QuietHours *QuietHours `json:"quietHours,omitempty"`
+	// categories without prefs are enabled and not digested
+	Categories map[string]*NotificationCategoryPrefs `json:"categories"`
+}
+
+type QuietHours struct {
+	// hh:mm, if End is before Start quiet hours span midnight
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type NotificationCategoryPrefs struct {
+	Enabled bool `json:"enabled"`
+	// batch notifications into a periodic digest rather than sending each
+	Digest bool `json:"digest"`
+}
+
+type GetNotificationPrefs struct{}
+
+func (_ *GetNotificationPrefs) Path() string {
+	return "/user/getNotificationPrefs"
+}
+
+func (a *GetNotificationPrefs) Do(c *app.Client) (*NotificationPrefs, error) {
+	res := &NotificationPrefs{}
+	err := app.Call(c, a.Path(), nil, &res)
+	return res, err
+}
+
+func (a *GetNotificationPrefs) MustDo(c *app.Client) *NotificationPrefs {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type SetNotificationPrefs struct {
+	TimeZone   string                                `json:"timeZone"`
+	QuietHours *QuietHours                           `json:"quietHours,omitempty"`
+	Categories map[string]*NotificationCategoryPrefs `json:"categories"`
+}
+
+func (_ *SetNotificationPrefs) Path() string {
+	return "/user/setNotificationPrefs"
+}
+
+func (a *SetNotificationPrefs) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), a, nil)
+}
+
+func (a *SetNotificationPrefs) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
+
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	CreatedOn  time.Time `json:"createdOn"`
+	LastSeenOn time.Time `json:"lastSeenOn"`
+	IsCurrent  bool      `json:"isCurrent"`
+}
+
+type GetSessions struct{}
+
+func (_ *GetSessions) Path() string {
+	return "/user/getSessions"
+}
+
+func (a *GetSessions) Do(c *app.Client) ([]*Session, error) {
+	res := []*Session{}
+	err := app.Call(c, a.Path(), nil, &res)
+	return res, err
+}
+
+func (a *GetSessions) MustDo(c *app.Client) []*Session {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type RevokeSession struct {
+	ID string `json:"id"`
+}
+
+func (_ *RevokeSession) Path() string {
+	return "/user/revokeSession"
+}
+
+func (a *RevokeSession) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), a, nil)
+}
+
+func (a *RevokeSession) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
+
+type RevokeAllSessions struct{}
+
+func (_ *RevokeAllSessions) Path() string {
+	return "/user/revokeAllSessions"
+}
+
+func (a *RevokeAllSessions) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), nil, nil)
+}
+
+func (a *RevokeAllSessions) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
+
+type Token struct {
+	ID         ID         `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedOn  time.Time  `json:"createdOn"`
+	ExpiresOn  *time.Time `json:"expiresOn"`
+	LastUsedOn *time.Time `json:"lastUsedOn"`
+}
+
+type CreateToken struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresOn *time.Time `json:"expiresOn"`
+}
+
+type CreateTokenRes struct {
+	Token *Token `json:"token"`
+	// Value is only ever returned here, it is stored hashed
+	Value string `json:"value"`
+}
+
+func (_ *CreateToken) Path() string {
+	return "/user/createToken"
+}
+
+func (a *CreateToken) Do(c *app.Client) (*CreateTokenRes, error) {
+	res := &CreateTokenRes{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *CreateToken) MustDo(c *app.Client) *CreateTokenRes {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type GetTokens struct{}
+
+func (_ *GetTokens) Path() string {
+	return "/user/getTokens"
+}
+
+func (a *GetTokens) Do(c *app.Client) ([]*Token, error) {
+	res := []*Token{}
+	err := app.Call(c, a.Path(), nil, &res)
+	return res, err
+}
+
+func (a *GetTokens) MustDo(c *app.Client) []*Token {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type DeleteToken struct {
+	ID ID `json:"id"`
+}
+
+func (_ *DeleteToken) Path() string {
+	return "/user/deleteToken"
+}
+
+func (a *DeleteToken) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), a, nil)
+}
+
+func (a *DeleteToken) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
+
+type LoginTOTP struct {
+	Challenge string `json:"challenge"`
+	// Code is a current totp code or an unused recovery code
+	Code string `json:"code"`
+}
+
+func (_ *LoginTOTP) Path() string {
+	return "/user/loginTOTP"
+}
+
+func (a *LoginTOTP) Do(c *app.Client) (*Me, error) {
+	res := &Me{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *LoginTOTP) MustDo(c *app.Client) *Me {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type TOTPEnrollment struct {
+	// Secret is the base32 secret for manual entry
+	Secret string `json:"secret"`
+	// URI is the otpauth uri to render as a QR code
+	URI string `json:"uri"`
+}
+
+type EnrollTOTP struct{}
+
+func (_ *EnrollTOTP) Path() string {
+	return "/user/enrollTOTP"
+}
+
+func (a *EnrollTOTP) Do(c *app.Client) (*TOTPEnrollment, error) {
+	res := &TOTPEnrollment{}
+	err := app.Call(c, a.Path(), nil, &res)
+	return res, err
+}
+
+func (a *EnrollTOTP) MustDo(c *app.Client) *TOTPEnrollment {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type ConfirmTOTP struct {
+	Code string `json:"code"`
+}
+
+func (_ *ConfirmTOTP) Path() string {
+	return "/user/confirmTOTP"
+}
+
+// Do returns the recovery codes, they are only ever returned here
+func (a *ConfirmTOTP) Do(c *app.Client) ([]string, error) {
+	res := []string{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *ConfirmTOTP) MustDo(c *app.Client) []string {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type DisableTOTP struct {
+	// Code is a current totp code or an unused recovery code
+	Code string `json:"code"`
+}
+
+func (_ *DisableTOTP) Path() string {
+	return "/user/disableTOTP"
+}
+
+func (a *DisableTOTP) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), a, nil)
+}
+
+func (a *DisableTOTP) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
+
+type WebAuthnCredential struct {
+	ID         []byte     `json:"id"`
+	Name       string     `json:"name"`
+	Transports []string   `json:"transports"`
+	CreatedOn  time.Time  `json:"createdOn"`
+	LastUsedOn *time.Time `json:"lastUsedOn"`
+}
+
+type WebAuthnRP struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebAuthnUser struct {
+	ID          []byte `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type WebAuthnParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type WebAuthnDescriptor struct {
+	Type       string   `json:"type"`
+	ID         []byte   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type WebAuthnSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// WebAuthnCreationOptions are the publicKey options to pass to
+// navigator.credentials.create, binary values are base64 encoded.
+type WebAuthnCreationOptions struct {
+	Challenge              []byte                `json:"challenge"`
+	RP                     *WebAuthnRP           `json:"rp"`
+	User                   *WebAuthnUser         `json:"user"`
+	PubKeyCredParams       []*WebAuthnParam      `json:"pubKeyCredParams"`
+	Timeout                int64                 `json:"timeout"`
+	ExcludeCredentials     []*WebAuthnDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection *WebAuthnSelection    `json:"authenticatorSelection"`
+	Attestation            string                `json:"attestation"`
+}
+
+type BeginWebAuthnRegistration struct{}
+
+func (_ *BeginWebAuthnRegistration) Path() string {
+	return "/user/beginWebAuthnRegistration"
+}
+
+func (a *BeginWebAuthnRegistration) Do(c *app.Client) (*WebAuthnCreationOptions, error) {
+	res := &WebAuthnCreationOptions{}
+	err := app.Call(c, a.Path(), nil, &res)
+	return res, err
+}
+
+func (a *BeginWebAuthnRegistration) MustDo(c *app.Client) *WebAuthnCreationOptions {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type FinishWebAuthnRegistration struct {
+	Name              string   `json:"name"`
+	ClientDataJSON    []byte   `json:"clientDataJSON"`
+	AttestationObject []byte   `json:"attestationObject"`
+	Transports        []string `json:"transports"`
+}
+
+func (_ *FinishWebAuthnRegistration) Path() string {
+	return "/user/finishWebAuthnRegistration"
+}
+
+func (a *FinishWebAuthnRegistration) Do(c *app.Client) (*WebAuthnCredential, error) {
+	res := &WebAuthnCredential{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *FinishWebAuthnRegistration) MustDo(c *app.Client) *WebAuthnCredential {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type GetWebAuthnCredentials struct{}
+
+func (_ *GetWebAuthnCredentials) Path() string {
+	return "/user/getWebAuthnCredentials"
+}
+
+func (a *GetWebAuthnCredentials) Do(c *app.Client) ([]*WebAuthnCredential, error) {
+	res := []*WebAuthnCredential{}
+	err := app.Call(c, a.Path(), nil, &res)
+	return res, err
+}
+
+func (a *GetWebAuthnCredentials) MustDo(c *app.Client) []*WebAuthnCredential {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type DeleteWebAuthnCredential struct {
+	ID []byte `json:"id"`
+}
+
+func (_ *DeleteWebAuthnCredential) Path() string {
+	return "/user/deleteWebAuthnCredential"
+}
+
+func (a *DeleteWebAuthnCredential) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), a, nil)
+}
+
+func (a *DeleteWebAuthnCredential) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
+
+// WebAuthnRequestOptions are the publicKey options to pass to
+// navigator.credentials.get, binary values are base64 encoded.
+type WebAuthnRequestOptions struct {
+	Challenge        []byte                `json:"challenge"`
+	RPID             string                `json:"rpId"`
+	Timeout          int64                 `json:"timeout"`
+	AllowCredentials []*WebAuthnDescriptor `json:"allowCredentials"`
+	UserVerification string                `json:"userVerification"`
+}
+
+type WebAuthnLogin struct {
+	// Handle must be passed to FinishWebAuthnLogin
+	Handle    string                  `json:"handle"`
+	PublicKey *WebAuthnRequestOptions `json:"publicKey"`
+}
+
+type BeginWebAuthnLogin struct {
+	// Challenge is from Login or LoginLinkLogin to use a passkey as a second
+	// factor, omit it to login with just a passkey
+	Challenge *string `json:"challenge,omitempty"`
+}
+
+func (_ *BeginWebAuthnLogin) Path() string {
+	return "/user/beginWebAuthnLogin"
+}
+
+func (a *BeginWebAuthnLogin) Do(c *app.Client) (*WebAuthnLogin, error) {
+	res := &WebAuthnLogin{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *BeginWebAuthnLogin) MustDo(c *app.Client) *WebAuthnLogin {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type FinishWebAuthnLogin struct {
+	Handle            string `json:"handle"`
+	ID                []byte `json:"id"`
+	ClientDataJSON    []byte `json:"clientDataJSON"`
+	AuthenticatorData []byte `json:"authenticatorData"`
+	Signature         []byte `json:"signature"`
+}
+
+func (_ *FinishWebAuthnLogin) Path() string {
+	return "/user/finishWebAuthnLogin"
+}
+
+func (a *FinishWebAuthnLogin) Do(c *app.Client) (*Me, error) {
+	res := &Me{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *FinishWebAuthnLogin) MustDo(c *app.Client) *Me {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type GetOIDCProviders struct{}
+
+func (_ *GetOIDCProviders) Path() string {
+	return "/user/getOIDCProviders"
+}
+
+func (a *GetOIDCProviders) Do(c *app.Client) ([]string, error) {
+	res := []string{}
+	err := app.Call(c, a.Path(), nil, &res)
+	return res, err
+}
+
+func (a *GetOIDCProviders) MustDo(c *app.Client) []string {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type OIDCRedirect struct {
+	// URL to send the user to at the provider, they are then redirected
+	// back with the state and code for FinishOIDCLogin
+	URL string `json:"url"`
+}
+
+// BeginOIDCLogin starts a login with the provider, or links the provider
+// account to the current user if already logged in.
+type BeginOIDCLogin struct {
+	Provider string `json:"provider"`
+}
+
+func (_ *BeginOIDCLogin) Path() string {
+	return "/user/beginOIDCLogin"
+}
+
+func (a *BeginOIDCLogin) Do(c *app.Client) (*OIDCRedirect, error) {
+	res := &OIDCRedirect{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *BeginOIDCLogin) MustDo(c *app.Client) *OIDCRedirect {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type FinishOIDCLogin struct {
+	State string `json:"state"`
+	Code  string `json:"code"`
+}
+
+func (_ *FinishOIDCLogin) Path() string {
+	return "/user/finishOIDCLogin"
+}
+
+func (a *FinishOIDCLogin) Do(c *app.Client) (*LoginRes, error) {
+	res := &LoginRes{}
+	err := app.Call(c, a.Path(), a, &res)
+	return res, err
+}
+
+func (a *FinishOIDCLogin) MustDo(c *app.Client) *LoginRes {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type OIDCIdentity struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedOn time.Time `json:"createdOn"`
+}
+
+type GetOIDCIdentities struct{}
+
+func (_ *GetOIDCIdentities) Path() string {
+	return "/user/getOIDCIdentities"
+}
+
+func (a *GetOIDCIdentities) Do(c *app.Client) ([]*OIDCIdentity, error) {
+	res := []*OIDCIdentity{}
+	err := app.Call(c, a.Path(), nil, &res)
+	return res, err
+}
+
+func (a *GetOIDCIdentities) MustDo(c *app.Client) []*OIDCIdentity {
+	res, err := a.Do(c)
+	PanicOn(err)
+	return res
+}
+
+type DeleteOIDCIdentity struct {
+	Provider string `json:"provider"`
+}
+
+func (_ *DeleteOIDCIdentity) Path() string {
+	return "/user/deleteOIDCIdentity"
+}
+
+func (a *DeleteOIDCIdentity) Do(c *app.Client) error {
+	return app.Call(c, a.Path(), a, nil)
+}
+
+func (a *DeleteOIDCIdentity) MustDo(c *app.Client) {
+	PanicOn(a.Do(c))
+}
@@ -0,0 +1,194 @@
+package usereps
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/web/app"
+	"github.com/0xor1/tlbx/pkg/web/app/service"
+	"github.com/0xor1/tlbx/pkg/web/server/realip"
+	"github.com/gomodule/redigo/redis"
+)
+
+// guard tracks strikes, e.g. failed logins or emails sent, against an
+// account and the requesting ip. Once either reaches its limit within window
+// it is locked out for backoff, which doubles with every further strike up
+// to maxBackoff. If accPerIP is set account strikes are only counted per ip
+// so nobody else can lock the account out, accGlobalLimit, if set, is a much
+// higher limit on strikes against the account from every ip. sendCap, if
+// set, is the most emails which may be sent to an account within window from
+// any ip.
+type guard struct {
+	name           string
+	accLimit       int64
+	accGlobalLimit int64
+	ipLimit        int64
+	window         time.Duration
+	backoff        time.Duration
+	maxBackoff     time.Duration
+	accPerIP       bool
+	sendCap        int64
+}
+
+var (
+	loginGuard = &guard{
+		name:           "login",
+		accLimit:       5,
+		accGlobalLimit: 100,
+		ipLimit:        50,
+		window:         time.Hour,
+		backoff:        time.Minute,
+		maxBackoff:     time.Hour,
+		accPerIP:       true,
+	}
+	// keyed by user id, login challenges are also limited to 5 attempts each
+	totpGuard = &guard{
+		name:       "totp",
+		accLimit:   10,
+		ipLimit:    50,
+		window:     time.Hour,
+		backoff:    time.Minute,
+		maxBackoff: time.Hour,
+	}
+	emailGuard = &guard{
+		name:       "email",
+		accLimit:   5,
+		ipLimit:    30,
+		window:     time.Hour,
+		backoff:    10 * time.Minute,
+		maxBackoff: 24 * time.Hour,
+		accPerIP:   true,
+		sendCap:    10,
+	}
+)
+
+type guardKey struct {
+	key   string
+	limit int64
+	isAcc bool
+}
+
+// keys returns the account key first, requests with no known ip are only
+// tracked by account.
+func (g *guard) keys(tlbx app.Tlbx, account string) []*guardKey {
+	ip := realip.FromRequest(tlbx.Req())
+	accKey := Strf("guard:%s:acc:%s", g.name, StrLower(account))
+	if g.accPerIP && ip != "" {
+		accKey = Strf("guard:%s:acc:%s:%s", g.name, ip, StrLower(account))
+	}
+	keys := []*guardKey{
+		{
+			key:   accKey,
+			limit: g.accLimit,
+			isAcc: true,
+		},
+	}
+	if g.accPerIP && ip != "" && g.accGlobalLimit > 0 {
+		keys = append(keys, &guardKey{
+			key:   Strf("guard:%s:acc:%s", g.name, StrLower(account)),
+			limit: g.accGlobalLimit,
+			isAcc: true,
+		})
+	}
+	if ip != "" {
+		keys = append(keys, &guardKey{
+			key:   Strf("guard:%s:ip:%s", g.name, ip),
+			limit: g.ipLimit,
+		})
+	}
+	return keys
+}
+
+// check returns a 429 if the account or ip is locked out.
+func (g *guard) check(tlbx app.Tlbx, account string) {
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	var retry int64
+	for _, k := range g.keys(tlbx, account) {
+		ttl, err := redis.Int64(cnn.Do("PTTL", k.key+":lock"))
+		PanicOn(err)
+		if ttl > retry {
+			retry = ttl
+		}
+	}
+	if retry > 0 {
+		secs := int64(math.Ceil(float64(retry) / 1000))
+		tlbx.Resp().Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+		app.ReturnIf(true, http.StatusTooManyRequests, "too many attempts, try again in %d seconds", secs)
+	}
+}
+
+// strike records a strike against the account and ip, it returns true if
+// this strike is the one that first locked out the account.
+func (g *guard) strike(tlbx app.Tlbx, account string) bool {
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	accLocked := false
+	for _, k := range g.keys(tlbx, account) {
+		PanicOn(cnn.Send("MULTI"))
+		PanicOn(cnn.Send("INCR", k.key))
+		PanicOn(cnn.Send("PEXPIRE", k.key, g.window.Milliseconds()))
+		res, err := redis.Values(cnn.Do("EXEC"))
+		PanicOn(err)
+		count, err := redis.Int64(res[0], nil)
+		PanicOn(err)
+		if count < k.limit {
+			continue
+		}
+		backoff := g.backoff
+		for n := count - k.limit; n > 0 && backoff < g.maxBackoff; n-- {
+			backoff *= 2
+		}
+		if backoff > g.maxBackoff {
+			backoff = g.maxBackoff
+		}
+		_, err = cnn.Do("SET", k.key+":lock", 1, "PX", backoff.Milliseconds())
+		PanicOn(err)
+		accLocked = accLocked || (k.isAcc && count == k.limit)
+	}
+	return accLocked
+}
+
+// notify returns true at most once per window for account, so emails about
+// lockouts can't be used to flood its inbox.
+func (g *guard) notify(tlbx app.Tlbx, account string) bool {
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	res, err := cnn.Do("SET", Strf("guard:%s:notified:%s", g.name, StrLower(account)), 1, "NX", "PX", g.window.Milliseconds())
+	PanicOn(err)
+	return res != nil
+}
+
+// reset clears the accounts strikes from the requesting ip, the ip's and
+// any global account strikes are left to expire.
+func (g *guard) reset(tlbx app.Tlbx, account string) {
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	key := g.keys(tlbx, account)[0].key
+	_, err := cnn.Do("DEL", key, key+":lock")
+	PanicOn(err)
+}
+
+// capped records an email send to account and returns true if sendCap sends
+// have already been made to it within window. Callers skip the send rather
+// than erroring, so the cap can't lock the owner out, it only stops their
+// inbox being flooded.
+func (g *guard) capped(tlbx app.Tlbx, account string) bool {
+	if g.sendCap < 1 {
+		return false
+	}
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	key := Strf("guard:%s:sent:%s", g.name, StrLower(account))
+	PanicOn(cnn.Send("MULTI"))
+	PanicOn(cnn.Send("INCR", key))
+	PanicOn(cnn.Send("PEXPIRE", key, g.window.Milliseconds()))
+	res, err := redis.Values(cnn.Do("EXEC"))
+	PanicOn(err)
+	count, err := redis.Int64(res[0], nil)
+	PanicOn(err)
+	return count > g.sendCap
+}
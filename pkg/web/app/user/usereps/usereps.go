@@ -5,6 +5,11 @@ package usereps
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"math"
 	"net/http"
@@ -19,19 +24,31 @@ import (
 
 	. "github.com/0xor1/tlbx/pkg/core"
 	"github.com/0xor1/tlbx/pkg/crypt"
+	"github.com/0xor1/tlbx/pkg/email/feedback"
+	"github.com/0xor1/tlbx/pkg/email/outbox"
+	"github.com/0xor1/tlbx/pkg/email/tmpl"
 	"github.com/0xor1/tlbx/pkg/isql"
 	"github.com/0xor1/tlbx/pkg/json"
+	"github.com/0xor1/tlbx/pkg/oidc"
 	"github.com/0xor1/tlbx/pkg/ptr"
+	"github.com/0xor1/tlbx/pkg/pwdcheck"
 	"github.com/0xor1/tlbx/pkg/store"
 	"github.com/0xor1/tlbx/pkg/web/app"
 	"github.com/0xor1/tlbx/pkg/web/app/service"
+	"github.com/0xor1/tlbx/pkg/web/app/service/fcm"
 	"github.com/0xor1/tlbx/pkg/web/app/service/sql"
+	storemw "github.com/0xor1/tlbx/pkg/web/app/service/store"
+	"github.com/0xor1/tlbx/pkg/web/app/session"
 	"github.com/0xor1/tlbx/pkg/web/app/session/me"
 	sqlh "github.com/0xor1/tlbx/pkg/web/app/sql"
 	"github.com/0xor1/tlbx/pkg/web/app/user"
 	"github.com/0xor1/tlbx/pkg/web/app/validate"
+	"github.com/0xor1/tlbx/pkg/web/server/realip"
+	"github.com/0xor1/tlbx/pkg/webauthn"
+	"github.com/0xor1/tlbx/pkg/webpush"
 	"github.com/disintegration/imaging"
 	"github.com/go-sql-driver/mysql"
+	"github.com/gomodule/redigo/redis"
 )
 
 const (
@@ -47,6 +64,39 @@ type AppData interface {
 	Validate(app.Tlbx, interface{})
 }
 
+// Config holds the optional features, each is disabled if left unset.
+type Config struct {
+	// TOTPIssuer is shown with the account in authenticator apps
+	TOTPIssuer string
+	// TOTPEncrKey32s encrypt totp secrets at rest, the first key encrypts
+	// and the rest only decrypt so keys can be rotated, totp two factor
+	// auth can't be enrolled in without them
+	TOTPEncrKey32s [][]byte
+	// WebAuthn enables passkeys
+	WebAuthn *webauthn.Config
+	// OIDCProviders enables logging in with accounts from other providers
+	OIDCProviders []*oidc.Provider
+	// PwdCheck enables pwd strength and breach checks
+	PwdCheck *pwdcheck.Checker
+	// EmailTemplates overrides the default email templates
+	EmailTemplates fs.FS
+}
+
+func config(configs ...func(*Config)) *Config {
+	c := &Config{
+		TOTPIssuer:     "tlbx",
+		TOTPEncrKey32s: nil,
+		WebAuthn:       nil,
+		OIDCProviders:  nil,
+		PwdCheck:       nil,
+		EmailTemplates: nil,
+	}
+	for _, config := range configs {
+		config(c)
+	}
+	return c
+}
+
 func New(
 	fromEmail,
 	activateFmtLink,
@@ -58,15 +108,30 @@ func New(
 	onSetSocials func(app.Tlbx, *user.User),
 	validateFcmTopic func(app.Tlbx, IDs) (sql.Tx, error),
 	enableJin bool,
+	configs ...func(*Config),
 ) []*app.Endpoint {
+	c := config(configs...)
+	webAuthn := c.WebAuthn
+	pwdCheck := c.PwdCheck
 	enableSocials := onSetSocials != nil
 	enableFCM := validateFcmTopic != nil
+	enableWebAuthn := webAuthn != nil
+	enableOIDC := len(c.OIDCProviders) > 0
+	emails := newEmails(c.EmailTemplates)
+	oidcNames := make([]string, 0, len(c.OIDCProviders))
+	oidcProvidersByName := make(map[string]*oidc.Provider, len(c.OIDCProviders))
+	for _, p := range c.OIDCProviders {
+		PanicIf(oidcProvidersByName[p.Name()] != nil, "duplicate oidc provider name %q", p.Name())
+		oidcNames = append(oidcNames, p.Name())
+		oidcProvidersByName[p.Name()] = p
+	}
 	eps := []*app.Endpoint{
 		{
 			Description:  "register a new account (requires email link)",
 			Path:         (&user.Register{}).Path(),
 			Timeout:      1000,
 			MaxBodyBytes: app.KB,
+			RateLimit:    registerRateLimit,
 			IsPrivate:    false,
 			GetDefaultArgs: func() interface{} {
 				d := &user.Register{}
@@ -117,6 +182,15 @@ func New(
 					validate.Str("alias", *args.Alias, tlbx, 0, aliasMaxLen)
 				}
 				validate.Str("email", args.Email, tlbx, 0, emailMaxLen, emailRegex)
+				validate.Str("pwd", args.Pwd, tlbx, pwdMinLen, pwdMaxLen, pwdRegexs...)
+				userInputs := []string{args.Email}
+				if args.Handle != nil {
+					userInputs = append(userInputs, *args.Handle)
+				}
+				if args.Alias != nil {
+					userInputs = append(userInputs, *args.Alias)
+				}
+				checkPwd(tlbx, pwdCheck, "pwd", args.Pwd, userInputs...)
 				activateCode := crypt.UrlSafeString(250)
 				id := me.Get(tlbx).ID()
 				srv := service.Get(tlbx)
@@ -149,7 +223,7 @@ func New(
 				pwdtx := srv.Pwd().BeginWrite()
 				defer pwdtx.Rollback()
 				setPwd(tlbx, pwdtx, id, args.Pwd)
-				sendActivateEmail(srv, args.Email, fromEmail, Strf(activateFmtLink, id, activateCode), args.Handle)
+				sendEmail(tlbx, usrtx, emails, args.Email, fromEmail, "activate", nil, args.Handle, &emailData{Link: Strf(activateFmtLink, id, activateCode)})
 				usrtx.Commit()
 				pwdtx.Commit()
 				return nil
@@ -160,6 +234,7 @@ func New(
 			Path:         (&user.ResendActivateLink{}).Path(),
 			Timeout:      500,
 			MaxBodyBytes: app.KB,
+			RateLimit:    emailRateLimit,
 			IsPrivate:    false,
 			GetDefaultArgs: func() interface{} {
 				return &user.ResendActivateLink{}
@@ -174,15 +249,17 @@ func New(
 			},
 			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
 				args := a.(*user.ResendActivateLink)
+				emailGuard.check(tlbx, args.Email)
+				emailGuard.strike(tlbx, args.Email)
 				srv := service.Get(tlbx)
-				tx := srv.User().BeginRead()
+				tx := srv.User().BeginWrite()
 				defer tx.Rollback()
 				fullUser := getUser(tx, &args.Email, nil)
-				tx.Commit()
-				if fullUser == nil || fullUser.ActivateCode == nil {
+				if fullUser == nil || fullUser.ActivateCode == nil || emailGuard.capped(tlbx, args.Email) {
 					return nil
 				}
-				sendActivateEmail(srv, args.Email, fromEmail, Strf(activateFmtLink, fullUser.ID, *fullUser.ActivateCode), fullUser.Handle)
+				sendEmail(tlbx, tx, emails, args.Email, fromEmail, "activate", fullUser.Locale, fullUser.Handle, &emailData{Link: Strf(activateFmtLink, fullUser.ID, *fullUser.ActivateCode)})
+				tx.Commit()
 				return nil
 			},
 		},
@@ -233,6 +310,7 @@ func New(
 			Path:         (&user.ChangeEmail{}).Path(),
 			Timeout:      500,
 			MaxBodyBytes: app.KB,
+			RateLimit:    emailRateLimit,
 			IsPrivate:    false,
 			GetDefaultArgs: func() interface{} {
 				return &user.ChangeEmail{}
@@ -260,8 +338,8 @@ func New(
 				fullUser.NewEmail = &args.NewEmail
 				fullUser.ChangeEmailCode = &changeEmailCode
 				updateUser(tx, fullUser)
+				sendEmail(tlbx, tx, emails, args.NewEmail, fromEmail, "confirmChangeEmail", fullUser.Locale, nil, &emailData{Link: Strf(confirmChangeEmailFmtLink, me, changeEmailCode)})
 				tx.Commit()
-				sendConfirmChangeEmailEmail(srv, args.NewEmail, fromEmail, Strf(confirmChangeEmailFmtLink, me, changeEmailCode))
 				return nil
 			},
 		},
@@ -270,6 +348,7 @@ func New(
 			Path:         (&user.ResendChangeEmailLink{}).Path(),
 			Timeout:      500,
 			MaxBodyBytes: app.KB,
+			RateLimit:    emailRateLimit,
 			IsPrivate:    false,
 			GetDefaultArgs: func() interface{} {
 				return nil
@@ -283,11 +362,11 @@ func New(
 			Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
 				srv := service.Get(tlbx)
 				me := me.AuthedGet(tlbx)
-				tx := srv.User().BeginRead()
+				tx := srv.User().BeginWrite()
 				defer tx.Rollback()
 				fullUser := getUser(tx, nil, &me)
+				sendEmail(tlbx, tx, emails, *fullUser.NewEmail, fromEmail, "confirmChangeEmail", fullUser.Locale, nil, &emailData{Link: Strf(confirmChangeEmailFmtLink, me, *fullUser.ChangeEmailCode)})
 				tx.Commit()
-				sendConfirmChangeEmailEmail(srv, *fullUser.NewEmail, fromEmail, Strf(confirmChangeEmailFmtLink, me, *fullUser.ChangeEmailCode))
 				return nil
 			},
 		},
@@ -329,6 +408,7 @@ func New(
 			Path:         (&user.ResetPwd{}).Path(),
 			Timeout:      1000,
 			MaxBodyBytes: app.KB,
+			RateLimit:    emailRateLimit,
 			IsPrivate:    false,
 			GetDefaultArgs: func() interface{} {
 				return &user.ResetPwd{}
@@ -343,6 +423,8 @@ func New(
 			},
 			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
 				args := a.(*user.ResetPwd)
+				emailGuard.check(tlbx, args.Email)
+				emailGuard.strike(tlbx, args.Email)
 				srv := service.Get(tlbx)
 				tx := srv.User().BeginWrite()
 				defer tx.Rollback()
@@ -353,16 +435,24 @@ func New(
 						mustWaitDur := (10 * time.Minute) - Now().Sub(*user.LastPwdResetOn)
 						app.BadReqIf(mustWaitDur > 0, "must wait %d seconds before reseting pwd again", int64(math.Ceil(mustWaitDur.Seconds())))
 					}
+					if emailGuard.capped(tlbx, args.Email) {
+						return nil
+					}
 					user.LastPwdResetOn = &now
 					updateUser(tx, user)
 					pwdtx := srv.Pwd().BeginWrite()
 					defer pwdtx.Rollback()
 					newPwd := `$aA1` + crypt.UrlSafeString(12)
 					setPwd(tlbx, pwdtx, user.ID, newPwd)
-					sendResetPwdEmail(srv, args.Email, fromEmail, newPwd)
+					sendEmail(tlbx, tx, emails, args.Email, fromEmail, "resetPwd", user.Locale, nil, &emailData{Pwd: newPwd})
+					// commit the queued email first, if the pwd commit then
+					// fails the old pwd still works, the other way round
+					// would change the pwd without ever sending it
+					tx.Commit()
 					pwdtx.Commit()
+					// only revoke once the new pwd is committed
+					session.RevokeAll(tlbx, user.ID, false)
 				}
-				tx.Commit()
 				return nil
 			},
 		},
@@ -388,12 +478,87 @@ func New(
 				args := a.(*user.SetPwd)
 				srv := service.Get(tlbx)
 				me := me.AuthedGet(tlbx)
+				validate.Str("newPwd", args.NewPwd, tlbx, pwdMinLen, pwdMaxLen, pwdRegexs...)
+				tx := srv.User().BeginRead()
+				defer tx.Rollback()
+				u := getUser(tx, nil, &me)
+				tx.Commit()
+				userInputs := []string{u.Email}
+				if u.Handle != nil {
+					userInputs = append(userInputs, *u.Handle)
+				}
+				if u.Alias != nil {
+					userInputs = append(userInputs, *u.Alias)
+				}
+				checkPwd(tlbx, pwdCheck, "newPwd", args.NewPwd, userInputs...)
 				pwdtx := srv.Pwd().BeginWrite()
 				defer pwdtx.Rollback()
 				pwd := getPwd(pwdtx, me)
-				app.BadReqIf(!bytes.Equal(crypt.ScryptKey([]byte(args.OldPwd), pwd.Salt, pwd.N, pwd.R, pwd.P, scryptKeyLen), pwd.Pwd), "current pwd does not match")
+				ok, _ := pwdHashers.Verify([]byte(args.OldPwd), pwd)
+				app.BadReqIf(!ok, "current pwd does not match")
 				setPwd(tlbx, pwdtx, me, args.NewPwd)
 				pwdtx.Commit()
+				session.RevokeAll(tlbx, me, true)
+				return nil
+			},
+		},
+		{
+			Description:  "set my preferred locale for emails, nil to use the Accept-Language header",
+			Path:         (&user.SetLocale{}).Path(),
+			Timeout:      500,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &user.SetLocale{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &user.SetLocale{
+					Locale: ptr.String("en-GB"),
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return nil
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*user.SetLocale)
+				if args.Locale != nil {
+					args.Locale = ptr.String(StrTrimWS(*args.Locale))
+					validate.Str("locale", *args.Locale, tlbx, 0, localeMaxLen, localeRegex)
+				}
+				srv := service.Get(tlbx)
+				me := me.AuthedGet(tlbx)
+				tx := srv.User().BeginWrite()
+				defer tx.Rollback()
+				user := getUser(tx, nil, &me)
+				user.Locale = args.Locale
+				updateUser(tx, user)
+				tx.Commit()
+				return nil
+			},
+		},
+		{
+			Description:  "resume sending emails to my address after they were stopped by a bounce or complaint",
+			Path:         (&user.UnsuppressEmail{}).Path(),
+			Timeout:      500,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return nil
+			},
+			GetExampleArgs: func() interface{} {
+				return nil
+			},
+			GetExampleResponse: func() interface{} {
+				return nil
+			},
+			Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
+				srv := service.Get(tlbx)
+				me := me.AuthedGet(tlbx)
+				tx := srv.User().BeginWrite()
+				defer tx.Rollback()
+				user := getUser(tx, nil, &me)
+				feedback.Unsuppress(tx, user.Email)
+				tx.Commit()
 				return nil
 			},
 		},
@@ -421,20 +586,28 @@ func New(
 				pwdtx := srv.Pwd().BeginWrite()
 				defer pwdtx.Rollback()
 				pwd := getPwd(pwdtx, m)
-				app.BadReqIf(!bytes.Equal(pwd.Pwd, crypt.ScryptKey([]byte(args.Pwd), pwd.Salt, pwd.N, pwd.R, pwd.P, scryptKeyLen)), "incorrect pwd")
+				ok, _ := pwdHashers.Verify([]byte(args.Pwd), pwd)
+				app.BadReqIf(!ok, "incorrect pwd")
 				tx := srv.User().BeginWrite()
 				defer tx.Rollback()
-				// jin and fcm tokens tables are cleared by foreign key cascade
+				// jin, fcm tokens, api tokens and oidc identities tables are cleared by foreign key cascade
 				_, err := tx.Exec(`DELETE FROM users WHERE id=?`, m)
 				PanicOn(err)
 				_, err = pwdtx.Exec(`DELETE FROM pwds WHERE id=?`, m)
 				PanicOn(err)
+				_, err = pwdtx.Exec(`DELETE FROM totps WHERE id=?`, m)
+				PanicOn(err)
+				_, err = pwdtx.Exec(`DELETE FROM recoveryCodes WHERE id=?`, m)
+				PanicOn(err)
+				_, err = pwdtx.Exec(`DELETE FROM webAuthnCredentials WHERE user=?`, m)
+				PanicOn(err)
 				if onDelete != nil {
 					onDelete(tlbx, m)
 				}
-				me.Del(tlbx)
 				tx.Commit()
 				pwdtx.Commit()
+				session.RevokeAll(tlbx, m, false)
+				me.Del(tlbx)
 				return nil
 			},
 		},
@@ -443,6 +616,7 @@ func New(
 			Path:         (&user.Login{}).Path(),
 			Timeout:      1000,
 			MaxBodyBytes: app.KB,
+			RateLimit:    loginRateLimit,
 			IsPrivate:    false,
 			GetDefaultArgs: func() interface{} {
 				return &user.Login{}
@@ -464,7 +638,7 @@ func New(
 				if enableFCM {
 					ex.FcmEnabled = ptr.Bool(true)
 				}
-				return ex
+				return &user.LoginRes{Me: ex}
 			},
 			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
 				emailOrPwdMismatch := func(condition bool) {
@@ -473,23 +647,37 @@ func New(
 				args := a.(*user.Login)
 				validate.Str("email", args.Email, tlbx, 0, emailMaxLen, emailRegex)
 				validate.Str("pwd", args.Pwd, tlbx, pwdMinLen, pwdMaxLen, pwdRegexs...)
+				loginGuard.check(tlbx, args.Email)
 				srv := service.Get(tlbx)
 				tx := srv.User().BeginRead()
 				defer tx.Rollback()
 				user := getUser(tx, &args.Email, nil)
-				emailOrPwdMismatch(user == nil)
+				if user == nil {
+					loginGuard.strike(tlbx, args.Email)
+					emailOrPwdMismatch(true)
+				}
 				pwdtx := srv.Pwd().BeginWrite()
 				defer pwdtx.Rollback()
 				pwd := getPwd(pwdtx, user.ID)
-				emailOrPwdMismatch(!bytes.Equal(pwd.Pwd, crypt.ScryptKey([]byte(args.Pwd), pwd.Salt, pwd.N, pwd.R, pwd.P, scryptKeyLen)))
-				// if encryption params have changed re encrypt on successful login
-				if len(pwd.Salt) != scryptSaltLen || len(pwd.Pwd) != scryptKeyLen || pwd.N != scryptN || pwd.R != scryptR || pwd.P != scryptP {
+				ok, rehash := pwdHashers.Verify([]byte(args.Pwd), pwd)
+				if !ok {
+					if loginGuard.strike(tlbx, args.Email) && loginGuard.notify(tlbx, args.Email) {
+						// only the first lock in a window queues an email
+						lockTx := srv.User().BeginWrite()
+						defer lockTx.Rollback()
+						sendEmail(tlbx, lockTx, emails, user.Email, fromEmail, "loginLocked", user.Locale, user.Handle, &emailData{IP: realip.FromRequest(tlbx.Req())})
+						lockTx.Commit()
+					}
+					emailOrPwdMismatch(true)
+				}
+				loginGuard.reset(tlbx, args.Email)
+				// if the hash alg or params have changed rehash on successful login
+				if rehash {
 					setPwd(tlbx, pwdtx, user.ID, args.Pwd)
 				}
 				tx.Commit()
 				pwdtx.Commit()
-				me.AuthedSet(tlbx, user.ID)
-				return &user.Me
+				return login(tlbx, user, enableWebAuthn)
 			},
 		},
 		{
@@ -497,6 +685,7 @@ func New(
 			Path:         (&user.SendLoginLinkEmail{}).Path(),
 			Timeout:      1000,
 			MaxBodyBytes: app.KB,
+			RateLimit:    emailRateLimit,
 			IsPrivate:    false,
 			GetDefaultArgs: func() interface{} {
 				return &user.SendLoginLinkEmail{}
@@ -512,16 +701,21 @@ func New(
 			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
 				args := a.(*user.SendLoginLinkEmail)
 				validate.Str("email", args.Email, tlbx, 0, emailMaxLen, emailRegex)
+				emailGuard.check(tlbx, args.Email)
+				emailGuard.strike(tlbx, args.Email)
 				srv := service.Get(tlbx)
 				tx := srv.User().BeginWrite()
 				defer tx.Rollback()
 				user := getUser(tx, &args.Email, nil)
 				app.BadReqIf(user == nil, "unknown email")
 				app.BadReqIf(user.LoginLinkCodeCreatedOn != nil && user.LoginLinkCodeCreatedOn.After(Now().Add(-8*time.Minute)), "An unused login link code still exists")
+				if emailGuard.capped(tlbx, args.Email) {
+					return nil
+				}
 				user.LoginLinkCodeCreatedOn = ptr.Time(NowMilli())
 				user.LoginLinkCode = ptr.String(crypt.UrlSafeString(250))
 				updateUser(tx, user)
-				sendLoginLinkEmail(srv, user.Email, fromEmail, Strf(loginLinkFmtLink, user.ID, *user.LoginLinkCode), user.Handle)
+				sendEmail(tlbx, tx, emails, user.Email, fromEmail, "loginLink", user.Locale, user.Handle, &emailData{Link: Strf(loginLinkFmtLink, user.ID, *user.LoginLinkCode)})
 				tx.Commit()
 				return nil
 			},
@@ -531,6 +725,7 @@ func New(
 			Path:         (&user.LoginLinkLogin{}).Path(),
 			Timeout:      1000,
 			MaxBodyBytes: app.KB,
+			RateLimit:    loginRateLimit,
 			IsPrivate:    false,
 			GetDefaultArgs: func() interface{} {
 				return &user.LoginLinkLogin{}
@@ -552,7 +747,7 @@ func New(
 				if enableFCM {
 					ex.FcmEnabled = ptr.Bool(true)
 				}
-				return ex
+				return &user.LoginRes{Me: ex}
 			},
 			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
 				args := a.(*user.LoginLinkLogin)
@@ -568,10 +763,202 @@ func New(
 				user.LoginLinkCode = nil
 				updateUser(tx, user)
 				tx.Commit()
-				me.AuthedSet(tlbx, user.ID)
+				return login(tlbx, user, enableWebAuthn)
+			},
+		},
+		{
+			Description:  "complete a login for a user with two factor auth enabled",
+			Path:         (&user.LoginTOTP{}).Path(),
+			Timeout:      1000,
+			MaxBodyBytes: app.KB,
+			RateLimit:    loginRateLimit,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &user.LoginTOTP{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &user.LoginTOTP{
+					Challenge: "Fk2b0t3s3c5kZ8mVd1rS4hY7uQ9wE6xA",
+					Code:      "123456",
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				ex := &user.Me{}
+				ex.ID = app.ExampleID()
+				if enableSocials {
+					ex.Handle = ptr.String("bloe_joggs")
+					ex.Alias = ptr.String("Joe Bloggs")
+					ex.HasAvatar = ptr.Bool(true)
+				}
+				if enableFCM {
+					ex.FcmEnabled = ptr.Bool(true)
+				}
+				return ex
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*user.LoginTOTP)
+				invalidChallenge := func(condition bool) {
+					app.ReturnIf(condition, http.StatusUnauthorized, "invalid or expired challenge")
+				}
+				srv := service.Get(tlbx)
+				cnn := srv.Cache().Get()
+				defer cnn.Close()
+				key := totpChallengePrefix + args.Challenge
+				idStr, err := redis.String(cnn.Do("HGET", key, "user"))
+				invalidChallenge(err == redis.ErrNil)
+				PanicOn(err)
+				id, err := ParseID(idStr)
+				PanicOn(err)
+				totpGuard.check(tlbx, id.String())
+				pwdtx := srv.Pwd().BeginWrite()
+				defer pwdtx.Rollback()
+				t := getTOTP(pwdtx, c.TOTPEncrKey32s, id)
+				invalidChallenge(t == nil || t.ConfirmedOn == nil)
+				if !checkTOTP(tlbx, pwdtx, id, t, args.Code) {
+					totpGuard.strike(tlbx, id.String())
+					attempts, err := redis.Int64(cnn.Do("HINCRBY", key, "attempts", 1))
+					PanicOn(err)
+					if attempts >= totpChallengeAttempts {
+						_, err = cnn.Do("DEL", key)
+						PanicOn(err)
+					}
+					app.ReturnIf(true, http.StatusUnauthorized, "invalid code")
+				}
+				pwdtx.Commit()
+				_, err = cnn.Do("DEL", key)
+				PanicOn(err)
+				tx := srv.User().BeginRead()
+				defer tx.Rollback()
+				user := getUser(tx, nil, &id)
+				invalidChallenge(user == nil)
+				tx.Commit()
+				totpGuard.reset(tlbx, id.String())
+				loginGuard.reset(tlbx, user.Email)
+				me.AuthedSet(tlbx, id)
 				return &user.Me
 			},
 		},
+		{
+			Description:  "start enrolling a totp authenticator, it isn't required at login until confirmed",
+			Path:         (&user.EnrollTOTP{}).Path(),
+			Timeout:      500,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return nil
+			},
+			GetExampleArgs: func() interface{} {
+				return nil
+			},
+			GetExampleResponse: func() interface{} {
+				return &user.TOTPEnrollment{
+					Secret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+					URI:    "otpauth://totp/example.com:joe@bloggs.example?digits=6&issuer=example.com&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+				}
+			},
+			Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
+				m := me.AuthedGet(tlbx)
+				app.ReturnIf(session.IsBearer(tlbx), http.StatusForbidden, "api tokens can not manage two factor auth")
+				app.BadReqIf(len(c.TOTPEncrKey32s) == 0, "two factor auth is not enabled")
+				srv := service.Get(tlbx)
+				pwdtx := srv.Pwd().BeginWrite()
+				defer pwdtx.Rollback()
+				t := getTOTP(pwdtx, c.TOTPEncrKey32s, m)
+				app.BadReqIf(t != nil && t.ConfirmedOn != nil, "two factor auth is already enabled")
+				secret := crypt.TOTPSecret()
+				_, err := pwdtx.Exec(`INSERT INTO totps (id, secret, confirmedOn, lastCounter) VALUES (?, ?, NULL, 0) ON DUPLICATE KEY UPDATE secret=VALUE(secret), confirmedOn=NULL, lastCounter=0`, m, crypt.Seal(c.TOTPEncrKey32s, secret))
+				PanicOn(err)
+				tx := srv.User().BeginRead()
+				defer tx.Rollback()
+				u := getUser(tx, nil, &m)
+				tx.Commit()
+				pwdtx.Commit()
+				return &user.TOTPEnrollment{
+					Secret: crypt.TOTPSecretString(secret),
+					URI:    crypt.TOTPURI(c.TOTPIssuer, u.Email, secret),
+				}
+			},
+		},
+		{
+			Description:  "confirm a totp authenticator with a current code, returns one time recovery codes",
+			Path:         (&user.ConfirmTOTP{}).Path(),
+			Timeout:      500,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &user.ConfirmTOTP{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &user.ConfirmTOTP{
+					Code: "123456",
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return []string{"k2b0t3s3c5kZ", "8mVd1rS4hY7u"}
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*user.ConfirmTOTP)
+				m := me.AuthedGet(tlbx)
+				app.ReturnIf(session.IsBearer(tlbx), http.StatusForbidden, "api tokens can not manage two factor auth")
+				totpGuard.check(tlbx, m.String())
+				srv := service.Get(tlbx)
+				pwdtx := srv.Pwd().BeginWrite()
+				defer pwdtx.Rollback()
+				t := getTOTP(pwdtx, c.TOTPEncrKey32s, m)
+				app.BadReqIf(t == nil, "two factor auth enrollment has not been started")
+				app.BadReqIf(t.ConfirmedOn != nil, "two factor auth is already enabled")
+				if !checkTOTP(tlbx, pwdtx, m, t, args.Code) {
+					totpGuard.strike(tlbx, m.String())
+					app.BadReqIf(true, "invalid code")
+				}
+				_, err := pwdtx.Exec(`UPDATE totps SET confirmedOn=? WHERE id=?`, tlbx.Start(), m)
+				PanicOn(err)
+				codes := setRecoveryCodes(pwdtx, m)
+				pwdtx.Commit()
+				// other sessions only passed the first factor
+				session.RevokeAll(tlbx, m, true)
+				return codes
+			},
+		},
+		{
+			Description:  "disable two factor auth",
+			Path:         (&user.DisableTOTP{}).Path(),
+			Timeout:      500,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &user.DisableTOTP{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &user.DisableTOTP{
+					Code: "123456",
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return nil
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*user.DisableTOTP)
+				m := me.AuthedGet(tlbx)
+				app.ReturnIf(session.IsBearer(tlbx), http.StatusForbidden, "api tokens can not manage two factor auth")
+				totpGuard.check(tlbx, m.String())
+				srv := service.Get(tlbx)
+				pwdtx := srv.Pwd().BeginWrite()
+				defer pwdtx.Rollback()
+				t := getTOTP(pwdtx, c.TOTPEncrKey32s, m)
+				app.BadReqIf(t == nil || t.ConfirmedOn == nil, "two factor auth is not enabled")
+				if !checkTOTP(tlbx, pwdtx, m, t, args.Code) {
+					totpGuard.strike(tlbx, m.String())
+					app.BadReqIf(true, "invalid code")
+				}
+				_, err := pwdtx.Exec(`DELETE FROM totps WHERE id=?`, m)
+				PanicOn(err)
+				_, err = pwdtx.Exec(`DELETE FROM recoveryCodes WHERE id=?`, m)
+				PanicOn(err)
+				pwdtx.Commit()
+				return nil
+			},
+		},
 		{
 			Description:  "logout",
 			Path:         (&user.Logout{}).Path(),
@@ -601,9 +988,16 @@ func New(
 							tokens = append(tokens, token)
 						}
 					}, `SELECT DISTINCT token FROM fcmTokens WHERE user=?`, m)
+					var subs []*webpush.Subscription
+					tx.Query(func(rows isql.Rows) {
+						subs = fcm.ScanWebPushSubscriptions(rows)
+					}, `SELECT DISTINCT endpoint, p256dh, auth FROM webPushSubscriptions WHERE user=?`, m)
 					_, err := tx.Exec(`DELETE FROM fcmTokens WHERE user=?`, m)
 					PanicOn(err)
+					_, err = tx.Exec(`DELETE FROM webPushSubscriptions WHERE user=?`, m)
+					PanicOn(err)
 					srv.FCM().RawAsyncSend("logout", tokens, map[string]string{}, 0)
+					srv.FCM().RawAsyncWebPush("logout", subs, map[string]string{}, 0)
 					tx.Commit()
 					me.Del(tlbx)
 				}
@@ -611,8 +1005,8 @@ func New(
 			},
 		},
 		{
-			Description:  "get me",
-			Path:         (&user.GetMe{}).Path(),
+			Description:  "get my active sessions, requires server side sessions",
+			Path:         (&user.GetSessions{}).Path(),
 			Timeout:      500,
 			MaxBodyBytes: app.KB,
 			IsPrivate:    false,
@@ -623,65 +1017,290 @@ func New(
 				return nil
 			},
 			GetExampleResponse: func() interface{} {
-				ex := &user.Me{}
-				ex.ID = app.ExampleID()
-				if enableSocials {
-					ex.Handle = ptr.String("bloe_joggs")
-					ex.Alias = ptr.String("Joe Bloggs")
-					ex.HasAvatar = ptr.Bool(true)
+				return []*user.Session{
+					{
+						ID:         "Fk2b0t3s3c5kZ8mVd1rS4hY7uQ9wE6xA",
+						Device:     "Mozilla/5.0 (X11; Linux x86_64; rv:89.0) Gecko/20100101 Firefox/89.0",
+						IP:         "203.0.113.7",
+						CreatedOn:  app.ExampleTime(),
+						LastSeenOn: app.ExampleTime(),
+						IsCurrent:  true,
+					},
 				}
-				if enableFCM {
-					ex.FcmEnabled = ptr.Bool(true)
-				}
-				return ex
 			},
 			Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
-				if !me.AuthedExists(tlbx) {
-					return nil
+				m := me.AuthedGet(tlbx)
+				infos := session.List(tlbx, m)
+				res := make([]*user.Session, 0, len(infos))
+				for _, info := range infos {
+					res = append(res, &user.Session{
+						ID:         info.ID,
+						Device:     info.Device,
+						IP:         info.IP,
+						CreatedOn:  info.CreatedOn,
+						LastSeenOn: info.LastSeenOn,
+						IsCurrent:  info.IsCurrent,
+					})
 				}
-				me := me.AuthedGet(tlbx)
-				tx := service.Get(tlbx).User().BeginRead()
-				defer tx.Rollback()
-				user := getUser(tx, nil, &me)
-				tx.Commit()
-				return &user.Me
+				return res
 			},
 		},
-	}
-	if enableJin {
-		eps = append(eps,
-			&app.Endpoint{
-				Description:  "set users jin (json bin), adhoc json content",
-				Path:         (&user.SetJin{}).Path(),
-				Timeout:      500,
-				MaxBodyBytes: 10 * app.KB,
-				IsPrivate:    false,
-				GetDefaultArgs: func() interface{} {
-					return &user.SetJin{}
-				},
-				GetExampleArgs: func() interface{} {
-					return &user.SetJin{
-						Val: exampleJin,
-					}
-				},
-				GetExampleResponse: func() interface{} {
-					return nil
-				},
-				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
-					args := a.(*user.SetJin)
-					me := me.AuthedGet(tlbx)
-					srv := service.Get(tlbx)
-					qryArgs := sqlh.NewArgs(0)
-					var qry string
-					if args.Val == nil {
-						qry = qryJinDelete(qryArgs, me)
-						_, err := srv.User().Exec(qry, qryArgs.Is()...)
-						PanicOn(err)
-					} else {
-						// if app requires init ctx data store it in jin
-						qry := qryJinInsert(qryArgs, me, args.Val)
-						_, err := srv.User().Exec(qry, qryArgs.Is()...)
-						PanicOn(err)
+		{
+			Description:  "revoke one of my sessions, revoking the current session logs out",
+			Path:         (&user.RevokeSession{}).Path(),
+			Timeout:      500,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &user.RevokeSession{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &user.RevokeSession{
+					ID: "Fk2b0t3s3c5kZ8mVd1rS4hY7uQ9wE6xA",
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return nil
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*user.RevokeSession)
+				m := me.AuthedGet(tlbx)
+				app.BadReqIf(!session.IsRevocable(tlbx), "sessions are not stored server side")
+				session.Revoke(tlbx, m, args.ID)
+				return nil
+			},
+		},
+		{
+			Description:  "revoke all of my sessions except the current one",
+			Path:         (&user.RevokeAllSessions{}).Path(),
+			Timeout:      500,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return nil
+			},
+			GetExampleArgs: func() interface{} {
+				return nil
+			},
+			GetExampleResponse: func() interface{} {
+				return nil
+			},
+			Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
+				m := me.AuthedGet(tlbx)
+				app.BadReqIf(!session.IsRevocable(tlbx), "sessions are not stored server side")
+				session.RevokeAll(tlbx, m, true)
+				return nil
+			},
+		},
+		{
+			Description:  "create a personal api token, the token value is only returned here",
+			Path:         (&user.CreateToken{}).Path(),
+			Timeout:      500,
+			MaxBodyBytes: app.KB * 5,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &user.CreateToken{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &user.CreateToken{
+					Name:      "ci",
+					Scopes:    []string{"/user/me"},
+					ExpiresOn: ptr.Time(app.ExampleTime()),
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return &user.CreateTokenRes{
+					Token: &user.Token{
+						ID:        app.ExampleID(),
+						Name:      "ci",
+						Scopes:    []string{"/user/me"},
+						CreatedOn: app.ExampleTime(),
+						ExpiresOn: ptr.Time(app.ExampleTime()),
+					},
+					Value: "Fk2b0t3s3c5kZ8mVd1rS4hY7uQ9wE6xAFk2b0t3s3c5kZ8mV",
+				}
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*user.CreateToken)
+				m := me.AuthedGet(tlbx)
+				app.ReturnIf(session.IsBearer(tlbx), http.StatusForbidden, "api tokens can not manage api tokens")
+				args.Name = StrTrimWS(args.Name)
+				validate.Str("name", args.Name, tlbx, 1, tokenNameMaxLen)
+				app.BadReqIf(len(args.Scopes) > tokenMaxScopes, "max scopes per token is %d", tokenMaxScopes)
+				for i, scope := range args.Scopes {
+					scope = StrLower(StrTrimWS(scope))
+					app.BadReqIf(!strings.HasPrefix(scope, "/"), "scopes must be endpoint paths starting with /")
+					args.Scopes[i] = scope
+				}
+				if args.Scopes == nil {
+					args.Scopes = []string{}
+				}
+				scopes := json.MustMarshal(args.Scopes)
+				app.BadReqIf(len(scopes) > tokenScopesMaxLen, "scopes too long")
+				if args.ExpiresOn != nil {
+					app.BadReqIf(!args.ExpiresOn.After(tlbx.Start()), "expiresOn must be in the future")
+				}
+				value := crypt.UrlSafeString(tokenLen)
+				res := &user.CreateTokenRes{
+					Token: &user.Token{
+						ID:        tlbx.NewID(),
+						Name:      args.Name,
+						Scopes:    args.Scopes,
+						CreatedOn: tlbx.Start(),
+						ExpiresOn: args.ExpiresOn,
+					},
+					Value: value,
+				}
+				srv := service.Get(tlbx)
+				tx := srv.User().BeginWrite()
+				defer tx.Rollback()
+				count := 0
+				PanicOn(tx.QueryRow(`SELECT COUNT(*) FROM tokens WHERE user=? FOR UPDATE`, m).Scan(&count))
+				app.BadReqIf(count >= tokenMaxPerUser, "max api tokens per user is %d", tokenMaxPerUser)
+				_, err := tx.Exec(`INSERT INTO tokens (user, id, name, scopes, hash, createdOn, expiresOn, lastUsedOn) VALUES (?, ?, ?, ?, ?, ?, ?, NULL)`, m, res.Token.ID, res.Token.Name, scopes, me.HashToken(value), res.Token.CreatedOn, res.Token.ExpiresOn)
+				PanicOn(err)
+				tx.Commit()
+				return res
+			},
+		},
+		{
+			Description:  "get my personal api tokens",
+			Path:         (&user.GetTokens{}).Path(),
+			Timeout:      500,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return nil
+			},
+			GetExampleArgs: func() interface{} {
+				return nil
+			},
+			GetExampleResponse: func() interface{} {
+				return []*user.Token{
+					{
+						ID:         app.ExampleID(),
+						Name:       "ci",
+						Scopes:     []string{"/user/me"},
+						CreatedOn:  app.ExampleTime(),
+						ExpiresOn:  ptr.Time(app.ExampleTime()),
+						LastUsedOn: ptr.Time(app.ExampleTime()),
+					},
+				}
+			},
+			Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
+				m := me.AuthedGet(tlbx)
+				app.ReturnIf(session.IsBearer(tlbx), http.StatusForbidden, "api tokens can not manage api tokens")
+				res := []*user.Token{}
+				PanicOn(service.Get(tlbx).User().Query(func(rows isql.Rows) {
+					for rows.Next() {
+						t := &user.Token{}
+						scopes := []byte{}
+						PanicOn(rows.Scan(&t.ID, &t.Name, &scopes, &t.CreatedOn, &t.ExpiresOn, &t.LastUsedOn))
+						json.MustUnmarshal(scopes, &t.Scopes)
+						res = append(res, t)
+					}
+				}, `SELECT id, name, scopes, createdOn, expiresOn, lastUsedOn FROM tokens WHERE user=? ORDER BY createdOn DESC`, m))
+				return res
+			},
+		},
+		{
+			Description:  "delete one of my personal api tokens",
+			Path:         (&user.DeleteToken{}).Path(),
+			Timeout:      500,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return &user.DeleteToken{}
+			},
+			GetExampleArgs: func() interface{} {
+				return &user.DeleteToken{
+					ID: app.ExampleID(),
+				}
+			},
+			GetExampleResponse: func() interface{} {
+				return nil
+			},
+			Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+				args := a.(*user.DeleteToken)
+				m := me.AuthedGet(tlbx)
+				app.ReturnIf(session.IsBearer(tlbx), http.StatusForbidden, "api tokens can not manage api tokens")
+				_, err := service.Get(tlbx).User().Exec(`DELETE FROM tokens WHERE user=? AND id=?`, m, args.ID)
+				PanicOn(err)
+				return nil
+			},
+		},
+		{
+			Description:  "get me",
+			Path:         (&user.GetMe{}).Path(),
+			Timeout:      500,
+			MaxBodyBytes: app.KB,
+			IsPrivate:    false,
+			GetDefaultArgs: func() interface{} {
+				return nil
+			},
+			GetExampleArgs: func() interface{} {
+				return nil
+			},
+			GetExampleResponse: func() interface{} {
+				ex := &user.Me{}
+				ex.ID = app.ExampleID()
+				if enableSocials {
+					ex.Handle = ptr.String("bloe_joggs")
+					ex.Alias = ptr.String("Joe Bloggs")
+					ex.HasAvatar = ptr.Bool(true)
+				}
+				if enableFCM {
+					ex.FcmEnabled = ptr.Bool(true)
+				}
+				return ex
+			},
+			Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
+				if !me.AuthedExists(tlbx) {
+					return nil
+				}
+				me := me.AuthedGet(tlbx)
+				tx := service.Get(tlbx).User().BeginRead()
+				defer tx.Rollback()
+				user := getUser(tx, nil, &me)
+				tx.Commit()
+				return &user.Me
+			},
+		},
+	}
+	if enableJin {
+		eps = append(eps,
+			&app.Endpoint{
+				Description:  "set users jin (json bin), adhoc json content",
+				Path:         (&user.SetJin{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: 10 * app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return &user.SetJin{}
+				},
+				GetExampleArgs: func() interface{} {
+					return &user.SetJin{
+						Val: exampleJin,
+					}
+				},
+				GetExampleResponse: func() interface{} {
+					return nil
+				},
+				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+					args := a.(*user.SetJin)
+					me := me.AuthedGet(tlbx)
+					srv := service.Get(tlbx)
+					qryArgs := sqlh.NewArgs(0)
+					var qry string
+					if args.Val == nil {
+						qry = qryJinDelete(qryArgs, me)
+						_, err := srv.User().Exec(qry, qryArgs.Is()...)
+						PanicOn(err)
+					} else {
+						// if app requires init ctx data store it in jin
+						qry := qryJinInsert(qryArgs, me, args.Val)
+						_, err := srv.User().Exec(qry, qryArgs.Is()...)
+						PanicOn(err)
 					}
 					return nil
 				},
@@ -902,6 +1521,7 @@ func New(
 				Timeout:          500,
 				MaxBodyBytes:     app.KB,
 				SkipXClientCheck: true,
+				SkipCSRFCheck:    true,
 				IsPrivate:        false,
 				GetDefaultArgs: func() interface{} {
 					return &user.GetAvatar{}
@@ -917,13 +1537,8 @@ func New(
 				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
 					args := a.(*user.GetAvatar)
 					srv := service.Get(tlbx)
-					name, mimeType, size, content := srv.Store().MustGet(AvatarBucket, store.Key(AvatarPrefix, args.User))
-					ds := &app.DownStream{}
+					ds := storemw.DownStream(tlbx, srv.Store(), AvatarBucket, store.Key(AvatarPrefix, args.User))
 					ds.ID = args.User
-					ds.Name = name
-					ds.Type = mimeType
-					ds.Size = size
-					ds.Content = content
 					return ds
 				},
 			})
@@ -969,8 +1584,12 @@ func New(
 							tokens = append(tokens, token)
 						}
 					}, `SELECT DISTINCT token FROM fcmTokens WHERE user=?`, me)
+					var subs []*webpush.Subscription
+					tx.Query(func(rows isql.Rows) {
+						subs = fcm.ScanWebPushSubscriptions(rows)
+					}, `SELECT DISTINCT endpoint, p256dh, auth FROM webPushSubscriptions WHERE user=?`, me)
 					tx.Commit()
-					if len(tokens) == 0 {
+					if len(tokens) == 0 && len(subs) == 0 {
 						// no tokens to notify
 						return nil
 					}
@@ -978,7 +1597,9 @@ func New(
 					if !args.Val {
 						fcmType = "disabled"
 					}
-					service.Get(tlbx).FCM().RawAsyncSend(fcmType, tokens, map[string]string{}, 0)
+					srv := service.Get(tlbx)
+					srv.FCM().RawAsyncSend(fcmType, tokens, map[string]string{}, 0)
+					srv.FCM().RawAsyncWebPush(fcmType, subs, map[string]string{}, 0)
 					return nil
 				},
 			},
@@ -1066,137 +1687,1170 @@ func New(
 					tx.Commit()
 					return nil
 				},
-			})
-	}
-	return eps
-}
-
-var (
-	handleRegex  = regexp.MustCompile(`\A[_a-z0-9]{1,20}\z`)
-	handleMinLen = 1
-	handleMaxLen = 20
-	emailRegex   = regexp.MustCompile(`\A.+@.+\..+\z`)
-	emailMaxLen  = 250
-	aliasMaxLen  = 50
-	pwdRegexs    = []*regexp.Regexp{
-		regexp.MustCompile(`[0-9]`),
-		regexp.MustCompile(`[a-z]`),
-		regexp.MustCompile(`[A-Z]`),
-		regexp.MustCompile(`[\w]`),
-	}
-	pwdMinLen     = 8
-	pwdMaxLen     = 100
-	scryptN       = 32768
-	scryptR       = 8
-	scryptP       = 1
-	scryptSaltLen = 256
-	scryptKeyLen  = 256
-	avatarDim     = 250
-	exampleJin    = json.MustFromString(`{"v":1, "saveDir":"/my/save/dir", "startTab":"favourites"}`)
-)
-
-func sendActivateEmail(srv service.Layer, sendTo, from, link string, handle *string) {
-	html := `<p>Thank you for registering.</p><p>Click this link to activate your account:</p><p><a href="` + link + `">Activate</a></p><p>If you didn't register for this account you can simply ignore this email.</p>`
-	txt := "Thank you for registering.\nClick this link to activate your account:\n\n" + link + "\n\nIf you didn't register for this account you can simply ignore this email."
-	if handle != nil {
-		html = Strf("Hi %s,\n\n%s", *handle, html)
-		txt = Strf("Hi %s,\n\n%s", *handle, txt)
-	}
-	srv.Email().MustSend([]string{sendTo}, from, "Activate", html, txt)
-}
-
-func sendLoginLinkEmail(srv service.Layer, sendTo, from, link string, handle *string) {
-	html := `<p>Here is the login link you requested.</p><p>Click this link to login to your account:</p><p><a href="` + link + `">Login</a></p><p>This link will only be valid for 10 minutes.</p><p>If you didn't request this link you can simply ignore this email.</p>`
-	txt := "Here is the login link you requested.\nClick this link to login to your account:\n\n" + link + "\n\nThis link will only be valid for 10 minutes.\n\nIf you didn't request this link you can simply ignore this email."
-	if handle != nil {
-		html = Strf("Hi %s,\n\n%s", *handle, html)
-		txt = Strf("Hi %s,\n\n%s", *handle, txt)
-	}
-	srv.Email().MustSend([]string{sendTo}, from, "Login Link", html, txt)
-}
-
-func sendConfirmChangeEmailEmail(srv service.Layer, sendTo, from, link string) {
-	srv.Email().MustSend([]string{sendTo}, from, "Confirm change email",
-		`<p>Click this link to change the email associated with your account:</p><p><a href="`+link+`">Confirm change email</a></p>`,
-		"Confirm change email:\n\n"+link)
-}
-
-func sendResetPwdEmail(srv service.Layer, sendTo, from, newPwd string) {
-	srv.Email().MustSend([]string{sendTo}, from, "Pwd Reset", `<p>New Pwd: `+newPwd+`</p>`, `New Pwd: `+newPwd)
-}
-
-type fullUser struct {
-	user.Me
-	Email                  string
-	RegisteredOn           time.Time
-	ActivatedOn            time.Time
-	NewEmail               *string
-	ActivateCode           *string
-	ChangeEmailCode        *string
-	LastPwdResetOn         *time.Time
-	LoginLinkCodeCreatedOn *time.Time
-	LoginLinkCode          *string
-}
-
-func getUser(tx sql.Tx, email *string, id *ID) *fullUser {
-	PanicIf(email == nil && id == nil, "one of email or id must not be nil")
-	query := `SELECT id, email, handle, alias, hasAvatar, fcmEnabled, registeredOn, activatedOn, newEmail, activateCode, changeEmailCode, lastPwdResetOn, loginLinkCodeCreatedOn, loginLinkCode FROM users WHERE `
-	var arg interface{}
-	if email != nil {
-		query += `email=?`
-		arg = *email
-	} else {
-		query += `id=?`
-		arg = *id
-	}
-	row := tx.QueryRow(query, arg)
-	res := &fullUser{}
-	err := row.Scan(&res.ID, &res.Email, &res.Handle, &res.Alias, &res.HasAvatar, &res.FcmEnabled, &res.RegisteredOn, &res.ActivatedOn, &res.NewEmail, &res.ActivateCode, &res.ChangeEmailCode, &res.LastPwdResetOn, &res.LoginLinkCodeCreatedOn, &res.LoginLinkCode)
-	if err == isql.ErrNoRows {
-		return nil
-	}
-	PanicOn(err)
-	return res
-}
-
-func updateUser(tx sql.Tx, user *fullUser) {
-	_, err := tx.Exec(`UPDATE users SET email=?, handle=?, alias=?, hasAvatar=?, fcmEnabled=?, registeredOn=?, activatedOn=?, newEmail=?, activateCode=?, changeEmailCode=?, lastPwdResetOn=?, loginLinkCodeCreatedOn=?, loginLinkCode=? WHERE id=?`, user.Email, user.Handle, user.Alias, user.HasAvatar, user.FcmEnabled, user.RegisteredOn, user.ActivatedOn, user.NewEmail, user.ActivateCode, user.ChangeEmailCode, user.LastPwdResetOn, user.LoginLinkCodeCreatedOn, user.LoginLinkCode, user.ID)
-	PanicOn(err)
-}
-
-type pwd struct {
-	ID   ID
-	Salt []byte
-	Pwd  []byte
-	N    int
-	R    int
-	P    int
-}
-
-func getPwd(pwdtx sql.Tx, id ID) *pwd {
-	row := pwdtx.QueryRow(`SELECT id, salt, pwd, n, r, p FROM pwds WHERE id=?`, id)
-	res := &pwd{}
-	err := row.Scan(&res.ID, &res.Salt, &res.Pwd, &res.N, &res.R, &res.P)
-	if err == isql.ErrNoRows {
-		return nil
-	}
-	PanicOn(err)
-	return res
-}
-
-func setPwd(tlbx app.Tlbx, pwdtx sql.Tx, id ID, pwd string) {
-	validate.Str("pwd", pwd, tlbx, pwdMinLen, pwdMaxLen, pwdRegexs...)
-	salt := crypt.Bytes(scryptSaltLen)
-	pwdBs := crypt.ScryptKey([]byte(pwd), salt, scryptN, scryptR, scryptP, scryptKeyLen)
-	_, err := pwdtx.Exec(`INSERT INTO pwds (id, salt, pwd, n, r, p) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE salt=VALUE(salt), pwd=VALUE(pwd), n=VALUE(n), r=VALUE(r), p=VALUE(p)`, id, salt, pwdBs, scryptN, scryptR, scryptP)
-	PanicOn(err)
-}
-
-func getJin(tx sql.Tx, me ID, dst interface{}) {
-	qryArgs := sqlh.NewArgs(0)
-	qry := qryJinSelect(qryArgs, me)
-	row := tx.QueryRow(qry, qryArgs.Is()...)
-	var err error
+			},
+			&app.Endpoint{
+				Description:  "get the vapid public key to pass as applicationServerKey to pushManager.subscribe, empty if web push isn't configured",
+				Path:         (&user.GetWebPushKey{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return nil
+				},
+				GetExampleArgs: func() interface{} {
+					return nil
+				},
+				GetExampleResponse: func() interface{} {
+					return "BEl62iUYgUivxIkv69yViEuiBIa-Ib9-SkvMeAtA3LFgDzkrxZJjSgSnfckjBJuBkr3qBUYIHBQFLXYp5Nksh8U"
+				},
+				Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
+					return service.Get(tlbx).FCM().WebPush().PublicKey()
+				},
+			},
+			&app.Endpoint{
+				Description:  "register for web push",
+				Path:         (&user.RegisterForWebPush{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: 2 * app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return &user.RegisterForWebPush{}
+				},
+				GetExampleArgs: func() interface{} {
+					ex := &user.RegisterForWebPush{
+						Topic:  IDs{app.ExampleID()},
+						Client: ptr.ID(app.ExampleID()),
+					}
+					ex.Subscription.Endpoint = "https://fcm.googleapis.com/fcm/send/abc:123"
+					ex.Subscription.Keys.P256dh = "BNcRdreALRFXTkOOUHK1EtK2wtaz5Ry4YfYCA_0QTpQtUbVlUls0VJXg7A8u-Ts1XbjhazAkj7I99e8QcYP7DkM"
+					ex.Subscription.Keys.Auth = "tBHItJI5svbpez7KI4CCXg"
+					return ex
+				},
+				GetExampleResponse: func() interface{} {
+					return app.ExampleID()
+				},
+				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+					args := a.(*user.RegisterForWebPush)
+					app.BadReqIf(len(args.Topic) == 0 || len(args.Topic) > 5, "topic must contain 1 to 5 ids")
+					app.BadReqIf(len(args.Subscription.Endpoint) > webPushEndpointMaxLen, "web push endpoint must be at most %d characters", webPushEndpointMaxLen)
+					err := service.Get(tlbx).FCM().WebPush().Validate(&args.Subscription)
+					app.BadReqIf(err != nil, "invalid web push subscription: %s", err)
+					client := args.Client
+					if client == nil {
+						client = ptr.ID(tlbx.NewID())
+					}
+					me := me.AuthedGet(tlbx)
+					tx := service.Get(tlbx).User().BeginWrite()
+					defer tx.Rollback()
+					u := getUser(tx, nil, &me)
+					app.BadReqIf(u.FcmEnabled == nil || !*u.FcmEnabled, "fcm not enabled for user, please enable first then register for topics")
+					// this query is used to get a users 5th subscription createdOn value if they have one
+					row := tx.QueryRow(`SELECT createdOn FROM webPushSubscriptions WHERE user=? ORDER BY createdOn DESC LIMIT 4, 1`, me)
+					fifthYoungestSubCreatedOn := time.Time{}
+					sqlh.PanicIfIsntNoRows(row.Scan(&fifthYoungestSubCreatedOn))
+					if !fifthYoungestSubCreatedOn.IsZero() {
+						// this user has 5 subscriptions already so delete the older ones
+						// to make room for this new one
+						_, err := tx.Exec(`DELETE FROM webPushSubscriptions WHERE user=? AND createdOn<=?`, me, fifthYoungestSubCreatedOn)
+						PanicOn(err)
+					}
+					appTx, err := validateFcmTopic(tlbx, args.Topic)
+					if appTx != nil {
+						defer appTx.Rollback()
+					}
+					PanicOn(err)
+					sub := args.Subscription
+					_, err = tx.Exec(`INSERT INTO webPushSubscriptions (topic, endpoint, p256dh, auth, user, client, createdOn) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE topic=VALUES(topic), endpoint=VALUES(endpoint), p256dh=VALUES(p256dh), auth=VALUES(auth), createdOn=VALUES(createdOn)`, args.Topic.StrJoin("_"), sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth, me, client, tlbx.Start())
+					PanicOn(err)
+					tx.Commit()
+					if appTx != nil {
+						appTx.Commit()
+					}
+					return client
+				},
+			},
+			&app.Endpoint{
+				Description:      "unregister from web push",
+				SkipXClientCheck: true,
+				Path:             (&user.UnregisterFromWebPush{}).Path(),
+				Timeout:          500,
+				MaxBodyBytes:     app.KB,
+				IsPrivate:        false,
+				GetDefaultArgs: func() interface{} {
+					return &user.UnregisterFromWebPush{}
+				},
+				GetExampleArgs: func() interface{} {
+					return &user.UnregisterFromWebPush{
+						Client: app.ExampleID(),
+					}
+				},
+				GetExampleResponse: func() interface{} {
+					return nil
+				},
+				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+					args := a.(*user.UnregisterFromWebPush)
+					me := me.AuthedGet(tlbx)
+					tx := service.Get(tlbx).User().BeginWrite()
+					defer tx.Rollback()
+					_, err := tx.Exec(`DELETE FROM webPushSubscriptions WHERE user=? AND client=?`, me, args.Client)
+					PanicOn(err)
+					tx.Commit()
+					return nil
+				},
+			},
+			&app.Endpoint{
+				Description:  "get notification preferences",
+				Path:         (&user.GetNotificationPrefs{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return nil
+				},
+				GetExampleArgs: func() interface{} {
+					return nil
+				},
+				GetExampleResponse: func() interface{} {
+					return exampleNotificationPrefs()
+				},
+				Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
+					me := me.AuthedGet(tlbx)
+					tx := service.Get(tlbx).User().BeginRead()
+					defer tx.Rollback()
+					res := &user.NotificationPrefs{
+						TimeZone:   "UTC",
+						Categories: map[string]*user.NotificationCategoryPrefs{},
+					}
+					s := &fcm.Settings{}
+					row := tx.QueryRow(`SELECT timeZone, quietHoursStart, quietHoursEnd FROM notificationSettings WHERE user=?`, me)
+					sqlh.PanicIfIsntNoRows(row.Scan(&s.TimeZone, &s.QuietHoursStart, &s.QuietHoursEnd))
+					if s.TimeZone != "" {
+						res.TimeZone = s.TimeZone
+					}
+					if s.QuietHoursStart != nil && s.QuietHoursEnd != nil {
+						res.QuietHours = &user.QuietHours{
+							Start: fmtMinutes(*s.QuietHoursStart),
+							End:   fmtMinutes(*s.QuietHoursEnd),
+						}
+					}
+					tx.Query(func(rows isql.Rows) {
+						for rows.Next() {
+							category := ""
+							prefs := &user.NotificationCategoryPrefs{}
+							PanicOn(rows.Scan(&category, &prefs.Enabled, &prefs.Digest))
+							res.Categories[category] = prefs
+						}
+					}, `SELECT category, enabled, digest FROM notificationCategories WHERE user=?`, me)
+					tx.Commit()
+					return res
+				},
+			},
+			&app.Endpoint{
+				Description:  "set notification preferences, replaces any existing preferences",
+				Path:         (&user.SetNotificationPrefs{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: 5 * app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return &user.SetNotificationPrefs{
+						TimeZone: "UTC",
+					}
+				},
+				GetExampleArgs: func() interface{} {
+					ex := exampleNotificationPrefs()
+					return &user.SetNotificationPrefs{
+						TimeZone:   ex.TimeZone,
+						QuietHours: ex.QuietHours,
+						Categories: ex.Categories,
+					}
+				},
+				GetExampleResponse: func() interface{} {
+					return nil
+				},
+				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+					args := a.(*user.SetNotificationPrefs)
+					_, err := time.LoadLocation(args.TimeZone)
+					app.BadReqIf(args.TimeZone == "" || args.TimeZone == "Local" || len(args.TimeZone) > timeZoneMaxLen || err != nil, "invalid time zone")
+					var quietStart, quietEnd *int
+					if args.QuietHours != nil {
+						quietStart = parseMinutes(tlbx, "quietHours.start", args.QuietHours.Start)
+						quietEnd = parseMinutes(tlbx, "quietHours.end", args.QuietHours.End)
+						app.BadReqIf(*quietStart == *quietEnd, "quietHours start and end must be different")
+					}
+					app.BadReqIf(len(args.Categories) > notificationCategoriesMax, "at most %d notification categories may be set", notificationCategoriesMax)
+					for category, prefs := range args.Categories {
+						app.BadReqIf(!fcm.CategoryRegex.MatchString(category), "invalid notification category %q", category)
+						app.BadReqIf(prefs == nil, "notification category %q prefs missing", category)
+					}
+					me := me.AuthedGet(tlbx)
+					tx := service.Get(tlbx).User().BeginWrite()
+					defer tx.Rollback()
+					_, err = tx.Exec(`INSERT INTO notificationSettings (user, timeZone, quietHoursStart, quietHoursEnd) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE timeZone=VALUES(timeZone), quietHoursStart=VALUES(quietHoursStart), quietHoursEnd=VALUES(quietHoursEnd)`, me, args.TimeZone, quietStart, quietEnd)
+					PanicOn(err)
+					_, err = tx.Exec(`DELETE FROM notificationCategories WHERE user=?`, me)
+					PanicOn(err)
+					for category, prefs := range args.Categories {
+						_, err = tx.Exec(`INSERT INTO notificationCategories (user, category, enabled, digest) VALUES (?, ?, ?, ?)`, me, category, prefs.Enabled, prefs.Digest)
+						PanicOn(err)
+					}
+					tx.Commit()
+					return nil
+				},
+			})
+	}
+	if enableWebAuthn {
+		eps = append(eps,
+			&app.Endpoint{
+				Description:  "start registering a passkey, pass the result to navigator.credentials.create",
+				Path:         (&user.BeginWebAuthnRegistration{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return nil
+				},
+				GetExampleArgs: func() interface{} {
+					return nil
+				},
+				GetExampleResponse: func() interface{} {
+					return &user.WebAuthnCreationOptions{
+						Challenge: exampleWebAuthnBytes,
+						RP: &user.WebAuthnRP{
+							ID:   "example.com",
+							Name: "Example",
+						},
+						User: &user.WebAuthnUser{
+							ID:          exampleWebAuthnBytes[:16],
+							Name:        "joe@bloggs.example",
+							DisplayName: "Joe Bloggs",
+						},
+						PubKeyCredParams: webAuthnParams(),
+						Timeout:          webAuthnTimeout.Milliseconds(),
+						ExcludeCredentials: []*user.WebAuthnDescriptor{
+							{
+								Type:       webAuthnType,
+								ID:         exampleWebAuthnBytes,
+								Transports: []string{"internal"},
+							},
+						},
+						AuthenticatorSelection: &user.WebAuthnSelection{
+							ResidentKey:      "preferred",
+							UserVerification: "preferred",
+						},
+						Attestation: "none",
+					}
+				},
+				Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
+					m := me.AuthedGet(tlbx)
+					app.ReturnIf(session.IsBearer(tlbx), http.StatusForbidden, "api tokens can not manage passkeys")
+					srv := service.Get(tlbx)
+					tx := srv.User().BeginRead()
+					defer tx.Rollback()
+					u := getUser(tx, nil, &m)
+					tx.Commit()
+					creds := getWebAuthnCredentials(srv.Pwd(), m)
+					app.BadReqIf(len(creds) >= webAuthnMaxPerUser, "max passkeys per user is %d", webAuthnMaxPerUser)
+					exclude := make([]*user.WebAuthnDescriptor, 0, len(creds))
+					for _, c := range creds {
+						exclude = append(exclude, &user.WebAuthnDescriptor{
+							Type:       webAuthnType,
+							ID:         c.ID,
+							Transports: c.Transports,
+						})
+					}
+					displayName := u.Email
+					if u.Alias != nil && *u.Alias != "" {
+						displayName = *u.Alias
+					} else if u.Handle != nil {
+						displayName = *u.Handle
+					}
+					challenge := webauthn.Challenge()
+					putWebAuthnState(tlbx, webAuthnRegPrefix+m.String(), "challenge", challenge)
+					return &user.WebAuthnCreationOptions{
+						Challenge: challenge,
+						RP: &user.WebAuthnRP{
+							ID:   webAuthn.RPID,
+							Name: webAuthn.RPName,
+						},
+						User: &user.WebAuthnUser{
+							ID:          m[:],
+							Name:        u.Email,
+							DisplayName: displayName,
+						},
+						PubKeyCredParams:   webAuthnParams(),
+						Timeout:            webAuthnTimeout.Milliseconds(),
+						ExcludeCredentials: exclude,
+						AuthenticatorSelection: &user.WebAuthnSelection{
+							ResidentKey:      "preferred",
+							UserVerification: "preferred",
+						},
+						Attestation: "none",
+					}
+				},
+			},
+			&app.Endpoint{
+				Description:  "finish registering a passkey with the result of navigator.credentials.create",
+				Path:         (&user.FinishWebAuthnRegistration{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: 10 * app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return &user.FinishWebAuthnRegistration{}
+				},
+				GetExampleArgs: func() interface{} {
+					return &user.FinishWebAuthnRegistration{
+						Name:              "laptop",
+						ClientDataJSON:    exampleWebAuthnBytes,
+						AttestationObject: exampleWebAuthnBytes,
+						Transports:        []string{"internal"},
+					}
+				},
+				GetExampleResponse: func() interface{} {
+					return &user.WebAuthnCredential{
+						ID:         exampleWebAuthnBytes,
+						Name:       "laptop",
+						Transports: []string{"internal"},
+						CreatedOn:  app.ExampleTime(),
+					}
+				},
+				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+					args := a.(*user.FinishWebAuthnRegistration)
+					m := me.AuthedGet(tlbx)
+					app.ReturnIf(session.IsBearer(tlbx), http.StatusForbidden, "api tokens can not manage passkeys")
+					args.Name = StrTrimWS(args.Name)
+					validate.Str("name", args.Name, tlbx, 1, webAuthnNameMaxLen)
+					transports := make([]string, 0, len(args.Transports))
+					for _, t := range args.Transports {
+						if webAuthnTransports[t] && len(transports) < len(webAuthnTransports) {
+							transports = append(transports, t)
+						}
+					}
+					state := takeWebAuthnState(tlbx, webAuthnRegPrefix+m.String())
+					app.BadReqIf(state["challenge"] == "", "passkey registration has expired")
+					c, err := webAuthn.VerifyRegistration([]byte(state["challenge"]), args.ClientDataJSON, args.AttestationObject, false)
+					app.BadReqIf(err != nil, "invalid passkey registration: %s", webAuthnErrMsg(err))
+					res := &user.WebAuthnCredential{
+						ID:         c.ID,
+						Name:       args.Name,
+						Transports: transports,
+						CreatedOn:  tlbx.Start(),
+					}
+					tx := service.Get(tlbx).Pwd().BeginWrite()
+					defer tx.Rollback()
+					count := 0
+					PanicOn(tx.QueryRow(`SELECT COUNT(*) FROM webAuthnCredentials WHERE user=? FOR UPDATE`, m).Scan(&count))
+					app.BadReqIf(count >= webAuthnMaxPerUser, "max passkeys per user is %d", webAuthnMaxPerUser)
+					_, err = tx.Exec(`INSERT INTO webAuthnCredentials (id, user, name, publicKey, signCount, transports, createdOn, lastUsedOn) VALUES (?, ?, ?, ?, ?, ?, ?, NULL)`, c.ID, m, res.Name, c.PublicKey, c.SignCount, json.MustMarshal(res.Transports), res.CreatedOn)
+					if err != nil {
+						mySqlErr, ok := err.(*mysql.MySQLError)
+						app.BadReqIf(ok && mySqlErr.Number == 1062, "passkey already registered")
+						PanicOn(err)
+					}
+					tx.Commit()
+					return res
+				},
+			},
+			&app.Endpoint{
+				Description:  "get my passkeys",
+				Path:         (&user.GetWebAuthnCredentials{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return nil
+				},
+				GetExampleArgs: func() interface{} {
+					return nil
+				},
+				GetExampleResponse: func() interface{} {
+					return []*user.WebAuthnCredential{
+						{
+							ID:         exampleWebAuthnBytes,
+							Name:       "laptop",
+							Transports: []string{"internal"},
+							CreatedOn:  app.ExampleTime(),
+							LastUsedOn: ptr.Time(app.ExampleTime()),
+						},
+					}
+				},
+				Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
+					m := me.AuthedGet(tlbx)
+					app.ReturnIf(session.IsBearer(tlbx), http.StatusForbidden, "api tokens can not manage passkeys")
+					return getWebAuthnCredentials(service.Get(tlbx).Pwd(), m)
+				},
+			},
+			&app.Endpoint{
+				Description:  "delete one of my passkeys",
+				Path:         (&user.DeleteWebAuthnCredential{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: 2 * app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return &user.DeleteWebAuthnCredential{}
+				},
+				GetExampleArgs: func() interface{} {
+					return &user.DeleteWebAuthnCredential{
+						ID: exampleWebAuthnBytes,
+					}
+				},
+				GetExampleResponse: func() interface{} {
+					return nil
+				},
+				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+					args := a.(*user.DeleteWebAuthnCredential)
+					m := me.AuthedGet(tlbx)
+					app.ReturnIf(session.IsBearer(tlbx), http.StatusForbidden, "api tokens can not manage passkeys")
+					_, err := service.Get(tlbx).Pwd().Exec(`DELETE FROM webAuthnCredentials WHERE user=? AND id=?`, m, args.ID)
+					PanicOn(err)
+					return nil
+				},
+			},
+			&app.Endpoint{
+				Description:  "start a passkey login, pass publicKey to navigator.credentials.get",
+				Path:         (&user.BeginWebAuthnLogin{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return &user.BeginWebAuthnLogin{}
+				},
+				GetExampleArgs: func() interface{} {
+					return &user.BeginWebAuthnLogin{
+						Challenge: ptr.String("Fk2b0t3s3c5kZ8mVd1rS4hY7uQ9wE6xA"),
+					}
+				},
+				GetExampleResponse: func() interface{} {
+					return &user.WebAuthnLogin{
+						Handle: "Fk2b0t3s3c5kZ8mVd1rS4hY7uQ9wE6xA",
+						PublicKey: &user.WebAuthnRequestOptions{
+							Challenge: exampleWebAuthnBytes,
+							RPID:      "example.com",
+							Timeout:   webAuthnTimeout.Milliseconds(),
+							AllowCredentials: []*user.WebAuthnDescriptor{
+								{
+									Type:       webAuthnType,
+									ID:         exampleWebAuthnBytes,
+									Transports: []string{"internal"},
+								},
+							},
+							UserVerification: "discouraged",
+						},
+					}
+				},
+				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+					args := a.(*user.BeginWebAuthnLogin)
+					app.BadReqIf(me.AuthedExists(tlbx), "already logged in")
+					srv := service.Get(tlbx)
+					res := &user.WebAuthnLogin{
+						Handle: crypt.UrlSafeString(webAuthnHandleLen),
+						PublicKey: &user.WebAuthnRequestOptions{
+							Challenge:        webauthn.Challenge(),
+							RPID:             webAuthn.RPID,
+							Timeout:          webAuthnTimeout.Milliseconds(),
+							AllowCredentials: []*user.WebAuthnDescriptor{},
+							// a passkey on its own must prove who is using it
+							UserVerification: "required",
+						},
+					}
+					state := []interface{}{"challenge", res.PublicKey.Challenge}
+					if args.Challenge != nil {
+						// second factor, the pwd or login link has already been checked
+						cnn := srv.Cache().Get()
+						defer cnn.Close()
+						idStr, err := redis.String(cnn.Do("HGET", totpChallengePrefix+*args.Challenge, "user"))
+						app.ReturnIf(err == redis.ErrNil, http.StatusUnauthorized, "invalid or expired challenge")
+						PanicOn(err)
+						id, err := ParseID(idStr)
+						PanicOn(err)
+						creds := getWebAuthnCredentials(srv.Pwd(), id)
+						app.ReturnIf(len(creds) == 0, http.StatusUnauthorized, "invalid or expired challenge")
+						for _, c := range creds {
+							res.PublicKey.AllowCredentials = append(res.PublicKey.AllowCredentials, &user.WebAuthnDescriptor{
+								Type:       webAuthnType,
+								ID:         c.ID,
+								Transports: c.Transports,
+							})
+						}
+						res.PublicKey.UserVerification = "discouraged"
+						state = append(state, "user", idStr, "loginChallenge", *args.Challenge)
+					}
+					putWebAuthnState(tlbx, webAuthnLoginPrefix+res.Handle, state...)
+					return res
+				},
+			},
+			&app.Endpoint{
+				Description:  "finish a passkey login with the result of navigator.credentials.get",
+				Path:         (&user.FinishWebAuthnLogin{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: 10 * app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return &user.FinishWebAuthnLogin{}
+				},
+				GetExampleArgs: func() interface{} {
+					return &user.FinishWebAuthnLogin{
+						Handle:            "Fk2b0t3s3c5kZ8mVd1rS4hY7uQ9wE6xA",
+						ID:                exampleWebAuthnBytes,
+						ClientDataJSON:    exampleWebAuthnBytes,
+						AuthenticatorData: exampleWebAuthnBytes,
+						Signature:         exampleWebAuthnBytes,
+					}
+				},
+				GetExampleResponse: func() interface{} {
+					ex := &user.Me{}
+					ex.ID = app.ExampleID()
+					if enableSocials {
+						ex.Handle = ptr.String("bloe_joggs")
+						ex.Alias = ptr.String("Joe Bloggs")
+						ex.HasAvatar = ptr.Bool(true)
+					}
+					if enableFCM {
+						ex.FcmEnabled = ptr.Bool(true)
+					}
+					return ex
+				},
+				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+					args := a.(*user.FinishWebAuthnLogin)
+					app.BadReqIf(me.AuthedExists(tlbx), "already logged in")
+					invalid := func(condition bool) {
+						app.ReturnIf(condition, http.StatusUnauthorized, "invalid passkey login")
+					}
+					// each handle can only be tried once
+					state := takeWebAuthnState(tlbx, webAuthnLoginPrefix+args.Handle)
+					invalid(state["challenge"] == "")
+					srv := service.Get(tlbx)
+					pwdtx := srv.Pwd().BeginWrite()
+					defer pwdtx.Rollback()
+					var id ID
+					c := &webauthn.Credential{}
+					row := pwdtx.QueryRow(`SELECT id, user, publicKey, signCount FROM webAuthnCredentials WHERE id=? FOR UPDATE`, args.ID)
+					err := row.Scan(&c.ID, &id, &c.PublicKey, &c.SignCount)
+					invalid(err == isql.ErrNoRows)
+					PanicOn(err)
+					isSecondFactor := state["user"] != ""
+					invalid(isSecondFactor && state["user"] != id.String())
+					signCount, err := webAuthn.VerifyAssertion([]byte(state["challenge"]), c, args.ClientDataJSON, args.AuthenticatorData, args.Signature, !isSecondFactor)
+					invalid(err != nil)
+					_, err = pwdtx.Exec(`UPDATE webAuthnCredentials SET signCount=?, lastUsedOn=? WHERE id=?`, signCount, tlbx.Start(), c.ID)
+					PanicOn(err)
+					tx := srv.User().BeginRead()
+					defer tx.Rollback()
+					user := getUser(tx, nil, &id)
+					invalid(user == nil)
+					tx.Commit()
+					pwdtx.Commit()
+					if isSecondFactor {
+						cnn := srv.Cache().Get()
+						defer cnn.Close()
+						_, err = cnn.Do("DEL", totpChallengePrefix+state["loginChallenge"])
+						PanicOn(err)
+					}
+					me.AuthedSet(tlbx, id)
+					return &user.Me
+				},
+			})
+	}
+	if enableOIDC {
+		eps = append(eps,
+			&app.Endpoint{
+				Description:  "get the names of the oidc providers which can be used to login",
+				Path:         (&user.GetOIDCProviders{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return nil
+				},
+				GetExampleArgs: func() interface{} {
+					return nil
+				},
+				GetExampleResponse: func() interface{} {
+					return []string{"google"}
+				},
+				Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
+					return oidcNames
+				},
+			},
+			&app.Endpoint{
+				Description:  "begin an oidc login, or link the provider account to the current user if already logged in",
+				Path:         (&user.BeginOIDCLogin{}).Path(),
+				Timeout:      15000,
+				MaxBodyBytes: app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return &user.BeginOIDCLogin{}
+				},
+				GetExampleArgs: func() interface{} {
+					return &user.BeginOIDCLogin{
+						Provider: "google",
+					}
+				},
+				GetExampleResponse: func() interface{} {
+					return &user.OIDCRedirect{
+						URL: "https://accounts.google.com/o/oauth2/v2/auth?client_id=abc&code_challenge=xyz&code_challenge_method=S256&response_type=code&scope=openid+email+profile&state=123",
+					}
+				},
+				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+					args := a.(*user.BeginOIDCLogin)
+					p := oidcProvidersByName[args.Provider]
+					app.BadReqIf(p == nil, "unknown oidc provider %q", args.Provider)
+					state, nonce, verifier := oidc.Verifier(), oidc.Verifier(), oidc.Verifier()
+					authURL, err := p.AuthURL(state, nonce, verifier)
+					if err != nil {
+						tlbx.Log().ErrorOn(err)
+						app.ReturnIf(true, http.StatusBadGateway, "oidc provider %s is unavailable", p.Name())
+					}
+					// tie the state to this browser's session so a victim can't
+					// be made to finish a login started by someone else
+					fields := []interface{}{"provider", p.Name(), "nonce", nonce, "verifier", verifier, "session", me.Get(tlbx).ID().String()}
+					if me.AuthedExists(tlbx) {
+						app.ReturnIf(session.IsBearer(tlbx), http.StatusForbidden, "api tokens can not link oidc accounts")
+						fields = append(fields, "link", me.AuthedGet(tlbx).String())
+					}
+					putState(tlbx, oidcStateExpiry, oidcStatePrefix+state, fields...)
+					return &user.OIDCRedirect{
+						URL: authURL,
+					}
+				},
+			},
+			&app.Endpoint{
+				Description:  "finish an oidc login with the state and code the provider redirected back with",
+				Path:         (&user.FinishOIDCLogin{}).Path(),
+				Timeout:      15000,
+				MaxBodyBytes: 5 * app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return &user.FinishOIDCLogin{}
+				},
+				GetExampleArgs: func() interface{} {
+					return &user.FinishOIDCLogin{
+						State: "123",
+						Code:  "abc",
+					}
+				},
+				GetExampleResponse: func() interface{} {
+					ex := &user.Me{}
+					ex.ID = app.ExampleID()
+					if enableSocials {
+						ex.Handle = ptr.String("bloe_joggs")
+						ex.Alias = ptr.String("Joe Bloggs")
+						ex.HasAvatar = ptr.Bool(true)
+					}
+					if enableFCM {
+						ex.FcmEnabled = ptr.Bool(true)
+					}
+					return &user.LoginRes{Me: ex}
+				},
+				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+					args := a.(*user.FinishOIDCLogin)
+					// each state can only be used once
+					state := takeState(tlbx, oidcStatePrefix+args.State)
+					p := oidcProvidersByName[state["provider"]]
+					app.ReturnIf(p == nil || me.Get(tlbx).ID().String() != state["session"], http.StatusUnauthorized, "invalid or expired oidc login")
+					claims, err := p.Exchange(args.Code, state["verifier"], state["nonce"])
+					if err != nil {
+						tlbx.Log().Warning("oidc login with %s failed: %s", p.Name(), ToError(err).Message())
+						app.ReturnIf(true, http.StatusUnauthorized, "oidc login failed")
+					}
+					srv := service.Get(tlbx)
+					tx := srv.User().BeginWrite()
+					defer tx.Rollback()
+					var id ID
+					row := tx.QueryRow(`SELECT user FROM oidcIdentities WHERE provider=? AND subject=?`, p.Name(), claims.Subject)
+					err = row.Scan(&id)
+					linked := err == nil
+					if err != isql.ErrNoRows {
+						PanicOn(err)
+					}
+					var u *fullUser
+					if state["link"] != "" {
+						app.ReturnIf(!me.AuthedExists(tlbx) || me.AuthedGet(tlbx).String() != state["link"], http.StatusUnauthorized, "invalid or expired oidc login")
+						m := me.AuthedGet(tlbx)
+						app.BadReqIf(linked && id != m, "%s account is already linked to another user", p.Name())
+						u = getUser(tx, nil, &m)
+						if !linked {
+							insertOIDCIdentity(tx, m, p.Name(), claims, tlbx.Start())
+						}
+						tx.Commit()
+						return &user.LoginRes{Me: &u.Me}
+					}
+					app.BadReqIf(me.AuthedExists(tlbx), "already logged in")
+					// provider accounts are only ever linked from a logged in
+					// session, never by matching emails
+					app.ReturnIf(!linked, http.StatusNotFound, "%s account isn't linked to a user, login and link it first", p.Name())
+					u = getUser(tx, nil, &id)
+					tx.Commit()
+					return login(tlbx, u, enableWebAuthn)
+				},
+			},
+			&app.Endpoint{
+				Description:  "get my linked oidc accounts",
+				Path:         (&user.GetOIDCIdentities{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return nil
+				},
+				GetExampleArgs: func() interface{} {
+					return nil
+				},
+				GetExampleResponse: func() interface{} {
+					return []*user.OIDCIdentity{
+						{
+							Provider:  "google",
+							Email:     "joe@bloggs.example",
+							CreatedOn: app.ExampleTime(),
+						},
+					}
+				},
+				Handler: func(tlbx app.Tlbx, _ interface{}) interface{} {
+					m := me.AuthedGet(tlbx)
+					res := []*user.OIDCIdentity{}
+					PanicOn(service.Get(tlbx).User().Query(func(rows isql.Rows) {
+						for rows.Next() {
+							i := &user.OIDCIdentity{}
+							PanicOn(rows.Scan(&i.Provider, &i.Email, &i.CreatedOn))
+							res = append(res, i)
+						}
+					}, `SELECT provider, email, createdOn FROM oidcIdentities WHERE user=? ORDER BY provider`, m))
+					return res
+				},
+			},
+			&app.Endpoint{
+				Description:  "unlink an oidc account",
+				Path:         (&user.DeleteOIDCIdentity{}).Path(),
+				Timeout:      500,
+				MaxBodyBytes: app.KB,
+				IsPrivate:    false,
+				GetDefaultArgs: func() interface{} {
+					return &user.DeleteOIDCIdentity{}
+				},
+				GetExampleArgs: func() interface{} {
+					return &user.DeleteOIDCIdentity{
+						Provider: "google",
+					}
+				},
+				GetExampleResponse: func() interface{} {
+					return nil
+				},
+				Handler: func(tlbx app.Tlbx, a interface{}) interface{} {
+					args := a.(*user.DeleteOIDCIdentity)
+					m := me.AuthedGet(tlbx)
+					app.ReturnIf(session.IsBearer(tlbx), http.StatusForbidden, "api tokens can not unlink oidc accounts")
+					srv := service.Get(tlbx)
+					tx := srv.User().BeginWrite()
+					defer tx.Rollback()
+					// the user must be left with some way to login
+					otherIdents := 0
+					PanicOn(tx.QueryRow(`SELECT COUNT(*) FROM oidcIdentities WHERE user=? AND provider<>? FOR UPDATE`, m, args.Provider).Scan(&otherIdents))
+					if otherIdents == 0 {
+						hasLogin := false
+						PanicOn(srv.Pwd().QueryRow(`SELECT EXISTS(SELECT 1 FROM pwds WHERE id=?) OR (? AND EXISTS(SELECT 1 FROM webAuthnCredentials WHERE user=?))`, m, enableWebAuthn, m).Scan(&hasLogin))
+						app.BadReqIf(!hasLogin, "can not unlink your only way to login")
+					}
+					_, err := tx.Exec(`DELETE FROM oidcIdentities WHERE user=? AND provider=?`, m, args.Provider)
+					PanicOn(err)
+					tx.Commit()
+					return nil
+				},
+			})
+	}
+	return eps
+}
+
+var (
+	// per ip limits for endpoints which are brute forced or send emails,
+	// these replace the rate limit mwares default policy
+	loginRateLimit = &app.RateLimit{
+		Algo:   app.TokenBucket,
+		Limit:  30,
+		Window: time.Minute,
+	}
+	registerRateLimit = &app.RateLimit{
+		Algo:   app.SlidingWindow,
+		Limit:  20,
+		Window: time.Hour,
+	}
+	emailRateLimit = &app.RateLimit{
+		Algo:   app.SlidingWindow,
+		Limit:  10,
+		Window: 10 * time.Minute,
+	}
+)
+
+var (
+	handleRegex  = regexp.MustCompile(`\A[_a-z0-9]{1,20}\z`)
+	handleMinLen = 1
+	handleMaxLen = 20
+	emailRegex   = regexp.MustCompile(`\A.+@.+\..+\z`)
+	emailMaxLen  = 250
+	aliasMaxLen  = 50
+	localeRegex  = regexp.MustCompile(`\A[a-zA-Z]{2,3}([-_][a-zA-Z0-9]{2,8})*\z`)
+	localeMaxLen = 35
+	pwdRegexs    = []*regexp.Regexp{
+		regexp.MustCompile(`[0-9]`),
+		regexp.MustCompile(`[a-z]`),
+		regexp.MustCompile(`[A-Z]`),
+		regexp.MustCompile(`[\w]`),
+	}
+	pwdMinLen = 8
+	pwdMaxLen = 100
+	// new pwds use argon2id, old scrypt pwds are rehashed on next login
+	pwdHashers = crypt.NewPwdHashers(
+		&crypt.Argon2id{
+			Time:    2,
+			Memory:  19 * 1024,
+			Threads: 1,
+			SaltLen: 32,
+			KeyLen:  32,
+		},
+		&crypt.Scrypt{
+			N:       32768,
+			R:       8,
+			P:       1,
+			SaltLen: 256,
+			KeyLen:  256,
+		})
+	avatarDim = 250
+	// the default email locale, templates are in emails/<locale>
+	emailLocale = "en"
+	// api token value length, tokens are random so sha256 is a safe hash
+	tokenLen          = 48
+	tokenNameMaxLen   = 50
+	tokenScopesMaxLen = 2000
+	tokenMaxScopes    = 20
+	tokenMaxPerUser   = 20
+	// two factor auth
+	totpChallengePrefix   = "totp-challenge:"
+	totpChallengeLen      = 32
+	totpChallengeExpiry   = 5 * time.Minute
+	totpChallengeAttempts = int64(5)
+	recoveryCodeCount     = 10
+	recoveryCodeLen       = 12
+	// passkeys
+	webAuthnType        = "public-key"
+	webAuthnRegPrefix   = "webauthn-reg:"
+	webAuthnLoginPrefix = "webauthn-login:"
+	webAuthnHandleLen   = 32
+	webAuthnTimeout     = 5 * time.Minute
+	webAuthnNameMaxLen  = 50
+	webAuthnMaxPerUser  = 20
+	webAuthnTransports  = map[string]bool{
+		"ble":        true,
+		"hybrid":     true,
+		"internal":   true,
+		"nfc":        true,
+		"smart-card": true,
+		"usb":        true,
+	}
+	// web push, matches the webPushSubscriptions.endpoint column
+	webPushEndpointMaxLen = 1000
+	// notification prefs, match the notificationSettings.timeZone column
+	timeZoneMaxLen            = 64
+	notificationCategoriesMax = 20
+	hhmmRegex                 = regexp.MustCompile(`\A([01][0-9]|2[0-3]):[0-5][0-9]\z`)
+	// oidc logins
+	oidcStatePrefix      = "oidc-state:"
+	oidcStateExpiry      = 10 * time.Minute
+	exampleWebAuthnBytes = []byte("0123456789abcdefghijklmnopqrstuv")
+	exampleJin           = json.MustFromString(`{"v":1, "saveDir":"/my/save/dir", "startTab":"favourites"}`)
+)
+
+//go:embed emails
+var defaultEmails embed.FS
+
+// newEmails returns the default email templates overridden by tmpls.
+func newEmails(tmpls fs.FS) *tmpl.Set {
+	defaults, err := fs.Sub(defaultEmails, "emails")
+	PanicOn(err)
+	if tmpls == nil {
+		return tmpl.New(emailLocale, defaults)
+	}
+	return tmpl.New(emailLocale, defaults, tmpls)
+}
+
+type emailData struct {
+	Handle string
+	Link   string
+	Pwd    string
+	IP     string
+}
+
+// sendEmail queues the email template name in the users stored locale, or if
+// they haven't set one, the best match for the requests Accept-Language. It
+// is added to the outbox in tx so it is only sent if tx commits.
+func sendEmail(tlbx app.Tlbx, tx sql.Tx, emails *tmpl.Set, sendTo, from, name string, locale, handle *string, data *emailData) {
+	prefs := tmpl.ParseAcceptLanguage(tlbx.Req().Header.Get("Accept-Language"))
+	if locale != nil {
+		prefs = append([]string{*locale}, prefs...)
+	}
+	if handle != nil {
+		data.Handle = *handle
+	}
+	e, err := emails.Render(emails.Locale(prefs...), name, data)
+	PanicOn(err)
+	outbox.Add(tx, tlbx.NewID(), []string{sendTo}, from, e.Subject, e.HTML, e.Text)
+}
+
+// login auths the session as u, unless u has two factor auth enabled, in
+// which case the session is left as is and a challenge for LoginTOTP or
+// BeginWebAuthnLogin is returned. Passkeys are a second factor if enabled.
+func login(tlbx app.Tlbx, u *fullUser, enableWebAuthn bool) *user.LoginRes {
+	srv := service.Get(tlbx)
+	enabled := false
+	PanicOn(srv.Pwd().QueryRow(`SELECT EXISTS(SELECT 1 FROM totps WHERE id=? AND confirmedOn IS NOT NULL) OR (? AND EXISTS(SELECT 1 FROM webAuthnCredentials WHERE user=?))`, u.ID, enableWebAuthn, u.ID).Scan(&enabled))
+	if !enabled {
+		me.AuthedSet(tlbx, u.ID)
+		return &user.LoginRes{Me: &u.Me}
+	}
+	challenge := crypt.UrlSafeString(totpChallengeLen)
+	key := totpChallengePrefix + challenge
+	cnn := srv.Cache().Get()
+	defer cnn.Close()
+	PanicOn(cnn.Send("MULTI"))
+	PanicOn(cnn.Send("HSET", key, "user", u.ID.String(), "attempts", 0))
+	PanicOn(cnn.Send("PEXPIRE", key, totpChallengeExpiry.Milliseconds()))
+	_, err := cnn.Do("EXEC")
+	PanicOn(err)
+	return &user.LoginRes{Challenge: &challenge}
+}
+
+type totp struct {
+	Secret      []byte
+	ConfirmedOn *time.Time
+	LastCounter int64
+}
+
+// getTOTP returns the users totp with its secret decrypted, secrets are
+// encrypted at rest with keys.
+func getTOTP(pwdtx sql.Tx, keys [][]byte, id ID) *totp {
+	row := pwdtx.QueryRow(`SELECT secret, confirmedOn, lastCounter FROM totps WHERE id=? FOR UPDATE`, id)
+	res := &totp{}
+	err := row.Scan(&res.Secret, &res.ConfirmedOn, &res.LastCounter)
+	if err == isql.ErrNoRows {
+		return nil
+	}
+	PanicOn(err)
+	res.Secret = crypt.MustOpen(keys, res.Secret)
+	return res
+}
+
+// checkTOTP returns true if code is a totp code that hasn't been used
+// before, allowing for 1 step of clock drift, or an unused recovery code,
+// which is then consumed.
+func checkTOTP(tlbx app.Tlbx, pwdtx sql.Tx, id ID, t *totp, code string) bool {
+	code = StrTrimWS(code)
+	now := crypt.TOTPCounter(tlbx.Start())
+	for counter := now - 1; counter <= now+1; counter++ {
+		if counter > t.LastCounter && subtle.ConstantTimeCompare([]byte(crypt.TOTPCode(t.Secret, counter)), []byte(code)) == 1 {
+			_, err := pwdtx.Exec(`UPDATE totps SET lastCounter=? WHERE id=?`, counter, id)
+			PanicOn(err)
+			t.LastCounter = counter
+			return true
+		}
+	}
+	if t.ConfirmedOn == nil {
+		return false
+	}
+	res, err := pwdtx.Exec(`DELETE FROM recoveryCodes WHERE id=? AND hash=?`, id, hashRecoveryCode(code))
+	PanicOn(err)
+	n, err := res.RowsAffected()
+	PanicOn(err)
+	return n == 1
+}
+
+// setRecoveryCodes replaces any existing recovery codes, they are only
+// stored hashed so must be shown to the user now.
+func setRecoveryCodes(pwdtx sql.Tx, id ID) []string {
+	_, err := pwdtx.Exec(`DELETE FROM recoveryCodes WHERE id=?`, id)
+	PanicOn(err)
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := crypt.UrlSafeString(recoveryCodeLen)
+		_, err = pwdtx.Exec(`INSERT INTO recoveryCodes (id, hash) VALUES (?, ?)`, id, hashRecoveryCode(code))
+		PanicOn(err)
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+// recovery codes are random so sha256 is a safe hash
+func hashRecoveryCode(code string) []byte {
+	sum := sha256.Sum256([]byte(code))
+	return sum[:]
+}
+
+func webAuthnParams() []*user.WebAuthnParam {
+	res := make([]*user.WebAuthnParam, 0, len(webauthn.Algs))
+	for _, alg := range webauthn.Algs {
+		res = append(res, &user.WebAuthnParam{
+			Type: webAuthnType,
+			Alg:  alg,
+		})
+	}
+	return res
+}
+
+func getWebAuthnCredentials(pwds sql.ClientCore, m ID) []*user.WebAuthnCredential {
+	res := []*user.WebAuthnCredential{}
+	PanicOn(pwds.Query(func(rows isql.Rows) {
+		for rows.Next() {
+			c := &user.WebAuthnCredential{}
+			transports := []byte{}
+			PanicOn(rows.Scan(&c.ID, &c.Name, &transports, &c.CreatedOn, &c.LastUsedOn))
+			json.MustUnmarshal(transports, &c.Transports)
+			res = append(res, c)
+		}
+	}, `SELECT id, name, transports, createdOn, lastUsedOn FROM webAuthnCredentials WHERE user=? ORDER BY createdOn DESC`, m))
+	return res
+}
+
+func insertOIDCIdentity(tx sql.Tx, m ID, provider string, claims *oidc.Claims, now time.Time) {
+	email := claims.Email
+	if len(email) > emailMaxLen {
+		email = email[:emailMaxLen]
+	}
+	_, err := tx.Exec(`INSERT INTO oidcIdentities (user, provider, subject, email, createdOn) VALUES (?, ?, ?, ?, ?)`, m, provider, claims.Subject, email, now)
+	if err != nil {
+		mySqlErr, ok := err.(*mysql.MySQLError)
+		app.BadReqIf(ok && mySqlErr.Number == 1062, "a %s account is already linked", provider)
+	}
+	PanicOn(err)
+}
+
+// putWebAuthnState stores the state of a pending ceremony until it times
+// out.
+func putWebAuthnState(tlbx app.Tlbx, key string, fields ...interface{}) {
+	putState(tlbx, webAuthnTimeout, key, fields...)
+}
+
+// takeWebAuthnState gets and deletes the state of a pending ceremony, so
+// each challenge can only be used once, it is empty if there is none.
+func takeWebAuthnState(tlbx app.Tlbx, key string) map[string]string {
+	return takeState(tlbx, key)
+}
+
+// putState stores the state of a pending login or registration until
+// expiry.
+func putState(tlbx app.Tlbx, expiry time.Duration, key string, fields ...interface{}) {
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	PanicOn(cnn.Send("MULTI"))
+	PanicOn(cnn.Send("DEL", key))
+	PanicOn(cnn.Send("HSET", append([]interface{}{key}, fields...)...))
+	PanicOn(cnn.Send("PEXPIRE", key, expiry.Milliseconds()))
+	_, err := cnn.Do("EXEC")
+	PanicOn(err)
+}
+
+// takeState gets and deletes the state stored by putState, so each
+// challenge can only be used once, it is empty if there is none.
+func takeState(tlbx app.Tlbx, key string) map[string]string {
+	cnn := service.Get(tlbx).Cache().Get()
+	defer cnn.Close()
+	PanicOn(cnn.Send("MULTI"))
+	PanicOn(cnn.Send("HGETALL", key))
+	PanicOn(cnn.Send("DEL", key))
+	res, err := redis.Values(cnn.Do("EXEC"))
+	PanicOn(err)
+	state, err := redis.StringMap(res[0], nil)
+	PanicOn(err)
+	return state
+}
+
+func webAuthnErrMsg(err error) string {
+	if err == nil {
+		return ""
+	}
+	return ToError(err).Message()
+}
+
+type fullUser struct {
+	user.Me
+	Email                  string
+	RegisteredOn           time.Time
+	ActivatedOn            time.Time
+	NewEmail               *string
+	ActivateCode           *string
+	ChangeEmailCode        *string
+	LastPwdResetOn         *time.Time
+	LoginLinkCodeCreatedOn *time.Time
+	LoginLinkCode          *string
+	Locale                 *string
+}
+
+func getUser(tx sql.Tx, email *string, id *ID) *fullUser {
+	PanicIf(email == nil && id == nil, "one of email or id must not be nil")
+	query := `SELECT id, email, handle, alias, hasAvatar, fcmEnabled, registeredOn, activatedOn, newEmail, activateCode, changeEmailCode, lastPwdResetOn, loginLinkCodeCreatedOn, loginLinkCode, locale FROM users WHERE `
+	var arg interface{}
+	if email != nil {
+		query += `email=?`
+		arg = *email
+	} else {
+		query += `id=?`
+		arg = *id
+	}
+	row := tx.QueryRow(query, arg)
+	res := &fullUser{}
+	err := row.Scan(&res.ID, &res.Email, &res.Handle, &res.Alias, &res.HasAvatar, &res.FcmEnabled, &res.RegisteredOn, &res.ActivatedOn, &res.NewEmail, &res.ActivateCode, &res.ChangeEmailCode, &res.LastPwdResetOn, &res.LoginLinkCodeCreatedOn, &res.LoginLinkCode, &res.Locale)
+	if err == isql.ErrNoRows {
+		return nil
+	}
+	PanicOn(err)
+	return res
+}
+
+func updateUser(tx sql.Tx, user *fullUser) {
+	_, err := tx.Exec(`UPDATE users SET email=?, handle=?, alias=?, hasAvatar=?, fcmEnabled=?, registeredOn=?, activatedOn=?, newEmail=?, activateCode=?, changeEmailCode=?, lastPwdResetOn=?, loginLinkCodeCreatedOn=?, loginLinkCode=?, locale=? WHERE id=?`, user.Email, user.Handle, user.Alias, user.HasAvatar, user.FcmEnabled, user.RegisteredOn, user.ActivatedOn, user.NewEmail, user.ActivateCode, user.ChangeEmailCode, user.LastPwdResetOn, user.LoginLinkCodeCreatedOn, user.LoginLinkCode, user.Locale, user.ID)
+	PanicOn(err)
+}
+
+func getPwd(pwdtx sql.Tx, id ID) *crypt.PwdHash {
+	row := pwdtx.QueryRow(`SELECT alg, salt, pwd, p1, p2, p3 FROM pwds WHERE id=?`, id)
+	res := &crypt.PwdHash{}
+	err := row.Scan(&res.Alg, &res.Salt, &res.Key, &res.Params[0], &res.Params[1], &res.Params[2])
+	if err == isql.ErrNoRows {
+		return nil
+	}
+	PanicOn(err)
+	return res
+}
+
+// checkPwd rejects weak or breached pwds with a field error per reason,
+// userInputs are the users email, handle etc.
+func checkPwd(tlbx app.Tlbx, pwdCheck *pwdcheck.Checker, field, pwd string, userInputs ...string) {
+	if pwdCheck == nil {
+		return
+	}
+	issues, err := pwdCheck.Check(pwd, userInputs...)
+	if err != nil {
+		// an unreadable breach corpus shouldn't stop pwds being set
+		tlbx.Log().ErrorOn(err)
+	}
+	fields := make([]*app.FieldErr, 0, len(issues))
+	for _, i := range issues {
+		fields = append(fields, &app.FieldErr{
+			Field: field,
+			Code:  i.Code,
+			Msg:   i.Msg,
+		})
+	}
+	app.BadReqFieldsIf(fields, "%s is not strong enough", field)
+}
+
+func setPwd(tlbx app.Tlbx, pwdtx sql.Tx, id ID, pwd string) {
+	validate.Str("pwd", pwd, tlbx, pwdMinLen, pwdMaxLen, pwdRegexs...)
+	h := pwdHashers.Hash([]byte(pwd))
+	_, err := pwdtx.Exec(`INSERT INTO pwds (id, alg, salt, pwd, p1, p2, p3) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE alg=VALUE(alg), salt=VALUE(salt), pwd=VALUE(pwd), p1=VALUE(p1), p2=VALUE(p2), p3=VALUE(p3)`, id, h.Alg, h.Salt, h.Key, h.Params[0], h.Params[1], h.Params[2])
+	PanicOn(err)
+}
+
+func getJin(tx sql.Tx, me ID, dst interface{}) {
+	qryArgs := sqlh.NewArgs(0)
+	qry := qryJinSelect(qryArgs, me)
+	row := tx.QueryRow(qry, qryArgs.Is()...)
+	var err error
 	if js, ok := dst.(*json.Json); ok {
 		err = row.Scan(js)
 	} else {
@@ -1213,3 +2867,36 @@ func delJin(tx sql.Tx, me ID) {
 	_, err := tx.Exec(qry, qryArgs.Is()...)
 	PanicOn(err)
 }
+
+// parseMinutes parses a hh:mm time to minutes after midnight.
+func parseMinutes(tlbx app.Tlbx, field, hhmm string) *int {
+	validate.Str(field, hhmm, tlbx, 5, 5, hhmmRegex)
+	h, m := 0, 0
+	_, err := fmt.Sscanf(hhmm, "%d:%d", &h, &m)
+	PanicOn(err)
+	return ptr.Int(h*60 + m)
+}
+
+func fmtMinutes(minutes int) string {
+	return Strf("%02d:%02d", minutes/60, minutes%60)
+}
+
+func exampleNotificationPrefs() *user.NotificationPrefs {
+	return &user.NotificationPrefs{
+		TimeZone: "Europe/London",
+		QuietHours: &user.QuietHours{
+			Start: "22:30",
+			End:   "07:00",
+		},
+		Categories: map[string]*user.NotificationCategoryPrefs{
+			"gameTurn": {
+				Enabled: true,
+				Digest:  false,
+			},
+			"listShared": {
+				Enabled: true,
+				Digest:  true,
+			},
+		},
+	}
+}
@@ -9,3 +9,7 @@ import (
 func Test(t *testing.T) {
 	usertest.Everything(t)
 }
+
+func TestCookieSessions(t *testing.T) {
+	usertest.EverythingCookieSessions(t)
+}
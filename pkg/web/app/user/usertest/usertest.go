@@ -1,25 +1,68 @@
 package usertest
 
 import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base32"
 	"encoding/base64"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/crypt"
+	"github.com/0xor1/tlbx/pkg/email/feedback"
+	"github.com/0xor1/tlbx/pkg/email/outbox"
+	fcmclient "github.com/0xor1/tlbx/pkg/fcm"
 	"github.com/0xor1/tlbx/pkg/json"
+	"github.com/0xor1/tlbx/pkg/oidc"
 	"github.com/0xor1/tlbx/pkg/ptr"
+	"github.com/0xor1/tlbx/pkg/pwdcheck"
 	"github.com/0xor1/tlbx/pkg/web/app"
 	"github.com/0xor1/tlbx/pkg/web/app/config"
+	"github.com/0xor1/tlbx/pkg/web/app/emailfeedback"
+	"github.com/0xor1/tlbx/pkg/web/app/emailfeedback/emailfeedbackeps"
 	"github.com/0xor1/tlbx/pkg/web/app/service"
+	"github.com/0xor1/tlbx/pkg/web/app/service/fcm"
 	"github.com/0xor1/tlbx/pkg/web/app/service/sql"
+	"github.com/0xor1/tlbx/pkg/web/app/session"
 	"github.com/0xor1/tlbx/pkg/web/app/test"
 	"github.com/0xor1/tlbx/pkg/web/app/user"
 	"github.com/0xor1/tlbx/pkg/web/app/user/usereps"
+	"github.com/0xor1/tlbx/pkg/webauthn"
+	"github.com/0xor1/tlbx/pkg/webpush"
 	"github.com/stretchr/testify/assert"
 )
 
+type failingEmail struct{}
+
+func (*failingEmail) Send(sendTo []string, from, subject, html, text string) error {
+	return Err("smtp unavailable")
+}
+
+func (e *failingEmail) MustSend(sendTo []string, from, subject, html, text string) {
+	PanicOn(e.Send(sendTo, from, subject, html, text))
+}
+
+// doFrom calls path as if from remoteAddr so per ip limits can be hit
+// without affecting the rest of the rig.
+func doFrom(r test.Rig, remoteAddr, path, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(http.MethodPut, "http://localhost"+app.ApiPathPrefix+path, strings.NewReader(body))
+	PanicOn(err)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("X-Client", "tlbx-go-client")
+	req.Header.Set(app.CSRFHeaderName, "csrf")
+	req.AddCookie(&http.Cookie{Name: app.CSRFCookieName, Value: "csrf"})
+	rec := httptest.NewRecorder()
+	r.RootHandler()(rec, req)
+	return rec
+}
+
 type appData struct {
 	Foo int    `json:"foo"`
 	Bar string `json:"bar"`
@@ -43,9 +86,19 @@ func (*appData) Validate(_ app.Tlbx, ad interface{}) {
 }
 
 func Everything(t *testing.T) {
+	everything(t, session.RedisStore)
+}
+
+// EverythingCookieSessions runs Everything with sessions held in cookies
+// rather than redis.
+func EverythingCookieSessions(t *testing.T) {
+	everything(t, session.CookieStore)
+}
+
+func everything(t *testing.T, sessionStore string) {
 	r := test.NewMeRig(
-		config.GetProcessed(config.GetBase()),
-		nil,
+		config.GetProcessed(config.GetBase().SetDefault("web.session.store", sessionStore)),
+		emailfeedbackeps.New(nil, "sparkpost", "sp-pwd"),
 		func(r test.Rig, reg *user.Register) {
 			reg.AppData = &appData{
 				Foo: r.Unique(),
@@ -146,14 +199,13 @@ func Everything(t *testing.T) {
 		Email: email,
 	}).MustDo(c)
 
-	var myID ID
-	var code string
-	row := r.User().Primary().QueryRow(`SELECT id, activateCode FROM users WHERE email=?`, email)
-	PanicOn(row.Scan(&myID, &code))
-
+	activateEmail := r.LatestEmail(email)
+	a.Equal("Activate", activateEmail.Subject)
+	a.Equal(2, len(r.Mailbox().Msgs(email)))
+	link := activateEmail.LinkQuery()
 	(&user.Activate{
-		Me:   myID,
-		Code: code,
+		Me:   MustParseID(link.Get("me")),
+		Code: link.Get("code"),
 	}).MustDo(c)
 
 	// check return ealry path
@@ -164,7 +216,7 @@ func Everything(t *testing.T) {
 	id := (&user.Login{
 		Email: email,
 		Pwd:   pwd,
-	}).MustDo(c).ID
+	}).MustDo(c).Me.ID
 
 	tmpFirstID := id.Copy()
 	defer func() {
@@ -174,46 +226,491 @@ func Everything(t *testing.T) {
 		PanicOn(err)
 	}()
 
+	// repeated failed logins lock out the account from the failing ip only
+	loginBody := func(p string) string {
+		return Strf(`{"email":%q,"pwd":%q}`, email, p)
+	}
+	wrongPwd := pwd + "wrong"
+	lockAddrs := []string{
+		Strf("172.17.%d.%d:1234", r.Unique()>>8&255, r.Unique()&255),
+		Strf("172.18.%d.%d:1234", r.Unique()>>8&255, r.Unique()&255),
+	}
+	for _, lockAddr := range lockAddrs {
+		for i := 0; i < 5; i++ {
+			lockRec := doFrom(r, lockAddr, (&user.Login{}).Path(), loginBody(wrongPwd))
+			a.Equal(http.StatusNotFound, lockRec.Code)
+		}
+		lockRec := doFrom(r, lockAddr, (&user.Login{}).Path(), loginBody(pwd))
+		a.Equal(http.StatusTooManyRequests, lockRec.Code)
+		a.Contains(lockRec.Body.String(), "too many attempts, try again in 60 seconds")
+	}
+	// only the first lock in a window emails the owner
+	a.Equal("Failed Login Attempts", r.LatestEmail(email).Subject)
+	lockedEmails := 0
+	for _, m := range r.Mailbox().Msgs(email) {
+		if m.Subject == "Failed Login Attempts" {
+			lockedEmails++
+		}
+	}
+	a.Equal(1, lockedEmails)
+	(&user.Login{
+		Email: email,
+		Pwd:   pwd,
+	}).MustDo(c)
+
+	// email sending endpoints are rate limited per ip whichever email is used
+	rlAddr := Strf("192.168.%d.%d:1234", r.Unique()>>8&255, r.Unique()&255)
+	for i := 0; i < 11; i++ {
+		rlRec := doFrom(r, rlAddr, (&user.SendLoginLinkEmail{}).Path(), Strf(`{"email":"rl%d_%d@test.localhost"}`, r.Unique(), i))
+		a.Equal("10", rlRec.Header().Get("X-Rate-Limit-Limit"))
+		if i < 10 {
+			a.Equal(http.StatusBadRequest, rlRec.Code)
+		} else {
+			a.Equal(http.StatusTooManyRequests, rlRec.Code)
+			a.NotEmpty(rlRec.Header().Get("Retry-After"))
+		}
+	}
+
+	// requesting emails for someone else only locks out the requesting ip
+	attackerAddr := Strf("172.16.%d.%d:1234", r.Unique()>>8&255, r.Unique()&255)
+	for i := 0; i < 6; i++ {
+		attackRec := doFrom(r, attackerAddr, (&user.ResendActivateLink{}).Path(), Strf(`{"email":%q}`, email))
+		if i < 5 {
+			a.Equal(http.StatusOK, attackRec.Code)
+		} else {
+			a.Equal(http.StatusTooManyRequests, attackRec.Code)
+		}
+	}
+	(&user.ResendActivateLink{
+		Email: email,
+	}).MustDo(c)
+
 	(&user.SendLoginLinkEmail{Email: email}).MustDo(c)
-	row = r.User().Primary().QueryRow(`SELECT loginLinkCode FROM users WHERE id=?`, id)
-	loginLinkCode := ""
-	PanicOn(row.Scan(&loginLinkCode))
+	// emails are queued in the outbox and sent by the dispatcher
+	emailID := ID{}
+	PanicOn(r.User().Primary().QueryRow(`SELECT id FROM emailOutbox WHERE sendTo=JSON_ARRAY(?) ORDER BY createdOn DESC LIMIT 1`, email).Scan(&emailID))
+	delivery := outbox.Get(r.User().Primary(), emailID)
+	a.Equal(outbox.StatusPending, delivery.Status)
+	a.Equal([]string{email}, delivery.SendTo)
+	for delivery.Status == outbox.StatusPending {
+		_, err = r.Outbox().DispatchOne(emailID)
+		a.Nil(err)
+		delivery = outbox.Get(r.User().Primary(), emailID)
+	}
+	a.Equal(outbox.StatusSent, delivery.Status)
+	a.Equal(1, delivery.Attempts)
+	a.NotNil(delivery.SentOn)
+	// bodies are blanked once they're done with as they may hold secrets
+	assertBlanked := func(id ID) {
+		var html, text string
+		PanicOn(r.User().Primary().QueryRow(`SELECT html, text FROM emailOutbox WHERE id=?`, id).Scan(&html, &text))
+		a.Empty(html)
+		a.Empty(text)
+	}
+	assertBlanked(emailID)
+	// failed sends are retried then dead lettered
+	failingEmailID := NewIDGen().MustNew()
+	outbox.Add(r.User().Primary(), failingEmailID, []string{email}, "test@test.localhost", "subject", "html", "text")
+	failing := outbox.NewDispatcher(r.User(), &failingEmail{}, r.Log(), &outbox.Config{
+		BatchSize:   1,
+		Lease:       time.Minute,
+		MaxAttempts: 2,
+	})
+	// only the failing email is dispatched, other tests' emails are left alone
+	dispatched, err := failing.DispatchOne(failingEmailID)
+	a.Nil(err)
+	a.True(dispatched)
+	delivery = outbox.Get(r.User().Primary(), failingEmailID)
+	a.Equal(outbox.StatusPending, delivery.Status)
+	a.Equal(1, delivery.Attempts)
+	a.Equal("smtp unavailable", *delivery.LastError)
+	dispatched, err = failing.DispatchOne(failingEmailID)
+	a.Nil(err)
+	a.True(dispatched)
+	delivery = outbox.Get(r.User().Primary(), failingEmailID)
+	a.Equal(outbox.StatusDead, delivery.Status)
+	a.Equal(2, delivery.Attempts)
+	a.Nil(delivery.NextAttemptOn)
+	assertBlanked(failingEmailID)
+	a.Nil(outbox.Get(r.User().Primary(), NewIDGen().MustNew()))
+
+	loginLinkEmail := r.LatestEmail(email)
+	a.Equal("Login Link", loginLinkEmail.Subject)
+	link = loginLinkEmail.LinkQuery()
+	a.Equal(id, MustParseID(link.Get("me")))
 	id = (&user.LoginLinkLogin{
 		Me:   id,
-		Code: loginLinkCode,
-	}).MustDo(c).ID
+		Code: link.Get("code"),
+	}).MustDo(c).Me.ID
 
+	changeEmail := Strf("change@test.localhost%d", r.Unique())
 	(&user.ChangeEmail{
-		NewEmail: Strf("change@test.localhost%d", r.Unique()),
+		NewEmail: changeEmail,
 	}).MustDo(c)
 
 	(&user.ResendChangeEmailLink{}).MustDo(c)
 
-	row = r.User().Primary().QueryRow(`SELECT changeEmailCode FROM users WHERE id=?`, id)
-	PanicOn(row.Scan(&code))
-
+	confirmEmail := r.LatestEmail(changeEmail)
+	a.Equal("Confirm change email", confirmEmail.Subject)
+	a.Equal(2, len(r.Mailbox().Msgs(changeEmail)))
 	(&user.ConfirmChangeEmail{
 		Me:   id,
-		Code: code,
+		Code: confirmEmail.LinkQuery().Get("code"),
 	}).MustDo(c)
 
 	(&user.ChangeEmail{
 		NewEmail: email,
 	}).MustDo(c)
 
-	row = r.User().Primary().QueryRow(`SELECT changeEmailCode FROM users WHERE id=?`, id)
-	PanicOn(row.Scan(&code))
-
 	(&user.ConfirmChangeEmail{
 		Me:   id,
-		Code: code,
+		Code: r.LatestEmail(email).LinkQuery().Get("code"),
 	}).MustDo(c)
 
+	// hard bounces and complaints suppress further emails
+	bounced := Strf("bounced@test.localhost%d", r.Unique())
+	defer func() {
+		_, err = r.User().Primary().Exec(`DELETE FROM emailSuppressions WHERE email=?`, bounced)
+		PanicOn(err)
+	}()
+	spEvents := []byte(Strf(`[{"msys":{"message_event":{"type":"bounce","bounce_class":"10","rcpt_to":%q,"raw_reason":"550 no such user"}}}]`, bounced))
+	err = (&emailfeedback.SparkPost{Body: spEvents}).Do(c)
+	a.Equal(http.StatusUnauthorized, err.(*app.ErrMsg).Status)
+	spReq, err := http.NewRequest(http.MethodPost, "http://localhost"+app.ApiPathPrefix+(&emailfeedback.SparkPost{}).Path(), bytes.NewReader(spEvents))
+	PanicOn(err)
+	spReq.SetBasicAuth("sparkpost", "sp-pwd")
+	spRec := httptest.NewRecorder()
+	r.RootHandler()(spRec, spReq)
+	a.Equal(http.StatusOK, spRec.Code)
+	suppressed, err := feedback.Suppressed(r.User().Primary(), bounced, email)
+	a.Nil(err)
+	a.Equal(map[string]bool{bounced: true}, suppressed)
+	r.Email().MustSend([]string{bounced, email}, "test@test.localhost", "subject", "html", "text")
+	a.Empty(r.Mailbox().Msgs(bounced))
+	a.Equal("subject", r.Mailbox().Latest(email).Subject)
+	// emails to only suppressed addresses aren't marked sent
+	suppressedEmailID := NewIDGen().MustNew()
+	outbox.Add(r.User().Primary(), suppressedEmailID, []string{bounced}, "test@test.localhost", "subject", "html", "text")
+	dispatched, err = r.Outbox().DispatchOne(suppressedEmailID)
+	a.Nil(err)
+	a.True(dispatched)
+	delivery = outbox.Get(r.User().Primary(), suppressedEmailID)
+	a.Equal(outbox.StatusSuppressed, delivery.Status)
+	a.Nil(delivery.SentOn)
+	assertBlanked(suppressedEmailID)
+	a.Empty(r.Mailbox().Msgs(bounced))
+	_, err = r.User().Primary().Exec(`DELETE FROM emailOutbox WHERE id=?`, suppressedEmailID)
+	PanicOn(err)
+	// users can resume emails to their own address
+	feedback.Suppress(r.User().Primary(), &feedback.Event{Email: email, Type: feedback.TypeComplaint, Detail: "spam"})
+	(&user.UnsuppressEmail{}).MustDo(c)
+	suppressed, err = feedback.Suppressed(r.User().Primary(), email)
+	a.Nil(err)
+	a.Empty(suppressed)
+
+	// server side sessions
+	c2 := r.NewClient()
+	(&user.Login{
+		Email: email,
+		Pwd:   pwd,
+	}).MustDo(c2)
+	if sessionStore == session.CookieStore {
+		a.Empty((&user.GetSessions{}).MustDo(c))
+		err = (&user.RevokeSession{ID: "abc"}).Do(c)
+		a.Equal(&app.ErrMsg{Status: http.StatusBadRequest, Msg: "sessions are not stored server side"}, err)
+		err = (&user.RevokeAllSessions{}).Do(c)
+		a.Equal(&app.ErrMsg{Status: http.StatusBadRequest, Msg: "sessions are not stored server side"}, err)
+	} else {
+		sessions := (&user.GetSessions{}).MustDo(c)
+		a.Equal(2, len(sessions))
+		var other string
+		for _, s := range sessions {
+			if !s.IsCurrent {
+				other = s.ID
+			}
+		}
+		a.NotEmpty(other)
+		(&user.RevokeSession{ID: other}).MustDo(c)
+		a.Nil((&user.GetMe{}).MustDo(c2))
+		a.Equal(1, len((&user.GetSessions{}).MustDo(c)))
+
+		(&user.Login{
+			Email: email,
+			Pwd:   pwd,
+		}).MustDo(c2)
+		(&user.RevokeAllSessions{}).MustDo(c)
+		a.Nil((&user.GetMe{}).MustDo(c2))
+	}
+
+	// setting pwd revokes all other sessions
+	(&user.Login{
+		Email: email,
+		Pwd:   pwd,
+	}).MustDo(c2)
+	// weak pwds are rejected with the reasons
+	err = (&user.SetPwd{
+		OldPwd: pwd,
+		NewPwd: "Aaaaaaaaa1",
+	}).Do(c)
+	a.Equal(&app.ErrMsg{
+		Status: http.StatusBadRequest,
+		Msg:    "newPwd is not strong enough",
+		Fields: []*app.FieldErr{
+			{
+				Field: "newPwd",
+				Code:  pwdcheck.CodeWeak,
+				Msg:   "pwd is too easy to guess, try a longer pwd with a mix of character types",
+			},
+			{
+				Field: "newPwd",
+				Code:  pwdcheck.CodeRepeats,
+				Msg:   "avoid repeated characters like aaa",
+			},
+		},
+	}, err)
 	newPwd := pwd + "123abc"
 	(&user.SetPwd{
 		OldPwd: pwd,
 		NewPwd: newPwd,
 	}).MustDo(c)
+	if sessionStore == session.CookieStore {
+		// cookie sessions can't be revoked
+		a.Equal(id, (&user.GetMe{}).MustDo(c2).ID)
+	} else {
+		a.Nil((&user.GetMe{}).MustDo(c2))
+	}
+	a.Equal(id, (&user.GetMe{}).MustDo(c).ID)
+
+	// emails are sent in the preferred locale
+	err = (&user.SetLocale{Locale: ptr.String("not a locale")}).Do(c)
+	a.Equal(http.StatusBadRequest, err.(*app.ErrMsg).Status)
+	(&user.SetLocale{Locale: ptr.String("en-GB")}).MustDo(c)
+	var locale *string
+	PanicOn(r.User().Primary().QueryRow(`SELECT locale FROM users WHERE id=?`, id).Scan(&locale))
+	a.Equal("en-GB", *locale)
+	(&user.SetLocale{}).MustDo(c)
+	PanicOn(r.User().Primary().QueryRow(`SELECT locale FROM users WHERE id=?`, id).Scan(&locale))
+	a.Nil(locale)
+
+	// personal api tokens
+	tokenRes := (&user.CreateToken{
+		Name:   "ci",
+		Scopes: []string{"/user/me"},
+	}).MustDo(c)
+	a.Equal("ci", tokenRes.Token.Name)
+	a.NotEmpty(tokenRes.Value)
+	tokens := (&user.GetTokens{}).MustDo(c)
+	a.Equal(1, len(tokens))
+	a.Equal(tokenRes.Token.ID, tokens[0].ID)
+	a.Equal([]string{"/user/me"}, tokens[0].Scopes)
+	a.Nil(tokens[0].LastUsedOn)
+	bc := r.NewClient()
+	bc.SetBearer(tokenRes.Value)
+	a.Equal(id, (&user.GetMe{}).MustDo(bc).ID)
+	a.NotNil((&user.GetTokens{}).MustDo(c)[0].LastUsedOn)
+	_, err = (&user.GetSessions{}).Do(bc)
+	a.Equal(&app.ErrMsg{Status: http.StatusForbidden, Msg: "bearer token is not scoped for /api/user/getsessions"}, err)
+	(&user.DeleteToken{ID: tokenRes.Token.ID}).MustDo(c)
+	a.Equal(0, len((&user.GetTokens{}).MustDo(c)))
+	_, err = (&user.GetMe{}).Do(bc)
+	a.Equal(&app.ErrMsg{Status: http.StatusUnauthorized, Msg: "invalid bearer token"}, err)
+	tokenRes = (&user.CreateToken{
+		Name: "all",
+	}).MustDo(c)
+	bc.SetBearer(tokenRes.Value)
+	_, err = (&user.CreateToken{Name: "nope"}).Do(bc)
+	a.Equal(&app.ErrMsg{Status: http.StatusForbidden, Msg: "api tokens can not manage api tokens"}, err)
+
+	// totp two factor auth
+	enrollment := (&user.EnrollTOTP{}).MustDo(c)
+	a.True(strings.HasPrefix(enrollment.URI, "otpauth://totp/"))
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	PanicOn(err)
+	counter := crypt.TOTPCounter(Now())
+	wrongCode := crypt.TOTPCode(secret, counter+5)
+	_, err = (&user.ConfirmTOTP{Code: wrongCode}).Do(c)
+	a.Equal(&app.ErrMsg{Status: http.StatusBadRequest, Msg: "invalid code"}, err)
+	recoveryCodes := (&user.ConfirmTOTP{Code: crypt.TOTPCode(secret, counter)}).MustDo(c)
+	a.Equal(10, len(recoveryCodes))
+	(&user.Logout{}).MustDo(c)
+	loginRes := (&user.Login{
+		Email: email,
+		Pwd:   newPwd,
+	}).MustDo(c)
+	a.Nil(loginRes.Me)
+	a.NotNil(loginRes.Challenge)
+	a.Nil((&user.GetMe{}).MustDo(c))
+	_, err = (&user.LoginTOTP{Challenge: *loginRes.Challenge, Code: wrongCode}).Do(c)
+	a.Equal(&app.ErrMsg{Status: http.StatusUnauthorized, Msg: "invalid code"}, err)
+	// codes can't be reused
+	_, err = (&user.LoginTOTP{Challenge: *loginRes.Challenge, Code: crypt.TOTPCode(secret, counter)}).Do(c)
+	a.Equal(&app.ErrMsg{Status: http.StatusUnauthorized, Msg: "invalid code"}, err)
+	a.Equal(id, (&user.LoginTOTP{Challenge: *loginRes.Challenge, Code: crypt.TOTPCode(secret, counter+1)}).MustDo(c).ID)
+	a.Equal(id, (&user.GetMe{}).MustDo(c).ID)
+	_, err = (&user.LoginTOTP{Challenge: *loginRes.Challenge, Code: recoveryCodes[0]}).Do(c)
+	a.Equal(&app.ErrMsg{Status: http.StatusUnauthorized, Msg: "invalid or expired challenge"}, err)
+	// recovery codes are single use
+	(&user.Logout{}).MustDo(c)
+	loginRes = (&user.Login{
+		Email: email,
+		Pwd:   newPwd,
+	}).MustDo(c)
+	a.Equal(id, (&user.LoginTOTP{Challenge: *loginRes.Challenge, Code: recoveryCodes[0]}).MustDo(c).ID)
+	(&user.Logout{}).MustDo(c)
+	loginRes = (&user.Login{
+		Email: email,
+		Pwd:   newPwd,
+	}).MustDo(c)
+	_, err = (&user.LoginTOTP{Challenge: *loginRes.Challenge, Code: recoveryCodes[0]}).Do(c)
+	a.Equal(&app.ErrMsg{Status: http.StatusUnauthorized, Msg: "invalid code"}, err)
+	a.Equal(id, (&user.LoginTOTP{Challenge: *loginRes.Challenge, Code: recoveryCodes[1]}).MustDo(c).ID)
+	(&user.DisableTOTP{Code: recoveryCodes[2]}).MustDo(c)
+
+	// passkeys
+	if auth := r.Authenticator(); auth != nil {
+		opts := (&user.BeginWebAuthnRegistration{}).MustDo(c)
+		a.Equal(id[:], opts.User.ID)
+		att := auth.Create(opts.Challenge, opts.User.ID)
+		register := &user.FinishWebAuthnRegistration{
+			Name:              "soft",
+			ClientDataJSON:    att.ClientDataJSON,
+			AttestationObject: att.AttestationObject,
+			Transports:        []string{"internal", "bogus"},
+		}
+		cred := register.MustDo(c)
+		a.Equal(att.ID, cred.ID)
+		a.Equal([]string{"internal"}, cred.Transports)
+		// challenges are single use
+		_, err = register.Do(c)
+		a.Equal(&app.ErrMsg{Status: http.StatusBadRequest, Msg: "passkey registration has expired"}, err)
+		creds := (&user.GetWebAuthnCredentials{}).MustDo(c)
+		a.Equal(1, len(creds))
+		a.Nil(creds[0].LastUsedOn)
+		finish := func(handle string, as *webauthn.SoftAssertion) *user.FinishWebAuthnLogin {
+			return &user.FinishWebAuthnLogin{
+				Handle:            handle,
+				ID:                as.ID,
+				ClientDataJSON:    as.ClientDataJSON,
+				AuthenticatorData: as.AuthenticatorData,
+				Signature:         as.Signature,
+			}
+		}
+		// as the only factor
+		(&user.Logout{}).MustDo(c)
+		wl := (&user.BeginWebAuthnLogin{}).MustDo(c)
+		as := auth.Get(wl.PublicKey.Challenge)
+		a.Equal(id[:], as.UserHandle)
+		a.Equal(id, finish(wl.Handle, as).MustDo(c).ID)
+		a.Equal(id, (&user.GetMe{}).MustDo(c).ID)
+		a.NotNil((&user.GetWebAuthnCredentials{}).MustDo(c)[0].LastUsedOn)
+		// as a second factor
+		(&user.Logout{}).MustDo(c)
+		loginRes = (&user.Login{
+			Email: email,
+			Pwd:   newPwd,
+		}).MustDo(c)
+		a.NotNil(loginRes.Challenge)
+		wl = (&user.BeginWebAuthnLogin{Challenge: loginRes.Challenge}).MustDo(c)
+		a.Equal(1, len(wl.PublicKey.AllowCredentials))
+		as = auth.Get(wl.PublicKey.Challenge, wl.PublicKey.AllowCredentials[0].ID)
+		a.Equal(id, finish(wl.Handle, as).MustDo(c).ID)
+		_, err = (&user.LoginTOTP{Challenge: *loginRes.Challenge, Code: recoveryCodes[3]}).Do(c)
+		a.Equal(&app.ErrMsg{Status: http.StatusUnauthorized, Msg: "invalid or expired challenge"}, err)
+		(&user.DeleteWebAuthnCredential{ID: cred.ID}).MustDo(c)
+		a.Equal(0, len((&user.GetWebAuthnCredentials{}).MustDo(c)))
+		// assertions can't be replayed
+		(&user.Logout{}).MustDo(c)
+		_, err = finish(wl.Handle, as).Do(c)
+		a.Equal(&app.ErrMsg{Status: http.StatusUnauthorized, Msg: "invalid passkey login"}, err)
+		a.Equal(id, (&user.Login{
+			Email: email,
+			Pwd:   newPwd,
+		}).MustDo(c).Me.ID)
+	}
+
+	// oidc
+	a.Contains((&user.GetOIDCProviders{}).MustDo(c), "fake")
+	oidcLogin := func(c *app.Client) (*user.LoginRes, error) {
+		redirect := (&user.BeginOIDCLogin{Provider: "fake"}).MustDo(c)
+		state, code, err := r.OIDC().Authorize(redirect.URL)
+		PanicOn(err)
+		finish := &user.FinishOIDCLogin{State: state, Code: code}
+		res, err := finish.Do(c)
+		// states are single use
+		_, replayErr := finish.Do(c)
+		a.Equal(&app.ErrMsg{Status: http.StatusUnauthorized, Msg: "invalid or expired oidc login"}, replayErr)
+		return res, err
+	}
+	_, err = (&user.BeginOIDCLogin{Provider: "nope"}).Do(c)
+	a.Equal(&app.ErrMsg{Status: http.StatusBadRequest, Msg: `unknown oidc provider "nope"`}, err)
+	// link while logged in, the provider email doesn't need to match
+	r.OIDC().SetUser(&oidc.FakeUser{
+		Subject: "a" + r.UniqueStr(),
+		Email:   "someone.else@oidc.example",
+	})
+	loginRes, err = oidcLogin(c)
+	a.Nil(err)
+	a.Equal(id, loginRes.Me.ID)
+	idents := (&user.GetOIDCIdentities{}).MustDo(c)
+	a.Equal(1, len(idents))
+	a.Equal("fake", idents[0].Provider)
+	a.Equal("someone.else@oidc.example", idents[0].Email)
+	_, err = oidcLogin(r.Bob().Client())
+	a.Equal(&app.ErrMsg{Status: http.StatusBadRequest, Msg: "fake account is already linked to another user"}, err)
+	// login with the linked account
+	(&user.Logout{}).MustDo(c)
+	loginRes, err = oidcLogin(c)
+	a.Nil(err)
+	a.Equal(id, loginRes.Me.ID)
+	// the last way to login can't be unlinked
+	tmpPwdID := NewIDGen().MustNew()
+	_, err = r.Pwd().Primary().Exec(`UPDATE pwds SET id=? WHERE id=?`, tmpPwdID, id)
+	PanicOn(err)
+	err = (&user.DeleteOIDCIdentity{Provider: "fake"}).Do(c)
+	a.Equal(&app.ErrMsg{Status: http.StatusBadRequest, Msg: "can not unlink your only way to login"}, err)
+	_, err = r.Pwd().Primary().Exec(`UPDATE pwds SET id=? WHERE id=?`, id, tmpPwdID)
+	PanicOn(err)
+	(&user.DeleteOIDCIdentity{Provider: "fake"}).MustDo(c)
+	a.Equal(0, len((&user.GetOIDCIdentities{}).MustDo(c)))
+	// unlinked accounts are never linked by email, even a verified one
+	(&user.Logout{}).MustDo(c)
+	r.OIDC().SetUser(&oidc.FakeUser{
+		Subject:       "b" + r.UniqueStr(),
+		Email:         email,
+		EmailVerified: true,
+	})
+	_, err = oidcLogin(c)
+	a.Equal(&app.ErrMsg{Status: http.StatusNotFound, Msg: "fake account isn't linked to a user, login and link it first"}, err)
+	// a login started in one browser can't be finished in another
+	(&user.Login{
+		Email: email,
+		Pwd:   newPwd,
+	}).MustDo(c)
+	loginRes, err = oidcLogin(c)
+	a.Nil(err)
+	(&user.Logout{}).MustDo(c)
+	redirect := (&user.BeginOIDCLogin{Provider: "fake"}).MustDo(r.NewClient())
+	state, code, err := r.OIDC().Authorize(redirect.URL)
+	PanicOn(err)
+	_, err = (&user.FinishOIDCLogin{State: state, Code: code}).Do(c)
+	a.Equal(&app.ErrMsg{Status: http.StatusUnauthorized, Msg: "invalid or expired oidc login"}, err)
+	loginRes, err = oidcLogin(c)
+	a.Nil(err)
+	a.Equal(id, loginRes.Me.ID)
+	a.Equal(email, (&user.GetOIDCIdentities{}).MustDo(c)[0].Email)
+
+	// old scrypt pwds are rehashed on the next login
+	old := crypt.NewPwdHashers(&crypt.Scrypt{N: 32768, R: 8, P: 1, SaltLen: 256, KeyLen: 256}).Hash([]byte(newPwd))
+	_, err = r.Pwd().Primary().Exec(`UPDATE pwds SET alg=?, salt=?, pwd=?, p1=?, p2=?, p3=? WHERE id=?`, old.Alg, old.Salt, old.Key, old.Params[0], old.Params[1], old.Params[2], id)
+	PanicOn(err)
+	(&user.Logout{}).MustDo(c)
+	(&user.Login{
+		Email: email,
+		Pwd:   newPwd,
+	}).MustDo(c)
+	var alg string
+	PanicOn(r.Pwd().Primary().QueryRow(`SELECT alg FROM pwds WHERE id=?`, id).Scan(&alg))
+	a.Equal(crypt.AlgArgon2id, alg)
 
 	(&user.Logout{}).MustDo(c)
 
@@ -251,8 +748,51 @@ func Everything(t *testing.T) {
 	a.True(me.ID.Equal(avatar.ID))
 	a.False(avatar.IsDownload)
 	a.Equal(int64(126670), avatar.Size)
+	a.NotEmpty(avatar.ETag)
+	a.Nil(avatar.Range)
 	avatar.Content.Close()
 
+	// ranged requests only fetch the requested bytes
+	req, err := http.NewRequest(http.MethodPut, "http://localhost"+app.ApiPathPrefix+(&user.GetAvatar{}).Path(), bytes.NewBufferString(Strf(`{"user":%q}`, me.ID)))
+	PanicOn(err)
+	req.Header.Set("Range", "bytes=100-199")
+	req.Header.Set("If-Range", avatar.ETag)
+	do := func() *http.Response {
+		req.Body, err = req.GetBody()
+		PanicOn(err)
+		rec := httptest.NewRecorder()
+		r.RootHandler()(rec, req)
+		return rec.Result()
+	}
+	res := do()
+	a.Equal(http.StatusPartialContent, res.StatusCode)
+	ranged := &app.DownStream{}
+	ranged.MustFromResp(res)
+	bs, err := ioutil.ReadAll(ranged.Content)
+	PanicOn(err)
+	ranged.Content.Close()
+	a.Equal(100, len(bs))
+	a.Equal(int64(126670), ranged.Size)
+	a.Equal(&app.Range{Start: 100, End: 199}, ranged.Range)
+
+	req.Header.Set("If-Range", `"stale"`)
+	res = do()
+	res.Body.Close()
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	// a date If-Range must match exactly, not just be after Last-Modified
+	req.Header.Set("If-Range", Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	res = do()
+	res.Body.Close()
+	a.Equal(http.StatusOK, res.StatusCode)
+
+	req.Header.Set("Range", "bytes=200000-")
+	req.Header.Del("If-Range")
+	res = do()
+	res.Body.Close()
+	a.Equal(http.StatusRequestedRangeNotSatisfiable, res.StatusCode)
+	a.Equal("bytes */126670", res.Header.Get("Content-Range"))
+
 	(&user.SetAvatar{
 		Avatar: ioutil.NopCloser(base64.NewDecoder(base64.StdEncoding, strings.NewReader(testImgNotSquare))),
 	}).MustDo(c)
@@ -292,18 +832,16 @@ func Everything(t *testing.T) {
 		},
 	}).MustDo(c)
 
-	row = r.User().Primary().QueryRow(`SELECT id, activateCode FROM users WHERE email=?`, email)
-	PanicOn(row.Scan(&myID, &code))
-
+	link = r.LatestEmail(email).LinkQuery()
 	(&user.Activate{
-		Me:   myID,
-		Code: code,
+		Me:   MustParseID(link.Get("me")),
+		Code: link.Get("code"),
 	}).MustDo(c)
 
 	id = (&user.Login{
 		Email: email,
 		Pwd:   pwd,
-	}).MustDo(c).ID
+	}).MustDo(c).Me.ID
 	a.Equal(id, (&user.GetMe{}).MustDo(c).ID)
 
 	defer func() {
@@ -390,6 +928,178 @@ func Everything(t *testing.T) {
 	(&user.SetFCMEnabled{
 		Val: true,
 	}).MustDo(ac)
+	pushes := r.Pushes(fcmToken, 2)
+	a.Len(pushes, 2)
+	a.ElementsMatch([]string{"disabled", "enabled"}, []string{pushes[0].Data["X-Fcm-Type"], pushes[1].Data["X-Fcm-Type"]})
+
+	// tokens not refreshed within the expiry window are deleted
+	_, err = r.User().Primary().Exec(`UPDATE fcmTokens SET createdOn=? WHERE client=?`, NowMilli().Add(-2*time.Hour), *client2)
+	PanicOn(err)
+	expired, err := fcm.NewTokenExpirer(r.User(), time.Hour, time.Hour, r.Log()).Expire()
+	a.Nil(err)
+	a.True(expired > 0)
+	tokenCount := 0
+	PanicOn(r.User().Primary().QueryRow(`SELECT COUNT(*) FROM fcmTokens WHERE client=?`, *client2).Scan(&tokenCount))
+	a.Zero(tokenCount)
+	client2 = (&user.RegisterForFCM{
+		Topic: IDs{idGen.MustNew()},
+		Token: fcmToken,
+	}).MustDo(ac)
+	fcm.DeleteTokens(r.User(), fcmToken)
+	PanicOn(r.User().Primary().QueryRow(`SELECT COUNT(*) FROM fcmTokens WHERE token=?`, fcmToken).Scan(&tokenCount))
+	a.Zero(tokenCount)
+
+	// tokens fcm reports as unregistered are deleted once pushed to
+	goneToken := "456:def"
+	(&user.RegisterForFCM{
+		Topic: IDs{idGen.MustNew()},
+		Token: goneToken,
+	}).MustDo(ac)
+	r.FCM().Fail(fcmclient.ErrUnregistered, goneToken)
+	(&user.SetFCMEnabled{
+		Val: false,
+	}).MustDo(ac)
+	a.Equal("disabled", r.Pushes(goneToken, 1)[0].Data["X-Fcm-Type"])
+	deadline := Now().Add(5 * time.Second)
+	for {
+		PanicOn(r.User().Primary().QueryRow(`SELECT COUNT(*) FROM fcmTokens WHERE token=?`, goneToken).Scan(&tokenCount))
+		if tokenCount == 0 || Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	a.Zero(tokenCount)
+	(&user.SetFCMEnabled{
+		Val: true,
+	}).MustDo(ac)
+
+	// test web push eps, the rig's web push client is a nop client
+	a.Equal("", (&user.GetWebPushKey{}).MustDo(ac))
+	_, uaX, uaY, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	PanicOn(err)
+	sub := webpush.Subscription{Endpoint: "https://fcm.googleapis.com/fcm/send/" + r.UniqueStr()}
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), uaX, uaY))
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(crypt.Bytes(16))
+	webPushClient := (&user.RegisterForWebPush{
+		Topic:        IDs{app.ExampleID()},
+		Subscription: sub,
+	}).MustDo(ac)
+	a.NotNil(webPushClient)
+	webPushClient2 := (&user.RegisterForWebPush{
+		Topic:        IDs{idGen.MustNew()},
+		Client:       webPushClient,
+		Subscription: sub,
+	}).MustDo(ac)
+	a.True(webPushClient.Equal(*webPushClient2))
+	subCount := 0
+	PanicOn(r.User().Primary().QueryRow(`SELECT COUNT(*) FROM webPushSubscriptions WHERE user=?`, r.Ali().ID()).Scan(&subCount))
+	a.Equal(1, subCount)
+	untrusted := sub
+	untrusted.Endpoint = "https://evil.example/push"
+	_, err = (&user.RegisterForWebPush{
+		Topic:        IDs{app.ExampleID()},
+		Subscription: untrusted,
+	}).Do(ac)
+	a.Equal(&app.ErrMsg{Status: http.StatusBadRequest, Msg: "invalid web push subscription: untrusted web push endpoint https://evil.example/push"}, err)
+	// toggling fcm enabled notifies web push subscriptions too
+	(&user.SetFCMEnabled{
+		Val: false,
+	}).MustDo(ac)
+	(&user.SetFCMEnabled{
+		Val: true,
+	}).MustDo(ac)
+	fcm.DeleteWebPushSubscriptions(r.User(), sub.Endpoint)
+	PanicOn(r.User().Primary().QueryRow(`SELECT COUNT(*) FROM webPushSubscriptions WHERE user=?`, r.Ali().ID()).Scan(&subCount))
+	a.Zero(subCount)
+	webPushClient = (&user.RegisterForWebPush{
+		Topic:        IDs{app.ExampleID()},
+		Subscription: sub,
+	}).MustDo(ac)
+	_, err = r.User().Primary().Exec(`UPDATE webPushSubscriptions SET createdOn=? WHERE client=?`, NowMilli().Add(-2*time.Hour), *webPushClient)
+	PanicOn(err)
+	expired, err = fcm.NewTokenExpirer(r.User(), time.Hour, time.Hour, r.Log()).Expire()
+	a.Nil(err)
+	a.True(expired > 0)
+	webPushClient = (&user.RegisterForWebPush{
+		Topic:        IDs{app.ExampleID()},
+		Subscription: sub,
+	}).MustDo(ac)
+	(&user.UnregisterFromWebPush{
+		Client: *webPushClient,
+	}).MustDo(ac)
+	PanicOn(r.User().Primary().QueryRow(`SELECT COUNT(*) FROM webPushSubscriptions WHERE user=?`, r.Ali().ID()).Scan(&subCount))
+	a.Zero(subCount)
+
+	// test notification prefs
+	prefs := (&user.GetNotificationPrefs{}).MustDo(ac)
+	a.Equal(&user.NotificationPrefs{TimeZone: "UTC", Categories: map[string]*user.NotificationCategoryPrefs{}}, prefs)
+	(&user.SetNotificationPrefs{
+		TimeZone:   "Europe/London",
+		QuietHours: &user.QuietHours{Start: "22:30", End: "07:00"},
+		Categories: map[string]*user.NotificationCategoryPrefs{
+			"gameTurn":   {Enabled: false},
+			"listShared": {Enabled: true, Digest: true},
+		},
+	}).MustDo(ac)
+	prefs = (&user.GetNotificationPrefs{}).MustDo(ac)
+	a.Equal("Europe/London", prefs.TimeZone)
+	a.Equal(&user.QuietHours{Start: "22:30", End: "07:00"}, prefs.QuietHours)
+	a.Equal(map[string]*user.NotificationCategoryPrefs{
+		"gameTurn":   {Enabled: false},
+		"listShared": {Enabled: true, Digest: true},
+	}, prefs.Categories)
+	err = (&user.SetNotificationPrefs{TimeZone: "Nowhere/Nope"}).Do(ac)
+	a.Equal(&app.ErrMsg{Status: http.StatusBadRequest, Msg: "invalid time zone"}, err)
+	err = (&user.SetNotificationPrefs{TimeZone: "UTC", QuietHours: &user.QuietHours{Start: "07:00", End: "07:00"}}).Do(ac)
+	a.Equal(&app.ErrMsg{Status: http.StatusBadRequest, Msg: "quietHours start and end must be different"}, err)
+	err = (&user.SetNotificationPrefs{TimeZone: "UTC", Categories: map[string]*user.NotificationCategoryPrefs{"not ok": {}}}).Do(ac)
+	a.Equal(&app.ErrMsg{Status: http.StatusBadRequest, Msg: `invalid notification category "not ok"`}, err)
+	// setting replaces all prefs
+	(&user.SetNotificationPrefs{TimeZone: "UTC"}).MustDo(ac)
+	prefs = (&user.GetNotificationPrefs{}).MustDo(ac)
+	a.Equal(&user.NotificationPrefs{TimeZone: "UTC", Categories: map[string]*user.NotificationCategoryPrefs{}}, prefs)
+
+	// held back notifications are sent as a digest once due
+	_, err = r.User().Primary().Exec(`INSERT INTO notificationDigests (user, category, count, digest, createdOn) VALUES (?, ?, ?, ?, ?), (?, ?, ?, ?, ?)`,
+		r.Ali().ID(), "listShared", 3, true, NowMilli().Add(-2*time.Hour),
+		r.Ali().ID(), "gameTurn", 1, false, NowMilli())
+	PanicOn(err)
+	digests := fcm.NewDigestSender(r.User(), fcmclient.NewNopClient(r.Log()), webpush.NewNopClient(r.Log()), time.Hour, time.Hour, r.Log())
+	sent, err := digests.Send()
+	a.Nil(err)
+	a.True(sent > 0)
+	heldCount := 0
+	PanicOn(r.User().Primary().QueryRow(`SELECT COUNT(*) FROM notificationDigests WHERE user=?`, r.Ali().ID()).Scan(&heldCount))
+	a.Zero(heldCount)
+	// digests aren't sent until the interval has passed
+	_, err = r.User().Primary().Exec(`INSERT INTO notificationDigests (user, category, count, digest, createdOn) VALUES (?, ?, ?, ?, ?)`, r.Ali().ID(), "listShared", 1, true, NowMilli())
+	PanicOn(err)
+	_, err = digests.Send()
+	a.Nil(err)
+	PanicOn(r.User().Primary().QueryRow(`SELECT COUNT(*) FROM notificationDigests WHERE user=?`, r.Ali().ID()).Scan(&heldCount))
+	a.Equal(1, heldCount)
+	// held notifications are kept if their digest isn't sent
+	digestToken := "789:ghi"
+	(&user.RegisterForFCM{
+		Topic: IDs{idGen.MustNew()},
+		Token: digestToken,
+	}).MustDo(ac)
+	r.FCM().Fail(fcmclient.ErrUnavailable, digestToken)
+	_, err = r.User().Primary().Exec(`UPDATE notificationDigests SET createdOn=? WHERE user=?`, NowMilli().Add(-2*time.Hour), r.Ali().ID())
+	PanicOn(err)
+	digests = fcm.NewDigestSender(r.User(), r.FCM(), webpush.NewNopClient(r.Log()), time.Hour, time.Hour, r.Log())
+	_, err = digests.Send()
+	a.Nil(err)
+	PanicOn(r.User().Primary().QueryRow(`SELECT COUNT(*) FROM notificationDigests WHERE user=? AND leasedUntil IS NULL`, r.Ali().ID()).Scan(&heldCount))
+	a.Equal(1, heldCount)
+	r.FCM().Succeed(digestToken)
+	sent, err = digests.Send()
+	a.Nil(err)
+	a.True(sent > 0)
+	a.Equal("digest", r.FCM().Latest(digestToken).Data["X-Fcm-Type"])
+	a.Equal(`{"listShared":1}`, r.FCM().Latest(digestToken).Data["categories"])
+	PanicOn(r.User().Primary().QueryRow(`SELECT COUNT(*) FROM notificationDigests WHERE user=?`, r.Ali().ID()).Scan(&heldCount))
+	a.Zero(heldCount)
 
 	js := (&user.GetJin{}).MustDo(ac)
 	a.Nil(js)
@@ -409,4 +1119,13 @@ func Everything(t *testing.T) {
 	(&user.UnregisterFromFCM{
 		Client: app.ExampleID(),
 	}).MustDo(ac)
+
+	// unregistering changes state so must pass the csrf check
+	for _, path := range []string{(&user.UnregisterFromFCM{}).Path(), (&user.UnregisterFromWebPush{}).Path()} {
+		unregReq, err := http.NewRequest(http.MethodPut, "http://localhost"+app.ApiPathPrefix+path, strings.NewReader(Strf(`{"client":%q}`, app.ExampleID())))
+		PanicOn(err)
+		unregRec := httptest.NewRecorder()
+		r.RootHandler()(unregRec, unregReq)
+		a.Equal(http.StatusForbidden, unregRec.Code)
+	}
 }
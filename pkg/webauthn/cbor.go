@@ -0,0 +1,211 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+)
+
+// a minimal cbor (rfc 8949) codec, just enough for attestation objects and
+// cose keys. Indefinite lengths, tags and floats are not supported.
+
+const cborMaxDepth = 16
+
+type cborDecoder struct {
+	bs  []byte
+	pos int
+}
+
+// decodeCBOR decodes the first cbor item in bs, returning it and the number
+// of bytes it used. Ints decode to int64, maps to map[interface{}]interface{}
+// and arrays to []interface{}.
+func decodeCBOR(bs []byte) (interface{}, int, error) {
+	d := &cborDecoder{bs: bs}
+	v, err := d.value(0)
+	return v, d.pos, err
+}
+
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if d.pos >= len(d.bs) {
+		return 0, 0, Err("cbor: unexpected end of data")
+	}
+	b := d.bs[d.pos]
+	d.pos++
+	major, info := b>>5, b&0x1f
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	var n int
+	switch info {
+	case 24:
+		n = 1
+	case 25:
+		n = 2
+	case 26:
+		n = 4
+	case 27:
+		n = 8
+	default:
+		return 0, 0, Err("cbor: unsupported additional info %d", info)
+	}
+	if len(d.bs)-d.pos < n {
+		return 0, 0, Err("cbor: unexpected end of data")
+	}
+	var arg uint64
+	for _, b := range d.bs[d.pos : d.pos+n] {
+		arg = arg<<8 | uint64(b)
+	}
+	d.pos += n
+	return major, arg, nil
+}
+
+func (d *cborDecoder) take(n uint64) ([]byte, error) {
+	if n > uint64(len(d.bs)-d.pos) {
+		return nil, Err("cbor: unexpected end of data")
+	}
+	bs := make([]byte, n)
+	copy(bs, d.bs[d.pos:])
+	d.pos += int(n)
+	return bs, nil
+}
+
+func (d *cborDecoder) value(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, Err("cbor: max depth exceeded")
+	}
+	major, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, Err("cbor: int overflow")
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, Err("cbor: int overflow")
+		}
+		return -1 - int64(arg), nil
+	case 2:
+		return d.take(arg)
+	case 3:
+		bs, err := d.take(arg)
+		return string(bs), err
+	case 4:
+		// every item is at least 1 byte
+		if arg > uint64(len(d.bs)-d.pos) {
+			return nil, Err("cbor: unexpected end of data")
+		}
+		arr := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case 5:
+		if arg > uint64(len(d.bs)-d.pos)/2 {
+			return nil, Err("cbor: unexpected end of data")
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, Err("cbor: unsupported map key type %T", k)
+			}
+			if _, exists := m[k]; exists {
+				return nil, Err("cbor: duplicate map key %v", k)
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		return m, nil
+	case 7:
+		switch arg {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		}
+	}
+	return nil, Err("cbor: unsupported major type %d", major)
+}
+
+// cborMap is encoded with its keys in the given order.
+type cborMap []cborPair
+
+type cborPair struct {
+	k interface{}
+	v interface{}
+}
+
+func encodeCBOR(v interface{}) []byte {
+	buf := &bytes.Buffer{}
+	writeCBOR(buf, v)
+	return buf.Bytes()
+}
+
+func writeCBORHead(buf *bytes.Buffer, major byte, arg uint64) {
+	major <<= 5
+	switch {
+	case arg < 24:
+		buf.WriteByte(major | byte(arg))
+	case arg <= math.MaxUint8:
+		buf.Write([]byte{major | 24, byte(arg)})
+	case arg <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		PanicOn(binary.Write(buf, binary.BigEndian, uint16(arg)))
+	case arg <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		PanicOn(binary.Write(buf, binary.BigEndian, uint32(arg)))
+	default:
+		buf.WriteByte(major | 27)
+		PanicOn(binary.Write(buf, binary.BigEndian, arg))
+	}
+}
+
+func writeCBOR(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case int:
+		if v >= 0 {
+			writeCBORHead(buf, 0, uint64(v))
+		} else {
+			writeCBORHead(buf, 1, uint64(-1-v))
+		}
+	case []byte:
+		writeCBORHead(buf, 2, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		writeCBORHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		writeCBORHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			writeCBOR(buf, item)
+		}
+	case cborMap:
+		writeCBORHead(buf, 5, uint64(len(v)))
+		for _, p := range v {
+			writeCBOR(buf, p.k)
+			writeCBOR(buf, p.v)
+		}
+	default:
+		PanicOn(Err("cbor: unsupported type %T", v))
+	}
+}
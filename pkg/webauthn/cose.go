@@ -0,0 +1,121 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+)
+
+// cose algorithm identifiers
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Algs are the supported algorithms in order of preference.
+var Algs = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// cose key parameters
+const (
+	coseKty     = 1
+	coseAlg     = 3
+	coseCrv     = -1
+	coseX       = -2
+	coseY       = -3
+	coseRSAN    = -1
+	coseRSAE    = -2
+	coseOKP     = 1
+	coseEC2     = 2
+	coseRSA     = 3
+	coseP256    = 1
+	coseEd25519 = 6
+)
+
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+func parsePublicKey(bs []byte) (*publicKey, error) {
+	v, n, err := decodeCBOR(bs)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(bs) {
+		return nil, Err("public key has trailing data")
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, Err("public key is not a cbor map")
+	}
+	getInt := func(k int64) int64 {
+		i, _ := m[k].(int64)
+		return i
+	}
+	getBytes := func(k int64) []byte {
+		bs, _ := m[k].([]byte)
+		return bs
+	}
+	kty, alg := getInt(coseKty), getInt(coseAlg)
+	switch {
+	case alg == AlgES256 && kty == coseEC2 && getInt(coseCrv) == coseP256:
+		x, y := getBytes(coseX), getBytes(coseY)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, Err("invalid ES256 public key coordinates")
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, Err("ES256 public key is not on the curve")
+		}
+		return &publicKey{alg: alg, key: key}, nil
+	case alg == AlgEdDSA && kty == coseOKP && getInt(coseCrv) == coseEd25519:
+		x := getBytes(coseX)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, Err("invalid EdDSA public key")
+		}
+		return &publicKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+	case alg == AlgRS256 && kty == coseRSA:
+		n, e := getBytes(coseRSAN), getBytes(coseRSAE)
+		if len(e) == 0 || len(e) > 4 {
+			return nil, Err("invalid RS256 public key exponent")
+		}
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if key.N.BitLen() < 2048 {
+			return nil, Err("RS256 public key must be at least 2048 bits")
+		}
+		return &publicKey{alg: alg, key: key}, nil
+	}
+	return nil, Err("unsupported public key, kty %d alg %d", kty, alg)
+}
+
+func (k *publicKey) verify(data, sig []byte) error {
+	valid := false
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(data)
+		valid = ecdsa.VerifyASN1(key, hash[:], sig)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, data, sig)
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(data)
+		valid = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+	}
+	if !valid {
+		return Err("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"sync"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/crypt"
+	"github.com/0xor1/tlbx/pkg/json"
+)
+
+// SoftAuthenticator is an in memory ES256 authenticator for tests, running
+// in a browser at origin. It always reports user presence and verification
+// and every credential is discoverable.
+type SoftAuthenticator struct {
+	mtx    *sync.Mutex
+	rpID   string
+	origin string
+	creds  []*softCred
+}
+
+type softCred struct {
+	id         []byte
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+type SoftAttestation struct {
+	ID                []byte
+	ClientDataJSON    []byte
+	AttestationObject []byte
+}
+
+type SoftAssertion struct {
+	ID                []byte
+	UserHandle        []byte
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	Signature         []byte
+}
+
+func NewSoftAuthenticator(rpID, origin string) *SoftAuthenticator {
+	return &SoftAuthenticator{
+		mtx:    &sync.Mutex{},
+		rpID:   rpID,
+		origin: origin,
+	}
+}
+
+// Create makes a new credential as navigator.credentials.create would.
+func (a *SoftAuthenticator) Create(challenge, userHandle []byte) *SoftAttestation {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	PanicOn(err)
+	cred := &softCred{
+		id:         crypt.Bytes(32),
+		userHandle: userHandle,
+		key:        key,
+	}
+	a.creds = append(a.creds, cred)
+	cred.signCount++
+	authData := a.authData(cred, flagUP|flagUV|flagAT)
+	authData = append(authData, make([]byte, 16)...)
+	authData = append(authData, byte(len(cred.id)>>8), byte(len(cred.id)))
+	authData = append(authData, cred.id...)
+	authData = append(authData, encodeCBOR(cborMap{
+		{coseKty, coseEC2},
+		{coseAlg, AlgES256},
+		{coseCrv, coseP256},
+		{coseX, key.X.FillBytes(make([]byte, 32))},
+		{coseY, key.Y.FillBytes(make([]byte, 32))},
+	})...)
+	return &SoftAttestation{
+		ID:             cred.id,
+		ClientDataJSON: a.clientData("webauthn.create", challenge),
+		AttestationObject: encodeCBOR(cborMap{
+			{"fmt", "none"},
+			{"attStmt", cborMap{}},
+			{"authData", authData},
+		}),
+	}
+}
+
+// Get signs challenge as navigator.credentials.get would, using the newest
+// credential in allow, or the newest credential if allow is empty.
+func (a *SoftAuthenticator) Get(challenge []byte, allow ...[]byte) *SoftAssertion {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	var cred *softCred
+	for i := len(a.creds) - 1; i >= 0 && cred == nil; i-- {
+		c := a.creds[i]
+		if len(allow) == 0 {
+			cred = c
+		}
+		for _, id := range allow {
+			if bytes.Equal(id, c.id) {
+				cred = c
+			}
+		}
+	}
+	PanicIf(cred == nil, "no credential found")
+	cred.signCount++
+	authData := a.authData(cred, flagUP|flagUV)
+	clientDataJSON := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	hash := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, cred.key, hash[:])
+	PanicOn(err)
+	return &SoftAssertion{
+		ID:                cred.id,
+		UserHandle:        cred.userHandle,
+		ClientDataJSON:    clientDataJSON,
+		AuthenticatorData: authData,
+		Signature:         sig,
+	}
+}
+
+func (a *SoftAuthenticator) authData(cred *softCred, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	authData := append([]byte{}, rpIDHash[:]...)
+	authData = append(authData, flags)
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, cred.signCount)
+	return append(authData, counter...)
+}
+
+func (a *SoftAuthenticator) clientData(typ string, challenge []byte) []byte {
+	return json.MustMarshal(&clientData{
+		Type:      typ,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    a.origin,
+	})
+}
@@ -0,0 +1,194 @@
+// Package webauthn verifies WebAuthn registrations and assertions. Only
+// attestation "none" is requested so attestation statements are never
+// verified, credentials are trusted on first use.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/crypt"
+	"github.com/0xor1/tlbx/pkg/json"
+)
+
+const (
+	flagUP = 0x01
+	flagUV = 0x04
+	flagAT = 0x40
+
+	ChallengeLen = 32
+)
+
+type Config struct {
+	// RPID is the relying party id, the registrable domain e.g. example.com
+	RPID   string
+	RPName string
+	// Origins are the allowed client origins e.g. https://app.example.com
+	Origins []string
+}
+
+// Credential is what needs storing from a registration, PublicKey is cose
+// encoded.
+type Credential struct {
+	ID        []byte
+	PublicKey []byte
+	SignCount uint32
+}
+
+// Challenge returns a new random challenge.
+func Challenge() []byte {
+	return crypt.Bytes(ChallengeLen)
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin,omitempty"`
+}
+
+func (c *Config) checkClientData(clientDataJSON []byte, typ string, challenge []byte) error {
+	cd := &clientData{}
+	if err := json.Unmarshal(clientDataJSON, cd); err != nil {
+		return Err("invalid client data: %s", err)
+	}
+	if cd.Type != typ {
+		return Err("client data type %q is not %q", cd.Type, typ)
+	}
+	received, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(received, challenge) != 1 {
+		return Err("client data challenge does not match")
+	}
+	if cd.CrossOrigin {
+		return Err("cross origin requests are not allowed")
+	}
+	for _, origin := range c.Origins {
+		if cd.Origin == origin {
+			return nil
+		}
+	}
+	return Err("client data origin %q is not allowed", cd.Origin)
+}
+
+type authData struct {
+	raw       []byte
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	credID    []byte
+	pubKey    []byte
+}
+
+func parseAuthData(bs []byte) (*authData, error) {
+	if len(bs) < 37 {
+		return nil, Err("authenticator data is too short")
+	}
+	ad := &authData{
+		raw:       bs,
+		rpIDHash:  bs[:32],
+		flags:     bs[32],
+		signCount: binary.BigEndian.Uint32(bs[33:37]),
+	}
+	if ad.flags&flagAT == 0 {
+		return ad, nil
+	}
+	// aaguid then credential id length
+	rest := bs[37:]
+	if len(rest) < 18 {
+		return nil, Err("attested credential data is too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, Err("attested credential data is too short")
+	}
+	ad.credID = rest[:idLen]
+	// any extensions follow the key
+	_, n, err := decodeCBOR(rest[idLen:])
+	if err != nil {
+		return nil, err
+	}
+	ad.pubKey = rest[idLen : idLen+n]
+	return ad, nil
+}
+
+func (c *Config) checkAuthData(ad *authData, requireUV bool) error {
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return Err("authenticator data rp id does not match")
+	}
+	if ad.flags&flagUP == 0 {
+		return Err("user presence is required")
+	}
+	if requireUV && ad.flags&flagUV == 0 {
+		return Err("user verification is required")
+	}
+	return nil
+}
+
+// VerifyRegistration checks the response to navigator.credentials.create
+// for challenge and returns the new credential.
+func (c *Config) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte, requireUV bool) (*Credential, error) {
+	if err := c.checkClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+	v, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	obj, _ := v.(map[interface{}]interface{})
+	raw, _ := obj["authData"].([]byte)
+	ad, err := parseAuthData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkAuthData(ad, requireUV); err != nil {
+		return nil, err
+	}
+	if ad.credID == nil || len(ad.credID) > 1023 {
+		return nil, Err("attested credential data is missing")
+	}
+	if _, err := parsePublicKey(ad.pubKey); err != nil {
+		return nil, err
+	}
+	return &Credential{
+		ID:        ad.credID,
+		PublicKey: ad.pubKey,
+		SignCount: ad.signCount,
+	}, nil
+}
+
+// VerifyAssertion checks the response to navigator.credentials.get for
+// challenge was signed by cred and returns the new sign count to store.
+func (c *Config) VerifyAssertion(challenge []byte, cred *Credential, clientDataJSON, authenticatorData, signature []byte, requireUV bool) (uint32, error) {
+	if err := c.checkClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+	ad, err := parseAuthData(authenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.checkAuthData(ad, requireUV); err != nil {
+		return 0, err
+	}
+	key, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := make([]byte, 0, len(ad.raw)+len(clientDataHash))
+	signed = append(append(signed, ad.raw...), clientDataHash[:]...)
+	if err := key.verify(signed, signature); err != nil {
+		return 0, err
+	}
+	// authenticators that don't count always send 0, otherwise a count that
+	// doesn't increase means the credential may have been cloned
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return 0, Err("sign count did not increase")
+	}
+	return ad.signCount, nil
+}
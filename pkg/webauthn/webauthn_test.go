@@ -0,0 +1,81 @@
+package webauthn
+
+import (
+	"testing"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func msg(err error) string {
+	if err == nil {
+		return ""
+	}
+	return ToError(err).Message()
+}
+
+func TestRegisterAndAssert(t *testing.T) {
+	a := assert.New(t)
+	c := &Config{
+		RPID:    "example.com",
+		RPName:  "Example",
+		Origins: []string{"https://app.example.com"},
+	}
+	auth := NewSoftAuthenticator(c.RPID, c.Origins[0])
+	challenge := Challenge()
+	att := auth.Create(challenge, []byte("user"))
+
+	_, err := c.VerifyRegistration(Challenge(), att.ClientDataJSON, att.AttestationObject, true)
+	a.Equal("client data challenge does not match", msg(err))
+	cred, err := c.VerifyRegistration(challenge, att.ClientDataJSON, att.AttestationObject, true)
+	a.Nil(err)
+	a.Equal(att.ID, cred.ID)
+	a.Equal(uint32(1), cred.SignCount)
+
+	challenge = Challenge()
+	as := auth.Get(challenge)
+	a.Equal(cred.ID, as.ID)
+	a.Equal([]byte("user"), as.UserHandle)
+	_, err = c.VerifyAssertion(challenge, cred, as.ClientDataJSON, as.AuthenticatorData, append([]byte{}, as.AuthenticatorData...), true)
+	a.Equal("invalid signature", msg(err))
+	count, err := c.VerifyAssertion(challenge, cred, as.ClientDataJSON, as.AuthenticatorData, as.Signature, true)
+	a.Nil(err)
+	a.Equal(uint32(2), count)
+	// replaying the same assertion looks like a cloned authenticator
+	cred.SignCount = count
+	_, err = c.VerifyAssertion(challenge, cred, as.ClientDataJSON, as.AuthenticatorData, as.Signature, true)
+	a.Equal("sign count did not increase", msg(err))
+
+	challenge = Challenge()
+	phish := NewSoftAuthenticator(c.RPID, "https://evil.example")
+	phish.Create(challenge, nil)
+	as = phish.Get(challenge)
+	_, err = c.VerifyAssertion(challenge, cred, as.ClientDataJSON, as.AuthenticatorData, as.Signature, true)
+	a.Equal(`client data origin "https://evil.example" is not allowed`, msg(err))
+
+	evil := NewSoftAuthenticator("evil.example", c.Origins[0])
+	evil.Create(challenge, nil)
+	as = evil.Get(challenge)
+	_, err = c.VerifyAssertion(challenge, cred, as.ClientDataJSON, as.AuthenticatorData, as.Signature, true)
+	a.Equal("authenticator data rp id does not match", msg(err))
+}
+
+func TestCBOR(t *testing.T) {
+	a := assert.New(t)
+	bs := encodeCBOR(cborMap{
+		{1, -7},
+		{"a", []interface{}{"b", []byte{1, 2}, 1000000}},
+	})
+	v, n, err := decodeCBOR(append(bs, 0xff))
+	a.Nil(err)
+	a.Equal(len(bs), n)
+	a.Equal(map[interface{}]interface{}{
+		int64(1): int64(-7),
+		"a":      []interface{}{"b", []byte{1, 2}, int64(1000000)},
+	}, v)
+	_, _, err = decodeCBOR(bs[:len(bs)-1])
+	a.Equal("cbor: unexpected end of data", msg(err))
+	// huge declared lengths fail before allocating
+	_, _, err = decodeCBOR([]byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	a.Equal("cbor: unexpected end of data", msg(err))
+}
@@ -0,0 +1,473 @@
+// Package webpush sends standards based Web Push messages, payloads are
+// encrypted per RFC 8291 and requests are authenticated with VAPID per
+// RFC 8292 so no push service specific credentials are required.
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/json"
+	"github.com/0xor1/tlbx/pkg/log"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	UrgencyVeryLow = "very-low"
+	UrgencyLow     = "low"
+	UrgencyNormal  = "normal"
+	UrgencyHigh    = "high"
+
+	// a single aes128gcm record is sent and push services only have to
+	// accept bodies up to 4096 bytes, 86 bytes of header, a 16 byte tag
+	// and the 1 byte padding delimiter leaves 3993 for the payload
+	recordSize     = 4096
+	headerLen      = 86
+	MaxPayloadSize = recordSize - headerLen - 16 - 1
+
+	// vapid jwts can be valid for at most 24 hours
+	vapidExpiry = 12 * time.Hour
+	// concurrent requests per Send call
+	maxConcurrency = 10
+)
+
+// DefaultEndpointHosts matches the push services used by the major browsers,
+// subscription endpoints are client supplied so they're restricted to stop
+// the server being used to make requests to arbitrary hosts.
+var DefaultEndpointHosts = regexp.MustCompile(`^(fcm\.googleapis\.com|updates\.push\.services\.mozilla\.com|[a-z0-9-]+\.notify\.windows\.com|web\.push\.apple\.com)$`)
+
+// Subscription matches the json of a browser PushSubscription.
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+func (s *Subscription) keys() (*ecdsa.PublicKey, []byte, error) {
+	pubBs, err := decode(s.Keys.P256dh)
+	if err != nil {
+		return nil, nil, Err("invalid p256dh key: %s", err)
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), pubBs)
+	if x == nil {
+		return nil, nil, Err("invalid p256dh key")
+	}
+	auth, err := decode(s.Keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return nil, nil, Err("invalid auth secret")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, auth, nil
+}
+
+type Message struct {
+	Subscriptions []*Subscription
+	Payload       []byte
+	// how long the push service should hold the message for offline
+	// clients, 0 means deliver now or drop it
+	TTL time.Duration
+	// optional, one of the Urgency constants
+	Urgency string
+}
+
+type SendResponse struct {
+	Success bool
+	Error   error
+}
+
+type BatchResponse struct {
+	SuccessCount int
+	FailureCount int
+	// in the same order as Message.Subscriptions
+	Responses []*SendResponse
+}
+
+// StatusError is returned for subscriptions the push service didn't accept.
+type StatusError struct {
+	Status int
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return Strf("web push service responded %d: %s", e.Status, e.Body)
+}
+
+// SubscriptionError is returned for subscriptions which can never be sent to.
+type SubscriptionError struct {
+	Msg string
+}
+
+func (e *SubscriptionError) Error() string {
+	return e.Msg
+}
+
+type Client interface {
+	// the vapid public key browsers must pass as applicationServerKey when
+	// subscribing
+	PublicKey() string
+	// Validate returns an error if sub can't be sent to
+	Validate(sub *Subscription) error
+	Send(ctx context.Context, m *Message) (*BatchResponse, error)
+	MustSend(ctx context.Context, m *Message) *BatchResponse
+}
+
+type Config struct {
+	// base64url encoded P-256 private key scalar, as generated by GenerateKeys
+	PrivateKey string
+	// contact for push service operators, a mailto: or https: url
+	Subject string
+	// matches hosts subscription endpoints are allowed on, defaults to
+	// DefaultEndpointHosts
+	EndpointHosts *regexp.Regexp
+	HTTP          *http.Client
+}
+
+func NewClient(c *Config) Client {
+	PanicIf(c.Subject == "", "web push subject must be set")
+	bs, err := decode(c.PrivateKey)
+	PanicOn(err)
+	PanicIf(len(bs) != 32, "web push private key must be 32 bytes")
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(bs)}
+	key.Curve = elliptic.P256()
+	key.X, key.Y = key.Curve.ScalarBaseMult(bs)
+	hosts := c.EndpointHosts
+	if hosts == nil {
+		hosts = DefaultEndpointHosts
+	}
+	h := c.HTTP
+	if h == nil {
+		h = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &client{
+		key:       key,
+		publicKey: base64.RawURLEncoding.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y)),
+		subject:   c.Subject,
+		hosts:     hosts,
+		http:      h,
+		mtx:       &sync.Mutex{},
+		jwts:      map[string]*vapidJWT{},
+	}
+}
+
+// GenerateKeys returns a new base64url encoded vapid key pair.
+func GenerateKeys() (private, public string, err error) {
+	key, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", ToError(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(key), base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), x, y)), nil
+}
+
+type vapidJWT struct {
+	token string
+	exp   time.Time
+}
+
+type client struct {
+	key       *ecdsa.PrivateKey
+	publicKey string
+	subject   string
+	hosts     *regexp.Regexp
+	http      *http.Client
+	mtx       *sync.Mutex
+	// cached per push service origin
+	jwts map[string]*vapidJWT
+}
+
+func (c *client) PublicKey() string {
+	return c.publicKey
+}
+
+func (c *client) Validate(sub *Subscription) error {
+	return validate(c.hosts, sub)
+}
+
+func (c *client) Send(ctx context.Context, m *Message) (*BatchResponse, error) {
+	if len(m.Payload) > MaxPayloadSize {
+		return nil, Err("web push payload is %d bytes, max is %d", len(m.Payload), MaxPayloadSize)
+	}
+	res := &BatchResponse{
+		Responses: make([]*SendResponse, len(m.Subscriptions)),
+	}
+	sem := make(chan struct{}, maxConcurrency)
+	wg := &sync.WaitGroup{}
+	for i, sub := range m.Subscriptions {
+		i, sub := i, sub
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			Do(func() {
+				err := c.send(ctx, sub, m)
+				res.Responses[i] = &SendResponse{Success: err == nil, Error: err}
+			}, func(r interface{}) {
+				res.Responses[i] = &SendResponse{Error: ToError(r)}
+			})
+		}()
+	}
+	wg.Wait()
+	for _, r := range res.Responses {
+		if r.Success {
+			res.SuccessCount++
+		} else {
+			res.FailureCount++
+		}
+	}
+	return res, nil
+}
+
+func (c *client) MustSend(ctx context.Context, m *Message) *BatchResponse {
+	res, err := c.Send(ctx, m)
+	PanicOn(err)
+	return res
+}
+
+func (c *client) send(ctx context.Context, sub *Subscription, m *Message) error {
+	if err := c.Validate(sub); err != nil {
+		return err
+	}
+	body, err := Encrypt(sub, m.Payload)
+	if err != nil {
+		return err
+	}
+	auth, err := c.vapid(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return ToError(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", Strf("%d", int64(m.TTL/time.Second)))
+	if m.Urgency != "" {
+		req.Header.Set("Urgency", m.Urgency)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return ToError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &StatusError{Status: resp.StatusCode, Body: string(respBody)}
+}
+
+// vapid returns the Authorization header value for a request to endpoint.
+func (c *client) vapid(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", ToError(err)
+	}
+	aud := u.Scheme + "://" + u.Host
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	jwt := c.jwts[aud]
+	// refresh well before expiry so a jwt never expires in flight
+	if jwt == nil || Now().After(jwt.exp.Add(-vapidExpiry/2)) {
+		exp := Now().Add(vapidExpiry)
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+		claims := base64.RawURLEncoding.EncodeToString(json.MustMarshal(map[string]interface{}{
+			"aud": aud,
+			"exp": exp.Unix(),
+			"sub": c.subject,
+		}))
+		unsigned := header + "." + claims
+		digest := sha256.Sum256([]byte(unsigned))
+		r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+		if err != nil {
+			return "", ToError(err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		jwt = &vapidJWT{
+			token: unsigned + "." + base64.RawURLEncoding.EncodeToString(sig),
+			exp:   exp,
+		}
+		c.jwts[aud] = jwt
+	}
+	return Strf("vapid t=%s, k=%s", jwt.token, c.publicKey), nil
+}
+
+// Encrypt encrypts payload for sub as a single aes128gcm record per RFC 8291.
+func Encrypt(sub *Subscription, payload []byte) ([]byte, error) {
+	if len(payload) > MaxPayloadSize {
+		return nil, Err("web push payload is %d bytes, max is %d", len(payload), MaxPayloadSize)
+	}
+	uaPub, auth, err := sub.keys()
+	if err != nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	asPriv, asX, asY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, ToError(err)
+	}
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, ToError(err)
+	}
+	sharedX, _ := curve.ScalarMult(uaPub.X, uaPub.Y, asPriv)
+	ecdhSecret := make([]byte, 32)
+	sharedX.FillBytes(ecdhSecret)
+	uaPubBs := elliptic.Marshal(curve, uaPub.X, uaPub.Y)
+	asPubBs := elliptic.Marshal(curve, asX, asY)
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPubBs...), asPubBs...)
+	ikm := make([]byte, 32)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, ecdhSecret, auth, keyInfo), ikm); err != nil {
+		return nil, ToError(err)
+	}
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	cek := make([]byte, 16)
+	if _, err = io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, ToError(err)
+	}
+	nonce := make([]byte, 12)
+	if _, err = io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, ToError(err)
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, ToError(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, ToError(err)
+	}
+
+	header := make([]byte, 0, headerLen)
+	header = append(header, salt...)
+	rs := make([]byte, 4)
+	binary.BigEndian.PutUint32(rs, recordSize)
+	header = append(header, rs...)
+	header = append(header, byte(len(asPubBs)))
+	header = append(header, asPubBs...)
+	// 0x02 delimits the last, and only, record
+	plaintext := append(append(make([]byte, 0, len(payload)+1), payload...), 0x02)
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// Failures returns the subscriptions which failed in res, the response to
+// sending to subs, split into those which are gone and should be forgotten
+// and those which failed transiently and may be retried. Subscriptions
+// without a response are retried.
+func Failures(subs []*Subscription, res *BatchResponse) (invalid []*Subscription, retry []*Subscription) {
+	responses := 0
+	if res != nil {
+		responses = len(res.Responses)
+	}
+	for i, sub := range subs {
+		if i >= responses || res.Responses[i] == nil {
+			retry = append(retry, sub)
+			continue
+		}
+		r := res.Responses[i]
+		if r.Success {
+			continue
+		}
+		if _, ok := r.Error.(*SubscriptionError); ok {
+			invalid = append(invalid, sub)
+			continue
+		}
+		statusErr, ok := r.Error.(*StatusError)
+		switch {
+		case !ok:
+			// network errors etc
+			retry = append(retry, sub)
+		case statusErr.Status == http.StatusNotFound || statusErr.Status == http.StatusGone:
+			invalid = append(invalid, sub)
+		case statusErr.Status == http.StatusTooManyRequests || statusErr.Status >= 500:
+			retry = append(retry, sub)
+		default:
+			// bad request, payload too large etc, retrying won't help
+		}
+	}
+	return
+}
+
+func validate(hosts *regexp.Regexp, sub *Subscription) error {
+	if sub == nil {
+		return &SubscriptionError{Msg: "nil web push subscription"}
+	}
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || !hosts.MatchString(u.Hostname()) {
+		return &SubscriptionError{Msg: Strf("untrusted web push endpoint %s", sub.Endpoint)}
+	}
+	if _, _, err = sub.keys(); err != nil {
+		return &SubscriptionError{Msg: ToError(err).Message()}
+	}
+	return nil
+}
+
+// browsers use unpadded base64url but some libs pad or use std encoding
+func decode(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	return bs, ToError(err)
+}
+
+func NewNopClient(l log.Log) Client {
+	return &nopClient{
+		log: l,
+	}
+}
+
+type nopClient struct {
+	log log.Log
+}
+
+func (c *nopClient) PublicKey() string {
+	return ""
+}
+
+func (c *nopClient) Validate(sub *Subscription) error {
+	return validate(DefaultEndpointHosts, sub)
+}
+
+func (c *nopClient) Send(ctx context.Context, m *Message) (*BatchResponse, error) {
+	c.log.Warning("nop web push client called for %d subscriptions", len(m.Subscriptions))
+	// report success so callers don't retry
+	res := &BatchResponse{
+		SuccessCount: len(m.Subscriptions),
+		Responses:    make([]*SendResponse, 0, len(m.Subscriptions)),
+	}
+	for range m.Subscriptions {
+		res.Responses = append(res.Responses, &SendResponse{Success: true})
+	}
+	return res, nil
+}
+
+func (c *nopClient) MustSend(ctx context.Context, m *Message) *BatchResponse {
+	res, err := c.Send(ctx, m)
+	PanicOn(err)
+	return res
+}
@@ -0,0 +1,175 @@
+package webpush
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/0xor1/tlbx/pkg/core"
+	"github.com/0xor1/tlbx/pkg/json"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/hkdf"
+)
+
+// browser is the user agent side of a subscription
+type browser struct {
+	priv []byte
+	pub  []byte
+	auth []byte
+}
+
+func newBrowser(endpoint string) (*browser, *Subscription) {
+	priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	PanicOn(err)
+	b := &browser{
+		priv: priv,
+		pub:  elliptic.Marshal(elliptic.P256(), x, y),
+		auth: make([]byte, 16),
+	}
+	_, err = rand.Read(b.auth)
+	PanicOn(err)
+	sub := &Subscription{Endpoint: endpoint}
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(b.pub)
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(b.auth)
+	return b, sub
+}
+
+func (b *browser) decrypt(body []byte) []byte {
+	salt := body[:16]
+	rs := binary.BigEndian.Uint32(body[16:20])
+	PanicIf(rs != recordSize, "unexpected record size %d", rs)
+	idLen := int(body[20])
+	asPub := body[21 : 21+idLen]
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, asPub)
+	sharedX, _ := curve.ScalarMult(x, y, b.priv)
+	ecdhSecret := make([]byte, 32)
+	sharedX.FillBytes(ecdhSecret)
+	keyInfo := append(append([]byte("WebPush: info\x00"), b.pub...), asPub...)
+	ikm := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, ecdhSecret, b.auth, keyInfo), ikm)
+	PanicOn(err)
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	cek := make([]byte, 16)
+	_, err = io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: aes128gcm\x00")), cek)
+	PanicOn(err)
+	nonce := make([]byte, 12)
+	_, err = io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: nonce\x00")), nonce)
+	PanicOn(err)
+	block, err := aes.NewCipher(cek)
+	PanicOn(err)
+	gcm, err := cipher.NewGCM(block)
+	PanicOn(err)
+	plaintext, err := gcm.Open(nil, nonce, body[21+idLen:], nil)
+	PanicOn(err)
+	PanicIf(plaintext[len(plaintext)-1] != 0x02, "missing last record delimiter")
+	return plaintext[:len(plaintext)-1]
+}
+
+func TestEncrypt(t *testing.T) {
+	a := assert.New(t)
+	b, sub := newBrowser("https://fcm.googleapis.com/fcm/send/abc")
+	payload := []byte(`{"X-Fcm-Type":"data"}`)
+	body, err := Encrypt(sub, payload)
+	a.Nil(err)
+	a.Equal(headerLen+len(payload)+1+16, len(body))
+	a.Equal(payload, b.decrypt(body))
+
+	_, err = Encrypt(sub, make([]byte, MaxPayloadSize+1))
+	a.NotNil(err)
+	sub.Keys.Auth = "abc"
+	_, err = Encrypt(sub, payload)
+	a.Equal("invalid auth secret", ToError(err).Message())
+}
+
+func TestClient(t *testing.T) {
+	a := assert.New(t)
+	priv, pub, err := GenerateKeys()
+	PanicOn(err)
+	pubBs, err := base64.RawURLEncoding.DecodeString(pub)
+	PanicOn(err)
+	x, y := elliptic.Unmarshal(elliptic.P256(), pubBs)
+	vapidKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+	var b *browser
+	received := [][]byte{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+			return
+		case "/busy":
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		a.Equal("aes128gcm", r.Header.Get("Content-Encoding"))
+		a.Equal("60", r.Header.Get("TTL"))
+		a.Equal(UrgencyHigh, r.Header.Get("Urgency"))
+		auth := regexp.MustCompile(`^vapid t=([^,]+), k=(.+)$`).FindStringSubmatch(r.Header.Get("Authorization"))
+		a.Len(auth, 3)
+		a.Equal(pub, auth[2])
+		parts := strings.Split(auth[1], ".")
+		a.Len(parts, 3)
+		claims := map[string]interface{}{}
+		claimBs, err := base64.RawURLEncoding.DecodeString(parts[1])
+		PanicOn(err)
+		json.MustUnmarshal(claimBs, &claims)
+		a.Equal("https://"+r.Host, claims["aud"])
+		a.Equal("mailto:test@test.localhost", claims["sub"])
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		PanicOn(err)
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		a.True(ecdsa.Verify(vapidKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])))
+		body, err := ioutil.ReadAll(r.Body)
+		PanicOn(err)
+		received = append(received, b.decrypt(body))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	c := NewClient(&Config{
+		PrivateKey:    priv,
+		Subject:       "mailto:test@test.localhost",
+		EndpointHosts: regexp.MustCompile(`^127\.0\.0\.1$`),
+		HTTP:          srv.Client(),
+	})
+	a.Equal(pub, c.PublicKey())
+	b, ok := newBrowser(srv.URL + "/ok")
+	_, gone := newBrowser(srv.URL + "/gone")
+	_, busy := newBrowser(srv.URL + "/busy")
+	_, untrusted := newBrowser("https://evil.example/push")
+	subs := []*Subscription{ok, gone, busy, untrusted}
+	res := c.MustSend(context.Background(), &Message{
+		Subscriptions: subs,
+		Payload:       []byte("hi"),
+		TTL:           time.Minute,
+		Urgency:       UrgencyHigh,
+	})
+	a.Equal(1, res.SuccessCount)
+	a.Equal(3, res.FailureCount)
+	a.Equal([][]byte{[]byte("hi")}, received)
+	a.Equal("untrusted web push endpoint https://evil.example/push", ToError(res.Responses[3].Error).Message())
+	invalid, retry := Failures(subs, res)
+	a.Equal([]*Subscription{gone, untrusted}, invalid)
+	a.Equal([]*Subscription{busy}, retry)
+
+	// missing responses are retried
+	invalid, retry = Failures(subs, &BatchResponse{Responses: res.Responses[:1]})
+	a.Empty(invalid)
+	a.Equal(subs[1:], retry)
+}
@@ -0,0 +1,9 @@
+# run against databases created before pwd hashers were pluggable,
+# existing pwds are all scrypt and are rehashed on their next login
+USE pwds;
+
+ALTER TABLE pwds
+    ADD COLUMN alg VARCHAR(20) NOT NULL DEFAULT 'scrypt' AFTER id,
+    RENAME COLUMN n TO p1,
+    RENAME COLUMN r TO p2,
+    RENAME COLUMN p TO p3;
@@ -0,0 +1,38 @@
+# run against databases created before api tokens and oidc logins were
+# added
+USE users;
+
+SET GLOBAL event_scheduler=ON;
+
+CREATE TABLE IF NOT EXISTS tokens (
+    user BINARY(16) NOT NULL,
+    id BINARY(16) NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    scopes VARCHAR(2000) NOT NULL,
+    hash BINARY(32) NOT NULL,
+    createdOn DATETIME(3) NOT NULL,
+    expiresOn DATETIME(3) NULL,
+    lastUsedOn DATETIME(3) NULL,
+    PRIMARY KEY (user, id),
+    UNIQUE INDEX (hash),
+    INDEX(expiresOn),
+    FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
+);
+
+# cleanup expired api tokens
+DROP EVENT IF EXISTS tokenCleanup;
+CREATE EVENT tokenCleanup
+ON SCHEDULE EVERY 24 HOUR
+STARTS CURRENT_TIMESTAMP + INTERVAL 1 HOUR
+DO DELETE FROM tokens WHERE expiresOn < NOW();
+
+CREATE TABLE IF NOT EXISTS oidcIdentities (
+    user BINARY(16) NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(250) NOT NULL,
+    createdOn DATETIME(3) NOT NULL,
+    PRIMARY KEY (provider, subject),
+    UNIQUE INDEX (user, provider),
+    FOREIGN KEY (user) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -7,14 +7,47 @@ USE pwds;
 DROP TABLE IF EXISTS pwds;
 CREATE TABLE pwds(
 	id BINARY(16) NOT NULL,
+	alg    VARCHAR(20) NOT NULL DEFAULT 'scrypt',
 	salt   VARBINARY(256) NOT NULL,
 	pwd    VARBINARY(256) NOT NULL,
-	n      MEDIUMINT UNSIGNED NOT NULL,
-	r      MEDIUMINT UNSIGNED NOT NULL,
-	p      MEDIUMINT UNSIGNED NOT NULL,
+	# alg specific params, scrypt: n, r, p, argon2id: time, memory, threads
+	p1     MEDIUMINT UNSIGNED NOT NULL,
+	p2     MEDIUMINT UNSIGNED NOT NULL,
+	p3     MEDIUMINT UNSIGNED NOT NULL,
     PRIMARY KEY (id)
 );
 
+DROP TABLE IF EXISTS totps;
+CREATE TABLE totps(
+    id          BINARY(16) NOT NULL,
+    # aes-gcm sealed with app.totp.encrKey32s
+    secret      VARBINARY(64) NOT NULL,
+    confirmedOn DATETIME(3) NULL,
+    lastCounter BIGINT NOT NULL,
+    PRIMARY KEY (id)
+);
+
+DROP TABLE IF EXISTS recoveryCodes;
+CREATE TABLE recoveryCodes(
+    id   BINARY(16) NOT NULL,
+    hash BINARY(32) NOT NULL,
+    PRIMARY KEY (id, hash)
+);
+
+DROP TABLE IF EXISTS webAuthnCredentials;
+CREATE TABLE webAuthnCredentials(
+	id         VARBINARY(1023) NOT NULL,
+	user       BINARY(16) NOT NULL,
+	name       VARCHAR(50) NOT NULL,
+	publicKey  VARBINARY(1024) NOT NULL,
+	signCount  INT UNSIGNED NOT NULL,
+	transports JSON NOT NULL,
+	createdOn  DATETIME(3) NOT NULL,
+	lastUsedOn DATETIME(3) NULL,
+    PRIMARY KEY (id),
+    INDEX (user, createdOn)
+);
+
 DROP USER IF EXISTS 'pwds'@'%';
 CREATE USER 'pwds'@'%' IDENTIFIED BY 'C0-Mm-0n-Pwd5';
 GRANT SELECT ON pwds.* TO 'pwds'@'%';